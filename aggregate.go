@@ -0,0 +1,108 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueprint
+
+import (
+	"fmt"
+)
+
+// AggregateModuleType is the module type of the modules created by CreateAggregateModule.
+const AggregateModuleType = "blueprint_aggregate"
+
+// aggregateDependencyTag is the tag of the dependencies of an aggregate module on its members.
+type aggregateDependencyTag struct {
+	BaseDependencyTag
+}
+
+var aggregateDepTag = aggregateDependencyTag{}
+
+// aggregateModule is the module created by CreateAggregateModule.
+type aggregateModule struct {
+	SimpleName
+}
+
+func (m *aggregateModule) GenerateBuildActions(ctx ModuleContext) {
+	mctx := ctx.(*moduleContext)
+
+	// Modules are generated after their dependencies, so the build statements of the members are
+	// complete.  Their outputs may refer to their own variables, which are written at the top
+	// level of the Ninja file, so the ninjaStrings can be used as they are.
+	def := &buildDef{
+		Rule:          Phony,
+		OutputStrings: []string{m.Name()},
+	}
+	for _, dep := range mctx.module.directDeps {
+		if dep.tag != aggregateDepTag {
+			continue
+		}
+		for _, memberDef := range dep.module.actionDefs.buildDefs {
+			def.Inputs = append(def.Inputs, memberDef.Outputs...)
+			def.Inputs = append(def.Inputs, memberDef.ImplicitOutputs...)
+			def.InputStrings = append(def.InputStrings, memberDef.OutputStrings...)
+			def.InputStrings = append(def.InputStrings, memberDef.ImplicitOutputStrings...)
+		}
+	}
+	mctx.actionDefs.buildDefs = append(mctx.actionDefs.buildDefs, def)
+}
+
+// CreateAggregateModule adds a module with the given name whose only build statement is a phony
+// target with the same name that depends on the outputs of all of the build statements of the
+// members, for example to build everything in a directory.  It must be called after
+// ResolveDependencies and before PrepareBuildActions, for example from the hook set by
+// SetBeforePrepareBuildActionsHook.  The module has type AggregateModuleType, is defined in the
+// Blueprints file of its first member, and depends on each of the members, so it is visited
+// like any other module and can be found by name.
+func (c *Context) CreateAggregateModule(name string, members []Module) (Module, []error) {
+	if !c.dependenciesReady || c.buildActionsReady {
+		return nil, []error{fmt.Errorf("CreateAggregateModule must be called after ResolveDependencies " +
+			"and before PrepareBuildActions")}
+	}
+
+	var memberInfos []*moduleInfo
+	for _, member := range members {
+		info, ok := c.moduleInfo[member]
+		if !ok {
+			return nil, []error{fmt.Errorf("aggregate module %q: member %v is not a module of this context",
+				name, member)}
+		}
+		memberInfos = append(memberInfos, info)
+	}
+
+	module := newModule(func() (Module, []interface{}) {
+		m := &aggregateModule{}
+		m.SimpleName.Properties.Name = name
+		return m, []interface{}{&m.SimpleName.Properties}
+	})
+	module.typeName = AggregateModuleType
+	if len(memberInfos) > 0 {
+		module.relBlueprintsFile = memberInfos[0].relBlueprintsFile
+		module.pos = memberInfos[0].pos
+	}
+
+	if errs := c.addModule(module); len(errs) > 0 {
+		// addModule registers the module before checking its name.
+		delete(c.moduleInfo, module.logicModule)
+		return nil, errs
+	}
+	for _, member := range memberInfos {
+		module.directDeps = append(module.directDeps, depInfo{member, aggregateDepTag})
+	}
+
+	if errs := c.updateDependencies(); len(errs) > 0 {
+		return nil, errs
+	}
+
+	return module.logicModule, nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueprint
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCreateAggregateModule(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"dir/Android.bp": []byte(`
+			test {
+			    name: "foo",
+			    stamp: true,
+			}
+			test {
+			    name: "bar",
+			    stamp: true,
+			}
+		`),
+	})
+	ctx.RegisterModuleType("test", stampTestModuleFactory)
+
+	_, errs := ctx.ParseFileList(".", []string{"dir/Android.bp"}, nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+
+	module := func(name string) Module {
+		return ctx.moduleGroupFromName(name, nil).modules.firstModule().logicModule
+	}
+
+	if _, errs := ctx.CreateAggregateModule("all_dir", []Module{module("foo")}); len(errs) != 1 {
+		t.Errorf("expected an error before ResolveDependencies, got %q", errs)
+	}
+
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected dep errors: %v", errs)
+	}
+
+	foo, bar := module("foo"), module("bar")
+
+	aggregate, errs := ctx.CreateAggregateModule("all_dir", []Module{foo, bar})
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	if _, errs := ctx.CreateAggregateModule("foo", nil); len(errs) != 1 {
+		t.Errorf("expected an error for a duplicate name, got %q", errs)
+	}
+
+	if g, w := ctx.ModuleType(aggregate), AggregateModuleType; g != w {
+		t.Errorf("expected module type %q, got %q", w, g)
+	}
+	if g, w := ctx.BlueprintFile(aggregate), "dir/Android.bp"; g != w {
+		t.Errorf("expected Blueprints file %q, got %q", w, g)
+	}
+	var deps []string
+	ctx.VisitDirectDeps(aggregate, func(dep Module) {
+		deps = append(deps, ctx.ModuleName(dep))
+	})
+	if w := []string{"foo", "bar"}; !reflect.DeepEqual(deps, w) {
+		t.Errorf("expected deps %q, got %q", w, deps)
+	}
+
+	_, errs = ctx.PrepareBuildActions(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors calling PrepareBuildActions: %v", errs)
+	}
+
+	buf := &strings.Builder{}
+	if err := ctx.WriteBuildFile(buf); err != nil {
+		t.Fatal(err)
+	}
+	if s := "build all_dir: phony foo.stamp bar.stamp\n"; !strings.Contains(buf.String(), s) {
+		t.Errorf("missing %q in:\n%s", s, buf.String())
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bootstrap
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/google/blueprint"
+)
+
+func TestGoBinaryLinkInputs(t *testing.T) {
+	ctx := blueprint.NewContext()
+	RegisterGoModuleTypes(ctx)
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			bootstrap_go_package {
+			    name: "lib",
+			    pkgPath: "example.com/lib",
+			    srcs: ["lib/lib.go"],
+			}
+			blueprint_go_binary {
+			    name: "bin",
+			    deps: ["lib"],
+			    srcs: ["main.go"],
+			}
+		`),
+		"lib/lib.go": nil,
+		"main.go":    nil,
+	})
+
+	_, errs := ctx.ParseFileList(".", []string{"Android.bp"}, globTestConfig{})
+	if len(errs) == 0 {
+		_, errs = ctx.ResolveDependencies(globTestConfig{})
+	}
+	if len(errs) == 0 {
+		_, errs = ctx.PrepareBuildActions(globTestConfig{})
+	}
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	buf := &strings.Builder{}
+	if err := ctx.WriteBuildFile(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Join the lines that Ninja continues with a trailing $.
+	manifest := regexp.MustCompile(`\$\n +`).ReplaceAllString(buf.String(), "")
+
+	var link string
+	for _, line := range strings.Split(manifest, "\n") {
+		if strings.HasPrefix(line, "build ") && strings.Contains(line, ": g.bootstrap.link ") {
+			link = line
+		}
+	}
+	if link == "" {
+		t.Fatalf("missing link statement in:\n%s", buf.String())
+	}
+
+	// The link statement depends on the archives of the imported packages, which restat keeps
+	// unchanged when a source change doesn't affect them, and not on their sources.
+	if !strings.Contains(link, "example.com/lib.a") {
+		t.Errorf("expected the archive of lib in the link inputs, got %q", link)
+	}
+	if strings.Contains(link, "lib.go") {
+		t.Errorf("unexpected source of lib in the link inputs, got %q", link)
+	}
+}
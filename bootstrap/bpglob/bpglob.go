@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/google/blueprint/deptools"
@@ -32,6 +33,10 @@ import (
 var (
 	out = flag.String("o", "", "file to write list of files that match glob")
 
+	caseInsensitive = flag.Bool("i", false, "spell matches with the case stored on a case-insensitive filesystem")
+
+	contentSensitive = flag.Bool("c", false, "also regenerate the output file when the contents of a matching file change")
+
 	globs []globArg
 )
 
@@ -75,7 +80,7 @@ func (e *excludeArgs) Set(s string) error {
 }
 
 func usage() {
-	fmt.Fprintln(os.Stderr, "usage: bpglob -o out -p glob [-e excludes ...] [-p glob ...]")
+	fmt.Fprintln(os.Stderr, "usage: bpglob [-i] [-c] -o out -p glob [-e excludes ...] [-p glob ...]")
 	flag.PrintDefaults()
 	os.Exit(2)
 }
@@ -92,7 +97,7 @@ func main() {
 		usage()
 	}
 
-	err := globsWithDepFile(*out, *out+".d", globs)
+	err := globsWithDepFile(pathtools.OsFs, *out, *out+".d", globs, *caseInsensitive, *contentSensitive)
 	if err != nil {
 		// Globs here were already run in the primary builder without error.  The only errors here should be if the glob
 		// pattern was made invalid by a change in the pathtools glob implementation, in which case the primary builder
@@ -113,36 +118,72 @@ func writeErrorOutput(path string, globErr error) {
 	}
 }
 
-// globsWithDepFile finds all files and directories that match glob.  Directories
+// globsWithDepFile finds all files and directories on fs that match glob.  Directories
 // will have a trailing '/'.  It compares the list of matches against the
 // contents of fileListFile, and rewrites fileListFile if it has changed.  It
 // also writes all of the directories it traversed as dependencies on fileListFile
 // to depFile.
 //
+// If caseInsensitive is set the matches and dependencies are spelled with the case
+// stored on the filesystem instead of the case of the patterns.
+//
+// If contentSensitive is set the matching files are also written as dependencies,
+// and fileListFile is always rewritten, as the rule that runs bpglob uses restat
+// and the rules that depend on fileListFile must be rerun when the contents of a
+// matching file change even though the list is unchanged.
+//
 // The format of glob is either path/*.ext for a single directory glob, or
 // path/**/*.ext for a recursive glob.
-func globsWithDepFile(fileListFile, depFile string, globs []globArg) error {
+func globsWithDepFile(fs pathtools.FileSystem, fileListFile, depFile string, globs []globArg,
+	caseInsensitive, contentSensitive bool) error {
+
 	var results pathtools.MultipleGlobResults
 	for _, glob := range globs {
-		result, err := pathtools.Glob(glob.pattern, glob.excludes, pathtools.FollowSymlinks)
+		result, err := fs.Glob(glob.pattern, glob.excludes, pathtools.FollowSymlinks)
 		if err != nil {
 			return err
 		}
+		if caseInsensitive {
+			result = result.WithCanonicalCase(fs)
+		}
 		results = append(results, result)
 	}
 
-	// Only write the output file if it has changed.
-	err := pathtools.WriteFileIfChanged(fileListFile, results.FileList(), 0666)
+	// Only write the output file if it has changed, unless the rules that depend on it must also
+	// be rerun when the contents of the matching files change.
+	writeFile := pathtools.WriteFileIfChanged
+	if contentSensitive {
+		writeFile = ioutil.WriteFile
+	}
+	err := writeFile(fileListFile, results.FileList(), 0666)
 	if err != nil {
 		return fmt.Errorf("failed to write file list to %q: %w", fileListFile, err)
 	}
 
 	// The depfile can be written unconditionally as its timestamp doesn't affect ninja's restat
 	// feature.
-	err = deptools.WriteDepFile(depFile, fileListFile, results.Deps())
+	deps := results.Deps()
+	if contentSensitive {
+		deps = append(deps, matchedFiles(results)...)
+	}
+	err = deptools.WriteDepFile(depFile, fileListFile, deps)
 	if err != nil {
 		return fmt.Errorf("failed to write dep file to %q: %w", depFile, err)
 	}
 
 	return nil
 }
+
+// matchedFiles returns the files that match the globs, skipping the matching directories as
+// their modification times are already covered by the searched directories.
+func matchedFiles(results pathtools.MultipleGlobResults) []string {
+	var files []string
+	for _, result := range results {
+		for _, match := range result.Matches {
+			if !strings.HasSuffix(match, "/") {
+				files = append(files, match)
+			}
+		}
+	}
+	return files
+}
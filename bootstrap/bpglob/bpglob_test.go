@@ -0,0 +1,130 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/blueprint/pathtools"
+)
+
+func TestGlobsWithDepFileContentSensitive(t *testing.T) {
+	for _, contentSensitive := range []bool{false, true} {
+		t.Run(map[bool]string{false: "directories", true: "content"}[contentSensitive], func(t *testing.T) {
+			dir := t.TempDir()
+			src := filepath.Join(dir, "src")
+			matched := filepath.Join(src, "a.c")
+			if err := os.MkdirAll(src, 0777); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(matched, []byte("a"), 0666); err != nil {
+				t.Fatal(err)
+			}
+
+			list := filepath.Join(dir, "list")
+			depFile := list + ".d"
+			globs := []globArg{{pattern: filepath.Join(src, "*.c")}}
+			if err := globsWithDepFile(pathtools.OsFs, list, depFile, globs, false, contentSensitive); err != nil {
+				t.Fatal(err)
+			}
+
+			deps, err := os.ReadFile(depFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if g := strings.Contains(string(deps), matched); g != contentSensitive {
+				t.Errorf("expected matched file in depfile to be %v, got depfile:\n%s", contentSensitive, deps)
+			}
+
+			// Backdate the list file so that a rewrite is visible, then change the contents of the
+			// matched file and run the glob again as ninja would.
+			old := time.Now().Add(-time.Hour).Truncate(time.Second)
+			if err := os.Chtimes(list, old, old); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(matched, []byte("b"), 0666); err != nil {
+				t.Fatal(err)
+			}
+			if err := globsWithDepFile(pathtools.OsFs, list, depFile, globs, false, contentSensitive); err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := os.Stat(list)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if g := !info.ModTime().Equal(old); g != contentSensitive {
+				t.Errorf("expected list file to be rewritten to be %v, got modification time %v",
+					contentSensitive, info.ModTime())
+			}
+		})
+	}
+}
+
+// patternCaseFs simulates a case-insensitive filesystem on top of the local disk: the "SRC"
+// directory in a pattern matches the stored "src" directory, and matches are returned spelled
+// with the case of the pattern.
+type patternCaseFs struct {
+	pathtools.FileSystem
+}
+
+func (fs patternCaseFs) Glob(pattern string, excludes []string,
+	follow pathtools.ShouldFollowSymlinks) (pathtools.GlobResult, error) {
+
+	result, err := fs.FileSystem.Glob(strings.Replace(pattern, "/SRC/", "/src/", 1), excludes, follow)
+	for i, match := range result.Matches {
+		result.Matches[i] = strings.Replace(match, "/src/", "/SRC/", 1)
+	}
+	return result, err
+}
+
+func TestGlobsWithDepFileCaseInsensitive(t *testing.T) {
+	for _, caseInsensitive := range []bool{false, true} {
+		t.Run(map[bool]string{false: "case sensitive", true: "case insensitive"}[caseInsensitive], func(t *testing.T) {
+			dir := t.TempDir()
+			src := filepath.Join(dir, "src")
+			if err := os.MkdirAll(src, 0777); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(src, "a.c"), nil, 0666); err != nil {
+				t.Fatal(err)
+			}
+
+			list := filepath.Join(dir, "list")
+			depFile := list + ".d"
+			globs := []globArg{{pattern: filepath.Join(dir, "SRC", "*.c")}}
+			fs := patternCaseFs{pathtools.OsFs}
+			if err := globsWithDepFile(fs, list, depFile, globs, caseInsensitive, false); err != nil {
+				t.Fatal(err)
+			}
+
+			fileList, err := os.ReadFile(list)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := filepath.Join(dir, "SRC", "a.c")
+			if caseInsensitive {
+				want = filepath.Join(src, "a.c")
+			}
+			if !strings.Contains(string(fileList), want) {
+				t.Errorf("expected %q in file list, got %s", want, fileList)
+			}
+		})
+	}
+}
@@ -16,6 +16,7 @@ package bootstrap
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -28,6 +29,7 @@ import (
 	"strings"
 
 	"github.com/google/blueprint"
+	"github.com/google/blueprint/pathtools"
 )
 
 type Args struct {
@@ -87,6 +89,18 @@ func RunBlueprint(args Args, stopBefore StopBefore, ctx *blueprint.Context, conf
 	}
 	ctx.SetModuleListFile(args.ModuleListFile)
 
+	// An empty Ninja file is checked as thoroughly as a real one if requested, so that it
+	// doesn't hide errors from the later phases, which can't be done if the caller asked to stop
+	// before them.
+	validateEmptyNinja := args.EmptyNinjaFile && ctx.GetEmptyNinjaValidation()
+	if validateEmptyNinja {
+		if stopBefore != DoEverything {
+			return nil, fmt.Errorf("empty Ninja file validation requires running every phase, " +
+				"but RunBlueprint was asked to stop before writing the Ninja file")
+		}
+		ctx.SetVerifyProvidersAreUnchanged(true)
+	}
+
 	var ninjaDeps []string
 	ninjaDeps = append(ninjaDeps, args.ModuleListFile)
 
@@ -101,6 +115,14 @@ func RunBlueprint(args Args, stopBefore StopBefore, ctx *blueprint.Context, conf
 
 	ctx.RegisterBottomUpMutator("bootstrap_plugin_deps", pluginDeps)
 	ctx.RegisterSingletonType("bootstrap", newSingletonFactory(), false)
+	if bootstrapConfig, ok := config.(BootstrapConfig); ok && ctx.GetGlobListDir() == "" {
+		ctx.SetGlobListDir(GlobDirectory(bootstrapConfig.SoongOutDir(), "blueprint"))
+	}
+	ctx.SetGlobFileFunc(func(ctx blueprint.ModuleContext, pattern string, excludes []string, fileListFile string) {
+		if err := GlobFileChecked(ctx, pattern, excludes, fileListFile); err != nil {
+			ctx.ModuleErrorf("%s", err)
+		}
+	})
 	RegisterGoModuleTypes(ctx)
 	blueprint.RegisterPackageIncludesModuleType(ctx)
 
@@ -122,6 +144,15 @@ func RunBlueprint(args Args, stopBefore StopBefore, ctx *blueprint.Context, conf
 		return ninjaDeps, nil
 	}
 
+	if stopBefore == StopAfterMutators {
+		if ctx.AfterMutatorsHook != nil {
+			if err := ctx.AfterMutatorsHook(); err != nil {
+				return nil, fatalErrors([]error{err})
+			}
+		}
+		return ninjaDeps, nil
+	}
+
 	if ctx.BeforePrepareBuildActionsHook != nil {
 		if err := ctx.BeforePrepareBuildActionsHook(); err != nil {
 			return nil, fatalErrors([]error{err})
@@ -155,6 +186,7 @@ func RunBlueprint(args Args, stopBefore StopBefore, ctx *blueprint.Context, conf
 	var out blueprint.StringWriterWriter
 	var f *os.File
 	var buf *bufio.Writer
+	var contents *bytes.Buffer
 
 	ctx.BeginEvent("write_files")
 	defer ctx.EndEvent("write_files")
@@ -163,6 +195,10 @@ func RunBlueprint(args Args, stopBefore StopBefore, ctx *blueprint.Context, conf
 			return nil, fmt.Errorf("error writing empty Ninja file: %s", err)
 		}
 		out = io.Discard.(blueprint.StringWriterWriter)
+	} else if ctx.GetOutFileHashCheck() {
+		// Collect the contents so that they can be compared with the existing file.
+		contents = &bytes.Buffer{}
+		out = contents
 	} else {
 		f, err := os.OpenFile(joinPath(ctx.SrcDir(), args.OutFile), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, outFilePermissions)
 		if err != nil {
@@ -177,6 +213,13 @@ func RunBlueprint(args Args, stopBefore StopBefore, ctx *blueprint.Context, conf
 		return nil, fmt.Errorf("error writing Ninja file contents: %s", err)
 	}
 
+	if contents != nil {
+		err := pathtools.WriteFileIfChanged(joinPath(ctx.SrcDir(), args.OutFile), contents.Bytes(), outFilePermissions)
+		if err != nil {
+			return nil, fmt.Errorf("error writing Ninja file: %s", err)
+		}
+	}
+
 	if buf != nil {
 		if err := buf.Flush(); err != nil {
 			return nil, fmt.Errorf("error flushing Ninja file contents: %s", err)
@@ -189,6 +232,22 @@ func RunBlueprint(args Args, stopBefore StopBefore, ctx *blueprint.Context, conf
 		}
 	}
 
+	if !args.EmptyNinjaFile {
+		err := ctx.WriteDirectoryBuildFiles(func(file string, contents []byte) error {
+			return pathtools.WriteFileIfChanged(joinPath(ctx.SrcDir(), file), contents, outFilePermissions)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error writing per-directory Ninja files: %s", err)
+		}
+	} else if validateEmptyNinja {
+		err := ctx.WriteDirectoryBuildFiles(func(file string, contents []byte) error {
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error generating per-directory Ninja files: %s", err)
+		}
+	}
+
 	providerValidationErrors := <-providersValidationChan
 	if providerValidationErrors != nil {
 		var sb strings.Builder
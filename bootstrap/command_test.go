@@ -0,0 +1,137 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bootstrap
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/blueprint"
+)
+
+type commandTestModule struct {
+	blueprint.SimpleName
+}
+
+func newCommandTestModule() (blueprint.Module, []interface{}) {
+	m := &commandTestModule{}
+	return m, []interface{}{&m.SimpleName.Properties}
+}
+
+func (m *commandTestModule) GenerateBuildActions(blueprint.ModuleContext) {}
+
+func TestStopAfterMutators(t *testing.T) {
+	newContext := func() *blueprint.Context {
+		ctx := blueprint.NewContext()
+		ctx.RegisterModuleType("test_module", newCommandTestModule)
+		ctx.RegisterBottomUpMutator("variants", func(mctx blueprint.BottomUpMutatorContext) {
+			mctx.CreateVariations("x", "y")
+		})
+		ctx.MockFileSystem(map[string][]byte{
+			"Android.bp": []byte(`test_module { name: "a" }`),
+		})
+		return ctx
+	}
+
+	ctx := newContext()
+	graph := &bytes.Buffer{}
+	ctx.SetAfterMutatorsHook(func() error {
+		return ctx.WriteDependencyGraphJSON(graph)
+	})
+	ctx.SetBeforePrepareBuildActionsHook(func() error {
+		return errors.New("PrepareBuildActions should not be called")
+	})
+
+	args := Args{
+		ModuleListFile: blueprint.MockModuleListFile,
+		OutFile:        "out/build.ninja",
+	}
+	deps, err := RunBlueprint(args, StopAfterMutators, ctx, globTestConfig{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(deps) == 0 || deps[0] != blueprint.MockModuleListFile {
+		t.Errorf("expected the module list file in the deps, got %q", deps)
+	}
+	if g := graph.String(); !strings.Contains(g, `"Variant": "x"`) || !strings.Contains(g, `"Variant": "y"`) {
+		t.Errorf("expected the hook to dump both variants of a, got:\n%s", g)
+	}
+
+	ctx = newContext()
+	ctx.SetAfterMutatorsHook(func() error { return errors.New("dump failed") })
+	if _, err := RunBlueprint(args, StopAfterMutators, ctx, globTestConfig{}); err == nil {
+		t.Errorf("expected RunBlueprint to fail when the hook fails")
+	}
+}
+
+func TestEventHandler(t *testing.T) {
+	ctx := blueprint.NewContext()
+	ctx.RegisterModuleType("test_module", newCommandTestModule)
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`test_module { name: "a" }`),
+	})
+
+	type event struct {
+		begin, end time.Time
+	}
+	events := make(map[string]event)
+	ctx.SetEventHandler(func(name string, begin, end time.Time) {
+		events[name] = event{begin, end}
+	})
+
+	args := Args{
+		ModuleListFile: blueprint.MockModuleListFile,
+		OutFile:        "out/build.ninja",
+	}
+	if _, err := RunBlueprint(args, StopBeforePrepareBuildActions, ctx, globTestConfig{}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, name := range []string{"list_modules", "parse_bp"} {
+		e, ok := events[name]
+		if !ok {
+			t.Errorf("expected event %q to be reported, got %v", name, events)
+			continue
+		}
+		if e.end.Before(e.begin) {
+			t.Errorf("expected event %q to end at or after %s, got %s", name, e.begin, e.end)
+		}
+	}
+}
+
+func TestEmptyNinjaValidation(t *testing.T) {
+	ctx := blueprint.NewContext()
+	ctx.RegisterModuleType("test_module", newCommandTestModule)
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`test_module { name: "a" }`),
+	})
+	ctx.SetEmptyNinjaValidation(true)
+	ctx.SetAfterMutatorsHook(func() error {
+		return errors.New("the mutators should not be run")
+	})
+
+	args := Args{
+		ModuleListFile: blueprint.MockModuleListFile,
+		OutFile:        "out/build.ninja",
+		EmptyNinjaFile: true,
+	}
+	_, err := RunBlueprint(args, StopAfterMutators, ctx, globTestConfig{})
+	if err == nil || !strings.Contains(err.Error(), "empty Ninja file validation requires running every phase") {
+		t.Errorf("expected an error for stopping early with empty Ninja file validation, got %v", err)
+	}
+}
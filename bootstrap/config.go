@@ -102,6 +102,11 @@ const (
 	DoEverything StopBefore = iota
 	StopBeforePrepareBuildActions
 	StopBeforeWriteNinja
+
+	// StopAfterMutators stops after ResolveDependencies has run all of the mutators, like
+	// StopBeforePrepareBuildActions, but calls the Context's AfterMutatorsHook first so that the
+	// mutated module graph can be dumped, for example with Context.WriteDependencyGraphJSON.
+	StopAfterMutators
 )
 
 type PrimaryBuilderInvocation struct {
@@ -16,16 +16,21 @@ package bootstrap
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"hash/fnv"
 	"io"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/blueprint"
 	"github.com/google/blueprint/pathtools"
+	"github.com/google/blueprint/proptools"
 )
 
 // This file supports globbing source files in Blueprints files.
@@ -72,9 +77,38 @@ type GlobFileContext interface {
 // GlobFile creates a rule to write to fileListFile a list of the files that match the specified
 // pattern but do not match any of the patterns specified in excludes.  The file will include
 // appropriate dependencies to regenerate the file if and only if the list of matching files has
-// changed.
+// changed.  It panics if the pattern or one of the excludes is malformed, use GlobFileChecked to
+// get an error instead.
 func GlobFile(ctx GlobFileContext, pattern string, excludes []string, fileListFile string) {
-	args := `-p "` + pattern + `"`
+	if err := GlobFileChecked(ctx, pattern, excludes, fileListFile); err != nil {
+		panic(err)
+	}
+}
+
+// GlobFileChecked is like GlobFile, but returns an error and creates no rule if the pattern or one
+// of the excludes is malformed, see pathtools.ValidatePattern.  The excludes are glob patterns that
+// may contain a recursive glob (**) as a whole path element, for example "**/*.h" excludes the
+// headers in every subdirectory.
+func GlobFileChecked(ctx GlobFileContext, pattern string, excludes []string, fileListFile string) error {
+	return globFile(ctx, pattern, excludes, fileListFile, false)
+}
+
+// GlobFileContentSensitive is like GlobFileChecked, but the file is also regenerated when the
+// contents of one of the matching files change, so that the rules that depend on it are rerun then
+// too.
+func GlobFileContentSensitive(ctx GlobFileContext, pattern string, excludes []string, fileListFile string) error {
+	return globFile(ctx, pattern, excludes, fileListFile, true)
+}
+
+func globFile(ctx GlobFileContext, pattern string, excludes []string, fileListFile string,
+	contentSensitive bool) error {
+	if err := validateGlob(pattern, excludes); err != nil {
+		return err
+	}
+	args := joinWithPrefixAndQuote([]string{pattern}, "-p ")
+	if contentSensitive {
+		args = "-c " + args
+	}
 	if len(excludes) > 0 {
 		args += " " + joinWithPrefixAndQuote(excludes, "-e ")
 	}
@@ -86,26 +120,49 @@ func GlobFile(ctx GlobFileContext, pattern string, excludes []string, fileListFi
 		},
 		Description: "glob " + pattern,
 	})
+	return nil
+}
+
+// validateGlob returns an error if pattern or one of the excludes is not a valid glob pattern.
+func validateGlob(pattern string, excludes []string) error {
+	if err := pathtools.ValidatePattern(pattern); err != nil {
+		return fmt.Errorf("invalid glob pattern %q: %w", pattern, err)
+	}
+	for _, exclude := range excludes {
+		if err := pathtools.ValidatePattern(exclude); err != nil {
+			return fmt.Errorf("invalid exclude %q for glob pattern %q: %w", exclude, pattern, err)
+		}
+	}
+	return nil
 }
 
 // multipleGlobFilesRule creates a rule to write to fileListFile a list of the files that match the specified
 // pattern but do not match any of the patterns specified in excludes.  The file will include
 // appropriate dependencies to regenerate the file if and only if the list of matching files has
-// changed.
-func multipleGlobFilesRule(ctx GlobFileContext, fileListFile string, shard int, globs pathtools.MultipleGlobResults) {
+// changed, or also when the contents of a matching file change if contentSensitive is true.  The
+// patterns and excludes are validated like in GlobFileChecked.
+func multipleGlobFilesRule(ctx GlobFileContext, fileListFile string, shard, numShards int,
+	globs pathtools.MultipleGlobResults, caseInsensitive, contentSensitive bool) error {
 	args := strings.Builder{}
 
+	if caseInsensitive {
+		args.WriteString("-i ")
+	}
+	if contentSensitive {
+		args.WriteString("-c ")
+	}
+
 	for i, glob := range globs {
+		if err := validateGlob(glob.Pattern, glob.Excludes); err != nil {
+			return err
+		}
 		if i != 0 {
 			args.WriteString(" ")
 		}
-		args.WriteString(`-p "`)
-		args.WriteString(glob.Pattern)
-		args.WriteString(`"`)
-		for _, exclude := range glob.Excludes {
-			args.WriteString(` -e "`)
-			args.WriteString(exclude)
-			args.WriteString(`"`)
+		args.WriteString(joinWithPrefixAndQuote([]string{glob.Pattern}, "-p "))
+		if len(glob.Excludes) > 0 {
+			args.WriteString(" ")
+			args.WriteString(joinWithPrefixAndQuote(glob.Excludes, "-e "))
 		}
 	}
 
@@ -115,22 +172,22 @@ func multipleGlobFilesRule(ctx GlobFileContext, fileListFile string, shard int,
 		Args: map[string]string{
 			"args": args.String(),
 		},
-		Description: fmt.Sprintf("regenerate globs shard %d of %d", shard, numGlobBuckets),
+		Description: fmt.Sprintf("regenerate globs shard %d of %d", shard, numShards),
 	})
+	return nil
 }
 
+// joinWithPrefixAndQuote returns the arguments in strs for a bpglob command, each preceded by
+// prefix.  Each argument is escaped for ninja and quoted for the shell, so that the glob characters
+// in patterns such as "**/*.h" reach bpglob unexpanded.
 func joinWithPrefixAndQuote(strs []string, prefix string) string {
 	if len(strs) == 0 {
 		return ""
 	}
 
-	if len(strs) == 1 {
-		return prefix + `"` + strs[0] + `"`
-	}
-
 	n := len(" ") * (len(strs) - 1)
 	for _, s := range strs {
-		n += len(prefix) + len(s) + len(`""`)
+		n += len(prefix) + len(s) + len(`''`)
 	}
 
 	ret := make([]byte, 0, n)
@@ -139,9 +196,7 @@ func joinWithPrefixAndQuote(strs []string, prefix string) string {
 			ret = append(ret, ' ')
 		}
 		ret = append(ret, prefix...)
-		ret = append(ret, '"')
-		ret = append(ret, s...)
-		ret = append(ret, '"')
+		ret = append(ret, proptools.NinjaAndShellEscapeIncludingSpaces(s)...)
 	}
 	return string(ret)
 }
@@ -161,6 +216,85 @@ type GlobSingleton struct {
 
 	// The source directory
 	SrcDir string
+
+	// Whether the source directory is on a case-insensitive filesystem, see
+	// blueprint.Context.SetCaseInsensitiveFS.  The glob results written by bpglob are then
+	// spelled with the stored case to match the results of the primary builder.
+	CaseInsensitive bool
+
+	// Whether the glob list files are also regenerated when the contents of a file that matches
+	// the globs change, which reruns the primary builder, see GlobFileContentSensitive.  By
+	// default they are only regenerated when the list of matching files changes.
+	ContentSensitive bool
+
+	// The number of glob list files that the globs are sorted into, defaultNumGlobBuckets if
+	// zero.  Fewer buckets write fewer files for builds with few globs, more buckets rerun fewer
+	// globs when a directory changes in builds with many globs.
+	NumGlobBuckets int
+
+	// The glob list files written by previous runs, loaded from and saved to the cache file in
+	// GlobDir by GenerateBuildActions, see writeGlobBucket.
+	writtenBuckets map[string]globBucketState
+
+	// writeFileList writes a glob list file, pathtools.WriteFileIfChanged if nil.  Tests replace
+	// it to count the writes.
+	writeFileList func(filename string, data []byte, perm os.FileMode) error
+}
+
+// globBucketState records a glob list file written by GenerateBuildActions.
+type globBucketState struct {
+	// Fingerprint is the hash of the contents of the file and of the modification times of the
+	// directories searched by its globs.
+	Fingerprint uint64
+
+	// ModTime is the modification time of the file after it was written.
+	ModTime time.Time
+}
+
+// globBucketCacheFile is the file in GlobDir that records the glob list files written by
+// previous runs, so that a no-op rebuild in a new process can skip them.
+const globBucketCacheFile = "cache.json"
+
+// writeGlobFileList writes a glob list file with writeFileList.
+func (s *GlobSingleton) writeGlobFileList(filename string, data []byte, perm os.FileMode) error {
+	if s.writeFileList != nil {
+		return s.writeFileList(filename, data, perm)
+	}
+	return pathtools.WriteFileIfChanged(filename, data, perm)
+}
+
+// loadGlobBucketCache reads the glob list files written by previous runs from the cache file if
+// they have not been read yet.  A missing or malformed cache file is treated as empty, so every
+// glob list file is written.
+func (s *GlobSingleton) loadGlobBucketCache() {
+	if s.writtenBuckets != nil {
+		return
+	}
+	s.writtenBuckets = make(map[string]globBucketState)
+	data, err := os.ReadFile(joinPath(s.SrcDir, filepath.Join(s.GlobDir, globBucketCacheFile)))
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &s.writtenBuckets); err != nil {
+		s.writtenBuckets = make(map[string]globBucketState)
+	}
+}
+
+// saveGlobBucketCache writes the glob list files recorded by writeGlobBucket to the cache file.
+func (s *GlobSingleton) saveGlobBucketCache() error {
+	data, err := json.Marshal(s.writtenBuckets)
+	if err != nil {
+		return err
+	}
+	return pathtools.WriteFileIfChanged(joinPath(s.SrcDir, filepath.Join(s.GlobDir, globBucketCacheFile)), data, 0666)
+}
+
+// numGlobBuckets returns the number of glob list files, see NumGlobBuckets.
+func (s *GlobSingleton) numGlobBuckets() int {
+	if s.NumGlobBuckets > 0 {
+		return s.NumGlobBuckets
+	}
+	return defaultNumGlobBuckets
 }
 
 func globBucketName(globDir string, globBucket int) string {
@@ -175,9 +309,11 @@ func GlobDirectory(buildDir, globListDir string) string {
 func (s *GlobSingleton) GenerateBuildActions(ctx blueprint.SingletonContext) {
 	// Sort the list of globs into buckets.  A hash function is used instead of sharding so that
 	// adding a new glob doesn't force rerunning all the buckets by shifting them all by 1.
-	globBuckets := make([]pathtools.MultipleGlobResults, numGlobBuckets)
+	numBuckets := s.numGlobBuckets()
+	s.loadGlobBucketCache()
+	globBuckets := make([]pathtools.MultipleGlobResults, numBuckets)
 	for _, g := range s.GlobLister() {
-		bucket := globToBucket(g)
+		bucket := globToBucket(g, numBuckets)
 		globBuckets[bucket] = append(globBuckets[bucket], g)
 	}
 
@@ -196,15 +332,72 @@ func (s *GlobSingleton) GenerateBuildActions(ctx blueprint.SingletonContext) {
 		// We don't need to write the depfile because we're guaranteed that ninja
 		// will run the command at least once (to record it into the ninja_log), so
 		// the depfile will be loaded from that execution.
-		absoluteFileListFile := joinPath(s.SrcDir, fileListFile)
-		err := pathtools.WriteFileIfChanged(absoluteFileListFile, globs.FileList(), 0666)
+		err := s.writeGlobBucket(fileListFile, globs)
 		if err != nil {
 			panic(fmt.Errorf("error writing %s: %s", fileListFile, err))
 		}
 
 		// Write out the ninja rule to run bpglob.
-		multipleGlobFilesRule(ctx, fileListFile, i, globs)
+		if err := multipleGlobFilesRule(ctx, fileListFile, i, numBuckets, globs, s.CaseInsensitive,
+			s.ContentSensitive); err != nil {
+			ctx.Errorf("%s", err)
+		}
+	}
+
+	if err := s.saveGlobBucketCache(); err != nil {
+		ctx.Errorf("error writing the glob list file cache: %s", err)
+	}
+}
+
+// writeGlobBucket writes the results of the globs in a bucket to fileListFile.  The file is not
+// written again if a previous run wrote the same results, none of the directories searched by the
+// globs have been modified since, and the file has not been modified since, which saves comparing
+// the contents of every glob list file on a rebuild where nothing changed.
+func (s *GlobSingleton) writeGlobBucket(fileListFile string, globs pathtools.MultipleGlobResults) error {
+	absoluteFileListFile := joinPath(s.SrcDir, fileListFile)
+	fileList := globs.FileList()
+	fingerprint, cacheable := s.globBucketFingerprint(fileList, globs)
+
+	if prev, ok := s.writtenBuckets[fileListFile]; ok && cacheable && prev.Fingerprint == fingerprint {
+		if info, err := os.Stat(absoluteFileListFile); err == nil && info.ModTime().Equal(prev.ModTime) {
+			return nil
+		}
+	}
+
+	err := s.writeGlobFileList(absoluteFileListFile, fileList, 0666)
+	if err != nil {
+		return err
+	}
+
+	delete(s.writtenBuckets, fileListFile)
+	if cacheable {
+		if info, err := os.Stat(absoluteFileListFile); err == nil {
+			s.writtenBuckets[fileListFile] = globBucketState{fingerprint, info.ModTime()}
+		}
+	}
+	return nil
+}
+
+// globBucketFingerprint returns the hash of the contents of a glob list file and of the
+// modification times of the directories searched by its globs.  It returns false if one of the
+// directories can't be read, in which case the file is always written.
+func (s *GlobSingleton) globBucketFingerprint(fileList []byte, globs pathtools.MultipleGlobResults) (uint64, bool) {
+	hash := fnv.New64a()
+	hash.Write(fileList)
+
+	deps := globs.Deps()
+	sort.Strings(deps)
+	for i, dep := range deps {
+		if i > 0 && dep == deps[i-1] {
+			continue
+		}
+		info, err := os.Stat(joinPath(s.SrcDir, dep))
+		if err != nil {
+			return 0, false
+		}
+		fmt.Fprintf(hash, "\x00%s\x00%d", dep, info.ModTime().UnixNano())
 	}
+	return hash.Sum64(), true
 }
 
 // Writes a .ninja file that contains instructions for regenerating the glob
@@ -241,7 +434,7 @@ func generateGlobNinjaFile(glob *GlobSingleton, config interface{}) ([]byte, []e
 	}
 
 	// PrepareBuildActions() will write $OUTDIR/soong/globs/$m/$i files
-	// where $m=bp2build|build and $i=0..numGlobBuckets
+	// where $m=bp2build|build and $i=0..glob.NumGlobBuckets
 	extraDeps, errs = ctx.PrepareBuildActions(config)
 	if len(extraDeps) > 0 {
 		return nil, []error{fmt.Errorf("shouldn't have extra deps")}
@@ -262,25 +455,37 @@ func generateGlobNinjaFile(glob *GlobSingleton, config interface{}) ([]byte, []e
 // GlobFileListFiles returns the list of files that contain the result of globs
 // in the build. It is suitable for inclusion in build.ninja.d (so that
 // build.ninja is regenerated if the globs change). The instructions to
-// regenerate these files are written by WriteBuildGlobsNinjaFile().
+// regenerate these files are written by WriteBuildGlobsNinjaFile().  It
+// assumes the default number of glob list files, use
+// GlobSingleton.GlobFileListFiles if NumGlobBuckets is set.
 func GlobFileListFiles(globDir string) []string {
+	return globFileListFiles(globDir, defaultNumGlobBuckets)
+}
+
+// GlobFileListFiles returns the list of files that contain the result of the
+// globs sorted into NumGlobBuckets files in GlobDir, see GlobFileListFiles.
+func (s *GlobSingleton) GlobFileListFiles() []string {
+	return globFileListFiles(s.GlobDir, s.numGlobBuckets())
+}
+
+func globFileListFiles(globDir string, numBuckets int) []string {
 	var fileListFiles []string
-	for i := 0; i < numGlobBuckets; i++ {
+	for i := 0; i < numBuckets; i++ {
 		fileListFile := globBucketName(globDir, i)
 		fileListFiles = append(fileListFiles, fileListFile)
 	}
 	return fileListFiles
 }
 
-const numGlobBuckets = 1024
+const defaultNumGlobBuckets = 1024
 
 // globToBucket converts a pathtools.GlobResult into a hashed bucket number in the range
-// [0, numGlobBuckets).
-func globToBucket(g pathtools.GlobResult) int {
+// [0, numBuckets).
+func globToBucket(g pathtools.GlobResult, numBuckets int) int {
 	hash := fnv.New32a()
 	io.WriteString(hash, g.Pattern)
 	for _, e := range g.Excludes {
 		io.WriteString(hash, e)
 	}
-	return int(hash.Sum32() % numGlobBuckets)
+	return int(hash.Sum32() % uint32(numBuckets))
 }
@@ -0,0 +1,277 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bootstrap
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/blueprint"
+	"github.com/google/blueprint/pathtools"
+)
+
+type globTestConfig struct{}
+
+func (globTestConfig) HostToolDir() string    { return "out/host" }
+func (globTestConfig) SoongOutDir() string    { return "out/soong" }
+func (globTestConfig) OutDir() string         { return "out" }
+func (globTestConfig) DebugCompilation() bool { return false }
+func (globTestConfig) RunGoTests() bool       { return false }
+func (globTestConfig) Subninjas() []string    { return nil }
+func (globTestConfig) PrimaryBuilderInvocations() []PrimaryBuilderInvocation {
+	return nil
+}
+
+func TestGlobBuckets(t *testing.T) {
+	srcDir := t.TempDir()
+	globDir := "globs"
+	if err := os.MkdirAll(filepath.Join(srcDir, globDir), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	globs := pathtools.MultipleGlobResults{
+		{Pattern: "a/*.c", Matches: []string{"a/x.c"}},
+		{Pattern: "b/**/*.go", Matches: []string{"b/y.go"}},
+		{Pattern: "d/*.h", Matches: []string{"d/z.h"}},
+	}
+	s := &GlobSingleton{
+		GlobLister:     func() pathtools.MultipleGlobResults { return globs },
+		GlobFile:       "globs.ninja",
+		GlobDir:        globDir,
+		SrcDir:         srcDir,
+		NumGlobBuckets: 4,
+	}
+
+	want := []string{"globs/0", "globs/1", "globs/2", "globs/3"}
+	if g := s.GlobFileListFiles(); !reflect.DeepEqual(g, want) {
+		t.Errorf("expected glob list files %q, got %q", want, g)
+	}
+
+	ninja, errs := generateGlobNinjaFile(s, globTestConfig{})
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if !strings.Contains(string(ninja), "shard 3 of 4") {
+		t.Errorf("expected 4 shards in:\n%s", ninja)
+	}
+	if strings.Contains(string(ninja), "shard 4 of 4") {
+		t.Errorf("unexpected fifth shard in:\n%s", ninja)
+	}
+
+	// The buckets are the FNV-32a hashes of the patterns modulo 4.
+	wantBuckets := map[string]string{
+		"globs/0": `[["d/z.h"]]`,
+		"globs/1": `[["b/y.go"]]`,
+		"globs/2": `[["a/x.c"]]`,
+		"globs/3": `[]`,
+	}
+	for file, want := range wantBuckets {
+		got, err := os.ReadFile(filepath.Join(srcDir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("expected %s to contain %s, got %s", file, want, got)
+		}
+	}
+}
+
+// countGlobFileListWrites makes s count the glob list files that it writes.
+func countGlobFileListWrites(s *GlobSingleton) *int {
+	writes := 0
+	s.writeFileList = func(filename string, data []byte, perm os.FileMode) error {
+		writes++
+		return pathtools.WriteFileIfChanged(filename, data, perm)
+	}
+	return &writes
+}
+
+// restartGlobSingleton returns a copy of s without the state kept in memory, as if the primary
+// builder was run again in a new process.
+func restartGlobSingleton(s *GlobSingleton) *GlobSingleton {
+	restarted := *s
+	restarted.writtenBuckets = nil
+	return &restarted
+}
+
+// newGlobCacheTestSingleton returns a GlobSingleton with a glob in each of numDirs directories
+// in a new source directory.
+func newGlobCacheTestSingleton(tb testing.TB, numDirs, numBuckets int) *GlobSingleton {
+	srcDir := tb.TempDir()
+	var globs pathtools.MultipleGlobResults
+	for i := 0; i < numDirs; i++ {
+		dir := fmt.Sprintf("dir%d", i)
+		if err := os.MkdirAll(filepath.Join(srcDir, dir), 0777); err != nil {
+			tb.Fatal(err)
+		}
+		globs = append(globs, pathtools.GlobResult{
+			Pattern: dir + "/*.c",
+			Matches: []string{dir + "/x.c"},
+			Deps:    []string{dir},
+		})
+	}
+	return &GlobSingleton{
+		GlobLister:     func() pathtools.MultipleGlobResults { return globs },
+		GlobFile:       "globs.ninja",
+		GlobDir:        "globs",
+		SrcDir:         srcDir,
+		NumGlobBuckets: numBuckets,
+	}
+}
+
+func TestGlobBucketCache(t *testing.T) {
+	s := newGlobCacheTestSingleton(t, 3, 4)
+	writes := countGlobFileListWrites(s)
+
+	generate := func(t *testing.T, wantWrites int) {
+		t.Helper()
+		*writes = 0
+		if _, errs := generateGlobNinjaFile(s, globTestConfig{}); len(errs) > 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+		if *writes != wantWrites {
+			t.Errorf("expected %d glob list files to be written, got %d", wantWrites, *writes)
+		}
+	}
+
+	generate(t, 4)
+	generate(t, 0)
+
+	// The cache is kept in the glob directory, so a new process doesn't write the buckets again.
+	s = restartGlobSingleton(s)
+	generate(t, 0)
+
+	// Modifying a searched directory writes the bucket that contains its glob.
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(s.SrcDir, "dir0"), future, future); err != nil {
+		t.Fatal(err)
+	}
+	generate(t, 1)
+	generate(t, 0)
+
+	// Removing a glob list file writes it again.
+	if err := os.Remove(filepath.Join(s.SrcDir, "globs", "3")); err != nil {
+		t.Fatal(err)
+	}
+	generate(t, 1)
+	if _, err := os.Stat(filepath.Join(s.SrcDir, "globs", "3")); err != nil {
+		t.Errorf("expected globs/3 to be written: %s", err)
+	}
+}
+
+func BenchmarkGlobBucketsNoopRebuild(b *testing.B) {
+	for _, cached := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cached=%v", cached), func(b *testing.B) {
+			s := newGlobCacheTestSingleton(b, 100, 64)
+			writes := countGlobFileListWrites(s)
+			if _, errs := generateGlobNinjaFile(s, globTestConfig{}); len(errs) > 0 {
+				b.Fatalf("unexpected errors: %v", errs)
+			}
+
+			cacheFile := filepath.Join(s.SrcDir, s.GlobDir, globBucketCacheFile)
+			*writes = 0
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s = restartGlobSingleton(s)
+				if !cached {
+					if err := os.Remove(cacheFile); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if _, errs := generateGlobNinjaFile(s, globTestConfig{}); len(errs) > 0 {
+					b.Fatalf("unexpected errors: %v", errs)
+				}
+			}
+			b.ReportMetric(float64(*writes)/float64(b.N), "writes/op")
+		})
+	}
+}
+
+type globFileTestContext struct {
+	params []blueprint.BuildParams
+}
+
+func (ctx *globFileTestContext) Config() interface{} { return globTestConfig{} }
+
+func (ctx *globFileTestContext) Build(pctx blueprint.PackageContext, params blueprint.BuildParams) {
+	ctx.params = append(ctx.params, params)
+}
+
+func TestGlobFileExcludes(t *testing.T) {
+	srcDir := t.TempDir()
+	for _, file := range []string{"a.c", "a.h", "sub/b.c", "sub/b.h", "sub/dir/c.h"} {
+		path := filepath.Join(srcDir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pattern := filepath.Join(srcDir, "**/*.?")
+	exclude := filepath.Join(srcDir, "**/*.h")
+
+	ctx := &globFileTestContext{}
+	GlobFile(ctx, pattern, []string{exclude}, "out/list")
+	if len(ctx.params) != 1 {
+		t.Fatalf("expected 1 rule, got %d", len(ctx.params))
+	}
+	wantArgs := "-p '" + pattern + "' -e '" + exclude + "'"
+	if g := ctx.params[0].Args["args"]; g != wantArgs {
+		t.Errorf("expected args %q, got %q", wantArgs, g)
+	}
+
+	if err := GlobFileContentSensitive(ctx, pattern, []string{exclude}, "out/list"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if g, w := ctx.params[1].Args["args"], "-c "+wantArgs; g != w {
+		t.Errorf("expected content sensitive args %q, got %q", w, g)
+	}
+
+	// bpglob evaluates the arguments with pathtools.Glob.
+	result, err := pathtools.Glob(pattern, []string{exclude}, pathtools.FollowSymlinks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(srcDir, "a.c"), filepath.Join(srcDir, "sub/b.c")}
+	if !reflect.DeepEqual(result.Matches, want) {
+		t.Errorf("expected matches %q, got %q", want, result.Matches)
+	}
+
+	for _, exclude := range []string{"a/**", "**/**/*.h", "a**/*.h", "[a/*.h"} {
+		ctx := &globFileTestContext{}
+		if err := GlobFileChecked(ctx, "**/*", []string{exclude}, "out/list"); err == nil {
+			t.Errorf("expected an error for exclude %q", exclude)
+		}
+		if len(ctx.params) != 0 {
+			t.Errorf("expected no rule for exclude %q, got %v", exclude, ctx.params)
+		}
+
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected GlobFile to panic for exclude %q", exclude)
+				}
+			}()
+			GlobFile(ctx, "**/*", []string{exclude}, "out/list")
+		}()
+	}
+}
@@ -15,8 +15,10 @@
 package blueprint
 
 import (
+	"bufio"
 	"bytes"
 	"cmp"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
@@ -36,6 +38,7 @@ import (
 	"sync/atomic"
 	"text/scanner"
 	"text/template"
+	"time"
 	"unsafe"
 
 	"github.com/google/blueprint/metrics"
@@ -46,6 +49,10 @@ import (
 
 var ErrBuildActionsNotReady = errors.New("build actions are not ready")
 
+// ErrParseCanceled is returned by ParseFileListCtx when its context is canceled before all the
+// Blueprints files have been parsed.
+var ErrParseCanceled = errors.New("parsing Blueprints files was canceled")
+
 const maxErrors = 10
 const MockModuleListFile = "bplist"
 
@@ -81,7 +88,12 @@ type Context struct {
 
 	BeforePrepareBuildActionsHook func() error
 
+	// AfterMutatorsHook is called by bootstrap.RunBlueprint when it stops after the mutators with
+	// bootstrap.StopAfterMutators, for example to dump the mutated module graph.
+	AfterMutatorsHook func() error
+
 	moduleFactories     map[string]ModuleFactory
+	valueTypes          map[string]proptools.ValueTypeParser
 	nameInterface       NameInterface
 	moduleGroups        []*moduleGroup
 	moduleInfo          map[Module]*moduleInfo
@@ -95,14 +107,149 @@ type Context struct {
 	dependenciesReady bool // set to true on a successful ResolveDependencies
 	buildActionsReady bool // set to true on a successful PrepareBuildActions
 
+	// set by the first call to orderOnlyDedupPhonys after PrepareBuildActions
+	dedupPhonys *localBuildActions
+
 	// set by SetIgnoreUnknownModuleTypes
 	ignoreUnknownModuleTypes bool
 
+	// set by SetStrictPropertyNames
+	strictPropertyNames bool
+
 	// set by SetAllowMissingDependencies
 	allowMissingDependencies bool
 
+	// set by SetDependencyCycleHandler
+	dependencyCycleHandler func(cycle []Module) error
+
 	verifyProvidersAreUnchanged bool
 
+	// set by SetOutFileHashCheck
+	outFileHashCheck bool
+
+	// set by SetReproducibleCommandPaths
+	reproducibleCommandPaths bool
+
+	// set by SetEmptyNinjaValidation
+	emptyNinjaValidation bool
+
+	// set by SetProgressCallback
+	progressCallback ProgressCallback
+
+	// set by SetSubninjaPerDirectory
+	subninjaPerDirectory bool
+
+	// set by SetAllowedDependencyTags
+	allowedDependencyTags map[string]bool
+
+	// set by SetDefaultHeavyRulePool
+	heavyRulePredicate func(RuleInfo) bool
+	heavyRulePoolDepth int
+
+	// set by SetGlobRuleConcurrencyPool
+	globRule          Rule
+	globRulePoolDepth int
+
+	// set by SetWorkingDirForCommands
+	workingDirForCommands string
+
+	// set by SetGlobExcludeDefaults
+	globExcludeDefaults []string
+
+	// set by SetCaseInsensitiveFS
+	caseInsensitiveFS bool
+
+	// set by SetGlobFileFunc
+	globFileFunc GlobFileFunc
+
+	// set by SetGlobListDir
+	globListDir string
+
+	// set by SetConcurrentParse
+	concurrentParse int
+
+	// set by SetErrorSink
+	errorSink          func(error)
+	errorSinkLock      sync.Mutex
+	reportedErrors     map[error]bool
+	reportedErrorCount int
+
+	// set by SetFailFast
+	failFast bool
+
+	// set by SetModuleGenerateTimeout
+	moduleGenerateTimeout time.Duration
+
+	// set by SetModuleProcessingLimit
+	moduleProcessingLimit int
+
+	// set by SetParallelism
+	parallelism int
+
+	// set by SetBlueprintsFileNames
+	blueprintsFileNames map[string]bool
+
+	// set by SetIndexedDedupPhonyNames
+	indexedDedupPhonyNames bool
+
+	// set by SetKeepParsedModules
+	keepParsedModules bool
+
+	// set by ResolveDependencies if keepParsedModules is set, see ReparseFile
+	parsedModules []parsedModule
+
+	// the rootDir passed to the last ParseFileList, see ReparseFile
+	parseRootDir string
+
+	// where the modules processed under moduleProcessingLimit are logged, os.Stderr if nil
+	moduleProcessingLog io.Writer
+
+	// set by RegisterModuleCreatedHook
+	moduleCreatedHooks []ModuleCreatedHook
+
+	// set by RegisterModuleInitHook
+	moduleInitHooks []ModuleInitHook
+
+	// set by RegisterDependencyRewriter
+	dependencyRewriters []DependencyRewriter
+
+	// set by RegisterDefaultsMerge
+	defaultsMerges []defaultsMerge
+
+	// set by RegisterSidecarDepsLoader
+	sidecarDepsLoaders []SidecarDepsLoader
+
+	// the dependencies returned by the sidecarDepsLoaders, by Blueprints file and then by module
+	// name
+	sidecarDeps     map[string]map[string][]string
+	sidecarDepsLock sync.Mutex
+
+	// set by RegisterNinjaPostProcessor
+	ninjaPostProcessors []NinjaPostProcessor
+
+	// canonical instances of dependency tags, see InternTag
+	internedTags sync.Map
+
+	// set by SetModuleBlob, cleared by ClearModuleBlobs
+	moduleBlobs     map[*moduleInfo]map[string][]byte
+	moduleBlobsLock sync.Mutex
+
+	// set by SetWarnOnEmptyModules
+	warnOnEmptyModules bool
+
+	// set by SetWarnOnIneffectiveRestat
+	warnOnIneffectiveRestat bool
+
+	// set during PrepareBuildActions
+	warnings []error
+
+	// set by AddWarning and while parsing, not cleared by PrepareBuildActions
+	parseWarnings     []error
+	parseWarningsLock sync.Mutex
+
+	// set during PrepareBuildActions, see InstallMap
+	installMap map[string]string
+
 	// set during PrepareBuildActions
 	nameTracker     *nameTracker
 	liveGlobals     *liveTracker
@@ -123,8 +270,9 @@ type Context struct {
 	// cache deps modified to determine whether cachedSortedModuleGroups needs to be recalculated
 	cachedDepsModified bool
 
-	globs    map[globKey]pathtools.GlobResult
-	globLock sync.Mutex
+	globs          map[globKey]pathtools.GlobResult
+	globRequesters map[globKey][]*moduleInfo
+	globLock       sync.Mutex
 
 	srcDir         string
 	fs             pathtools.FileSystem
@@ -150,6 +298,10 @@ type Context struct {
 	// String values that can be used to gate build graph traversal
 	includeTags *IncludeTags
 
+	// set by shouldVisitFile, keyed by directory
+	includeDecisions     map[string]IncludeDecision
+	includeDecisionsLock sync.Mutex
+
 	sourceRootDirs *SourceRootDirs
 }
 
@@ -175,7 +327,7 @@ func (dirs *SourceRootDirs) SourceRootDirAllowed(path string) (bool, string) {
 			prefix = prefix[1:]
 			disallowedPrefix = true
 		}
-		if strings.HasPrefix(path, prefix) {
+		if sourceRootDirMatches(path, prefix) {
 			if disallowedPrefix {
 				return false, prefix
 			} else {
@@ -186,6 +338,27 @@ func (dirs *SourceRootDirs) SourceRootDirAllowed(path string) (bool, string) {
 	return true, ""
 }
 
+// sourceRootDirMatches returns true if path starts with prefix.  A "*" segment in prefix matches
+// any single segment of path, so "vendor/*/tests" matches "vendor/foo/tests/bar".
+func sourceRootDirMatches(path, prefix string) bool {
+	if !strings.Contains(prefix, "*") {
+		return strings.HasPrefix(path, prefix)
+	}
+	prefixSegments := strings.Split(prefix, "/")
+	pathSegments := strings.Split(path, "/")
+	if len(pathSegments) < len(prefixSegments) {
+		return false
+	}
+	last := len(prefixSegments) - 1
+	for i, segment := range prefixSegments[:last] {
+		if segment != "*" && segment != pathSegments[i] {
+			return false
+		}
+	}
+	// Like a literal prefix, the final segment only needs to be a prefix of the path segment.
+	return prefixSegments[last] == "*" || strings.HasPrefix(pathSegments[last], prefixSegments[last])
+}
+
 func (c *Context) AddSourceRootDirs(dirs ...string) {
 	c.sourceRootDirs.Add(dirs...)
 }
@@ -204,6 +377,16 @@ func (tags *IncludeTags) Contains(tag string) bool {
 	return exists
 }
 
+// containsAll returns true if all of the given tags are in tags.
+func (tags *IncludeTags) containsAll(names []string) bool {
+	for _, name := range names {
+		if !tags.Contains(name) {
+			return false
+		}
+	}
+	return true
+}
+
 func (c *Context) AddIncludeTags(names ...string) {
 	c.includeTags.Add(names...)
 }
@@ -212,6 +395,113 @@ func (c *Context) ContainsIncludeTag(name string) bool {
 	return c.includeTags.Contains(name)
 }
 
+// IncludeDecision records why the Blueprints file in a directory was included in or excluded from
+// parsing by its blueprint_package_includes module.
+type IncludeDecision struct {
+	// Dir is the directory containing the Blueprints file.
+	Dir string
+
+	// Included is true if all of the tags in MatchAll were added with AddIncludeTags.
+	Included bool
+
+	// MatchAll is the list of tags required by the blueprint_package_includes module.
+	MatchAll []string
+
+	// Missing is the list of tags in MatchAll that were not added with AddIncludeTags.
+	Missing []string
+}
+
+// IncludeDecisions returns the decisions made while parsing for each directory whose Blueprints
+// file contains a blueprint_package_includes module, sorted by directory.
+func (c *Context) IncludeDecisions() []IncludeDecision {
+	c.includeDecisionsLock.Lock()
+	defer c.includeDecisionsLock.Unlock()
+
+	decisions := make([]IncludeDecision, 0, len(c.includeDecisions))
+	for _, decision := range c.includeDecisions {
+		decisions = append(decisions, decision)
+	}
+	sort.Slice(decisions, func(i, j int) bool {
+		return decisions[i].Dir < decisions[j].Dir
+	})
+	return decisions
+}
+
+// recordIncludeDecision records the decision made for the Blueprints file named file by its
+// blueprint_package_includes module pi.
+func (c *Context) recordIncludeDecision(file string, pi *PackageIncludes, included bool) {
+	decision := IncludeDecision{
+		Dir:      filepath.Dir(file),
+		Included: included,
+		MatchAll: append([]string(nil), pi.MatchAll()...),
+	}
+	for _, tag := range pi.MatchAll() {
+		if !c.ContainsIncludeTag(tag) {
+			decision.Missing = append(decision.Missing, tag)
+		}
+	}
+
+	c.includeDecisionsLock.Lock()
+	defer c.includeDecisionsLock.Unlock()
+	if c.includeDecisions == nil {
+		c.includeDecisions = make(map[string]IncludeDecision)
+	}
+	c.includeDecisions[decision.Dir] = decision
+}
+
+// ReachableUnderTags returns the modules that would be reachable from the module named root if
+// only the given include tags had been added with AddIncludeTags, without changing the include
+// tags of the Context.  The blueprint_package_includes module of each directory is re-evaluated
+// with the given tags, and the dependencies of root are followed only into modules defined in
+// directories that would be included.  Only modules that are in the Context can be returned, so
+// modules in directories that were excluded while parsing are never reachable.  It should be
+// called after ResolveDependencies.  It returns nil if root does not exist or would be excluded.
+func (c *Context) ReachableUnderTags(root string, tags []string) []Module {
+	group := c.moduleGroupFromName(root, nil)
+	if group == nil {
+		return nil
+	}
+
+	includeTags := &IncludeTags{}
+	includeTags.Add(tags...)
+
+	c.includeDecisionsLock.Lock()
+	included := make(map[string]bool, len(c.includeDecisions))
+	for dir, decision := range c.includeDecisions {
+		included[dir] = includeTags.containsAll(decision.MatchAll)
+	}
+	c.includeDecisionsLock.Unlock()
+
+	isIncluded := func(module *moduleInfo) bool {
+		if include, ok := included[filepath.Dir(module.relBlueprintsFile)]; ok {
+			return include
+		}
+		return true
+	}
+
+	var reachable []Module
+	visited := make(map[*moduleInfo]bool)
+	var visit func(module *moduleInfo)
+	visit = func(module *moduleInfo) {
+		if visited[module] || !isIncluded(module) {
+			return
+		}
+		visited[module] = true
+		reachable = append(reachable, module.logicModule)
+		for _, dep := range module.directDeps {
+			visit(dep.module)
+		}
+	}
+
+	for _, module := range group.modules {
+		if m := module.module(); m != nil {
+			visit(m)
+		}
+	}
+
+	return reachable
+}
+
 // An Error describes a problem that was encountered that is related to a
 // particular location in a Blueprints file.
 type BlueprintError struct {
@@ -323,6 +613,11 @@ type moduleInfo struct {
 	pos               scanner.Position
 	propertyPos       map[string]scanner.Position
 	createdBy         *moduleInfo
+	createdByMutator  string   // the mutator that created the module if createdBy is set
+	disabled          bool     // set by the enabled property, see commonProperties
+	common            bool     // set by the common property, see commonProperties
+	testData          []string // set by the test_data property, see commonProperties
+	testDataFiles     []string // testData resolved by resolveTestData
 
 	variant variant
 
@@ -344,6 +639,7 @@ type moduleInfo struct {
 
 	// set during each runMutator
 	splitModules modulesOrAliases
+	pruned       bool // set by PruneVariant, removed from its group at the end of the mutator
 
 	// Used by TransitionMutator implementations
 	transitionVariations     []string
@@ -399,6 +695,12 @@ func (module *moduleInfo) String() string {
 	return s
 }
 
+// outputDir returns the relative path that is reserved for intermediates of this variant of the
+// module.
+func (module *moduleInfo) outputDir() string {
+	return filepath.Join(filepath.Dir(module.relBlueprintsFile), module.Name(), module.variant.name)
+}
+
 func (module *moduleInfo) namespace() Namespace {
 	return module.group.namespace
 }
@@ -453,9 +755,11 @@ type singletonInfo struct {
 	singleton Singleton
 	name      string
 	parallel  bool
+	pre       bool
 
 	// set during PrepareBuildActions
 	actionDefs localBuildActions
+	generated  int // the number of times GenerateBuildActions was called, see checkSingletonsRan
 }
 
 type mutatorInfo struct {
@@ -472,9 +776,11 @@ func newContext() *Context {
 		Context:                     context.Background(),
 		EventHandler:                &eventHandler,
 		moduleFactories:             make(map[string]ModuleFactory),
+		valueTypes:                  make(map[string]proptools.ValueTypeParser),
 		nameInterface:               NewSimpleNameInterface(),
 		moduleInfo:                  make(map[Module]*moduleInfo),
 		globs:                       make(map[globKey]pathtools.GlobResult),
+		globRequesters:              make(map[globKey][]*moduleInfo),
 		fs:                          pathtools.OsFs,
 		finishedMutators:            make(map[*mutatorInfo]bool),
 		includeTags:                 &IncludeTags{},
@@ -572,6 +878,231 @@ func (c *Context) RegisterModuleType(name string, factory ModuleFactory) {
 	c.moduleFactories[name] = factory
 }
 
+// RegisterValueType registers a custom type for property values, such as a duration or a version
+// number, that is written in Blueprints files as a string.  Property struct fields tagged with
+// blueprint_value_type:"<name>" are set from the value returned by parse instead of the string
+// itself, for example:
+//
+//	ctx.RegisterValueType("duration", func(s string) (interface{}, error) {
+//	    return time.ParseDuration(s)
+//	})
+//
+//	type myModuleProperties struct {
+//	    Timeout *int64 `blueprint_value_type:"duration"`
+//	}
+//
+// An error returned by parse is reported as a PropertyError at the position of the value.  See
+// proptools.UnpackPropertiesWithValueTypes for the types of field that the value can be stored in.
+func (c *Context) RegisterValueType(name string, parse func(string) (interface{}, error)) {
+	if _, present := c.valueTypes[name]; present {
+		panic(fmt.Errorf("value type %q is already registered", name))
+	}
+	c.valueTypes[name] = parse
+}
+
+// A ModuleCreatedHook is called with each module created by MutatorContext.CreateModule and the
+// name of the mutator that created it.
+type ModuleCreatedHook func(created Module, creator string)
+
+// RegisterModuleCreatedHook registers a function that is called whenever a mutator creates a new
+// module with CreateModule, for example to track synthesized modules and where they came from.
+// The hooks are called synchronously once the mutator pass that created the module finishes,
+// after the module has been added to the Context, in the order they were registered.
+func (c *Context) RegisterModuleCreatedHook(hook ModuleCreatedHook) {
+	c.moduleCreatedHooks = append(c.moduleCreatedHooks, hook)
+}
+
+// A ModuleInitContext is passed to a ModuleInitHook to describe the module and collect errors.
+type ModuleInitContext interface {
+	// Module returns the module whose properties have been assigned.
+	Module() Module
+
+	// ModuleName returns the name of the module.
+	ModuleName() string
+
+	// ModuleType returns the name of the module type that was used to create the module.
+	ModuleType() string
+
+	// BlueprintsFile returns the path of the Blueprints file that defined the module.
+	BlueprintsFile() string
+
+	// ModuleErrorf reports an error at the position of the module definition.
+	ModuleErrorf(fmt string, args ...interface{})
+
+	// PropertyErrorf reports an error at the position of the property, or of the module
+	// definition if the property was not set.
+	PropertyErrorf(property, fmt string, args ...interface{})
+}
+
+// A ModuleInitHook is called with each module defined in a Blueprints file once its properties
+// have been assigned.
+type ModuleInitHook func(ctx ModuleInitContext)
+
+// RegisterModuleInitHook registers a function that is called for each module defined in a
+// Blueprints file, or added by its load hooks, after its properties have been assigned and
+// before it is added to the Context.  It can be used to validate properties, for example to
+// check that a required property is set, before any mutators run.  The hooks are called
+// synchronously from a single goroutine, in the order they were registered, so they do not need
+// to be reentrant.  Modules created by mutators are not passed to the hooks, see
+// RegisterModuleCreatedHook.
+func (c *Context) RegisterModuleInitHook(hook ModuleInitHook) {
+	c.moduleInitHooks = append(c.moduleInitHooks, hook)
+}
+
+type moduleInitContext struct {
+	module *moduleInfo
+	errs   []error
+}
+
+func (ctx *moduleInitContext) Module() Module {
+	return ctx.module.logicModule
+}
+
+func (ctx *moduleInitContext) ModuleName() string {
+	return ctx.module.Name()
+}
+
+func (ctx *moduleInitContext) ModuleType() string {
+	return ctx.module.typeName
+}
+
+func (ctx *moduleInitContext) BlueprintsFile() string {
+	return ctx.module.relBlueprintsFile
+}
+
+func (ctx *moduleInitContext) ModuleErrorf(format string, args ...interface{}) {
+	ctx.errs = append(ctx.errs, &ModuleError{
+		BlueprintError: BlueprintError{
+			Err: fmt.Errorf(format, args...),
+			Pos: ctx.module.pos,
+		},
+		module: ctx.module,
+	})
+}
+
+func (ctx *moduleInitContext) PropertyErrorf(property, format string, args ...interface{}) {
+	pos := ctx.module.propertyPos[property]
+	if !pos.IsValid() {
+		pos = ctx.module.pos
+	}
+	ctx.errs = append(ctx.errs, &PropertyError{
+		ModuleError: ModuleError{
+			BlueprintError: BlueprintError{
+				Err: fmt.Errorf(format, args...),
+				Pos: pos,
+			},
+			module: ctx.module,
+		},
+		property: property,
+	})
+}
+
+// runModuleInitHooks calls the hooks registered with RegisterModuleInitHook for module and returns
+// the errors they reported.
+func (c *Context) runModuleInitHooks(module *moduleInfo) []error {
+	if len(c.moduleInitHooks) == 0 {
+		return nil
+	}
+	ctx := &moduleInitContext{module: module}
+	for _, hook := range c.moduleInitHooks {
+		hook(ctx)
+	}
+	return ctx.errs
+}
+
+// A DependencyRewriter is called with the module adding a dependency, the dependency tag and the
+// name of the dependency, and returns the name of the module the dependency should be on instead,
+// or name itself to leave the dependency unchanged.
+type DependencyRewriter func(from Module, tag DependencyTag, name string) string
+
+// RegisterDependencyRewriter registers a function that can redirect the dependencies added by
+// mutators to other modules, for example to move every dependency on libfoo to libfoo_v2 without
+// editing the Blueprints files.  Rewriters apply to dependencies added with AddDependency,
+// AddVariationDependencies and AddFarVariationDependencies, and are called before the variant of
+// the dependency is chosen, so the variants of the new module are matched.  They are called in the
+// order they were registered, each with the name returned by the previous one, and may be called
+// concurrently from multiple mutators.
+func (c *Context) RegisterDependencyRewriter(rewriter DependencyRewriter) {
+	c.dependencyRewriters = append(c.dependencyRewriters, rewriter)
+}
+
+// rewriteDependency returns the name of the module a dependency on depName should be on after
+// applying the rewriters registered with RegisterDependencyRewriter.
+func (c *Context) rewriteDependency(module *moduleInfo, tag DependencyTag, depName string) string {
+	for _, rewriter := range c.dependencyRewriters {
+		depName = rewriter(module.logicModule, tag, depName)
+	}
+	return depName
+}
+
+// A SidecarDepsLoader is called with the path of each Blueprints file that is parsed, and returns
+// additional dependencies for the modules defined in it, keyed by module name, read from a file
+// generated next to it such as a deps.json file.  It also returns the files it read, or tried to
+// read, so that the build is regenerated when they change.
+type SidecarDepsLoader func(bpPath string) (deps map[string][]string, ninjaFileDeps []string, err error)
+
+// SidecarDependencyTag is the dependency tag of the dependencies added by a SidecarDepsLoader.
+type SidecarDependencyTag struct {
+	BaseDependencyTag
+}
+
+// RegisterSidecarDepsLoader registers a function that provides dependencies for the modules in a
+// Blueprints file that are not written in the Blueprints file itself, for example a generated
+// dependency graph.  The loader is called when each Blueprints file is parsed, possibly
+// concurrently, and the dependencies it returns are added during ResolveDependencies with a
+// SidecarDependencyTag, like the dependencies returned by DynamicDependerModule.  The files it
+// returns are included in the dependencies returned by ParseFileList and ParseBlueprintsFiles.
+func (c *Context) RegisterSidecarDepsLoader(loader SidecarDepsLoader) {
+	c.sidecarDepsLoaders = append(c.sidecarDepsLoaders, loader)
+}
+
+// loadSidecarDeps calls the loaders registered with RegisterSidecarDepsLoader for a Blueprints
+// file and records the dependencies they return.  It returns the files the loaders read.
+func (c *Context) loadSidecarDeps(bpPath string) (ninjaFileDeps []string, errs []error) {
+	for _, loader := range c.sidecarDepsLoaders {
+		deps, loaderNinjaFileDeps, err := loader(bpPath)
+		ninjaFileDeps = append(ninjaFileDeps, loaderNinjaFileDeps...)
+		if err != nil {
+			errs = append(errs, &BlueprintError{
+				Err: fmt.Errorf("failed to load sidecar dependencies: %w", err),
+				Pos: scanner.Position{Filename: bpPath},
+			})
+			continue
+		}
+		if len(deps) == 0 {
+			continue
+		}
+
+		c.sidecarDepsLock.Lock()
+		if c.sidecarDeps == nil {
+			c.sidecarDeps = make(map[string]map[string][]string)
+		}
+		if c.sidecarDeps[bpPath] == nil {
+			c.sidecarDeps[bpPath] = make(map[string][]string)
+		}
+		for name, moduleDeps := range deps {
+			c.sidecarDeps[bpPath][name] = append(c.sidecarDeps[bpPath][name], moduleDeps...)
+		}
+		c.sidecarDepsLock.Unlock()
+	}
+	return ninjaFileDeps, errs
+}
+
+// A NinjaPostProcessor transforms the complete Ninja manifest text written by
+// Context.WriteBuildFile, or the parts of a manifest written by MergeBuildFiles that come from
+// one Context.
+type NinjaPostProcessor func(manifest []byte) ([]byte, error)
+
+// RegisterNinjaPostProcessor registers a function that WriteBuildFile runs over the complete
+// serialized Ninja manifest before writing it, for example to add a prefix to the commands of
+// compile rules.  The post-processors run in the order they were registered, each on the output
+// of the previous one.  They see the manifest as text and must keep it valid Ninja syntax,
+// Blueprint does not check the result.  If a post-processor returns an error nothing is written
+// and WriteBuildFile returns the error.
+func (c *Context) RegisterNinjaPostProcessor(postProcessor NinjaPostProcessor) {
+	c.ninjaPostProcessors = append(c.ninjaPostProcessors, postProcessor)
+}
+
 // A SingletonFactory function creates a new Singleton object.  See the
 // Context.RegisterSingletonType method for details about how a registered
 // SingletonFactory is used by a Context.
@@ -588,6 +1119,21 @@ type SingletonFactory func() Singleton
 // factory function should be a named function so that its package and name can
 // be included in the generated Ninja file for debugging purposes.
 func (c *Context) RegisterSingletonType(name string, factory SingletonFactory, parallel bool) {
+	c.registerSingletonType(name, factory, parallel, false)
+}
+
+// RegisterPreSingletonType registers a singleton type whose GenerateBuildActions is called by
+// PrepareBuildActions before the GenerateBuildActions method of any module, for example to
+// compute global state that the modules use to generate their build actions.  Pre-singletons run
+// after all of the mutators have finished, so they see the final modules, variants and
+// dependencies, but the modules have no build actions yet and the providers they set in
+// GenerateBuildActions are not available.  They run one at a time in registration order, and
+// share the names of the singletons registered with RegisterSingletonType, which must be unique.
+func (c *Context) RegisterPreSingletonType(name string, factory SingletonFactory) {
+	c.registerSingletonType(name, factory, false, true)
+}
+
+func (c *Context) registerSingletonType(name string, factory SingletonFactory, parallel, pre bool) {
 	for _, s := range c.singletonInfo {
 		if s.name == name {
 			panic(fmt.Errorf("singleton %q is already registered", name))
@@ -599,6 +1145,7 @@ func (c *Context) RegisterSingletonType(name string, factory SingletonFactory, p
 		singleton: factory(),
 		name:      name,
 		parallel:  parallel,
+		pre:       pre,
 	})
 }
 
@@ -951,6 +1498,27 @@ func (c *Context) SetIgnoreUnknownModuleTypes(ignoreUnknownModuleTypes bool) {
 	c.ignoreUnknownModuleTypes = ignoreUnknownModuleTypes
 }
 
+// SetStrictPropertyNames makes unrecognized properties in module definitions, for example a typo
+// like "dpes" for "deps", be reported as PropertyErrors that name the module and the property,
+// instead of the BlueprintErrors reported by default.  In both cases the module is not added.
+func (c *Context) SetStrictPropertyNames(strict bool) {
+	c.strictPropertyNames = strict
+}
+
+// SetDependencyCycleHandler sets a function that is called with each dependency cycle that is
+// found, instead of always reporting the cycle as an error.  The cycle is the chain reported in
+// the error: each module depends on the next one and the last one depends on the first, starting
+// from the first module in order of name and variant, so the same cycle is always reported in the
+// same order.  If the handler returns an error the cycle is reported as an error followed by the
+// returned error, as if there was no handler.  If it returns nil Blueprint breaks the cycle and
+// continues: for a cycle of dependencies it removes the dependency of the last module in the
+// cycle on the first, and for a cycle found while a mutator was waiting for a dependency to be
+// visited it stops waiting, so the waiting mutator may see a dependency that has not been
+// visited yet.
+func (c *Context) SetDependencyCycleHandler(handler func(cycle []Module) error) {
+	c.dependencyCycleHandler = handler
+}
+
 // SetAllowMissingDependencies changes the behavior of Blueprint to ignore
 // unresolved dependencies.  If the module's GenerateBuildActions calls
 // ModuleContext.GetMissingDependencies Blueprint will not emit any errors
@@ -971,68 +1539,783 @@ func (c *Context) GetVerifyProvidersAreUnchanged() bool {
 	return c.verifyProvidersAreUnchanged
 }
 
-func (c *Context) SetModuleListFile(listFile string) {
-	c.moduleListFile = listFile
+// SetOutFileHashCheck makes bootstrap.RunBlueprint compare the new Ninja file contents with
+// the existing output file and only write the file if they differ, preserving the modification
+// time of an unchanged file so that Ninja doesn't reload an identical manifest.  The whole file
+// is held in memory while it is compared.
+func (c *Context) SetOutFileHashCheck(outFileHashCheck bool) {
+	c.outFileHashCheck = outFileHashCheck
 }
 
-func (c *Context) ListModulePaths(baseDir string) (paths []string, err error) {
-	reader, err := c.fs.Open(c.moduleListFile)
-	if err != nil {
+func (c *Context) GetOutFileHashCheck() bool {
+	return c.outFileHashCheck
+}
+
+// SetEmptyNinjaValidation makes bootstrap.RunBlueprint fully check the build actions when it
+// is asked to write an empty Ninja file, as if it was writing a real one.  The Ninja file and the
+// per-directory Ninja files are generated and discarded, and SetVerifyProvidersAreUnchanged is
+// turned on.  Errors that would otherwise only be reported by a real build fail the empty build
+// too.  RunBlueprint returns an error if it is also asked to stop before writing the Ninja file,
+// as the later phases would not be checked.
+func (c *Context) SetEmptyNinjaValidation(validate bool) {
+	c.emptyNinjaValidation = validate
+}
+
+func (c *Context) GetEmptyNinjaValidation() bool {
+	return c.emptyNinjaValidation
+}
+
+// SetProgressCallback sets a function that is called with the progress of ParseFileList,
+// ResolveDependencies, PrepareBuildActions and WriteBuildFile, for example to show a progress bar.
+// The phase is one of ProgressParse, ProgressResolve, ProgressPrepare or ProgressWrite, and done
+// and total count the files parsed, the modules visited by mutators, the modules generated or the
+// modules written.  The total may be an
+// estimate that changes while the phase runs, but it is never less than done, and each phase ends
+// with a call where done equals total.  The callback is called about 100 times per phase, from
+// whichever goroutine finished the work, but never concurrently.  A nil callback, the default,
+// disables progress reporting.
+func (c *Context) SetProgressCallback(callback ProgressCallback) {
+	c.progressCallback = callback
+}
+
+// SetReproducibleCommandPaths makes WriteBuildFile, WriteBuildFileTo and WriteDirectoryBuildFiles
+// replace the absolute path of the source directory set by SetSrcDir, or of the current directory
+// if none was set, with paths relative to it in the Ninja files they write, so that the files are
+// the same when the source tree is checked out in a different place.  Ninja runs in the source
+// directory, so commands, inputs, outputs and depfiles still refer to the same files.  A path that
+// is exactly the source directory becomes ".", and paths inside it lose the prefix, for example
+// "-I/src/include" becomes "-Iinclude".  Paths are only rewritten where the absolute source
+// directory appears as a whole path component, so "/src2" is left unchanged.  The rewriting is
+// applied before any NinjaPostProcessors.
+//
+// It can't be combined with SetWorkingDirForCommands, whose commands run in another directory and
+// rely on the absolute paths that this would make relative to the directory Ninja runs in.
+// PrepareBuildActions and the functions that write Ninja files return an error if both are set.
+func (c *Context) SetReproducibleCommandPaths(reproducible bool) {
+	c.reproducibleCommandPaths = reproducible
+}
+
+func (c *Context) GetReproducibleCommandPaths() bool {
+	return c.reproducibleCommandPaths
+}
+
+// relativizeSrcDirPaths replaces the absolute source directory in manifest as described in
+// SetReproducibleCommandPaths.
+func (c *Context) relativizeSrcDirPaths(manifest []byte) ([]byte, error) {
+	if err := c.checkReproducibleCommandPaths(); err != nil {
 		return nil, err
 	}
-	defer reader.Close()
-	bytes, err := ioutil.ReadAll(reader)
+
+	srcDir, err := filepath.Abs(c.srcDir)
 	if err != nil {
 		return nil, err
 	}
-	text := string(bytes)
+	if srcDir == "/" {
+		// Every absolute path is inside the root directory, leave them alone.
+		return manifest, nil
+	}
 
-	text = strings.Trim(text, "\n")
-	lines := strings.Split(text, "\n")
-	for i := range lines {
-		lines[i] = filepath.Join(baseDir, lines[i])
+	isPathByte := func(b byte) bool {
+		return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' ||
+			strings.IndexByte("._-+@~,%/", b) >= 0
 	}
 
-	return lines, nil
+	prefix := []byte(srcDir)
+	var ret []byte
+	replaced := false
+	last := 0
+	for i := 0; i < len(manifest); {
+		j := bytes.Index(manifest[i:], prefix)
+		if j < 0 {
+			break
+		}
+		start := i + j
+		end := start + len(prefix)
+		i = end
+		k := start
+		for k > 0 && isPathByte(manifest[k-1]) {
+			k--
+		}
+		if bytes.IndexByte(manifest[k:start], '/') >= 0 {
+			// The source directory is the end of a longer path, as opposed to following a flag
+			// like -I.
+			continue
+		}
+		replacement := "."
+		if end < len(manifest) && manifest[end] == '/' {
+			replacement = ""
+			end++
+		} else if end < len(manifest) && isPathByte(manifest[end]) {
+			// A sibling of the source directory with a longer name.
+			continue
+		}
+		ret = append(ret, manifest[last:start]...)
+		ret = append(ret, replacement...)
+		replaced = true
+		last = end
+		i = end
+	}
+	if !replaced {
+		return manifest, nil
+	}
+	return append(ret, manifest[last:]...), nil
 }
 
-// a fileParseContext tells the status of parsing a particular file
-type fileParseContext struct {
-	// name of file
-	fileName string
+// SetSubninjaPerDirectory makes WriteBuildFile leave out the build actions of modules and instead
+// include a "subninja <builddir>/subninja/<dir>/modules.ninja" statement for each directory that
+// contains Blueprints files defining modules with build actions, where <builddir> is the Ninja
+// build directory set by SingletonContext.SetOutDir, which is required.  The build actions of the
+// modules in each directory are then written to those files by WriteDirectoryBuildFiles.  The global variables, pools and rules, the phony targets for
+// deduplicated order-only dependencies and the singleton build actions stay in the top-level
+// file, so they are available to every subninja.  Together the files describe the same build as
+// the single file written without this option, but changing the modules in one directory only
+// changes that directory's file.
+func (c *Context) SetSubninjaPerDirectory(subninjaPerDirectory bool) {
+	c.subninjaPerDirectory = subninjaPerDirectory
+}
 
-	// scope to use when resolving variables
-	Scope *parser.Scope
+func (c *Context) GetSubninjaPerDirectory() bool {
+	return c.subninjaPerDirectory
+}
 
-	// pointer to the one in the parent directory
-	parent *fileParseContext
+// SetIndexedDedupPhonyNames names the phony targets that replace the order-only dependencies
+// shared by several build actions dedup-0, dedup-1 and so on, numbered in the order in which the
+// modules sorted by name first use them, instead of dedup-<hash of the dependencies>.  The numbers
+// make it easier to follow which build actions share a phony in the Ninja file, but adding a set of
+// order-only dependencies renumbers all of the later phony targets, so the hashed names, which only
+// change with the dependencies, remain the default.
+func (c *Context) SetIndexedDedupPhonyNames(indexed bool) {
+	c.indexedDedupPhonyNames = indexed
+}
 
-	// is closed once FileHandler has completed for this file
-	doneVisiting chan struct{}
+// SetAllowedDependencyTags restricts the types of the dependency tags that can be used by the
+// dependencies between modules.  After all mutators have run, ResolveDependencies returns an error
+// for each dependency whose tag type isn't in types.  Types are named as by the %T verb of the fmt
+// package, for example "*android.dependencyTag", and dependencies added with a nil tag have the
+// type "<nil>".  An empty list, the default, allows all tag types.
+func (c *Context) SetAllowedDependencyTags(types []string) {
+	c.allowedDependencyTags = nil
+	if len(types) > 0 {
+		c.allowedDependencyTags = make(map[string]bool, len(types))
+		for _, typ := range types {
+			c.allowedDependencyTags[typ] = true
+		}
+	}
 }
 
-// ParseBlueprintsFiles parses a set of Blueprints files starting with the file
-// at rootFile.  When it encounters a Blueprints file with a set of subdirs
-// listed it recursively parses any Blueprints files found in those
-// subdirectories.
-//
-// If no errors are encountered while parsing the files, the list of paths on
-// which the future output will depend is returned.  This list will include both
-// Blueprints file paths as well as directory paths for cases where wildcard
-// subdirs are found.
-func (c *Context) ParseBlueprintsFiles(rootFile string,
-	config interface{}) (deps []string, errs []error) {
+// RuleInfo describes a rule for the predicate passed to SetDefaultHeavyRulePool.
+type RuleInfo struct {
+	// Name is the name of the rule in the Ninja file.
+	Name string
 
-	baseDir := filepath.Dir(rootFile)
-	pathsToParse, err := c.ListModulePaths(baseDir)
-	if err != nil {
-		return nil, []error{err}
-	}
-	return c.ParseFileList(baseDir, pathsToParse, config)
+	// Command is the command of the rule as written in the Ninja file, before variables are
+	// expanded.
+	Command string
+
+	Comment string
 }
 
-type shouldVisitFileInfo struct {
-	shouldVisitFile bool
+// heavyRulePoolName is the name of the pool created by SetDefaultHeavyRulePool.
+const heavyRulePoolName = "heavy"
+
+// SetDefaultHeavyRulePool limits the number of parallel jobs that run rules known to use a lot of
+// resources, such as memory hungry linkers, since Ninja has no directive to set a default number of
+// jobs.  PrepareBuildActions calls predicate with each global and local rule that isn't already in
+// a pool, and puts the rules it returns true for in a pool named "heavy" with the given depth, which
+// is written with the global pools.  A nil predicate, the default, leaves the rules unchanged.
+func (c *Context) SetDefaultHeavyRulePool(predicate func(RuleInfo) bool, depth int) {
+	c.heavyRulePredicate = predicate
+	c.heavyRulePoolDepth = depth
+}
+
+// assignHeavyRulePool puts the rules selected by the predicate passed to SetDefaultHeavyRulePool
+// in the heavy rule pool, adding the pool to the global pools if any rule was selected.
+func (c *Context) assignHeavyRulePool() {
+	if c.heavyRulePredicate == nil {
+		return
+	}
+
+	pool := NewBuiltinPool(heavyRulePoolName)
+	used := false
+	assign := func(rule Rule, def *ruleDef) {
+		if def.Pool != nil {
+			return
+		}
+		info := RuleInfo{
+			Name:    c.nameTracker.Rule(rule),
+			Comment: def.Comment,
+		}
+		if command := def.Variables["command"]; command != nil {
+			info.Command = command.Value(c.nameTracker)
+		}
+		if c.heavyRulePredicate(info) {
+			def.Pool = pool
+			used = true
+		}
+	}
+
+	for _, rule := range c.sortedGlobalRules() {
+		assign(rule, c.globalRules[rule])
+	}
+	for _, module := range c.modulesSorted {
+		for _, rule := range module.actionDefs.rules {
+			assign(rule, rule.def_)
+		}
+	}
+	for _, info := range c.singletonInfo {
+		for _, rule := range info.actionDefs.rules {
+			assign(rule, rule.def_)
+		}
+	}
+
+	if used {
+		c.globalPools[pool] = &poolDef{
+			Comment: "Pool for the rules selected by Context.SetDefaultHeavyRulePool",
+			Depth:   c.heavyRulePoolDepth,
+		}
+	}
+}
+
+// globRulePoolName is the name of the pool created by SetGlobRuleConcurrencyPool.
+const globRulePoolName = "glob"
+
+// SetGlobRuleConcurrencyPool limits the number of glob file lists that Ninja regenerates in
+// parallel, to avoid starting a process for every glob at once on a cold build.  PrepareBuildActions
+// puts globRule, the rule that regenerates the file lists such as bootstrap.GlobRule, in a pool
+// named "glob" with the given depth, which is written with the global pools.  A depth of 0, the
+// default, leaves the rule unchanged.
+func (c *Context) SetGlobRuleConcurrencyPool(globRule Rule, depth int) {
+	c.globRule = globRule
+	c.globRulePoolDepth = depth
+}
+
+// assignGlobRulePool puts the rule passed to SetGlobRuleConcurrencyPool in the glob pool if the
+// rule is used.
+func (c *Context) assignGlobRulePool() {
+	if c.globRulePoolDepth <= 0 {
+		return
+	}
+	def := c.globalRules[c.globRule]
+	if def == nil {
+		return
+	}
+
+	pool := NewBuiltinPool(globRulePoolName)
+	def.Pool = pool
+	c.globalPools[pool] = &poolDef{
+		Comment: "Pool for the glob rule set by Context.SetGlobRuleConcurrencyPool",
+		Depth:   c.globRulePoolDepth,
+	}
+}
+
+// SetErrorSink sets a function that is called with each error found by ParseBlueprintsFiles,
+// ParseFileList, ResolveDependencies and PrepareBuildActions as soon as it is found, so that
+// wrappers can report errors while a long build is still running.  The errors are still
+// returned by those methods as well.  The sink is never called concurrently, and is called at
+// most once for each error.
+func (c *Context) SetErrorSink(sink func(error)) {
+	c.errorSink = sink
+}
+
+// reportErrors passes each error in errs that hasn't already been reported to the sink set by
+// SetErrorSink.
+func (c *Context) reportErrors(errs []error) {
+	if c.errorSink == nil || len(errs) == 0 {
+		return
+	}
+
+	c.errorSinkLock.Lock()
+	defer c.errorSinkLock.Unlock()
+
+	if c.reportedErrors == nil {
+		c.reportedErrors = make(map[error]bool)
+	}
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if c.failFast && c.reportedErrorCount > 0 {
+			return
+		}
+		// Errors whose dynamic type can't be used as a map key can't be deduplicated.
+		if reflect.TypeOf(err).Comparable() {
+			if c.reportedErrors[err] {
+				continue
+			}
+			c.reportedErrors[err] = true
+		}
+		c.errorSink(err)
+		c.reportedErrorCount++
+	}
+}
+
+// SetFailFast causes ParseBlueprintsFiles, ParseFileList, ResolveDependencies and
+// PrepareBuildActions to stop at the first fatal error and return only that error, instead of
+// accumulating up to maxErrors errors.  This gives faster feedback at the cost of only reporting
+// one problem per run.  Only the first error is passed to the sink set by SetErrorSink.
+func (c *Context) SetFailFast(failFast bool) {
+	c.failFast = failFast
+}
+
+// errorLimit returns the number of errors a phase accumulates before it stops early.
+func (c *Context) errorLimit() int {
+	if c.failFast {
+		return 0
+	}
+	return maxErrors
+}
+
+// failFastErrors returns only the first error in errs if SetFailFast was called.
+func (c *Context) failFastErrors(errs []error) []error {
+	if c.failFast && len(errs) > 1 {
+		return errs[:1]
+	}
+	return errs
+}
+
+// SetModuleGenerateTimeout causes PrepareBuildActions to fail with an error naming the module and
+// the Blueprints file that defines it if a call to GenerateBuildActions takes longer than d, to
+// debug modules that hang.  The stuck call can't be stopped, its goroutine is abandoned.  A zero
+// duration, the default, disables the timeout and calls GenerateBuildActions directly.
+func (c *Context) SetModuleGenerateTimeout(d time.Duration) {
+	c.moduleGenerateTimeout = d
+}
+
+// SetModuleProcessingLimit causes PrepareBuildActions to call GenerateBuildActions on at most the
+// first n modules in dependency order, logging the name of each module to stderr before processing
+// it so that the log is complete even if one of them crashes, and then stop with an error instead
+// of generating the rest of the build actions.  It is intended for
+// bisecting crashes in GenerateBuildActions and must not be used for real builds.  A limit of zero
+// processes all modules.
+func (c *Context) SetModuleProcessingLimit(n int) {
+	c.moduleProcessingLimit = n
+}
+
+// SetParallelism limits the number of modules that are visited concurrently by parallel mutators,
+// by GenerateBuildActions and by the other passes over all modules to n, for example to share a
+// machine with other jobs.  Visitors that are waiting for another module to be visited are not
+// counted.  A value of zero, the default, uses a limit of 1000, which in practice leaves the
+// parallelism to the Go scheduler and GOMAXPROCS.
+func (c *Context) SetParallelism(n int) {
+	c.parallelism = n
+}
+
+// parallelVisitLimit returns the limit to pass to parallelVisit, see SetParallelism.
+func (c *Context) parallelVisitLimit() int {
+	if c.parallelism > 0 {
+		return c.parallelism
+	}
+	return parallelVisitLimit
+}
+
+// SetWarnOnEmptyModules causes PrepareBuildActions to record a warning for every module whose
+// GenerateBuildActions created no build statements and set no providers, which usually means the
+// module is misconfigured.  Modules that implement NoBuildActionsModule are never warned about.
+// The warnings are available from Warnings after PrepareBuildActions returns.
+func (c *Context) SetWarnOnEmptyModules(warnOnEmptyModules bool) {
+	c.warnOnEmptyModules = warnOnEmptyModules
+}
+
+// SetWarnOnIneffectiveRestat causes PrepareBuildActions to record a warning for every rule that
+// sets Restat but whose command does not appear to leave its outputs untouched when their contents
+// have not changed, in which case restat never prevents anything from being rebuilt.  The check is
+// a best-effort match of the command, with the values of variables substituted, against the
+// patterns in conditionalWritePatterns.  The warnings are available from Warnings after
+// PrepareBuildActions returns.
+func (c *Context) SetWarnOnIneffectiveRestat(warnOnIneffectiveRestat bool) {
+	c.warnOnIneffectiveRestat = warnOnIneffectiveRestat
+}
+
+// conditionalWritePatterns are fragments of commands that indicate that a command only writes its
+// outputs when their contents change, for example by comparing a temporary file with the existing
+// output.  bpglob is included because it only rewrites its output when the glob results change.
+var conditionalWritePatterns = []string{
+	"cmp ",
+	"diff ",
+	"if_changed",
+	"if-changed",
+	"IfChanged",
+	"bpglob",
+}
+
+// checkRestatRules returns a warning for every live global rule and every rule created by a module
+// or singleton that sets restat without a command that matches conditionalWritePatterns.
+func (c *Context) checkRestatRules() []error {
+	var warnings []error
+
+	check := func(rule Rule, def *ruleDef, lookup func(Variable) *ninjaString) {
+		command := def.Variables["command"]
+		if def.Variables["restat"] == nil || command == nil {
+			return
+		}
+		expanded := command.expand(lookup, c.nameTracker)
+		for _, pattern := range conditionalWritePatterns {
+			if strings.Contains(expanded, pattern) {
+				return
+			}
+		}
+		warnings = append(warnings, fmt.Errorf("rule %s sets restat but its command always rewrites its outputs: %s",
+			c.nameTracker.Rule(rule), expanded))
+	}
+
+	globalLookup := func(v Variable) *ninjaString {
+		return c.liveGlobals.variables[v]
+	}
+	for rule, def := range c.liveGlobals.rules {
+		check(rule, def, globalLookup)
+	}
+
+	checkLocal := func(defs *localBuildActions) {
+		if len(defs.rules) == 0 {
+			return
+		}
+		locals := make(map[Variable]*ninjaString, len(defs.variables))
+		for _, v := range defs.variables {
+			locals[v] = v.value_
+		}
+		lookup := func(v Variable) *ninjaString {
+			if value, ok := locals[v]; ok {
+				return value
+			}
+			return globalLookup(v)
+		}
+		for _, r := range defs.rules {
+			check(r, r.def_, lookup)
+		}
+	}
+	for _, module := range c.modulesSorted {
+		checkLocal(&module.actionDefs)
+	}
+	for _, info := range c.singletonInfo {
+		checkLocal(&info.actionDefs)
+	}
+
+	sort.Slice(warnings, func(i, j int) bool {
+		return warnings[i].Error() < warnings[j].Error()
+	})
+	return warnings
+}
+
+// Warnings returns the non-fatal problems found while parsing, such as properties tagged
+// `blueprint:"deprecated"` that are set in a Blueprints file, the warnings added with AddWarning,
+// and the non-fatal problems found by the last call to PrepareBuildActions, in that order.
+func (c *Context) Warnings() []error {
+	c.parseWarningsLock.Lock()
+	warnings := append([]error(nil), c.parseWarnings...)
+	c.parseWarningsLock.Unlock()
+
+	// Warnings are added concurrently while parsing and by parallel mutators, sort them so that they
+	// are reported in a stable order.
+	sort.SliceStable(warnings, func(i, j int) bool {
+		return warnings[i].Error() < warnings[j].Error()
+	})
+	return append(warnings, c.warnings...)
+}
+
+// NoBuildActionsModule is implemented by modules that are expected to produce no build
+// statements and no providers, to exclude them from the warnings enabled by
+// Context.SetWarnOnEmptyModules.
+type NoBuildActionsModule interface {
+	Module
+
+	NoBuildActions()
+}
+
+// isEmpty returns true if the module produced no build statements and set no providers.
+func (module *moduleInfo) isEmpty() bool {
+	if len(module.actionDefs.buildDefs) > 0 {
+		return false
+	}
+	for _, p := range module.providers {
+		if p != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// SetWorkingDirForCommands causes every rule command written to the Ninja file to be
+// wrapped as "cd <dir> && <command>", for builds that use tools which are sensitive to the
+// directory they are run from.  A relative dir is interpreted relative to the directory Ninja
+// runs in and may not escape it, an absolute dir must be inside the source directory if one
+// was set with SetSrcDir.  The dir may not be the build directory or inside it.  An empty dir
+// disables the wrapping.
+//
+// Ninja expands $in and $out relative to the directory it runs in, so references to them in the
+// command and rspfile_content of a rule are replaced by references to the in_wd and out_wd
+// variables of each build statement, which hold the same paths made absolute.  Ninja still reads
+// the depfile and writes the rspfile relative to the directory it runs in, which refers to the
+// same files as a command that names them from $out, for example as $out.d.  Depfiles written by
+// the command list the absolute paths it was given, which Ninja resolves to the same files.
+// Literal relative paths in the command itself are the responsibility of the rule.
+func (c *Context) SetWorkingDirForCommands(dir string) {
+	c.workingDirForCommands = dir
+}
+
+// SetConcurrentParse sets the maximum number of Blueprints files that are read and parsed at the
+// same time by ParseFileList and ParseBlueprintsFiles.  A limit of 1 parses one file at a time,
+// and a limit of 0 restores the default of 200, which stays below the default limit of 256 open
+// files on Darwin.  When a limit is set, modules are registered sorted by the path of the
+// Blueprints file that defines them, so the order doesn't depend on the limit or on scheduling.
+func (c *Context) SetConcurrentParse(n int) {
+	c.concurrentParse = n
+}
+
+// SetGlobExcludeDefaults sets exclude patterns that are added to the excludes of every glob,
+// including the globs used to find Blueprints files and those made through GlobWithDeps, for
+// example []string{"**/.git/**", "**/*~", "**/OWNERS"}.  The patterns use the same syntax as
+// the excludes passed to GlobWithDeps and are combined with them.  They are recorded in the
+// glob results like any other exclude, so changing them reruns the affected globs.
+func (c *Context) SetGlobExcludeDefaults(patterns []string) {
+	c.globExcludeDefaults = append([]string(nil), patterns...)
+}
+
+// SetCaseInsensitiveFS makes globs spell paths with the case stored on the filesystem, for
+// source trees on case-insensitive filesystems such as the defaults on macOS and Windows.  The
+// literal parts of glob patterns and excludes are converted to the stored case before globbing,
+// so patterns that only differ in case share a glob result and a glob bucket, and the matches and
+// dependencies are converted to the stored case after globbing.  See pathtools.CanonicalCase.
+func (c *Context) SetCaseInsensitiveFS(caseInsensitiveFS bool) {
+	c.caseInsensitiveFS = caseInsensitiveFS
+}
+
+func (c *Context) GetCaseInsensitiveFS() bool {
+	return c.caseInsensitiveFS
+}
+
+// GlobFileFunc creates a build statement in ctx that writes to fileListFile a list of the files
+// that match pattern but do not match any of the patterns in excludes, and that only updates
+// fileListFile when the list of matching files has changed.  bootstrap.GlobFile is the usual
+// implementation.
+type GlobFileFunc func(ctx ModuleContext, pattern string, excludes []string, fileListFile string)
+
+// SetGlobFileFunc sets the function used by ModuleContext.AddGlobDependency to create the build
+// statement that writes a glob's file list file.
+func (c *Context) SetGlobFileFunc(f GlobFileFunc) {
+	c.globFileFunc = f
+}
+
+// SetGlobListDir sets the directory in the build directory that ModuleContext.AddGlobDependency
+// writes the file list files to, usually the directory of the glob list files written by
+// bootstrap.GlobSingleton, see bootstrap.GlobDirectory.  The file list files are put in a modules
+// subdirectory, so they don't collide with the files of the GlobSingleton.
+func (c *Context) SetGlobListDir(dir string) {
+	c.globListDir = dir
+}
+
+func (c *Context) GetGlobListDir() string {
+	return c.globListDir
+}
+
+// checkReproducibleCommandPaths returns an error if SetReproducibleCommandPaths is combined with
+// SetWorkingDirForCommands.
+func (c *Context) checkReproducibleCommandPaths() error {
+	if c.reproducibleCommandPaths && c.workingDirForCommands != "" {
+		return fmt.Errorf("reproducible command paths can't be used with working directory for commands %q, "+
+			"which needs absolute paths", c.workingDirForCommands)
+	}
+	return nil
+}
+
+func (c *Context) validateWorkingDirForCommands() error {
+	dir := c.workingDirForCommands
+	if dir == "" {
+		return nil
+	}
+
+	if err := c.checkReproducibleCommandPaths(); err != nil {
+		return err
+	}
+
+	if filepath.Clean(dir) != dir {
+		return fmt.Errorf("working directory for commands %q is not a clean path", dir)
+	}
+
+	if !filepath.IsAbs(dir) {
+		if dir == ".." || strings.HasPrefix(dir, "../") {
+			return fmt.Errorf("working directory for commands %q is outside the directory ninja runs in", dir)
+		}
+	} else if filepath.IsAbs(c.srcDir) {
+		if rel, err := filepath.Rel(c.srcDir, dir); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			return fmt.Errorf("working directory for commands %q is outside the source directory %q",
+				dir, c.srcDir)
+		}
+	}
+
+	return nil
+}
+
+// ruleDefForWrite returns the ruleDef that should be written to the Ninja file for def, applying
+// the wrapper set by SetWorkingDirForCommands if there is one.
+func (c *Context) ruleDefForWrite(def *ruleDef) *ruleDef {
+	if c.workingDirForCommands == "" {
+		return def
+	}
+	return def.withWorkingDir("cd " + proptools.NinjaAndShellEscapeIncludingSpaces(c.workingDirForCommands) + " && ")
+}
+
+// buildDefForWrite returns the buildDef that should be written to the Ninja file for def.  If
+// SetWorkingDirForCommands was called it adds the absolute paths of the inputs and outputs that
+// ruleDefForWrite makes the command use instead of $in and $out.  lookup returns the values of the
+// variables that the paths may refer to.
+func (c *Context) buildDefForWrite(def *buildDef, lookup func(Variable) *ninjaString) (*buildDef, error) {
+	if c.workingDirForCommands == "" || def.RuleDef == nil {
+		return def, nil
+	}
+	if _, ok := def.RuleDef.Variables["command"]; !ok {
+		return def, nil
+	}
+
+	root, err := c.ninjaRootDir()
+	if err != nil {
+		return nil, err
+	}
+	escapedRoot := proptools.NinjaEscape(root)
+
+	// The paths of ninjaStrings are already ninja escaped, the plain strings are not.
+	absPaths := func(paths []*ninjaString, strs []string) *ninjaString {
+		var list []string
+		for _, path := range paths {
+			escaped := path.expand(lookup, c.nameTracker)
+			if !filepath.IsAbs(escaped) {
+				escaped = escapedRoot + "/" + escaped
+			}
+			list = append(list, proptools.ShellEscape(escaped))
+		}
+		for _, path := range strs {
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(root, path)
+			}
+			list = append(list, proptools.NinjaAndShellEscape(path))
+		}
+		return simpleNinjaString(strings.Join(list, " "))
+	}
+
+	return def.withVariables(map[string]*ninjaString{
+		workingDirInVariable:  absPaths(def.Inputs, def.InputStrings),
+		workingDirOutVariable: absPaths(def.Outputs, def.OutputStrings),
+	}), nil
+}
+
+// ninjaRootDir returns the absolute path of the directory Ninja runs in, which is the source
+// directory set by SetSrcDir, or the current directory if none was set.
+func (c *Context) ninjaRootDir() (string, error) {
+	return filepath.Abs(c.srcDir)
+}
+
+// SetModuleListFile sets the file that lists the Blueprints files to parse, one per line.  The
+// file may be compressed with gzip, see ListModulePaths.
+func (c *Context) SetModuleListFile(listFile string) {
+	c.moduleListFile = listFile
+}
+
+// SetBlueprintsFileNames sets the names of the files that are Blueprints files, for example
+// "Android.bp" or "BUILD.bp".  ListModulePaths and WalkBlueprintsFiles skip the paths whose base
+// name is not exactly one of names, and MockFileSystem looks for files with these names instead of
+// "Android.bp".  By default every path in the module list file is a Blueprints file.
+func (c *Context) SetBlueprintsFileNames(names []string) {
+	c.blueprintsFileNames = nil
+	if len(names) > 0 {
+		c.blueprintsFileNames = make(map[string]bool, len(names))
+		for _, name := range names {
+			c.blueprintsFileNames[name] = true
+		}
+	}
+}
+
+// filterBlueprintsFiles returns the paths in paths whose base name was set by
+// SetBlueprintsFileNames, or paths if SetBlueprintsFileNames was not called.
+func (c *Context) filterBlueprintsFiles(paths []string) []string {
+	if c.blueprintsFileNames == nil {
+		return paths
+	}
+	var filtered []string
+	for _, path := range paths {
+		if c.blueprintsFileNames[filepath.Base(path)] {
+			filtered = append(filtered, path)
+		}
+	}
+	return filtered
+}
+
+// gzipMagic is the header that every gzip compressed file starts with.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// ListModulePaths returns the paths listed in the module list file set by SetModuleListFile,
+// joined to baseDir, skipping the paths that are not Blueprints files according to
+// SetBlueprintsFileNames.  A module list file that has a .gz extension or starts with the gzip header
+// is decompressed first, and produces the same paths in the same order as the uncompressed file.
+func (c *Context) ListModulePaths(baseDir string) (paths []string, err error) {
+	reader, err := c.fs.Open(c.moduleListFile)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasSuffix(c.moduleListFile, ".gz") || bytes.HasPrefix(data, gzipMagic) {
+		gzipReader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress module list file %q: %w", c.moduleListFile, err)
+		}
+		data, err = ioutil.ReadAll(gzipReader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress module list file %q: %w", c.moduleListFile, err)
+		}
+	}
+	text := string(data)
+
+	text = strings.Trim(text, "\n")
+	lines := c.filterBlueprintsFiles(strings.Split(text, "\n"))
+	for i := range lines {
+		lines[i] = filepath.Join(baseDir, lines[i])
+	}
+
+	return lines, nil
+}
+
+// a fileParseContext tells the status of parsing a particular file
+type fileParseContext struct {
+	// name of file
+	fileName string
+
+	// scope to use when resolving variables
+	Scope *parser.Scope
+
+	// pointer to the one in the parent directory
+	parent *fileParseContext
+
+	// is closed once FileHandler has completed for this file
+	doneVisiting chan struct{}
+}
+
+// ParseBlueprintsFiles parses a set of Blueprints files starting with the file
+// at rootFile.  When it encounters a Blueprints file with a set of subdirs
+// listed it recursively parses any Blueprints files found in those
+// subdirectories.
+//
+// If no errors are encountered while parsing the files, the list of paths on
+// which the future output will depend is returned.  This list will include both
+// Blueprints file paths as well as directory paths for cases where wildcard
+// subdirs are found.
+func (c *Context) ParseBlueprintsFiles(rootFile string,
+	config interface{}) (deps []string, errs []error) {
+
+	baseDir := filepath.Dir(rootFile)
+	pathsToParse, err := c.ListModulePaths(baseDir)
+	if err != nil {
+		errs = []error{err}
+		c.reportErrors(errs)
+		return nil, errs
+	}
+	return c.ParseFileList(baseDir, pathsToParse, config)
+}
+
+type shouldVisitFileInfo struct {
+	shouldVisitFile bool
 	skippedModules  []string
 	reasonForSkip   string
 	errs            []error
@@ -1053,7 +2336,8 @@ func shouldVisitFile(c *Context, file *parser.File) shouldVisitFileInfo {
 			if def.Type != "blueprint_package_includes" {
 				continue
 			}
-			module, errs := processModuleDef(def, file.Name, c.moduleFactories, nil, c.ignoreUnknownModuleTypes)
+			module, errs := processModuleDef(def, file.Name, c.moduleFactories, nil, c.valueTypes,
+				c.ignoreUnknownModuleTypes, c.strictPropertyNames)
 			if len(errs) > 0 {
 				// This file contains errors in blueprint_package_includes
 				// Visit anyways so that we can report errors on other modules in the file
@@ -1069,6 +2353,7 @@ func shouldVisitFile(c *Context, file *parser.File) shouldVisitFileInfo {
 
 	if blueprintPackageIncludes != nil {
 		packageMatches := blueprintPackageIncludes.MatchesIncludeTags(c)
+		c.recordIncludeDecision(file.Name, blueprintPackageIncludes, packageMatches)
 		if !packageMatches {
 			return shouldVisitFileInfo{
 				shouldVisitFile: false,
@@ -1086,23 +2371,107 @@ func shouldVisitFile(c *Context, file *parser.File) shouldVisitFileInfo {
 		return shouldVisitFileInfo{
 			shouldVisitFile: shouldVisit,
 			skippedModules:  skippedModules,
-			reasonForSkip: fmt.Sprintf(
-				"%q is a descendant of %q, and that path prefix was not included in PRODUCT_SOURCE_ROOT_DIRS",
-				file.Name,
-				invalidatingPrefix,
-			),
+			reasonForSkip:   sourceRootDirSkipReason(file.Name, invalidatingPrefix),
 		}
 	}
 	return shouldVisitFileInfo{shouldVisitFile: true}
 }
 
+// sourceRootDirSkipReason returns the reason given for skipping the modules in file because of
+// the prefix passed to AddSourceRootDirs.
+func sourceRootDirSkipReason(file, prefix string) string {
+	return fmt.Sprintf(
+		"%q is a descendant of %q, and that path prefix was not included in PRODUCT_SOURCE_ROOT_DIRS",
+		file,
+		prefix,
+	)
+}
+
+// ParseString parses the contents of a single Blueprints file that is held in memory, and returns
+// the module definitions it contains.  The filename is relative to dir and is only used to
+// describe the positions of the modules and of any errors, which are reported in the same format
+// as ParseFileList.  Unlike ParseFileList, the modules are not added to the Context, and any
+// Blueprints files listed in a build variable are not parsed.
+func (c *Context) ParseString(dir, filename string, contents string) ([]*parser.Module, []error) {
+	file, _, errs := c.parseOne(dir, filepath.Join(dir, filename), strings.NewReader(contents),
+		parser.NewScope(nil), nil)
+	if file == nil {
+		return nil, errs
+	}
+
+	var modules []*parser.Module
+	for _, def := range file.Defs {
+		if module, ok := def.(*parser.Module); ok {
+			modules = append(modules, module)
+		}
+	}
+	return modules, errs
+}
+
 func (c *Context) ParseFileList(rootDir string, filePaths []string,
 	config interface{}) (deps []string, errs []error) {
 
+	return c.parseFileList(context.Background(), rootDir, filePaths, nil, config)
+}
+
+// ParseFileListCtx is like ParseFileList, but stops parsing when goCtx is done.  Once goCtx is
+// done no more Blueprints files are opened and no more modules are added, and it returns
+// ErrParseCanceled with any other errors as soon as the files already being parsed are finished.
+// The modules from the files that were parsed before it was canceled are left in the Context, so
+// it should not be used further.
+func (c *Context) ParseFileListCtx(goCtx context.Context, rootDir string, filePaths []string,
+	config interface{}) (deps []string, errs []error) {
+
+	return c.parseFileList(goCtx, rootDir, filePaths, nil, config)
+}
+
+// ParseReaders parses Blueprints files whose contents are read from readers instead of from the
+// file system, and adds the modules they define like ParseFileList.  The keys of readers are the
+// paths of the files, which are used as the names of the files in the positions of the modules
+// and of any errors, and to determine the directories of the modules.  Blueprints files listed
+// in a build variable are read from the file system unless they are also in readers.  The
+// returned dependencies do not include the paths in readers, as they do not exist on disk.
+func (c *Context) ParseReaders(rootDir string, readers map[string]io.Reader,
+	config interface{}) (deps []string, errs []error) {
+
+	filePaths := make([]string, 0, len(readers))
+	for filePath := range readers {
+		filePaths = append(filePaths, filePath)
+	}
+	sort.Strings(filePaths)
+
+	return c.parseFileList(context.Background(), rootDir, filePaths, readers, config)
+}
+
+// parseFileList implements ParseFileList and ParseReaders, the files in readers are read from
+// their reader instead of from the file system.
+func (c *Context) parseFileList(goCtx context.Context, rootDir string, filePaths []string,
+	readers map[string]io.Reader, config interface{}) (deps []string, errs []error) {
+
+	defer func() {
+		errs = c.failFastErrors(errs)
+		c.reportErrors(errs)
+	}()
+
 	if len(filePaths) < 1 {
 		return nil, []error{fmt.Errorf("no paths provided to parse")}
 	}
 
+	c.parseRootDir = rootDir
+
+	return c.addFileModules(goCtx, len(filePaths), config, func(handleOneFile FileHandler) ([]string, []error) {
+		return c.walkBlueprintsFiles(goCtx, rootDir, filePaths, readers, handleOneFile)
+	})
+}
+
+// addFileModules adds the modules defined in the Blueprints files that walk passes to its
+// FileHandler, which may be called concurrently.  It is the single path through which modules are
+// added by ParseFileList, ParseJSONModules and ReparseFile: files skipped by AddSourceRootDirs are
+// recorded, the sidecar dependencies are loaded, and the load hooks and init hooks of each module
+// are run before it is added.  numFiles is the number of files reported to the progress callback.
+func (c *Context) addFileModules(goCtx context.Context, numFiles int, config interface{},
+	walk func(handleOneFile FileHandler) ([]string, []error)) (deps []string, errs []error) {
+
 	c.dependenciesReady = false
 
 	type newModuleInfo struct {
@@ -1120,12 +2489,20 @@ func (c *Context) ParseFileList(rootDir string, filePaths []string,
 	errsCh := make(chan []error)
 	doneCh := make(chan struct{})
 	skipCh := make(chan newSkipInfo)
+	sidecarDepsCh := make(chan []string)
 	var numErrs uint32
 	var numGoroutines int32
 
+	firstNewGroup := len(c.moduleGroups)
+
+	progress := c.startProgress(ProgressParse, numFiles)
+	defer progress.finish()
+
 	// handler must be reentrant
 	handleOneFile := func(file *parser.File) {
-		if atomic.LoadUint32(&numErrs) > maxErrors {
+		defer progress.increment()
+
+		if atomic.LoadUint32(&numErrs) > uint32(c.errorLimit()) || goCtx.Err() != nil {
 			return
 		}
 
@@ -1169,11 +2546,27 @@ func (c *Context) ParseFileList(rootDir string, filePaths []string,
 			return
 		}
 
+		if len(c.sidecarDepsLoaders) > 0 {
+			sidecarFileDeps, errs := c.loadSidecarDeps(file.Name)
+			if len(errs) > 0 {
+				atomic.AddUint32(&numErrs, uint32(len(errs)))
+				errsCh <- errs
+			}
+			if len(sidecarFileDeps) > 0 {
+				sidecarDepsCh <- sidecarFileDeps
+			}
+		}
+
 		for _, def := range file.Defs {
 			switch def := def.(type) {
 			case *parser.Module:
-				module, errs := processModuleDef(def, file.Name, c.moduleFactories, scopedModuleFactories, c.ignoreUnknownModuleTypes)
+				module, errs := processModuleDef(def, file.Name, c.moduleFactories, scopedModuleFactories,
+					c.valueTypes, c.ignoreUnknownModuleTypes, c.strictPropertyNames)
+				if len(errs) == 0 && module != nil {
+					errs = c.expandGlobProperties(module)
+				}
 				if len(errs) == 0 && module != nil {
+					c.warnDeprecatedProperties(module)
 					errs = addModule(module)
 				}
 
@@ -1194,7 +2587,7 @@ func (c *Context) ParseFileList(rootDir string, filePaths []string,
 	atomic.AddInt32(&numGoroutines, 1)
 	go func() {
 		var errs []error
-		deps, errs = c.WalkBlueprintsFiles(rootDir, filePaths, handleOneFile)
+		deps, errs = walk(handleOneFile)
 		if len(errs) > 0 {
 			errsCh <- errs
 		}
@@ -1206,16 +2599,21 @@ loop:
 	for {
 		select {
 		case newErrs := <-errsCh:
+			c.reportErrors(newErrs)
 			errs = append(errs, newErrs...)
 		case module := <-moduleCh:
-			newErrs := c.addModule(module.moduleInfo)
+			newErrs := c.runModuleInitHooks(module.moduleInfo)
+			newErrs = append(newErrs, c.addModule(module.moduleInfo)...)
 			hookDeps = append(hookDeps, module.deps...)
 			if module.added != nil {
 				module.added <- struct{}{}
 			}
 			if len(newErrs) > 0 {
+				c.reportErrors(newErrs)
 				errs = append(errs, newErrs...)
 			}
+		case sidecarDeps := <-sidecarDepsCh:
+			hookDeps = append(hookDeps, sidecarDeps...)
 		case <-doneCh:
 			n := atomic.AddInt32(&numGoroutines, -1)
 			if n == 0 {
@@ -1232,6 +2630,18 @@ loop:
 		}
 	}
 
+	// Files are parsed concurrently, so modules are added in an order that depends on scheduling.
+	// When SetConcurrentParse was called, sort the new modules by the Blueprints file that defines
+	// them to make the registration order deterministic.  Modules from the same file are added by
+	// a single visitor, so the stable sort keeps them in the order they were defined.
+	if c.concurrentParse > 0 {
+		newGroups := c.moduleGroups[firstNewGroup:]
+		sort.SliceStable(newGroups, func(i, j int) bool {
+			return newGroups[i].modules.firstModule().relBlueprintsFile <
+				newGroups[j].modules.firstModule().relBlueprintsFile
+		})
+	}
+
 	deps = append(deps, hookDeps...)
 	return deps, errs
 }
@@ -1258,9 +2668,19 @@ type FileHandler func(*parser.File)
 // ancestor directory has completed.
 //
 // WalkBlueprintsFiles will not return until all calls to visitor have returned.
+//
+// File paths whose base name was not set by SetBlueprintsFileNames are skipped.
 func (c *Context) WalkBlueprintsFiles(rootDir string, filePaths []string,
 	visitor FileHandler) (deps []string, errs []error) {
 
+	return c.walkBlueprintsFiles(context.Background(), rootDir, c.filterBlueprintsFiles(filePaths), nil, visitor)
+}
+
+// walkBlueprintsFiles implements WalkBlueprintsFiles, the files in readers are read from their
+// reader instead of from the file system, and are not returned in deps.
+func (c *Context) walkBlueprintsFiles(goCtx context.Context, rootDir string, filePaths []string,
+	readers map[string]io.Reader, visitor FileHandler) (deps []string, errs []error) {
+
 	// make a mapping from ancestors to their descendants to facilitate parsing ancestors first
 	descendantsMap, err := findBlueprintDescendants(filePaths)
 	if err != nil {
@@ -1280,10 +2700,15 @@ func (c *Context) WalkBlueprintsFiles(rootDir string, filePaths []string,
 	activeCount := 0
 	var pending []fileParseContext
 	tooManyErrors := false
+	canceled := false
+	doneCh := goCtx.Done()
 
-	// Limit concurrent calls to parseBlueprintFiles to 200
+	// Limit concurrent calls to parseBlueprintFiles to 200 unless SetConcurrentParse was called
 	// Darwin has a default limit of 256 open files
 	maxActiveCount := 200
+	if c.concurrentParse > 0 {
+		maxActiveCount = c.concurrentParse
+	}
 
 	// count the number of pending calls to visitor()
 	visitorWaitGroup := sync.WaitGroup{}
@@ -1294,11 +2719,13 @@ func (c *Context) WalkBlueprintsFiles(rootDir string, filePaths []string,
 		}
 		blueprintsSet[blueprint.fileName] = true
 		activeCount++
-		deps = append(deps, blueprint.fileName)
+		if _, virtual := readers[blueprint.fileName]; !virtual {
+			deps = append(deps, blueprint.fileName)
+		}
 		visitorWaitGroup.Add(1)
 		go func() {
-			file, blueprints, deps, errs := c.openAndParse(blueprint.fileName, blueprint.Scope, rootDir,
-				&blueprint)
+			file, blueprints, deps, errs := c.openAndParse(blueprint.fileName, readers[blueprint.fileName],
+				blueprint.Scope, rootDir, &blueprint)
 			if len(errs) > 0 {
 				errsCh <- errs
 			}
@@ -1315,7 +2742,7 @@ func (c *Context) WalkBlueprintsFiles(rootDir string, filePaths []string,
 				<-blueprint.parent.doneVisiting
 			}
 
-			if len(errs) == 0 {
+			if len(errs) == 0 && goCtx.Err() == nil {
 				// process this file
 				visitor(file)
 			}
@@ -1348,23 +2775,29 @@ func (c *Context) WalkBlueprintsFiles(rootDir string, filePaths []string,
 
 loop:
 	for {
-		if len(errs) > maxErrors {
+		if len(errs) > c.errorLimit() {
 			tooManyErrors = true
 		}
 
 		select {
 		case newErrs := <-errsCh:
+			c.reportErrors(newErrs)
 			errs = append(errs, newErrs...)
 		case dep := <-depsCh:
 			deps = append(deps, dep)
+		case <-doneCh:
+			// Stop starting new files, but wait for the ones that have already started.
+			canceled = true
+			doneCh = nil
+			pending = nil
 		case blueprint := <-blueprintsCh:
-			if tooManyErrors {
+			if tooManyErrors || canceled {
 				continue
 			}
 			foundParseableBlueprint(blueprint)
 		case blueprint := <-doneParsingCh:
 			activeCount--
-			if !tooManyErrors {
+			if !tooManyErrors && !canceled {
 				startParseDescendants(blueprint)
 			}
 			if activeCount < maxActiveCount && len(pending) > 0 {
@@ -1384,6 +2817,12 @@ loop:
 	// wait for every visitor() to complete
 	visitorWaitGroup.Wait()
 
+	// Check the context rather than canceled, in case it was canceled after the last file was
+	// parsed but before it was visited.
+	if goCtx.Err() != nil {
+		errs = append(errs, ErrParseCanceled)
+	}
+
 	return
 }
 
@@ -1396,7 +2835,11 @@ func (c *Context) MockFileSystem(files map[string][]byte) {
 		// no module list file specified; find every file named Blueprints
 		pathsToParse := []string{}
 		for candidate := range files {
-			if filepath.Base(candidate) == "Android.bp" {
+			if c.blueprintsFileNames != nil {
+				if c.blueprintsFileNames[filepath.Base(candidate)] {
+					pathsToParse = append(pathsToParse, candidate)
+				}
+			} else if filepath.Base(candidate) == "Android.bp" {
 				pathsToParse = append(pathsToParse, candidate)
 			}
 		}
@@ -1416,11 +2859,17 @@ func (c *Context) SetFs(fs pathtools.FileSystem) {
 	c.fs = fs
 }
 
-// openAndParse opens and parses a single Blueprints file, and returns the results
-func (c *Context) openAndParse(filename string, scope *parser.Scope, rootDir string,
+// openAndParse opens and parses a single Blueprints file, and returns the results.  If reader is
+// not nil the contents of the file are read from it instead of from the file system.
+func (c *Context) openAndParse(filename string, reader io.Reader, scope *parser.Scope, rootDir string,
 	parent *fileParseContext) (file *parser.File,
 	subBlueprints []fileParseContext, deps []string, errs []error) {
 
+	if reader != nil {
+		file, subBlueprints, errs = c.parseOne(rootDir, filename, reader, scope, parent)
+		return parsedFile(file, subBlueprints, errs)
+	}
+
 	f, err := c.fs.Open(filename)
 	if err != nil {
 		// couldn't open the file; see if we can provide a clearer error than "could not open file"
@@ -1453,10 +2902,18 @@ func (c *Context) openAndParse(filename string, scope *parser.Scope, rootDir str
 		file, subBlueprints, errs = c.parseOne(rootDir, filename, f, scope, parent)
 	}()
 
+	return parsedFile(file, subBlueprints, errs)
+}
+
+// parsedFile returns the results of openAndParse for a file parsed by parseOne.
+func parsedFile(file *parser.File, subBlueprints []fileParseContext,
+	errs []error) (*parser.File, []fileParseContext, []string, []error) {
+
 	if len(errs) > 0 {
 		return nil, nil, nil, errs
 	}
 
+	var deps []string
 	for _, b := range subBlueprints {
 		deps = append(deps, b.fileName)
 	}
@@ -1887,8 +3344,35 @@ func newModule(factory ModuleFactory) *moduleInfo {
 	}
 }
 
+// commonProperties are the properties that are supported by every module type defined in a
+// Blueprints file, in addition to the properties returned by its factory.  A module type whose
+// factory declares one of them with a different type handles that property itself, and it is
+// left out of the common properties of its modules.
+type commonProperties struct {
+	// Enabled can be set to false to disable the module.  A disabled module goes through the
+	// mutators like any other module, but GenerateBuildActions is not called on it, and it is an
+	// error for an enabled module to depend on it unless the dependency tag implements
+	// OptionalDependencyTag.
+	Enabled *bool
+
+	// Common can be set to true to keep a single variant of the module, for example for data
+	// files or documentation that are the same for every architecture.  Mutators that create
+	// variations of the module get the module itself back for every variation instead of new
+	// variants, and dependencies from any variant of another module on it resolve to the single
+	// variant, whatever variations they request.
+	Common *bool
+
+	// Test_data lists the files, relative to the directory of the Blueprints file, that the tests
+	// built by the module need when they run.  They are not inputs of the build, but are listed
+	// by TestDataManifest.  Elements may be globs, and elements prefixed with "!" are excluded
+	// from the globs.
+	Test_data []string
+}
+
 func processModuleDef(moduleDef *parser.Module,
-	relBlueprintsFile string, moduleFactories, scopedModuleFactories map[string]ModuleFactory, ignoreUnknownModuleTypes bool) (*moduleInfo, []error) {
+	relBlueprintsFile string, moduleFactories, scopedModuleFactories map[string]ModuleFactory,
+	valueTypes map[string]proptools.ValueTypeParser, ignoreUnknownModuleTypes,
+	strictPropertyNames bool) (*moduleInfo, []error) {
 
 	factory, ok := moduleFactories[moduleDef.Type]
 	if !ok && scopedModuleFactories != nil {
@@ -1912,13 +3396,42 @@ func processModuleDef(moduleDef *parser.Module,
 
 	module.relBlueprintsFile = relBlueprintsFile
 
-	propertyMap, errs := proptools.UnpackProperties(moduleDef.Properties, module.properties...)
+	var common commonProperties
+	commonStructs, copyCommon := commonPropertiesFor(module.properties, &common)
+	propertyMap, errs := proptools.UnpackPropertiesWithValueTypes(moduleDef.Properties, valueTypes,
+		append(append([]interface{}(nil), module.properties...), commonStructs...)...)
 	if len(errs) > 0 {
 		for i, err := range errs {
 			if unpackErr, ok := err.(*proptools.UnpackError); ok {
-				err = &BlueprintError{
-					Err: unpackErr.Err,
-					Pos: unpackErr.Pos,
+				var unrecognizedErr *proptools.UnrecognizedPropertyError
+				if strictPropertyNames && errors.As(unpackErr.Err, &unrecognizedErr) {
+					err = &PropertyError{
+						ModuleError: ModuleError{
+							BlueprintError: BlueprintError{
+								Err: fmt.Errorf("unrecognized property of module type %q", moduleDef.Type),
+								Pos: unpackErr.Pos,
+							},
+							module: module,
+						},
+						property: unrecognizedErr.Property,
+					}
+				} else {
+					err = &BlueprintError{
+						Err: unpackErr.Err,
+						Pos: unpackErr.Pos,
+					}
+				}
+				errs[i] = err
+			} else if valueTypeErr, ok := err.(*proptools.ValueTypeError); ok {
+				err = &PropertyError{
+					ModuleError: ModuleError{
+						BlueprintError: BlueprintError{
+							Err: valueTypeErr.Err,
+							Pos: valueTypeErr.Pos,
+						},
+						module: module,
+					},
+					property: valueTypeErr.Property,
 				}
 				errs[i] = err
 			}
@@ -1926,6 +3439,10 @@ func processModuleDef(moduleDef *parser.Module,
 		return nil, errs
 	}
 
+	copyCommon()
+	module.disabled = common.Enabled != nil && !*common.Enabled
+	module.common = common.Common != nil && *common.Common
+	module.testData = common.Test_data
 	module.pos = moduleDef.TypePos
 	module.propertyPos = make(map[string]scanner.Position)
 	for name, propertyDef := range propertyMap {
@@ -1935,6 +3452,71 @@ func processModuleDef(moduleDef *parser.Module,
 	return module, nil
 }
 
+// commonPropertiesFor returns the structs to unpack the common properties of a module with the
+// given property structs into, and a function that copies the unpacked values into common.  It
+// returns common itself unless one of the property structs declares a common property with a
+// different type, in which case the returned struct leaves that property out.
+func commonPropertiesFor(propertyStructs []interface{}, common *commonProperties) ([]interface{}, func()) {
+	declared := declaredPropertyTypes(propertyStructs)
+	commonType := reflect.TypeOf(*common)
+	conflict := false
+	for i := 0; i < commonType.NumField(); i++ {
+		field := commonType.Field(i)
+		if t, ok := declared[proptools.PropertyNameForField(field.Name)]; ok && t != field.Type {
+			conflict = true
+		}
+	}
+	if !conflict {
+		return []interface{}{common}, func() {}
+	}
+
+	filteredType, _ := proptools.FilterPropertyStruct(commonType,
+		func(field reflect.StructField, prefix string) (bool, reflect.StructField) {
+			t, ok := declared[proptools.PropertyNameForField(field.Name)]
+			return !ok || t == field.Type, field
+		})
+	if filteredType == nil {
+		return nil, func() {}
+	}
+	filtered := reflect.New(filteredType)
+	return []interface{}{filtered.Interface()}, func() {
+		commonValue := reflect.ValueOf(common).Elem()
+		for i := 0; i < filteredType.NumField(); i++ {
+			commonValue.FieldByName(filteredType.Field(i).Name).Set(filtered.Elem().Field(i))
+		}
+	}
+}
+
+// declaredPropertyTypes returns the types of the top level properties declared by the given
+// property structs, including the properties of embedded structs, keyed by property name.
+func declaredPropertyTypes(propertyStructs []interface{}) map[string]reflect.Type {
+	declared := make(map[string]reflect.Type)
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if proptools.IsEmbedded(field) && field.Type.Kind() == reflect.Struct {
+				walk(field.Type)
+				continue
+			}
+			if proptools.ShouldSkipProperty(field) {
+				continue
+			}
+			declared[proptools.PropertyNameForField(field.Name)] = field.Type
+		}
+	}
+	for _, propertyStruct := range propertyStructs {
+		t := reflect.TypeOf(propertyStruct)
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() == reflect.Struct {
+			walk(t)
+		}
+	}
+	return declared
+}
+
 func (c *Context) addModule(module *moduleInfo) []error {
 	name := module.logicModule.Name()
 	if name == "" {
@@ -1976,6 +3558,10 @@ func (c *Context) addModule(module *moduleInfo) []error {
 func (c *Context) ResolveDependencies(config interface{}) (deps []string, errs []error) {
 	c.BeginEvent("resolve_deps")
 	defer c.EndEvent("resolve_deps")
+	defer func() {
+		errs = c.failFastErrors(errs)
+		c.reportErrors(errs)
+	}()
 	return c.resolveDependencies(c.Context, config)
 }
 
@@ -1983,8 +3569,19 @@ func (c *Context) resolveDependencies(ctx context.Context, config interface{}) (
 	pprof.Do(ctx, pprof.Labels("blueprint", "ResolveDependencies"), func(ctx context.Context) {
 		c.initProviders()
 
+		c.copyParsedModules()
 		c.liveGlobals = newLiveTracker(c, config)
 
+		errs = c.resolveNamespaceImports()
+		if len(errs) > 0 {
+			return
+		}
+
+		errs = c.resolveTestData()
+		if len(errs) > 0 {
+			return
+		}
+
 		errs = c.updateDependencies()
 		if len(errs) > 0 {
 			return
@@ -1995,6 +3592,16 @@ func (c *Context) resolveDependencies(ctx context.Context, config interface{}) (
 			return
 		}
 
+		errs = c.checkDisabledDependencies()
+		if len(errs) > 0 {
+			return
+		}
+
+		errs = c.checkAllowedDependencyTags()
+		if len(errs) > 0 {
+			return
+		}
+
 		c.BeginEvent("clone_modules")
 		if !c.SkipCloneModulesAfterMutators {
 			c.cloneModules()
@@ -2015,6 +3622,7 @@ func (c *Context) resolveDependencies(ctx context.Context, config interface{}) (
 // DynamicDependerModule interface then this set consists of the union of those
 // module names returned by its DynamicDependencies method and those added by calling
 // AddDependencies or AddVariationDependencies on DynamicDependencyModuleContext.
+// The dependencies returned for the module by the SidecarDepsLoaders are added as well.
 func blueprintDepsMutator(ctx BottomUpMutatorContext) {
 	if dynamicDepender, ok := ctx.Module().(DynamicDependerModule); ok {
 		func() {
@@ -2032,6 +3640,11 @@ func blueprintDepsMutator(ctx BottomUpMutatorContext) {
 			ctx.AddDependency(ctx.Module(), nil, dynamicDeps...)
 		}()
 	}
+
+	module := ctx.moduleInfo()
+	if sidecarDeps := ctx.(*mutatorContext).context.sidecarDeps[module.relBlueprintsFile][module.Name()]; len(sidecarDeps) > 0 {
+		ctx.AddDependency(ctx.Module(), SidecarDependencyTag{}, sidecarDeps...)
+	}
 }
 
 // findExactVariantOrSingle searches the moduleGroup for a module with the same variant as module,
@@ -2053,11 +3666,34 @@ func findExactVariantOrSingle(module *moduleInfo, possible *moduleGroup, reverse
 	return found
 }
 
+// InternTag returns a canonical instance of tag that is shared with every other tag that is equal
+// to it, so that the dependencies of a large graph that all use equal tags don't each hold their
+// own copy.  Tags whose values can't be compared are returned unchanged.  Tags passed to the
+// methods that add dependencies are interned automatically.
+func (c *Context) InternTag(tag DependencyTag) (interned DependencyTag) {
+	if tag == nil || !reflect.TypeOf(tag).Comparable() {
+		return tag
+	}
+
+	// A comparable type may still contain interface fields holding values that are not
+	// comparable, which causes a panic when the tag is hashed.
+	defer func() {
+		if r := recover(); r != nil {
+			interned = tag
+		}
+	}()
+
+	v, _ := c.internedTags.LoadOrStore(tag, tag)
+	return v.(DependencyTag)
+}
+
 func (c *Context) addDependency(module *moduleInfo, tag DependencyTag, depName string) (*moduleInfo, []error) {
 	if _, ok := tag.(BaseDependencyTag); ok {
 		panic("BaseDependencyTag is not allowed to be used directly!")
 	}
 
+	depName = c.rewriteDependency(module, tag, depName)
+
 	if depName == module.Name() {
 		return nil, []error{&BlueprintError{
 			Err: fmt.Errorf("%q depends on itself", depName),
@@ -2071,7 +3707,7 @@ func (c *Context) addDependency(module *moduleInfo, tag DependencyTag, depName s
 	}
 
 	if m := findExactVariantOrSingle(module, possibleDeps, false); m != nil {
-		module.newDirectDeps = append(module.newDirectDeps, depInfo{m, tag})
+		module.newDirectDeps = append(module.newDirectDeps, depInfo{m, c.InternTag(tag)})
 		atomic.AddUint32(&c.depsModified, 1)
 		return m, nil
 	}
@@ -2163,21 +3799,102 @@ func findVariant(module *moduleInfo, possibleDeps *moduleGroup, variations []Var
 		}
 	}
 
+	if foundDep == nil {
+		// A module with the common property is never split, so its single variant is shared by
+		// all variants of the modules that depend on it.
+		if m := possibleDeps.modules.firstModule(); m != nil && m.common {
+			foundDep = m
+		}
+	}
+
+	return foundDep, newVariant
+}
+
+// findClosestVariant returns the variant in possibleDeps whose variations include the given
+// variations, like findVariant for a far dependency.  If several variants match it returns the one
+// with the fewest variations beyond the given ones, rather than the first one, and if more than
+// one of those is equally close it returns the first of them.
+func findClosestVariant(possibleDeps *moduleGroup, variations []Variation) (*moduleInfo, variationMap) {
+	var newVariant variationMap
+	for _, v := range variations {
+		if newVariant == nil {
+			newVariant = make(variationMap)
+		}
+		newVariant[v.Mutator] = v.Variation
+	}
+
+	var foundDep *moduleInfo
+	bestDistance := 0
+	for _, m := range possibleDeps.modules {
+		variant := m.moduleOrAliasVariant().variations
+		if !newVariant.subsetOf(variant) {
+			continue
+		}
+		if distance := variationKeysDistance(newVariant, variant); foundDep == nil || distance < bestDistance {
+			foundDep = m.moduleOrAliasTarget()
+			bestDistance = distance
+		}
+	}
+
+	if foundDep == nil {
+		if m := possibleDeps.modules.firstModule(); m != nil && m.common {
+			foundDep = m
+		}
+	}
+
 	return foundDep, newVariant
 }
 
+// variationKeysDistance returns the number of mutators that have a variation in only one of a and b.
+func variationKeysDistance(a, b variationMap) int {
+	distance := 0
+	for mutator := range a {
+		if _, ok := b[mutator]; !ok {
+			distance++
+		}
+	}
+	for mutator := range b {
+		if _, ok := a[mutator]; !ok {
+			distance++
+		}
+	}
+	return distance
+}
+
+// variantMatch selects how addVariationDependency chooses the variant of the dependency.
+type variantMatch int
+
+const (
+	// matchVariant matches the variations of the depending module, see AddVariationDependencies.
+	matchVariant variantMatch = iota
+	// matchFarVariant matches the first variant that has the given variations, see
+	// AddFarVariationDependencies.
+	matchFarVariant
+	// matchClosestFarVariant matches the variant that has the given variations and the fewest
+	// others, see AddClosestFarVariationDependencies.
+	matchClosestFarVariant
+)
+
 func (c *Context) addVariationDependency(module *moduleInfo, variations []Variation,
-	tag DependencyTag, depName string, far bool) (*moduleInfo, []error) {
+	tag DependencyTag, depName string, match variantMatch) (*moduleInfo, []error) {
 	if _, ok := tag.(BaseDependencyTag); ok {
 		panic("BaseDependencyTag is not allowed to be used directly!")
 	}
 
+	depName = c.rewriteDependency(module, tag, depName)
+
 	possibleDeps := c.moduleGroupFromName(depName, module.namespace())
 	if possibleDeps == nil {
 		return nil, c.discoveredMissingDependencies(module, depName, nil)
 	}
 
-	foundDep, newVariant := findVariant(module, possibleDeps, variations, far, false)
+	var foundDep *moduleInfo
+	var newVariant variationMap
+	if match == matchClosestFarVariant {
+		foundDep, newVariant = findClosestVariant(possibleDeps, variations)
+	} else {
+		foundDep, newVariant = findVariant(module, possibleDeps, variations, match == matchFarVariant, false)
+	}
 
 	if foundDep == nil {
 		if c.allowMissingDependencies {
@@ -2208,7 +3925,7 @@ func (c *Context) addVariationDependency(module *moduleInfo, variations []Variat
 			Pos: module.pos,
 		}}
 	}
-	module.newDirectDeps = append(module.newDirectDeps, depInfo{foundDep, tag})
+	module.newDirectDeps = append(module.newDirectDeps, depInfo{foundDep, c.InternTag(tag)})
 	atomic.AddUint32(&c.depsModified, 1)
 	return foundDep, nil
 }
@@ -2239,7 +3956,7 @@ func (c *Context) addInterVariantDependency(origModule *moduleInfo, tag Dependen
 			origModule.Name()))
 	}
 
-	fromInfo.newDirectDeps = append(fromInfo.newDirectDeps, depInfo{toInfo, tag})
+	fromInfo.newDirectDeps = append(fromInfo.newDirectDeps, depInfo{toInfo, c.InternTag(tag)})
 	atomic.AddUint32(&c.depsModified, 1)
 	return toInfo
 }
@@ -2370,8 +4087,23 @@ const parallelVisitLimit = 1000
 // to wait for another dependency to be visited.  If a visit function returns true to cancel
 // while another visitor is paused, the paused visitor will never be resumed and its goroutine
 // will stay paused forever.
+//
+// Modules that become ready to visit at the same time are started, or added to the backlog, in
+// order of module group name and then variant name, and dependency cycles are searched for in the
+// same order, so the visit order with a limit of 1 and any reported cycle do not depend on the
+// order of the modules list or on map iteration order.
 func parallelVisit(modules []*moduleInfo, order visitOrderer, limit int,
 	visit func(module *moduleInfo, pause chan<- pauseSpec) bool) []error {
+	return parallelVisitWithCycleHandler(modules, order, limit, nil, visit)
+}
+
+// parallelVisitWithCycleHandler is parallelVisit, but calls onCycle when it finds a cycle of
+// visitors that are paused on each other.  If onCycle returns errors they are returned, otherwise
+// the visitor whose pause was found to complete the cycle is resumed and the visit continues.
+// If onCycle is nil the cycle is returned as errors.
+func parallelVisitWithCycleHandler(modules []*moduleInfo, order visitOrderer, limit int,
+	onCycle func(cycle []*moduleInfo) []error,
+	visit func(module *moduleInfo, pause chan<- pauseSpec) bool) []error {
 
 	doneCh := make(chan *moduleInfo)
 	cancelCh := make(chan bool)
@@ -2436,12 +4168,18 @@ func parallelVisit(modules []*moduleInfo, order visitOrderer, limit int,
 	toVisit := len(modules)
 
 	// Start or backlog any modules that are not waiting for any other modules.
+	var ready []*moduleInfo
 	for _, module := range modules {
 		if module.waitingCount == 0 {
-			startOrBacklog(module)
+			ready = append(ready, module)
 		}
 	}
+	sortModulesForVisit(ready)
+	for _, module := range ready {
+		startOrBacklog(module)
+	}
 
+resume:
 	for active > 0 {
 		select {
 		case <-cancelCh:
@@ -2457,6 +4195,9 @@ func parallelVisit(modules []*moduleInfo, order visitOrderer, limit int,
 				// Unpause or backlog any modules that were waiting for this one.
 				if unpauses, ok := pauseMap[doneModule]; ok {
 					delete(pauseMap, doneModule)
+					sort.SliceStable(unpauses, func(i, j int) bool {
+						return visitOrderLess(unpauses[i].paused, unpauses[j].paused)
+					})
 					for _, unpause := range unpauses {
 						unpauseOrBacklog(unpause)
 					}
@@ -2468,12 +4209,17 @@ func parallelVisit(modules []*moduleInfo, order visitOrderer, limit int,
 				// Decrement waitingCount on the next modules in the tree based
 				// on propagation order, and start or backlog them if they are
 				// ready to start.
+				var ready []*moduleInfo
 				for _, module := range order.propagate(doneModule) {
 					module.waitingCount--
 					if module.waitingCount == 0 {
-						startOrBacklog(module)
+						ready = append(ready, module)
 					}
 				}
+				sortModulesForVisit(ready)
+				for _, module := range ready {
+					startOrBacklog(module)
+				}
 			}
 		case pauseSpec := <-pauseCh:
 			if pauseSpec.until.waitingCount == -1 {
@@ -2548,12 +4294,28 @@ func parallelVisit(modules []*moduleInfo, order visitOrderer, limit int,
 				return nil
 			}
 
-			// Iterate over the modules list instead of pauseMap to provide deterministic ordering.
-			for _, module := range modules {
-				for _, pauseSpec := range pauseMap[module] {
+			// Iterate over the sorted modules list instead of pauseMap to provide deterministic
+			// ordering.
+			sortedModules := append([]*moduleInfo(nil), modules...)
+			sortModulesForVisit(sortedModules)
+			for _, module := range sortedModules {
+				for i, pauseSpec := range pauseMap[module] {
 					cycle := check(pauseSpec.paused, pauseSpec.until)
 					if len(cycle) > 0 {
-						return cycleError(cycle)
+						if onCycle == nil {
+							return cycleError(cycle)
+						}
+						if errs := onCycle(cycle); len(errs) > 0 {
+							return errs
+						}
+						// Break the cycle by resuming the paused visitor as if the module it is
+						// paused on had finished, and continue visiting.
+						pauseMap[module] = append(pauseMap[module][:i:i], pauseMap[module][i+1:]...)
+						if len(pauseMap[module]) == 0 {
+							delete(pauseMap, module)
+						}
+						unpauseOrBacklog(pauseSpec)
+						goto resume
 					}
 				}
 			}
@@ -2575,6 +4337,90 @@ func parallelVisit(modules []*moduleInfo, order visitOrderer, limit int,
 	return nil
 }
 
+// visitOrderLess is the tie-break used by parallelVisit between modules that are ready to be
+// visited at the same time: modules are ordered by module group name and then by variant name.
+func visitOrderLess(a, b *moduleInfo) bool {
+	if aName, bName := visitOrderGroupName(a), visitOrderGroupName(b); aName != bName {
+		return aName < bName
+	}
+	return a.variant.name < b.variant.name
+}
+
+// visitOrderGroupName returns the name of the module's group, or an empty string for modules that
+// have not been added to a group.
+func visitOrderGroupName(module *moduleInfo) string {
+	if module.group == nil {
+		return ""
+	}
+	return module.group.name
+}
+
+func sortModulesForVisit(modules []*moduleInfo) {
+	sort.SliceStable(modules, func(i, j int) bool {
+		return visitOrderLess(modules[i], modules[j])
+	})
+}
+
+// dependencyCycleChain returns the modules of a cycle found by updateDependencies or
+// parallelVisit in the order reported by cycleError, so that each module depends on the next one
+// and the last one depends on the first, rotated to start from the first module in visit order.
+func dependencyCycleChain(cycle []*moduleInfo) []*moduleInfo {
+	chain := make([]*moduleInfo, 0, len(cycle))
+	chain = append(chain, cycle[0])
+	for i := len(cycle) - 1; i > 0; i-- {
+		chain = append(chain, cycle[i])
+	}
+
+	start := 0
+	for i, module := range chain {
+		if visitOrderLess(module, chain[start]) {
+			start = i
+		}
+	}
+	return append(chain[start:], chain[:start]...)
+}
+
+// onDependencyCycle calls the handler set by SetDependencyCycleHandler with a cycle found by
+// updateDependencies or parallelVisit.  It returns the errors to report if the cycle is fatal,
+// or nil if the caller should break the cycle.
+func (c *Context) onDependencyCycle(cycle []*moduleInfo) []error {
+	if c.dependencyCycleHandler == nil {
+		return cycleError(cycle)
+	}
+
+	chain := dependencyCycleChain(cycle)
+	modules := make([]Module, len(chain))
+	for i, module := range chain {
+		modules[i] = module.logicModule
+	}
+	if err := c.dependencyCycleHandler(modules); err != nil {
+		return append(cycleError(cycle), err)
+	}
+	return nil
+}
+
+// breakDependencyCycle removes the dependency of the last module of the cycle on the first, in
+// the order returned by dependencyCycleChain.  If that dependency is only the implicit one on an
+// earlier variant of the same module it removes the closest earlier direct dependency in the
+// cycle instead.  It returns false if the cycle has no direct dependency to remove.
+func breakDependencyCycle(cycle []*moduleInfo) bool {
+	chain := dependencyCycleChain(cycle)
+	for i := len(chain) - 1; i >= 0; i-- {
+		from, to := chain[i], chain[(i+1)%len(chain)]
+		directDeps := from.directDeps[:0]
+		for _, dep := range from.directDeps {
+			if dep.module != to {
+				directDeps = append(directDeps, dep)
+			}
+		}
+		if len(directDeps) < len(from.directDeps) {
+			from.directDeps = directDeps
+			return true
+		}
+	}
+	return false
+}
+
 func cycleError(cycle []*moduleInfo) (errs []error) {
 	// The cycle list is in reverse order because all the 'check' calls append
 	// their own module to the list.
@@ -2598,18 +4444,49 @@ func cycleError(cycle []*moduleInfo) (errs []error) {
 	return errs
 }
 
+// ValidateNoSelfDependency returns an error for each module variant that has a direct dependency
+// on itself.  ResolveDependencies runs it before looking for dependency cycles, so that a module
+// that depends on itself is reported as such instead of as a dependency cycle.
+func (c *Context) ValidateNoSelfDependency() []error {
+	var errs []error
+	for _, group := range c.moduleGroups {
+		for _, moduleOrAlias := range group.modules {
+			module := moduleOrAlias.module()
+			if module == nil {
+				continue
+			}
+			for _, dep := range module.directDeps {
+				if dep.module == module {
+					errs = append(errs, &BlueprintError{
+						Err: fmt.Errorf("%s depends on itself", module),
+						Pos: module.pos,
+					})
+					break
+				}
+			}
+		}
+	}
+	return errs
+}
+
 // updateDependencies recursively walks the module dependency graph and updates
 // additional fields based on the dependencies.  It builds a sorted list of modules
 // such that dependencies of a module always appear first, and populates reverse
 // dependency links and counts of total dependencies.  It also reports errors when
-// it encounters dependency cycles.  This should be called after resolveDependencies,
+// it encounters self dependencies or dependency cycles.  This should be called after resolveDependencies,
 // as well as after any mutator pass has called addDependency
 func (c *Context) updateDependencies() (errs []error) {
 	c.cachedDepsModified = true
+
+	if errs := c.ValidateNoSelfDependency(); len(errs) > 0 {
+		return errs
+	}
+
 	visited := make(map[*moduleInfo]bool)  // modules that were already checked
 	checking := make(map[*moduleInfo]bool) // modules actively being checked
 
 	sorted := make([]*moduleInfo, 0, len(c.moduleInfo))
+	var cycles [][]*moduleInfo
 
 	var check func(group *moduleInfo) []*moduleInfo
 
@@ -2655,7 +4532,7 @@ func (c *Context) updateDependencies() (errs []error) {
 					if cycle[0] == module {
 						// We are the "start" of the cycle, so we're responsible
 						// for generating the errors.
-						errs = append(errs, cycleError(cycle)...)
+						cycles = append(cycles, cycle)
 
 						// We can continue processing this module's children to
 						// find more cycles.  Since all the modules that were
@@ -2684,13 +4561,29 @@ func (c *Context) updateDependencies() (errs []error) {
 				if cycle[len(cycle)-1] != module {
 					panic("inconceivable!")
 				}
-				errs = append(errs, cycleError(cycle)...)
+				cycles = append(cycles, cycle)
 			}
 		}
 	}
 
 	c.modulesSorted = sorted
 
+	broken := false
+	for _, cycle := range cycles {
+		if cycleErrs := c.onDependencyCycle(cycle); len(cycleErrs) > 0 {
+			errs = append(errs, cycleErrs...)
+		} else if breakDependencyCycle(cycle) {
+			broken = true
+		} else {
+			errs = append(errs, cycleError(cycle)...)
+		}
+	}
+	if len(errs) == 0 && broken {
+		// The sorted list and the reverse dependencies were computed with the cycles, compute
+		// them again without them.
+		return c.updateDependencies()
+	}
+
 	return
 }
 
@@ -2749,6 +4642,14 @@ type JSONAction struct {
 	Inputs  []string
 	Outputs []string
 	Desc    string
+
+	// NoCache is set for actions whose outputs are scratch files that must not be cached, see
+	// BuildParams.NoCache.
+	NoCache bool `json:",omitempty"`
+
+	// DirectoryOutputs are the output directories of the action, see BuildParams.DirectoryOutputs.
+	// They are not included in Outputs.
+	DirectoryOutputs []string `json:",omitempty"`
 }
 
 // JSONActionSupplier allows JSON representation of additional actions that are not registered in
@@ -2809,6 +4710,9 @@ func jsonModuleWithActionsFromModuleInfo(m *moduleInfo, nameTracker *nameTracker
 		if d, ok := bDef.Variables["description"]; ok {
 			a.Desc = d.Value(nameTracker)
 		}
+		a.NoCache = bDef.NoCache
+		a.DirectoryOutputs = append(append([]string(nil), bDef.DirectoryOutputStrings...),
+			getNinjaStrings(bDef.DirectoryOutputs, nameTracker)...)
 		actions = append(actions, a)
 	}
 
@@ -2889,6 +4793,60 @@ func (c *Context) PrintJSONGraphAndActions(wGraph io.Writer, wActions io.Writer)
 	writeJson(wActions, modulesToActions)
 }
 
+// jsonGraphModule is a module variant in the output of WriteDependencyGraphJSON.
+type jsonGraphModule struct {
+	Name      string
+	Variant   string
+	Blueprint string
+	Deps      []jsonGraphDep
+}
+
+// jsonGraphDep is a direct dependency in the output of WriteDependencyGraphJSON.
+type jsonGraphDep struct {
+	Name    string
+	Variant string
+	Tag     string
+}
+
+// WriteDependencyGraphJSON writes the dependency graph as a JSON list of module variants, sorted
+// by module name and then variant name, for tools that visualize or compare the graph.  Each
+// entry has the Name, Variant and Blueprint file of the module and the direct dependencies in
+// Deps, in the order they were added, with the Name and Variant of the dependency and the Go type
+// of the dependency tag in Tag.  It should be called after ResolveDependencies.
+func (c *Context) WriteDependencyGraphJSON(w io.Writer) error {
+	modules := make([]*moduleInfo, 0, len(c.moduleInfo))
+	for _, m := range c.moduleInfo {
+		modules = append(modules, m)
+	}
+	sortModulesForVisit(modules)
+
+	graph := make([]jsonGraphModule, 0, len(modules))
+	for _, m := range modules {
+		jm := jsonGraphModule{
+			Name:      m.Name(),
+			Variant:   m.variant.name,
+			Blueprint: m.relBlueprintsFile,
+			Deps:      make([]jsonGraphDep, 0, len(m.directDeps)),
+		}
+		for _, d := range m.directDeps {
+			tag := ""
+			if d.tag != nil {
+				tag = fmt.Sprintf("%T", d.tag)
+			}
+			jm.Deps = append(jm.Deps, jsonGraphDep{
+				Name:    d.module.Name(),
+				Variant: d.module.variant.name,
+				Tag:     tag,
+			})
+		}
+		graph = append(graph, jm)
+	}
+
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	return e.Encode(graph)
+}
+
 func writeJson(w io.Writer, modules []*JsonModule) {
 	e := json.NewEncoder(w)
 	e.SetIndent("", "\t")
@@ -2917,8 +4875,19 @@ func writeJson(w io.Writer, modules []*JsonModule) {
 func (c *Context) PrepareBuildActions(config interface{}) (deps []string, errs []error) {
 	c.BeginEvent("prepare_build_actions")
 	defer c.EndEvent("prepare_build_actions")
+	defer func() {
+		errs = c.failFastErrors(errs)
+		c.reportErrors(errs)
+	}()
 	pprof.Do(c.Context, pprof.Labels("blueprint", "PrepareBuildActions"), func(ctx context.Context) {
 		c.buildActionsReady = false
+		c.dedupPhonys = nil
+		c.warnings = nil
+
+		if err := c.validateWorkingDirForCommands(); err != nil {
+			errs = []error{err}
+			return
+		}
 
 		if !c.dependenciesReady {
 			var extraDeps []string
@@ -2929,64 +4898,315 @@ func (c *Context) PrepareBuildActions(config interface{}) (deps []string, errs [
 			deps = append(deps, extraDeps...)
 		}
 
-		var depsModules []string
-		depsModules, errs = c.generateModuleBuildActions(config, c.liveGlobals)
-		if len(errs) > 0 {
+		var preSingletons, singletons []*singletonInfo
+		for _, info := range c.singletonInfo {
+			if info.pre {
+				preSingletons = append(preSingletons, info)
+			} else {
+				singletons = append(singletons, info)
+			}
+		}
+
+		var depsPreSingletons []string
+		if len(preSingletons) > 0 {
+			c.BeginEvent("pre_singletons")
+			depsPreSingletons, errs = c.generateSingletonBuildActions(config, preSingletons, c.liveGlobals)
+			c.EndEvent("pre_singletons")
+			if len(errs) > 0 {
+				return
+			}
+		}
+
+		var depsModules []string
+		depsModules, errs = c.generateModuleBuildActions(config, c.liveGlobals)
+		if len(errs) > 0 {
+			return
+		}
+
+		if c.moduleProcessingLimit > 0 {
+			errs = []error{c.moduleProcessingLimitError()}
+			return
+		}
+
+		var depsSingletons []string
+		depsSingletons, errs = c.generateSingletonBuildActions(config, singletons, c.liveGlobals)
+		if len(errs) > 0 {
+			return
+		}
+
+		errs = c.checkSingletonsRan()
+		if len(errs) > 0 {
+			return
+		}
+
+		errs = c.checkPhonyOutputs()
+		if len(errs) > 0 {
+			return
+		}
+
+		errs = c.checkDirectoryOutputs()
+		if len(errs) > 0 {
+			return
+		}
+
+		if err := c.checkWorkingDirForCommands(); err != nil {
+			errs = []error{err}
+			return
+		}
+
+		deps = append(deps, depsPreSingletons...)
+		deps = append(deps, depsModules...)
+		deps = append(deps, depsSingletons...)
+
+		if c.outDir != nil {
+			err := c.liveGlobals.addNinjaStringDeps(c.outDir)
+			if err != nil {
+				errs = []error{err}
+				return
+			}
+		}
+
+		pkgNames, depsPackages := c.makeUniquePackageNames(c.liveGlobals)
+
+		deps = append(deps, depsPackages...)
+
+		nameTracker := c.memoizeFullNames(c.liveGlobals, pkgNames)
+
+		// This will panic if it finds a problem since it's a programming error.
+		c.checkForVariableReferenceCycles(c.liveGlobals.variables, nameTracker)
+
+		c.nameTracker = nameTracker
+		c.globalVariables = c.liveGlobals.variables
+		c.globalPools = c.liveGlobals.pools
+		c.globalRules = c.liveGlobals.rules
+
+		c.assignGlobRulePool()
+		c.assignHeavyRulePool()
+
+		if c.warnOnIneffectiveRestat {
+			c.warnings = append(c.warnings, c.checkRestatRules()...)
+		}
+
+		c.installMap, errs = c.generateInstallMap()
+		if len(errs) > 0 {
+			return
+		}
+
+		c.buildActionsReady = true
+	})
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	return deps, nil
+}
+
+// checkPhonyOutputs returns an error for each phony target created by a module, for example with
+// ModuleContext.Phony, whose name is also an output of another build statement.
+func (c *Context) checkPhonyOutputs() []error {
+	var errs []error
+	phonyError := func(module *moduleInfo, format string, args ...interface{}) {
+		errs = append(errs, &ModuleError{
+			BlueprintError: BlueprintError{
+				Err: fmt.Errorf(format, args...),
+				Pos: module.pos,
+			},
+			module: module,
+		})
+	}
+
+	modules := c.sortedModules()
+	phonyBy := make(map[string]*moduleInfo)
+	for _, module := range modules {
+		for _, def := range module.actionDefs.buildDefs {
+			if def.Rule != Phony {
+				continue
+			}
+			for _, name := range def.OutputStrings {
+				if other, exists := phonyBy[name]; exists && other != module {
+					phonyError(module, "phony target %q is also created by %s", name, other)
+					continue
+				}
+				phonyBy[name] = module
+			}
+		}
+	}
+	if len(phonyBy) == 0 {
+		return errs
+	}
+
+	checkOutputs := func(outputs []string, owner string) {
+		for _, output := range outputs {
+			if module, exists := phonyBy[output]; exists {
+				phonyError(module, "phony target %q is also an output of %s", output, owner)
+			}
+		}
+	}
+	for _, module := range modules {
+		for _, def := range module.actionDefs.buildDefs {
+			if def.Rule != Phony {
+				checkOutputs(def.OutputStrings, module.String())
+				checkOutputs(def.ImplicitOutputStrings, module.String())
+				checkOutputs(def.DirectoryOutputStrings, module.String())
+			}
+		}
+	}
+	for _, info := range c.singletonInfo {
+		for _, def := range info.actionDefs.buildDefs {
+			checkOutputs(def.OutputStrings, fmt.Sprintf("singleton %q", info.name))
+			checkOutputs(def.ImplicitOutputStrings, fmt.Sprintf("singleton %q", info.name))
+			checkOutputs(def.DirectoryOutputStrings, fmt.Sprintf("singleton %q", info.name))
+		}
+	}
+
+	return errs
+}
+
+// checkDirectoryOutputs returns an error for each directory output, see
+// BuildParams.DirectoryOutputs, that is also an output of another build statement or contains one,
+// and for each build statement without a Dyndep that uses a directory output, or a path inside
+// it, as an explicit or implicit input.  Only outputs and inputs without variables are checked.
+func (c *Context) checkDirectoryOutputs() []error {
+	type buildOwner struct {
+		def    *buildDef
+		module *moduleInfo
+		name   string
+	}
+
+	var owners []buildOwner
+	dirs := make(map[string]buildOwner)
+	for _, module := range c.sortedModules() {
+		for _, def := range module.actionDefs.buildDefs {
+			owners = append(owners, buildOwner{def, module, module.String()})
+		}
+	}
+	for _, info := range c.singletonInfo {
+		for _, def := range info.actionDefs.buildDefs {
+			owners = append(owners, buildOwner{def, nil, fmt.Sprintf("singleton %q", info.name)})
+		}
+	}
+
+	var errs []error
+	ownerError := func(owner buildOwner, format string, args ...interface{}) {
+		if owner.module == nil {
+			errs = append(errs, fmt.Errorf("%s: %s", owner.name, fmt.Sprintf(format, args...)))
 			return
 		}
+		errs = append(errs, &ModuleError{
+			BlueprintError: BlueprintError{
+				Err: fmt.Errorf(format, args...),
+				Pos: owner.module.pos,
+			},
+			module: owner.module,
+		})
+	}
 
-		var depsSingletons []string
-		depsSingletons, errs = c.generateSingletonBuildActions(config, c.singletonInfo, c.liveGlobals)
-		if len(errs) > 0 {
-			return
+	for _, owner := range owners {
+		for _, dir := range owner.def.DirectoryOutputStrings {
+			if other, exists := dirs[dir]; exists && other.def != owner.def {
+				ownerError(owner, "directory output %q is also created by %s", dir, other.name)
+				continue
+			}
+			dirs[dir] = owner
 		}
+	}
+	if len(dirs) == 0 {
+		return errs
+	}
 
-		deps = append(deps, depsModules...)
-		deps = append(deps, depsSingletons...)
-
-		if c.outDir != nil {
-			err := c.liveGlobals.addNinjaStringDeps(c.outDir)
-			if err != nil {
-				errs = []error{err}
-				return
+	// findDir returns the directory output that is path or contains it, if any.
+	findDir := func(path string) (string, buildOwner, bool) {
+		for p := path; p != "." && p != "/" && p != ""; p = filepath.Dir(p) {
+			if owner, exists := dirs[p]; exists {
+				return p, owner, true
 			}
 		}
+		return "", buildOwner{}, false
+	}
 
-		pkgNames, depsPackages := c.makeUniquePackageNames(c.liveGlobals)
-
-		deps = append(deps, depsPackages...)
-
-		nameTracker := c.memoizeFullNames(c.liveGlobals, pkgNames)
+	for _, owner := range owners {
+		def := owner.def
+		for _, outputs := range [][]string{def.OutputStrings, def.ImplicitOutputStrings} {
+			for _, output := range outputs {
+				if dir, other, ok := findDir(output); ok && other.def != def {
+					ownerError(owner, "output %q is inside directory output %q of %s", output, dir, other.name)
+				}
+			}
+		}
+		for _, dir := range def.DirectoryOutputStrings {
+			if parent, other, ok := findDir(filepath.Dir(dir)); ok && other.def != def {
+				ownerError(owner, "directory output %q is inside directory output %q of %s", dir, parent, other.name)
+			}
+		}
 
-		// This will panic if it finds a problem since it's a programming error.
-		c.checkForVariableReferenceCycles(c.liveGlobals.variables, nameTracker)
+		if def.HasDyndep {
+			continue
+		}
+		for _, inputs := range [][]string{def.InputStrings, def.ImplicitStrings} {
+			for _, input := range inputs {
+				if dir, other, ok := findDir(input); ok && other.def != def {
+					ownerError(owner, "input %q uses directory output %q of %s, which must be an order-only "+
+						"dependency or a validation unless a Dyndep is set", input, dir, other.name)
+				}
+			}
+		}
+	}
 
-		c.nameTracker = nameTracker
-		c.globalVariables = c.liveGlobals.variables
-		c.globalPools = c.liveGlobals.pools
-		c.globalRules = c.liveGlobals.rules
+	return errs
+}
 
-		c.buildActionsReady = true
-	})
+// checkWorkingDirForCommands returns an error if the directory set by SetWorkingDirForCommands is
+// the build directory or inside it.  Blueprint doesn't create the working directory, and the
+// contents of the build directory are generated by the build and may be removed by it.
+func (c *Context) checkWorkingDirForCommands() error {
+	if c.workingDirForCommands == "" || c.outDir == nil {
+		return nil
+	}
 
-	if len(errs) > 0 {
-		return nil, errs
+	outDir, err := c.outDir.Eval(c.liveGlobals.variables)
+	if err != nil {
+		return err
+	}
+	root, err := c.ninjaRootDir()
+	if err != nil {
+		return err
 	}
 
-	return deps, nil
+	abs := func(path string) string {
+		if filepath.IsAbs(path) {
+			return filepath.Clean(path)
+		}
+		return filepath.Join(root, path)
+	}
+	rel, err := filepath.Rel(abs(outDir), abs(c.workingDirForCommands))
+	if err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+		return fmt.Errorf("working directory for commands %q is inside the build directory %q",
+			c.workingDirForCommands, outDir)
+	}
+	return nil
 }
 
 func (c *Context) runMutators(ctx context.Context, config interface{}) (deps []string, errs []error) {
+	progress := c.startProgress(ProgressResolve, len(c.mutatorInfo)*len(c.modulesSorted))
+	defer progress.finish()
+
 	pprof.Do(ctx, pprof.Labels("blueprint", "runMutators"), func(ctx context.Context) {
-		for _, mutator := range c.mutatorInfo {
+		visited := 0
+		for i, mutator := range c.mutatorInfo {
+			// Mutators may add or split modules, so estimate the total from the number of modules
+			// before each mutator.
+			progress.setTotal(visited + (len(c.mutatorInfo)-i)*len(c.modulesSorted))
+			visited += len(c.modulesSorted)
+
 			pprof.Do(ctx, pprof.Labels("mutator", mutator.name), func(context.Context) {
 				c.BeginEvent(mutator.name)
 				defer c.EndEvent(mutator.name)
 				var newDeps []string
 				if mutator.topDownMutator != nil {
-					newDeps, errs = c.runMutator(config, mutator, topDownMutator)
+					newDeps, errs = c.runMutator(config, mutator, topDownMutator, progress)
 				} else if mutator.bottomUpMutator != nil {
-					newDeps, errs = c.runMutator(config, mutator, bottomUpMutator)
+					newDeps, errs = c.runMutator(config, mutator, bottomUpMutator, progress)
 				} else {
 					panic("no mutator set on " + mutator.name)
 				}
@@ -3053,7 +5273,7 @@ type reverseDep struct {
 }
 
 func (c *Context) runMutator(config interface{}, mutator *mutatorInfo,
-	direction mutatorDirection) (deps []string, errs []error) {
+	direction mutatorDirection, progress *progressReporter) (deps []string, errs []error) {
 
 	newModuleInfo := make(map[Module]*moduleInfo)
 	for k, v := range c.moduleInfo {
@@ -3113,10 +5333,17 @@ func (c *Context) runMutator(config interface{}, mutator *mutatorInfo,
 		}()
 
 		module.finishedMutator = mutator
+		progress.increment()
 
 		if len(mctx.errs) > 0 {
 			errsCh <- mctx.errs
-			return true
+			// Errors about skipped dependencies don't stop the mutator, so that the dependencies
+			// added by every module are known when their dependency paths are computed.
+			if slices.ContainsFunc(mctx.errs, func(err error) bool {
+				return asSkippedDependencyError(err) == nil
+			}) {
+				return true
+			}
 		}
 
 		if len(mctx.newVariations) > 0 {
@@ -3141,6 +5368,11 @@ func (c *Context) runMutator(config interface{}, mutator *mutatorInfo,
 		for {
 			select {
 			case newErrs := <-errsCh:
+				// Errors about skipped dependencies are reported once the mutator has finished
+				// and their dependency paths are known.
+				c.reportErrors(slices.DeleteFunc(slices.Clone(newErrs), func(err error) bool {
+					return asSkippedDependencyError(err) != nil
+				}))
 				errs = append(errs, newErrs...)
 			case globalStateChange := <-globalStateCh:
 				for _, r := range globalStateChange.reverse {
@@ -3166,7 +5398,8 @@ func (c *Context) runMutator(config interface{}, mutator *mutatorInfo,
 
 	var visitErrs []error
 	if mutator.parallel {
-		visitErrs = parallelVisit(c.modulesSorted, direction.orderer(), parallelVisitLimit, visit)
+		visitErrs = parallelVisitWithCycleHandler(c.modulesSorted, direction.orderer(), c.parallelVisitLimit(),
+			c.onDependencyCycle, visit)
 	} else {
 		direction.orderer().visit(c.modulesSorted, visit)
 	}
@@ -3180,11 +5413,15 @@ func (c *Context) runMutator(config interface{}, mutator *mutatorInfo,
 	done <- true
 
 	if len(errs) > 0 {
+		c.addMutatorSkippedDependencyPaths(errs, reverseDeps)
 		return nil, errs
 	}
 
 	c.moduleInfo = newModuleInfo
 
+	// The dependencies on defaults modules added by the mutator, see RegisterDefaultsMerge.
+	defaults := make(pendingDefaults)
+
 	for _, group := range c.moduleGroups {
 		for i := 0; i < len(group.modules); i++ {
 			module := group.modules[i].module()
@@ -3211,6 +5448,7 @@ func (c *Context) runMutator(config interface{}, mutator *mutatorInfo,
 			}
 
 			// Add in any new direct dependencies that were added by the mutator
+			c.addDefaultsDeps(defaults, module, module.newDirectDeps)
 			module.directDeps = append(module.directDeps, module.newDirectDeps...)
 			module.newDirectDeps = nil
 		}
@@ -3245,19 +5483,37 @@ func (c *Context) runMutator(config interface{}, mutator *mutatorInfo,
 		}
 	}
 
+	if c.removePrunedVariants(newModuleInfo, reverseDeps) {
+		c.depsModified++
+	}
+
 	// Add in any new reverse dependencies that were added by the mutator
 	for module, deps := range reverseDeps {
 		sort.Sort(depSorter(deps))
+		c.addDefaultsDeps(defaults, module, deps)
 		module.directDeps = append(module.directDeps, deps...)
 		c.depsModified++
 	}
 
 	for _, module := range newModules {
+		// Modules created in a directory with CreateModuleInDirectory are skipped like modules
+		// defined in a Blueprints file in that directory.
+		if allowed, prefix := c.sourceRootDirs.SourceRootDirAllowed(module.relBlueprintsFile); !allowed {
+			c.nameInterface.NewSkippedModule(newNamespaceContextFromFilename(module.relBlueprintsFile),
+				module.Name(), SkippedModuleInfo{
+					filename: module.relBlueprintsFile,
+					reason:   sourceRootDirSkipReason(module.relBlueprintsFile, prefix),
+				})
+			continue
+		}
 		errs = c.addModule(module)
 		if len(errs) > 0 {
 			return nil, errs
 		}
 		atomic.AddUint32(&c.depsModified, 1)
+		for _, hook := range c.moduleCreatedHooks {
+			hook(module.logicModule, mutator.name)
+		}
 	}
 
 	errs = c.handleRenames(rename)
@@ -3277,9 +5533,122 @@ func (c *Context) runMutator(config interface{}, mutator *mutatorInfo,
 		}
 	}
 
+	if len(defaults) > 0 {
+		c.mergeDefaults(defaults)
+	}
+
 	return deps, errs
 }
 
+// addMutatorSkippedDependencyPaths sets the dependency paths of the errors about skipped modules
+// from a mutator that failed, including the dependencies that the mutator added, and reports them.
+func (c *Context) addMutatorSkippedDependencyPaths(errs []error, reverseDeps map[*moduleInfo][]depInfo) {
+	var skippedErrs []error
+	for _, err := range errs {
+		if asSkippedDependencyError(err) != nil {
+			skippedErrs = append(skippedErrs, err)
+		}
+	}
+	if len(skippedErrs) == 0 {
+		return
+	}
+
+	dependents := make(map[*moduleInfo][]*moduleInfo)
+	addDeps := func(module *moduleInfo, deps []depInfo) {
+		for _, dep := range deps {
+			dependents[dep.module] = append(dependents[dep.module], module)
+		}
+	}
+	for _, module := range c.modulesSorted {
+		addDeps(module, module.directDeps)
+		addDeps(module, module.newDirectDeps)
+		addDeps(module, reverseDeps[module])
+	}
+	addSkippedDependencyPaths(skippedErrs, func(module *moduleInfo) []*moduleInfo {
+		return dependents[module]
+	})
+	c.reportErrors(skippedErrs)
+}
+
+// removePrunedVariants removes the variants that called PruneVariant during the current mutator
+// from their module groups, along with any aliases to them and any dependencies on them.  Groups
+// whose variants were all pruned are removed, so that later dependencies on their name report a
+// missing dependency.  It returns true if any variants were removed.
+func (c *Context) removePrunedVariants(moduleInfo map[Module]*moduleInfo,
+	reverseDeps map[*moduleInfo][]depInfo) bool {
+
+	pruned := false
+	var emptyGroups []*moduleGroup
+	for _, group := range c.moduleGroups {
+		modules := group.modules[:0]
+		for _, moduleOrAlias := range group.modules {
+			if m := moduleOrAlias.module(); m != nil && m.pruned {
+				delete(moduleInfo, m.logicModule)
+				pruned = true
+				continue
+			}
+			if alias := moduleOrAlias.alias(); alias != nil && alias.target.pruned {
+				continue
+			}
+			modules = append(modules, moduleOrAlias)
+		}
+		group.modules = modules
+		if len(modules) == 0 {
+			emptyGroups = append(emptyGroups, group)
+		}
+	}
+
+	if !pruned {
+		return false
+	}
+
+	if len(emptyGroups) > 0 {
+		c.moduleGroups = slices.DeleteFunc(c.moduleGroups, func(group *moduleGroup) bool {
+			return len(group.modules) == 0
+		})
+		// Other NameInterfaces can't remove a group, moduleGroupFromName and sortedModuleGroups
+		// skip the empty groups instead.
+		if s, ok := c.nameInterface.(*SimpleNameInterface); ok {
+			for _, group := range emptyGroups {
+				s.removeModule(ModuleGroup{moduleGroup: group})
+			}
+		}
+	}
+
+	removeDeps := func(deps []depInfo) []depInfo {
+		ret := deps[:0]
+		for _, dep := range deps {
+			if !dep.module.pruned {
+				ret = append(ret, dep)
+			}
+		}
+		return ret
+	}
+
+	for _, group := range c.moduleGroups {
+		for _, moduleOrAlias := range group.modules {
+			module := moduleOrAlias.module()
+			if module == nil {
+				continue
+			}
+			module.directDeps = removeDeps(module.directDeps)
+			if module.createdBy != nil && module.createdBy.pruned {
+				module.createdBy = nil
+			}
+		}
+	}
+
+	for module, deps := range reverseDeps {
+		if module.pruned {
+			delete(reverseDeps, module)
+		} else {
+			reverseDeps[module] = removeDeps(deps)
+		}
+	}
+
+	return true
+}
+
 // Replaces every build logic module with a clone of itself.  Prevents introducing problems where
 // a mutator sets a non-property member variable on a module, which works until a later mutator
 // creates variants of that module.
@@ -3291,7 +5660,7 @@ func (c *Context) cloneModules() {
 	ch := make(chan update)
 	doneCh := make(chan bool)
 	go func() {
-		errs := parallelVisit(c.modulesSorted, unorderedVisitorImpl{}, parallelVisitLimit,
+		errs := parallelVisit(c.modulesSorted, unorderedVisitorImpl{}, c.parallelVisitLimit(),
 			func(m *moduleInfo, pause chan<- pauseSpec) bool {
 				origLogicModule := m.logicModule
 				m.logicModule, m.properties = c.cloneLogicModule(m)
@@ -3339,6 +5708,33 @@ func spliceModules(modules modulesOrAliases, i int, newModules modulesOrAliases)
 	return dest, i + spliceSize - 1
 }
 
+// generateWithTimeout calls generate, which calls GenerateBuildActions on module, and returns an
+// error naming the module if it doesn't return within the duration set by
+// SetModuleGenerateTimeout.  The goroutine running a generate call that timed out is abandoned.
+func (c *Context) generateWithTimeout(module *moduleInfo, generate func()) error {
+	done := make(chan struct{})
+	go func() {
+		generate()
+		close(done)
+	}()
+
+	timer := time.NewTimer(c.moduleGenerateTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+		return &ModuleError{
+			BlueprintError: BlueprintError{
+				Err: fmt.Errorf("GenerateBuildActions did not finish within %s", c.moduleGenerateTimeout),
+				Pos: module.pos,
+			},
+			module: module,
+		}
+	}
+}
+
 func (c *Context) generateModuleBuildActions(config interface{},
 	liveGlobals *liveTracker) ([]string, []error) {
 
@@ -3346,10 +5742,12 @@ func (c *Context) generateModuleBuildActions(config interface{},
 	defer c.EndEvent("generateModuleBuildActions")
 	var deps []string
 	var errs []error
+	var warnings []error
 
 	cancelCh := make(chan struct{})
 	errsCh := make(chan []error)
 	depsCh := make(chan []string)
+	warningsCh := make(chan error)
 
 	go func() {
 		for {
@@ -3358,16 +5756,38 @@ func (c *Context) generateModuleBuildActions(config interface{},
 				close(cancelCh)
 				return
 			case newErrs := <-errsCh:
+				c.reportErrors(newErrs)
 				errs = append(errs, newErrs...)
 			case newDeps := <-depsCh:
 				deps = append(deps, newDeps...)
-
+			case newWarning := <-warningsCh:
+				warnings = append(warnings, newWarning)
 			}
 		}
 	}()
 
-	visitErrs := parallelVisit(c.modulesSorted, bottomUpVisitor, parallelVisitLimit,
+	// modulesSorted is in dependency order, so the first moduleProcessingLimit modules include all
+	// of their own dependencies.
+	var processModule map[*moduleInfo]bool
+	if limit := c.moduleProcessingLimit; limit > 0 && limit < len(c.modulesSorted) {
+		processModule = make(map[*moduleInfo]bool, limit)
+		for _, module := range c.modulesSorted[:limit] {
+			processModule[module] = true
+		}
+	}
+	logProcessing := c.moduleProcessingLogger()
+
+	progress := c.startProgress(ProgressPrepare, len(c.modulesSorted))
+	defer progress.finish()
+
+	visitErrs := parallelVisit(c.modulesSorted, bottomUpVisitor, c.parallelVisitLimit(),
 		func(module *moduleInfo, pause chan<- pauseSpec) bool {
+			defer progress.increment()
+
+			if module.disabled || (processModule != nil && !processModule[module]) {
+				return false
+			}
+
 			uniqueName := c.nameInterface.UniqueName(newNamespaceContext(module), module.group.name)
 			sanitizedName := toNinjaName(uniqueName)
 			sanitizedVariant := toNinjaName(module.variant.name)
@@ -3390,8 +5810,11 @@ func (c *Context) generateModuleBuildActions(config interface{},
 			}
 
 			mctx.module.startedGenerateBuildActions = true
+			if logProcessing != nil {
+				logProcessing(module)
+			}
 
-			func() {
+			generate := func() {
 				defer func() {
 					if r := recover(); r != nil {
 						in := fmt.Sprintf("GenerateBuildActions for %s", module)
@@ -3404,7 +5827,17 @@ func (c *Context) generateModuleBuildActions(config interface{},
 					}
 				}()
 				mctx.module.logicModule.GenerateBuildActions(mctx)
-			}()
+				mctx.buildGlobDependencies()
+			}
+
+			if c.moduleGenerateTimeout > 0 {
+				if err := c.generateWithTimeout(module, generate); err != nil {
+					errsCh <- []error{err}
+					return true
+				}
+			} else {
+				generate()
+			}
 
 			mctx.module.finishedGenerateBuildActions = true
 
@@ -3418,6 +5851,9 @@ func (c *Context) generateModuleBuildActions(config interface{},
 				for _, depName := range module.missingDeps {
 					errs = append(errs, c.missingDependencyError(module, depName))
 				}
+				addSkippedDependencyPaths(errs, func(module *moduleInfo) []*moduleInfo {
+					return module.reverseDeps
+				})
 				errsCh <- errs
 				return true
 			}
@@ -3430,6 +5866,18 @@ func (c *Context) generateModuleBuildActions(config interface{},
 				errsCh <- newErrs
 				return true
 			}
+
+			if c.warnOnEmptyModules && module.isEmpty() {
+				if _, ok := module.logicModule.(NoBuildActionsModule); !ok {
+					warningsCh <- &ModuleError{
+						BlueprintError: BlueprintError{
+							Err: fmt.Errorf("produced no build actions and no providers"),
+							Pos: module.pos,
+						},
+						module: module,
+					}
+				}
+			}
 			return false
 		})
 
@@ -3438,9 +5886,50 @@ func (c *Context) generateModuleBuildActions(config interface{},
 
 	errs = append(errs, visitErrs...)
 
+	// Sort the warnings so that they are reported in a stable order regardless of the order
+	// the parallel visitor produced them in.
+	sort.Slice(warnings, func(i, j int) bool {
+		return warnings[i].Error() < warnings[j].Error()
+	})
+	c.warnings = append(c.warnings, warnings...)
+
 	return deps, errs
 }
 
+// moduleProcessingLogger returns a function that logs each module that generateModuleBuildActions
+// processes when moduleProcessingLimit is set, or nil if it isn't.  The modules are logged before
+// their GenerateBuildActions is called, so that the log identifies the module when it crashes.
+func (c *Context) moduleProcessingLogger() func(module *moduleInfo) {
+	if c.moduleProcessingLimit <= 0 {
+		return nil
+	}
+	w := c.moduleProcessingLog
+	if w == nil {
+		w = os.Stderr
+	}
+
+	var lock sync.Mutex
+	processed := 0
+	return func(module *moduleInfo) {
+		lock.Lock()
+		defer lock.Unlock()
+		processed++
+		fmt.Fprintf(w, "processing module %d of %d: %s in %s\n", processed, len(c.modulesSorted),
+			module, module.relBlueprintsFile)
+	}
+}
+
+// moduleProcessingLimitError returns the error that stops PrepareBuildActions after
+// generateModuleBuildActions processed the modules allowed by moduleProcessingLimit.
+func (c *Context) moduleProcessingLimitError() error {
+	processed := c.moduleProcessingLimit
+	if processed > len(c.modulesSorted) {
+		processed = len(c.modulesSorted)
+	}
+	return fmt.Errorf("stopped after processing %d of %d modules because of SetModuleProcessingLimit",
+		processed, len(c.modulesSorted))
+}
+
 func (c *Context) generateOneSingletonBuildActions(config interface{},
 	info *singletonInfo, liveGlobals *liveTracker) ([]string, []error) {
 
@@ -3472,6 +5961,7 @@ func (c *Context) generateOneSingletonBuildActions(config interface{},
 				}
 			}
 		}()
+		info.generated++
 		info.singleton.GenerateBuildActions(sctx)
 	}()
 
@@ -3511,7 +6001,8 @@ func (c *Context) generateParallelSingletonBuildActions(config interface{},
 			case dep := <-depsCh:
 				deps = append(deps, dep...)
 			case newErrs := <-errsCh:
-				if len(errs) <= maxErrors {
+				if len(errs) <= c.errorLimit() {
+					c.reportErrors(newErrs)
 					errs = append(errs, newErrs...)
 				}
 			}
@@ -3557,6 +6048,10 @@ func (c *Context) generateSingletonBuildActions(config interface{},
 		errs = append(errs, newErrs...)
 	}
 
+	for _, info := range singletons {
+		info.generated = 0
+	}
+
 	// Force a resort of the module groups before running singletons so that two singletons running in parallel
 	// don't cause a data race when they trigger a resort in VisitAllModules.
 	c.sortedModuleGroups()
@@ -3567,7 +6062,7 @@ func (c *Context) generateSingletonBuildActions(config interface{},
 	for _, info := range singletons {
 		if !info.parallel {
 			runSingleton(info)
-			if len(errs) > maxErrors {
+			if len(errs) > c.errorLimit() {
 				break
 			}
 		}
@@ -3576,6 +6071,18 @@ func (c *Context) generateSingletonBuildActions(config interface{},
 	return deps, errs
 }
 
+// checkSingletonsRan returns an internal error for each registered singleton whose
+// GenerateBuildActions was not called exactly once by generateSingletonBuildActions.
+func (c *Context) checkSingletonsRan() (errs []error) {
+	for _, info := range c.singletonInfo {
+		if info.generated != 1 {
+			errs = append(errs, fmt.Errorf("GenerateBuildActions was called %d times for singleton %q instead of once, "+
+				"this is an internal error", info.generated, info.name))
+		}
+	}
+	return errs
+}
+
 func (c *Context) processLocalBuildActions(out, in *localBuildActions,
 	liveGlobals *liveTracker) []error {
 
@@ -3728,19 +6235,163 @@ func (c *Context) discoveredMissingDependencies(module *moduleInfo, depName stri
 	return []error{c.missingDependencyError(module, depName)}
 }
 
+// OptionalDependencyTag can be implemented by a DependencyTag to allow an enabled module to depend
+// on a module that was disabled with "enabled: false".  The dependency is kept, so the depending
+// module should use BaseModuleContext.OtherModuleEnabled to skip it.
+type OptionalDependencyTag interface {
+	DependencyTag
+
+	// OptionalDependency returns true if the dependency may be on a disabled module.
+	OptionalDependency() bool
+}
+
+// checkDisabledDependencies reports an error for each dependency of an enabled module on a
+// disabled module that is not optional, see OptionalDependencyTag.  If missing dependencies are
+// allowed the disabled module is recorded as a missing dependency instead.
+func (c *Context) checkDisabledDependencies() (errs []error) {
+	for _, module := range c.modulesSorted {
+		if module.disabled {
+			continue
+		}
+		for _, dep := range module.directDeps {
+			if !dep.module.disabled {
+				continue
+			}
+			if optional, ok := dep.tag.(OptionalDependencyTag); ok && optional.OptionalDependency() {
+				continue
+			}
+			if c.allowMissingDependencies {
+				if !inList(dep.module.Name(), module.missingDeps) {
+					module.missingDeps = append(module.missingDeps, dep.module.Name())
+				}
+				continue
+			}
+			errs = append(errs, disabledDependencyError(module, dep.module))
+		}
+	}
+	return errs
+}
+
+// checkAllowedDependencyTags returns an error for each dependency whose tag type isn't allowed by
+// SetAllowedDependencyTags.
+func (c *Context) checkAllowedDependencyTags() (errs []error) {
+	if c.allowedDependencyTags == nil {
+		return nil
+	}
+	for _, module := range c.modulesSorted {
+		for _, dep := range module.directDeps {
+			if typ := fmt.Sprintf("%T", dep.tag); !c.allowedDependencyTags[typ] {
+				errs = append(errs, &BlueprintError{
+					Err: fmt.Errorf("module %q depends on module %q with disallowed dependency tag type %s",
+						module.Name(), dep.module.Name(), typ),
+					Pos: module.pos,
+				})
+			}
+		}
+	}
+	return errs
+}
+
+func disabledDependencyError(module, dep *moduleInfo) error {
+	return &BlueprintError{
+		Err: fmt.Errorf("module %q depends on disabled module %q; %q was defined in file [%v], but was disabled by its \"enabled\" property",
+			module.Name(), dep.Name(), dep.Name(), dep.relBlueprintsFile),
+		Pos: module.pos,
+	}
+}
+
 func (c *Context) missingDependencyError(module *moduleInfo, depName string) (errs error) {
+	if group := c.moduleGroupFromName(depName, module.namespace()); group != nil {
+		if dep := group.modules.firstModule(); dep != nil && dep.disabled {
+			return disabledDependencyError(module, dep)
+		}
+	}
+
 	guess := namesLike(depName, module.Name(), c.moduleGroups)
 	err := c.nameInterface.MissingDependencyError(module.Name(), module.namespace(), depName, guess)
+	if _, skipped := c.nameInterface.SkippedModuleFromName(depName, module.namespace()); skipped {
+		err = &skippedDependencyError{
+			err:    err,
+			module: module,
+			dep:    depName,
+		}
+	}
 	return &BlueprintError{
 		Err: err,
 		Pos: module.pos,
 	}
 }
 
+// skippedDependencyError is an error for a dependency on a module that was skipped because of
+// AddSourceRootDirs.  The skip may be the cause of errors in modules that only depend on the
+// skipped module indirectly, so the error includes the path of dependencies to it.
+type skippedDependencyError struct {
+	err    error
+	module *moduleInfo
+	dep    string
+
+	// set by addSkippedDependencyPaths
+	path []string
+}
+
+func (e *skippedDependencyError) Error() string {
+	if len(e.path) == 0 {
+		return e.err.Error()
+	}
+	return fmt.Sprintf("%s; dependency path: %s", e.err, strings.Join(e.path, " -> "))
+}
+
+func (e *skippedDependencyError) Unwrap() error {
+	return e.err
+}
+
+func asSkippedDependencyError(err error) *skippedDependencyError {
+	if blueprintErr, ok := err.(*BlueprintError); ok {
+		if skippedErr, ok := blueprintErr.Err.(*skippedDependencyError); ok {
+			return skippedErr
+		}
+	}
+	return nil
+}
+
+// addSkippedDependencyPaths sets the dependency path of each error in errs about a dependency on a
+// skipped module.  The path starts from the root-most module that reaches the depending module
+// through the modules returned by dependents, and ends with the skipped module.
+func addSkippedDependencyPaths(errs []error, dependents func(*moduleInfo) []*moduleInfo) {
+	for _, err := range errs {
+		skippedErr := asSkippedDependencyError(err)
+		if skippedErr == nil {
+			continue
+		}
+		path := []string{skippedErr.dep}
+		visited := make(map[*moduleInfo]bool)
+		for module := skippedErr.module; module != nil; {
+			visited[module] = true
+			path = append(path, module.Name())
+			next := module
+			module = nil
+			for _, dependent := range dependents(next) {
+				if !visited[dependent] {
+					module = dependent
+					break
+				}
+			}
+		}
+		slices.Reverse(path)
+		skippedErr.path = path
+	}
+}
+
+// moduleGroupFromName returns the module group with the given name as seen from a module in the
+// given namespace.  For a BlueprintNamespace the name is looked up in the namespace itself, then
+// in each of its imported namespaces, and then in the default namespace.
 func (c *Context) moduleGroupFromName(name string, namespace Namespace) *moduleGroup {
-	group, exists := c.nameInterface.ModuleFromName(name, namespace)
-	if exists {
-		return group.moduleGroup
+	for _, ns := range namespaceSearchOrder(namespace) {
+		group, exists := c.nameInterface.ModuleFromName(name, ns)
+		// A group is empty if all of its variants were removed by PruneVariant.
+		if exists && len(group.modules) > 0 {
+			return group.moduleGroup
+		}
 	}
 	return nil
 }
@@ -3750,7 +6401,9 @@ func (c *Context) sortedModuleGroups() []*moduleGroup {
 		unwrap := func(wrappers []ModuleGroup) []*moduleGroup {
 			result := make([]*moduleGroup, 0, len(wrappers))
 			for _, group := range wrappers {
-				result = append(result, group.moduleGroup)
+				if len(group.modules) > 0 {
+					result = append(result, group.moduleGroup)
+				}
 			}
 			return result
 		}
@@ -4034,7 +6687,17 @@ func (c *Context) AllTargets() (map[string]string, error) {
 				}
 				targets[outputValue] = ruleName
 			}
-			for _, output := range append(buildDef.OutputStrings, buildDef.ImplicitOutputStrings...) {
+			for _, output := range buildDef.DirectoryOutputs {
+				outputValue, err := output.Eval(c.globalVariables)
+				if err != nil {
+					return err
+				}
+				targets[outputValue] = ruleName
+			}
+			for _, output := range append(buildDef.OutputStrings, buildDef.ImplicitOutputStrings...) {
+				targets[output] = ruleName
+			}
+			for _, output := range buildDef.DirectoryOutputStrings {
 				targets[output] = ruleName
 			}
 		}
@@ -4093,14 +6756,109 @@ func (c *Context) ModuleDir(logicModule Module) string {
 	return filepath.Dir(c.BlueprintFile(logicModule))
 }
 
+// ModuleSubDir returns the unique name of the variant of the given module.  It is derived from
+// the variations of the module in mutator registration order, so it is stable between runs and
+// unique among the variants of a module.  See ModuleContext.ModuleSubDir.  It returns "" for
+// modules that are not in the Context.
 func (c *Context) ModuleSubDir(logicModule Module) string {
-	module := c.moduleInfo[logicModule]
-	return module.variant.name
+	if module, ok := c.moduleInfo[logicModule]; ok {
+		return module.variant.name
+	}
+	return ""
+}
+
+// ModuleVariantName returns the name of the variant of the given module, made up of its variations
+// in mutator registration order joined with '_', for example "arm64_shared", or "" if the module
+// has no variations.  It is the same name that errors about the module print after its name, as in
+// `module "foo" variant "arm64_shared"`, and is currently the same as ModuleSubDir.  It returns ""
+// for modules that are not in the Context.
+func (c *Context) ModuleVariantName(logicModule Module) string {
+	if module, ok := c.moduleInfo[logicModule]; ok {
+		return module.variant.name
+	}
+	return ""
+}
+
+// ModuleCreator returns the module that created the given module with CreateModule, and the name
+// of the mutator that created it, or "" if it was created by a load hook.  If the creator was split
+// into variants afterwards its first variant is returned.  The boolean is false for modules defined
+// in Blueprints files, for created modules whose creator was removed by PruneVariant, and for
+// modules that are not in the Context.
+func (c *Context) ModuleCreator(logicModule Module) (Module, string, bool) {
+	module, ok := c.moduleInfo[logicModule]
+	if !ok {
+		return nil, "", false
+	}
+	creator := module.createdBy
+	// The variants of a module that was split in the same mutator as its creator still point to
+	// the creator from before the split.
+	for creator != nil && creator.splitModules != nil {
+		var first *moduleInfo
+		for _, moduleOrAlias := range creator.splitModules {
+			if m := moduleOrAlias.module(); m != nil && !m.pruned {
+				first = m
+				break
+			}
+		}
+		creator = first
+	}
+	if creator == nil || creator.pruned {
+		return nil, "", false
+	}
+	return creator.logicModule, module.createdByMutator, true
 }
 
+// ModuleOutputDir returns a relative path that is unique to the given module and variant, made
+// up of the directory of the module, its name and its ModuleSubDir.  It can be used as a prefix
+// for intermediates so that modules don't each need their own scheme to avoid collisions.  It
+// returns "" for modules that are not in the Context.
+func (c *Context) ModuleOutputDir(logicModule Module) string {
+	if module, ok := c.moduleInfo[logicModule]; ok {
+		return module.outputDir()
+	}
+	return ""
+}
+
+// ModuleType returns the name that the type of the given module was registered under with
+// RegisterModuleType, or the type name passed to CreateModule for modules created by mutators and
+// load hooks.  It returns "" for modules created without a type name, and for modules that are not
+// in the Context.
 func (c *Context) ModuleType(logicModule Module) string {
-	module := c.moduleInfo[logicModule]
-	return module.typeName
+	if module, ok := c.moduleInfo[logicModule]; ok {
+		return module.typeName
+	}
+	return ""
+}
+
+// ModuleProperties returns the property structs of the given module, which are the pointers its
+// factory returned, so that tools such as linters can inspect the values set in its Blueprints file
+// with reflection.  The structs are the ones used by the module, and must not be modified.  It
+// returns an error if the module is not in the Context.
+func (c *Context) ModuleProperties(logicModule Module) ([]interface{}, error) {
+	module, ok := c.moduleInfo[logicModule]
+	if !ok {
+		return nil, fmt.Errorf("ModuleProperties called on unknown module %q", logicModule.Name())
+	}
+	return append([]interface{}(nil), module.properties...), nil
+}
+
+// ModuleVariant returns the variant of the module with the given name whose variations, keyed by
+// the name of the mutator that created them, are exactly the given variations, for tools that need
+// to inspect a particular variant such as the one for one architecture.  A module that was never
+// split matches an empty map.  Aliases are followed to the variant they point to, as when a
+// dependency is added with AddVariationDependencies.  It returns false if there is no module with
+// the name, or no variant with exactly those variations.
+func (c *Context) ModuleVariant(name string, variations map[string]string) (Module, bool) {
+	group := c.moduleGroupFromName(name, nil)
+	if group == nil {
+		return nil, false
+	}
+	for _, m := range group.modules {
+		if m.moduleOrAliasVariant().variations.equal(variations) {
+			return m.moduleOrAliasTarget().logicModule, true
+		}
+	}
+	return nil, false
 }
 
 // ModuleProvider returns the value, if any, for the provider for a module.  If the value for the
@@ -4112,11 +6870,164 @@ func (c *Context) ModuleProvider(logicModule Module, provider AnyProviderKey) (a
 	return c.provider(module, provider.provider())
 }
 
+// SetModuleBlob stores data under key for the given module, replacing any data previously stored
+// under the same key.  The blobs are a scratch store that tools can use to keep data computed for
+// a module, for example the parsed contents of a generated file, between phases without defining
+// a provider.  Unlike providers they are not hashed or validated, and Blueprint never reads them.
+// It may be called concurrently, for example from GenerateBuildActions.
+func (c *Context) SetModuleBlob(logicModule Module, key string, data []byte) {
+	module := c.moduleInfo[logicModule]
+	if module == nil {
+		panic(fmt.Errorf("SetModuleBlob called on unknown module %q", logicModule.Name()))
+	}
+
+	c.moduleBlobsLock.Lock()
+	defer c.moduleBlobsLock.Unlock()
+
+	if c.moduleBlobs == nil {
+		c.moduleBlobs = make(map[*moduleInfo]map[string][]byte)
+	}
+	blobs := c.moduleBlobs[module]
+	if blobs == nil {
+		blobs = make(map[string][]byte)
+		c.moduleBlobs[module] = blobs
+	}
+	blobs[key] = data
+}
+
+// GetModuleBlob returns the data stored under key for the given module by SetModuleBlob, and
+// whether any data was stored.
+func (c *Context) GetModuleBlob(logicModule Module, key string) ([]byte, bool) {
+	module := c.moduleInfo[logicModule]
+
+	c.moduleBlobsLock.Lock()
+	defer c.moduleBlobsLock.Unlock()
+
+	data, ok := c.moduleBlobs[module][key]
+	return data, ok
+}
+
+// ClearModuleBlobs discards the data stored by SetModuleBlob for all modules so that its memory
+// can be reclaimed.
+func (c *Context) ClearModuleBlobs() {
+	c.moduleBlobsLock.Lock()
+	defer c.moduleBlobsLock.Unlock()
+
+	c.moduleBlobs = nil
+}
+
 func (c *Context) BlueprintFile(logicModule Module) string {
 	module := c.moduleInfo[logicModule]
 	return module.relBlueprintsFile
 }
 
+// BlueprintFilesForTarget returns the Blueprints files that define the module with the given name
+// and the modules it transitively depends on, relative to the root directory the files were
+// parsed from.  The list is sorted and contains each file once.  It is useful for tools that
+// need to fetch only the Blueprints files required to build one module, and may only be called
+// after ResolveDependencies.
+func (c *Context) BlueprintFilesForTarget(name string) ([]string, error) {
+	if !c.dependenciesReady {
+		return nil, fmt.Errorf("BlueprintFilesForTarget called before ResolveDependencies")
+	}
+
+	group := c.moduleGroupFromName(name, nil)
+	if group == nil {
+		return nil, fmt.Errorf("module %q not found", name)
+	}
+
+	visited := make(map[*moduleInfo]bool)
+	seenFiles := make(map[string]bool)
+	var files []string
+	var visit func(module *moduleInfo)
+	visit = func(module *moduleInfo) {
+		if visited[module] {
+			return
+		}
+		visited[module] = true
+		if !seenFiles[module.relBlueprintsFile] {
+			seenFiles[module.relBlueprintsFile] = true
+			files = append(files, module.relBlueprintsFile)
+		}
+		for _, dep := range module.directDeps {
+			visit(dep.module)
+		}
+	}
+
+	for _, moduleOrAlias := range group.modules {
+		if module := moduleOrAlias.module(); module != nil {
+			visit(module)
+		}
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+// LongestDependencyChain returns the longest chain of modules in which each module directly
+// depends on the next, ignoring dependencies with a TestDependencyTag.  The length of the chain is
+// the number of modules that must be built one after another, so it limits how much of the build
+// can run in parallel.  When several chains have the same length the one that comes first when
+// comparing module names, and then variant names, module by module is returned, so the result
+// does not depend on the order that modules were defined in.  It returns an error if it is called
+// before ResolveDependencies or if the dependencies contain a cycle.
+func (c *Context) LongestDependencyChain() ([]Module, error) {
+	if !c.dependenciesReady {
+		return nil, fmt.Errorf("LongestDependencyChain called before ResolveDependencies")
+	}
+
+	// length is the number of modules in the longest chain starting at a module, and next is the
+	// second module in that chain.  A length of -1 marks a module whose chain is being computed.
+	length := make(map[*moduleInfo]int)
+	next := make(map[*moduleInfo]*moduleInfo)
+
+	var chainLength func(module *moduleInfo) (int, error)
+	chainLength = func(module *moduleInfo) (int, error) {
+		if l, ok := length[module]; ok {
+			if l < 0 {
+				return 0, fmt.Errorf("dependency cycle through %s", module)
+			}
+			return l, nil
+		}
+		length[module] = -1
+
+		l := 1
+		for _, dep := range module.directDeps {
+			if IsTestDependencyTag(dep.tag) {
+				continue
+			}
+			depLength, err := chainLength(dep.module)
+			if err != nil {
+				return 0, err
+			}
+			if depLength+1 > l || (depLength+1 == l && visitOrderLess(dep.module, next[module])) {
+				l = depLength + 1
+				next[module] = dep.module
+			}
+		}
+
+		length[module] = l
+		return l, nil
+	}
+
+	var start *moduleInfo
+	for _, module := range c.modulesSorted {
+		l, err := chainLength(module)
+		if err != nil {
+			return nil, err
+		}
+		if start == nil || l > length[start] || (l == length[start] && visitOrderLess(module, start)) {
+			start = module
+		}
+	}
+
+	var chain []Module
+	for module := start; module != nil; module = next[module] {
+		chain = append(chain, module.logicModule)
+	}
+	return chain, nil
+}
+
 func (c *Context) ModuleErrorf(logicModule Module, format string,
 	args ...interface{}) error {
 
@@ -4137,6 +7048,32 @@ func (c *Context) VisitAllModulesIf(pred func(Module) bool,
 	c.visitAllModulesIf(pred, visit)
 }
 
+// VisitAllModuleGroups calls visit once for each module, sorted by name, with the name of the
+// module and its variants in the order they were created by the mutators.  Aliases created by
+// the mutators are not included.  Modules with the same name in different namespaces are visited
+// separately.  The variants slice is newly allocated for each call and may be retained.  It should
+// be called after ResolveDependencies, once the mutators have created all the variants.
+func (c *Context) VisitAllModuleGroups(visit func(name string, variants []Module)) {
+	var group *moduleGroup
+
+	defer func() {
+		if r := recover(); r != nil {
+			panic(newPanicErrorf(r, "VisitAllModuleGroups(%s) for %s",
+				funcName(visit), group.name))
+		}
+	}()
+
+	for _, group = range c.sortedModuleGroups() {
+		variants := make([]Module, 0, len(group.modules))
+		for _, moduleOrAlias := range group.modules {
+			if module := moduleOrAlias.module(); module != nil {
+				variants = append(variants, module.logicModule)
+			}
+		}
+		visit(group.name, variants)
+	}
+}
+
 func (c *Context) VisitDirectDeps(module Module, visit func(Module)) {
 	topModule := c.moduleInfo[module]
 
@@ -4150,6 +7087,9 @@ func (c *Context) VisitDirectDeps(module Module, visit func(Module)) {
 	}()
 
 	for _, dep := range topModule.directDeps {
+		if IsTestDependencyTag(dep.tag) {
+			continue
+		}
 		visiting = dep.module
 		visit(dep.module.logicModule)
 	}
@@ -4168,6 +7108,9 @@ func (c *Context) VisitDirectDepsIf(module Module, pred func(Module) bool, visit
 	}()
 
 	for _, dep := range topModule.directDeps {
+		if IsTestDependencyTag(dep.tag) {
+			continue
+		}
 		visiting = dep.module
 		if pred(dep.module.logicModule) {
 			visit(dep.module.logicModule)
@@ -4175,6 +7118,93 @@ func (c *Context) VisitDirectDepsIf(module Module, pred func(Module) bool, visit
 	}
 }
 
+// VisitDirectReverseDeps calls visit for each module that directly depends on module, in order of
+// module name and then variant name.  Like VisitDirectDeps it skips dependencies
+// with a TestDependencyTag, and it skips the implicit ordering between the variants of a module.
+// It does nothing if ResolveDependencies has not completed.
+func (c *Context) VisitDirectReverseDeps(module Module, visit func(Module)) {
+	if !c.dependenciesReady {
+		return
+	}
+	topModule := c.moduleInfo[module]
+
+	var visiting *moduleInfo
+
+	defer func() {
+		if r := recover(); r != nil {
+			panic(newPanicErrorf(r, "VisitDirectReverseDeps(%s, %s) for dependency %s",
+				topModule, funcName(visit), visiting))
+		}
+	}()
+
+	var rdeps []*moduleInfo
+	for _, rdep := range topModule.reverseDeps {
+		for _, dep := range rdep.directDeps {
+			if dep.module == topModule && !IsTestDependencyTag(dep.tag) {
+				rdeps = append(rdeps, rdep)
+				break
+			}
+		}
+	}
+	sortModulesForVisit(rdeps)
+
+	for _, rdep := range rdeps {
+		visiting = rdep
+		visit(rdep.logicModule)
+	}
+}
+
+// VisitDirectDepsWithTags calls visit for each direct dependency of module with the dependency
+// tag used to depend on it.  Like VisitDirectDeps it skips dependencies with a
+// TestDependencyTag.
+func (c *Context) VisitDirectDepsWithTags(module Module, visit func(tag DependencyTag, dep Module)) {
+	topModule := c.moduleInfo[module]
+
+	var visiting *moduleInfo
+
+	defer func() {
+		if r := recover(); r != nil {
+			panic(newPanicErrorf(r, "VisitDirectDepsWithTags(%s, %s) for dependency %s",
+				topModule, funcName(visit), visiting))
+		}
+	}()
+
+	for _, dep := range topModule.directDeps {
+		if IsTestDependencyTag(dep.tag) {
+			continue
+		}
+		visiting = dep.module
+		visit(dep.tag, dep.module.logicModule)
+	}
+}
+
+// VisitDirectDepsWithTagIf calls visit for each direct dependency of module whose dependency tag
+// pred returns true for.  Like VisitDirectDeps it skips dependencies with a TestDependencyTag.
+// It is named differently from VisitDirectDepsIf, whose pred is called with the dependency
+// instead of its tag.
+func (c *Context) VisitDirectDepsWithTagIf(module Module, pred func(DependencyTag) bool, visit func(Module)) {
+	topModule := c.moduleInfo[module]
+
+	var visiting *moduleInfo
+
+	defer func() {
+		if r := recover(); r != nil {
+			panic(newPanicErrorf(r, "VisitDirectDepsWithTagIf(%s, %s, %s) for dependency %s",
+				topModule, funcName(pred), funcName(visit), visiting))
+		}
+	}()
+
+	for _, dep := range topModule.directDeps {
+		if IsTestDependencyTag(dep.tag) {
+			continue
+		}
+		visiting = dep.module
+		if pred(dep.tag) {
+			visit(dep.module.logicModule)
+		}
+	}
+}
+
 func (c *Context) VisitDepsDepthFirst(module Module, visit func(Module)) {
 	topModule := c.moduleInfo[module]
 
@@ -4187,7 +7217,10 @@ func (c *Context) VisitDepsDepthFirst(module Module, visit func(Module)) {
 		}
 	}()
 
-	c.walkDeps(topModule, false, nil, func(dep depInfo, parent *moduleInfo) {
+	c.walkDeps(topModule, false, skipTestDependencies, func(dep depInfo, parent *moduleInfo) {
+		if IsTestDependencyTag(dep.tag) {
+			return
+		}
 		visiting = dep.module
 		visit(dep.module.logicModule)
 	})
@@ -4205,7 +7238,10 @@ func (c *Context) VisitDepsDepthFirstIf(module Module, pred func(Module) bool, v
 		}
 	}()
 
-	c.walkDeps(topModule, false, nil, func(dep depInfo, parent *moduleInfo) {
+	c.walkDeps(topModule, false, skipTestDependencies, func(dep depInfo, parent *moduleInfo) {
+		if IsTestDependencyTag(dep.tag) {
+			return
+		}
 		if pred(dep.module.logicModule) {
 			visiting = dep.module
 			visit(dep.module.logicModule)
@@ -4213,6 +7249,176 @@ func (c *Context) VisitDepsDepthFirstIf(module Module, pred func(Module) bool, v
 	})
 }
 
+// WalkDeps calls visit for each transitive dependency of the module, traversing the dependency
+// tree in top down order and skipping dependencies with a TestDependencyTag.  visit may be called
+// multiple times for the same (child, parent) pair if there are multiple direct dependencies
+// between them with different tags.  If visit returns false WalkDeps will not continue recursing
+// down to child.
+func (c *Context) WalkDeps(module Module, visit func(child, parent Module, tag DependencyTag) bool) {
+	c.walkDepsForVisit("WalkDeps", module, false, visit)
+}
+
+// WalkDepsIncludingTests is like WalkDeps, but also follows dependencies with a
+// TestDependencyTag.
+func (c *Context) WalkDepsIncludingTests(module Module, visit func(child, parent Module, tag DependencyTag) bool) {
+	c.walkDepsForVisit("WalkDepsIncludingTests", module, true, visit)
+}
+
+func (c *Context) walkDepsForVisit(name string, module Module, includeTests bool,
+	visit func(child, parent Module, tag DependencyTag) bool) {
+
+	topModule := c.moduleInfo[module]
+
+	var visiting *moduleInfo
+
+	defer func() {
+		if r := recover(); r != nil {
+			panic(newPanicErrorf(r, "%s(%s, %s) for dependency %s",
+				name, topModule, funcName(visit), visiting))
+		}
+	}()
+
+	c.walkDeps(topModule, true, func(dep depInfo, parent *moduleInfo) bool {
+		if !includeTests && IsTestDependencyTag(dep.tag) {
+			return false
+		}
+		visiting = dep.module
+		return visit(dep.module.logicModule, parent.logicModule, dep.tag)
+	}, nil)
+}
+
+// skipTestDependencies is a visitDown function for walkDeps that doesn't recurse into
+// dependencies with a TestDependencyTag.
+func skipTestDependencies(dep depInfo, parent *moduleInfo) bool {
+	return !IsTestDependencyTag(dep.tag)
+}
+
+// LicenseTag can be implemented by a DependencyTag to control whether the licenses of the
+// dependency are included in the licenses of the depending module by
+// Context.TransitiveLicenses.  Dependencies whose tags don't implement LicenseTag propagate
+// licenses.
+type LicenseTag interface {
+	DependencyTag
+
+	// PropagatesLicenses returns true if the licenses of the dependency should be included in
+	// the licenses of the depending module.
+	PropagatesLicenses() bool
+}
+
+// LicensedModule is implemented by modules that have licenses.
+type LicensedModule interface {
+	Module
+
+	// Licenses returns the licenses that apply to the module itself.
+	Licenses() []string
+}
+
+// TransitiveLicenses returns the sorted, deduplicated licenses of the module and of every module
+// it transitively depends on through dependencies that propagate licenses, see LicenseTag.
+// Dependencies with a TestDependencyTag are not followed.
+func (c *Context) TransitiveLicenses(module Module) []string {
+	topModule := c.moduleInfo[module]
+
+	licenses := make(map[string]bool)
+	addLicenses := func(module *moduleInfo) {
+		if licensed, ok := module.logicModule.(LicensedModule); ok {
+			for _, license := range licensed.Licenses() {
+				licenses[license] = true
+			}
+		}
+	}
+
+	addLicenses(topModule)
+	c.walkDeps(topModule, false, func(dep depInfo, parent *moduleInfo) bool {
+		if IsTestDependencyTag(dep.tag) {
+			return false
+		}
+		if licenseTag, ok := dep.tag.(LicenseTag); ok && !licenseTag.PropagatesLicenses() {
+			return false
+		}
+		addLicenses(dep.module)
+		return true
+	}, nil)
+
+	result := make([]string, 0, len(licenses))
+	for license := range licenses {
+		result = append(result, license)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// DependencyDistances returns the length of the shortest dependency path from each module in
+// modules to each other module in modules, keyed by the (from, to) pair, or -1 if there is no path.
+// The distance from a module to itself is 0.  Paths follow the same dependencies as WalkDeps, so
+// dependencies with a TestDependencyTag are not followed.  The search from each module runs in
+// parallel, up to the same limit used when running mutators.
+func (c *Context) DependencyDistances(modules []Module) map[[2]Module]int {
+	var sources []*moduleInfo
+	targets := make(map[*moduleInfo]bool, len(modules))
+	for _, module := range modules {
+		m := c.moduleInfo[module]
+		if !targets[m] {
+			targets[m] = true
+			sources = append(sources, m)
+		}
+	}
+
+	distances := make([]map[*moduleInfo]int, len(sources))
+	index := make(map[*moduleInfo]int, len(sources))
+	for i, m := range sources {
+		index[m] = i
+	}
+
+	parallelVisit(sources, unorderedVisitorImpl{}, c.parallelVisitLimit(),
+		func(source *moduleInfo, pause chan<- pauseSpec) bool {
+			distances[index[source]] = c.dependencyDistancesFrom(source, targets)
+			return false
+		})
+
+	result := make(map[[2]Module]int, len(sources)*len(sources))
+	for i, from := range sources {
+		for _, to := range sources {
+			distance, ok := distances[i][to]
+			if !ok {
+				distance = -1
+			}
+			result[[2]Module{from.logicModule, to.logicModule}] = distance
+		}
+	}
+	return result
+}
+
+// dependencyDistancesFrom returns the length of the shortest dependency path from source to each of
+// the reachable modules in targets, using a breadth first search that stops once every target has
+// been found.
+func (c *Context) dependencyDistancesFrom(source *moduleInfo, targets map[*moduleInfo]bool) map[*moduleInfo]int {
+	distances := map[*moduleInfo]int{source: 0}
+	found := 1
+
+	visited := map[*moduleInfo]bool{source: true}
+	queue := []*moduleInfo{source}
+	for distance := 1; len(queue) > 0 && found < len(targets); distance++ {
+		var next []*moduleInfo
+		for _, module := range queue {
+			for _, dep := range module.directDeps {
+				if IsTestDependencyTag(dep.tag) || visited[dep.module] {
+					continue
+				}
+				visited[dep.module] = true
+				next = append(next, dep.module)
+				if targets[dep.module] {
+					distances[dep.module] = distance
+					found++
+				}
+			}
+		}
+		queue = next
+	}
+
+	return distances
+}
+
 func (c *Context) PrimaryModule(module Module) Module {
 	return c.moduleInfo[module].group.modules.firstModule().logicModule
 }
@@ -4274,10 +7480,129 @@ func (c *Context) VerifyProvidersWereUnchanged() []error {
 	return errors
 }
 
+// SectionMask selects the sections of the Ninja manifest written by WriteBuildFileTo.
+type SectionMask uint
+
+const (
+	// SectionVariables selects the ninja_required_version, builddir and global variables.
+	SectionVariables SectionMask = 1 << iota
+	// SectionPools selects the global pools.
+	SectionPools
+	// SectionRules selects the global rules.
+	SectionRules
+	// SectionModules selects the subninja statements and the build actions of the modules.
+	SectionModules
+	// SectionSingletons selects the build actions of the singletons.
+	SectionSingletons
+	// SectionPhonies selects the phony targets for deduplicated order-only dependencies and
+	// installed files.
+	SectionPhonies
+
+	// SectionAll selects every section, the whole manifest written by WriteBuildFile.
+	SectionAll = SectionVariables | SectionPools | SectionRules | SectionModules |
+		SectionSingletons | SectionPhonies
+)
+
+// WriteBuildFileTo writes the sections of the Ninja manifest selected by sections to w, for
+// example to inspect only the rules or the build actions of the modules.  The header comment is
+// always written.  With SectionAll the output is identical to WriteBuildFile, otherwise the
+// NinjaPostProcessors are not applied and the output may not be a valid manifest on its own.
+func (c *Context) WriteBuildFileTo(w io.Writer, sections SectionMask) error {
+	if sw, ok := w.(StringWriterWriter); ok {
+		return c.writeBuildFileSections(sw, sections)
+	}
+
+	bw := bufio.NewWriter(w)
+	if err := c.writeBuildFileSections(bw, sections); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func (c *Context) writeBuildFileSections(w StringWriterWriter, sections SectionMask) error {
+	if sections == SectionAll {
+		return c.WriteBuildFile(w)
+	}
+	if !c.reproducibleCommandPaths {
+		return c.writeBuildFile(w, sections, c.progressCallback)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := c.writeBuildFile(buf, sections, c.progressCallback); err != nil {
+		return err
+	}
+	manifest, err := c.relativizeSrcDirPaths(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(manifest)
+	return err
+}
+
 // WriteBuildFile writes the Ninja manifest text for the generated build
 // actions to w.  If this is called before PrepareBuildActions successfully
-// completes then ErrBuildActionsNotReady is returned.
+// completes then ErrBuildActionsNotReady is returned.  If any NinjaPostProcessors
+// were registered the manifest is passed through them before it is written.
 func (c *Context) WriteBuildFile(w StringWriterWriter) error {
+	return c.writeFullBuildFile(w, c.progressCallback)
+}
+
+// WriteBuildFileWithProgress writes the Ninja manifest like WriteBuildFile, and calls progress
+// with the number of modules whose build actions have been written so far and the number of
+// modules that have build actions, so that callers can show that a long write is progressing.
+// progress is called about 100 times, from the calling goroutine, and the last call has written
+// equal to total.  It is called instead of the callback set by SetProgressCallback.
+func (c *Context) WriteBuildFileWithProgress(w StringWriterWriter, progress func(written, total int)) error {
+	return c.writeFullBuildFile(w, func(_ string, written, total int) {
+		progress(written, total)
+	})
+}
+
+// writeFullBuildFile implements WriteBuildFile, reporting the modules written to callback.
+func (c *Context) writeFullBuildFile(w StringWriterWriter, callback ProgressCallback) error {
+	if !c.hasPostProcessing() {
+		return c.writeBuildFile(w, SectionAll, callback)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := c.writeBuildFile(buf, SectionAll, callback); err != nil {
+		return err
+	}
+
+	manifest, err := c.postProcessBuildFile(buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(manifest)
+	return err
+}
+
+// hasPostProcessing returns true if postProcessBuildFile changes the manifest.
+func (c *Context) hasPostProcessing() bool {
+	return len(c.ninjaPostProcessors) > 0 || c.reproducibleCommandPaths
+}
+
+// postProcessBuildFile applies the rewriting set by SetReproducibleCommandPaths and then the
+// registered NinjaPostProcessors to manifest.
+func (c *Context) postProcessBuildFile(manifest []byte) ([]byte, error) {
+	if c.reproducibleCommandPaths {
+		var err error
+		if manifest, err = c.relativizeSrcDirPaths(manifest); err != nil {
+			return nil, err
+		}
+	}
+	for i, postProcessor := range c.ninjaPostProcessors {
+		var err error
+		manifest, err = postProcessor(manifest)
+		if err != nil {
+			return nil, fmt.Errorf("ninja post-processor %d: %w", i, err)
+		}
+	}
+	return manifest, nil
+}
+
+func (c *Context) writeBuildFile(w StringWriterWriter, sections SectionMask, callback ProgressCallback) error {
 	var err error
 	pprof.Do(c.Context, pprof.Labels("blueprint", "WriteBuildFile"), func(ctx context.Context) {
 		if !c.buildActionsReady {
@@ -4287,42 +7612,62 @@ func (c *Context) WriteBuildFile(w StringWriterWriter) error {
 
 		nw := newNinjaWriter(w)
 
-		if err = c.writeBuildFileHeader(nw); err != nil {
+		if err = writeBuildFileHeader(nw, c.pkgAssociations()); err != nil {
 			return
 		}
 
-		if err = c.writeNinjaRequiredVersion(nw); err != nil {
-			return
+		if sections&SectionVariables != 0 {
+			if err = c.writeNinjaRequiredVersion(nw); err != nil {
+				return
+			}
 		}
 
-		if err = c.writeSubninjas(nw); err != nil {
-			return
+		if sections&SectionModules != 0 {
+			if err = c.writeSubninjas(nw); err != nil {
+				return
+			}
 		}
 
 		// TODO: Group the globals by package.
 
-		if err = c.writeGlobalVariables(nw); err != nil {
-			return
+		if sections&SectionVariables != 0 {
+			if err = c.writeGlobalVariables(nw); err != nil {
+				return
+			}
 		}
 
-		if err = c.writeGlobalPools(nw); err != nil {
-			return
+		if sections&SectionPools != 0 {
+			if err = c.writeGlobalPools(nw); err != nil {
+				return
+			}
 		}
 
-		if err = c.writeBuildDir(nw); err != nil {
-			return
+		if sections&SectionVariables != 0 {
+			if err = c.writeBuildDir(nw); err != nil {
+				return
+			}
 		}
 
-		if err = c.writeGlobalRules(nw); err != nil {
-			return
+		if sections&SectionRules != 0 {
+			if err = c.writeGlobalRules(nw); err != nil {
+				return
+			}
 		}
 
-		if err = c.writeAllModuleActions(nw); err != nil {
+		if err = c.writeAllModuleActions(nw, sections, callback); err != nil {
 			return
 		}
 
-		if err = c.writeAllSingletonActions(nw); err != nil {
-			return
+		if sections&SectionSingletons != 0 {
+			if err = c.writeAllSingletonActions(nw); err != nil {
+				return
+			}
+		}
+
+		if sections&SectionPhonies != 0 {
+			if err = writeInstallPhony(nw, c.installMap, c.nameTracker); err != nil {
+				return
+			}
 		}
 	})
 
@@ -4352,7 +7697,20 @@ func (s *pkgAssociationSorter) Swap(i, j int) {
 	s.pkgs[i], s.pkgs[j] = s.pkgs[j], s.pkgs[i]
 }
 
-func (c *Context) writeBuildFileHeader(nw *ninjaWriter) error {
+// pkgAssociations returns the names used in the ninja file for each of the Go packages that
+// define live globals.
+func (c *Context) pkgAssociations() []pkgAssociation {
+	var pkgs []pkgAssociation
+	for pkg, name := range c.nameTracker.pkgNames {
+		pkgs = append(pkgs, pkgAssociation{
+			PkgName: name,
+			PkgPath: pkg.pkgPath,
+		})
+	}
+	return pkgs
+}
+
+func writeBuildFileHeader(nw *ninjaWriter, pkgs []pkgAssociation) error {
 	headerTemplate := template.New("fileHeader")
 	_, err := headerTemplate.Parse(fileHeaderTemplate)
 	if err != nil {
@@ -4360,15 +7718,10 @@ func (c *Context) writeBuildFileHeader(nw *ninjaWriter) error {
 		panic(err)
 	}
 
-	var pkgs []pkgAssociation
 	maxNameLen := 0
-	for pkg, name := range c.nameTracker.pkgNames {
-		pkgs = append(pkgs, pkgAssociation{
-			PkgName: name,
-			PkgPath: pkg.pkgPath,
-		})
-		if len(name) > maxNameLen {
-			maxNameLen = len(name)
+	for _, pkg := range pkgs {
+		if len(pkg.PkgName) > maxNameLen {
+			maxNameLen = len(pkg.PkgName)
 		}
 	}
 
@@ -4428,35 +7781,24 @@ func (c *Context) writeBuildDir(nw *ninjaWriter) error {
 	return nil
 }
 
-func (c *Context) writeGlobalVariables(nw *ninjaWriter) error {
+// globalVariablesInWriteOrder returns the global variables sorted by name, except that every
+// variable comes after the variables its value refers to.
+func (c *Context) globalVariablesInWriteOrder() []Variable {
 	visited := make(map[Variable]bool)
+	ordered := make([]Variable, 0, len(c.globalVariables))
 
-	var walk func(v Variable) error
-	walk = func(v Variable) error {
+	var walk func(v Variable)
+	walk = func(v Variable) {
 		visited[v] = true
 
 		// First visit variables on which this variable depends.
-		value := c.globalVariables[v]
-		for _, dep := range value.Variables() {
+		for _, dep := range c.globalVariables[v].Variables() {
 			if !visited[dep] {
-				err := walk(dep)
-				if err != nil {
-					return err
-				}
+				walk(dep)
 			}
 		}
 
-		err := nw.Assign(c.nameTracker.Variable(v), value.Value(c.nameTracker))
-		if err != nil {
-			return err
-		}
-
-		err = nw.BlankLine()
-		if err != nil {
-			return err
-		}
-
-		return nil
+		ordered = append(ordered, v)
 	}
 
 	globalVariables := make([]Variable, 0, len(c.globalVariables))
@@ -4470,17 +7812,31 @@ func (c *Context) writeGlobalVariables(nw *ninjaWriter) error {
 
 	for _, v := range globalVariables {
 		if !visited[v] {
-			err := walk(v)
-			if err != nil {
-				return nil
-			}
+			walk(v)
+		}
+	}
+
+	return ordered
+}
+
+func (c *Context) writeGlobalVariables(nw *ninjaWriter) error {
+	for _, v := range c.globalVariablesInWriteOrder() {
+		err := nw.Assign(c.nameTracker.Variable(v), c.globalVariables[v].Value(c.nameTracker))
+		if err != nil {
+			return err
+		}
+
+		err = nw.BlankLine()
+		if err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-func (c *Context) writeGlobalPools(nw *ninjaWriter) error {
+// sortedGlobalPools returns the global pools sorted by name.
+func (c *Context) sortedGlobalPools() []Pool {
 	globalPools := make([]Pool, 0, len(c.globalPools))
 	for pool := range c.globalPools {
 		globalPools = append(globalPools, pool)
@@ -4490,7 +7846,11 @@ func (c *Context) writeGlobalPools(nw *ninjaWriter) error {
 		return cmp.Compare(c.nameTracker.Pool(a), c.nameTracker.Pool(b))
 	})
 
-	for _, pool := range globalPools {
+	return globalPools
+}
+
+func (c *Context) writeGlobalPools(nw *ninjaWriter) error {
+	for _, pool := range c.sortedGlobalPools() {
 		name := c.nameTracker.Pool(pool)
 		def := c.globalPools[pool]
 		err := def.WriteTo(nw, name)
@@ -4507,7 +7867,8 @@ func (c *Context) writeGlobalPools(nw *ninjaWriter) error {
 	return nil
 }
 
-func (c *Context) writeGlobalRules(nw *ninjaWriter) error {
+// sortedGlobalRules returns the global rules sorted by name.
+func (c *Context) sortedGlobalRules() []Rule {
 	globalRules := make([]Rule, 0, len(c.globalRules))
 	for rule := range c.globalRules {
 		globalRules = append(globalRules, rule)
@@ -4517,9 +7878,13 @@ func (c *Context) writeGlobalRules(nw *ninjaWriter) error {
 		return cmp.Compare(c.nameTracker.Rule(a), c.nameTracker.Rule(b))
 	})
 
-	for _, rule := range globalRules {
+	return globalRules
+}
+
+func (c *Context) writeGlobalRules(nw *ninjaWriter) error {
+	for _, rule := range c.sortedGlobalRules() {
 		name := c.nameTracker.Rule(rule)
-		def := c.globalRules[rule]
+		def := c.ruleDefForWrite(c.globalRules[rule])
 		err := def.WriteTo(nw, name, c.nameTracker)
 		if err != nil {
 			return err
@@ -4586,24 +7951,245 @@ func (s moduleSorter) Swap(i, j int) {
 	s.modules[i], s.modules[j] = s.modules[j], s.modules[i]
 }
 
-func (c *Context) writeAllModuleActions(nw *ninjaWriter) error {
+// writeAllModuleActions writes the build actions of the modules if sections includes
+// SectionModules, and the phony targets for their deduplicated order-only dependencies if it
+// includes SectionPhonies.  The order-only dependencies are deduplicated either way, so that the
+// build actions are the same as in the whole manifest.
+func (c *Context) writeAllModuleActions(nw *ninjaWriter, sections SectionMask, callback ProgressCallback) error {
 	c.BeginEvent("modules")
 	defer c.EndEvent("modules")
-	headerTemplate := template.New("moduleHeader")
-	if _, err := headerTemplate.Parse(moduleHeaderTemplate); err != nil {
-		// This is a programming error.
-		panic(err)
+
+	modules := c.sortedModules()
+
+	phonys := c.orderOnlyDedupPhonys()
+	if sections&SectionPhonies != 0 {
+		if err := c.writeLocalBuildActions(nw, phonys); err != nil {
+			return err
+		}
+	}
+
+	if sections&SectionModules == 0 {
+		return nil
+	}
+
+	if c.subninjaPerDirectory {
+		dirs, _ := modulesByDirectory(modules)
+		for _, dir := range dirs {
+			file, err := c.directoryBuildFile(dir)
+			if err != nil {
+				return err
+			}
+			if err := nw.Subninja(file); err != nil {
+				return err
+			}
+		}
+		return nw.BlankLine()
 	}
 
+	total := 0
+	for _, module := range modules {
+		if len(module.actionDefs.variables)+len(module.actionDefs.rules)+len(module.actionDefs.buildDefs) > 0 {
+			total++
+		}
+	}
+	progress := startProgressWithCallback(callback, ProgressWrite, total)
+	defer progress.finish()
+
+	return c.writeModuleActions(nw, modules, progress)
+}
+
+// directoryBuildFile returns the path of the file that WriteDirectoryBuildFiles writes the build
+// actions of the modules in dir to.  The files are in the Ninja build directory so that they are
+// not written to the source tree, and are named modules.ninja so that the file for the top-level
+// directory doesn't collide with a top-level build.ninja there.
+func (c *Context) directoryBuildFile(dir string) (string, error) {
+	outDir, err := c.OutDir()
+	if err != nil {
+		return "", err
+	}
+	if outDir == "" {
+		return "", fmt.Errorf("SetSubninjaPerDirectory requires the Ninja build directory to be set " +
+			"with SingletonContext.SetOutDir")
+	}
+	return filepath.Join(outDir, "subninja", dir, "modules.ninja"), nil
+}
+
+// modulesByDirectory groups the modules that have build actions by the directory of the Blueprints
+// file that defines them, keeping their order.  It returns the sorted list of directories.
+func modulesByDirectory(modules []*moduleInfo) ([]string, map[string][]*moduleInfo) {
+	byDir := make(map[string][]*moduleInfo)
+	var dirs []string
+	for _, module := range modules {
+		if len(module.actionDefs.variables)+len(module.actionDefs.rules)+len(module.actionDefs.buildDefs) == 0 {
+			continue
+		}
+		dir := filepath.Dir(module.relBlueprintsFile)
+		if _, exists := byDir[dir]; !exists {
+			dirs = append(dirs, dir)
+		}
+		byDir[dir] = append(byDir[dir], module)
+	}
+	sort.Strings(dirs)
+	return dirs, byDir
+}
+
+// WriteDirectoryBuildFiles calls write with the path and the Ninja manifest text of each of the
+// per-directory files that the file written by WriteBuildFile includes when SetSubninjaPerDirectory
+// is set.  The NinjaPostProcessors are not applied to these files.
+func (c *Context) WriteDirectoryBuildFiles(write func(file string, contents []byte) error) error {
+	if !c.buildActionsReady {
+		return ErrBuildActionsNotReady
+	}
+	if !c.subninjaPerDirectory {
+		return nil
+	}
+
+	// The build actions refer to the phony targets written in the top-level file.
+	c.orderOnlyDedupPhonys()
+
+	dirs, byDir := modulesByDirectory(c.sortedModules())
+	buf := &bytes.Buffer{}
+	for _, dir := range dirs {
+		buf.Reset()
+		if err := c.writeModuleActions(newNinjaWriter(buf), byDir[dir], nil); err != nil {
+			return err
+		}
+		contents := buf.Bytes()
+		if c.reproducibleCommandPaths {
+			var err error
+			if contents, err = c.relativizeSrcDirPaths(contents); err != nil {
+				return err
+			}
+		}
+		file, err := c.directoryBuildFile(dir)
+		if err != nil {
+			return err
+		}
+		if err := write(file, contents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteBuildFileSharded writes the Ninja manifest like WriteBuildFile, but splits the build actions
+// of the modules across shards files named build.0.ninja to build.<shards-1>.ninja in dir, which
+// are included with subninja statements from dir/build.ninja, so that no single file is too large
+// for Ninja to parse quickly.  All of the variants of a module are written to the same file, and
+// the modules are distributed in their sorted order so that each file has about the same number of
+// build statements.  The global variables, pools and rules, the singleton build actions and the
+// phony targets stay in build.ninja, so they are available to every shard.
+//
+// dir is used both to write the files and in the subninja statements, so it must be absolute or
+// relative to the directory Ninja runs in.  Files whose contents are unchanged are not rewritten.
+// The NinjaPostProcessors are not applied, and it can't be used with SetSubninjaPerDirectory.
+func (c *Context) WriteBuildFileSharded(dir string, shards int) error {
+	if !c.buildActionsReady {
+		return ErrBuildActionsNotReady
+	}
+	if shards < 1 {
+		return fmt.Errorf("WriteBuildFileSharded called with %d shards", shards)
+	}
+	if c.subninjaPerDirectory {
+		return fmt.Errorf("WriteBuildFileSharded can't be used with SetSubninjaPerDirectory")
+	}
+
+	write := func(file string, contents []byte) error {
+		if c.reproducibleCommandPaths {
+			var err error
+			if contents, err = c.relativizeSrcDirPaths(contents); err != nil {
+				return err
+			}
+		}
+		return pathtools.WriteFileIfChanged(file, contents, 0666)
+	}
+
+	shardFiles := make([]string, shards)
+	for i := range shardFiles {
+		shardFiles[i] = filepath.Join(dir, fmt.Sprintf("build.%d.ninja", i))
+	}
+
+	buf := &bytes.Buffer{}
+	if err := c.writeBuildFile(buf, SectionAll&^SectionModules, nil); err != nil {
+		return err
+	}
+	nw := newNinjaWriter(buf)
+	if err := c.writeSubninjas(nw); err != nil {
+		return err
+	}
+	for _, file := range shardFiles {
+		if err := nw.Subninja(file); err != nil {
+			return err
+		}
+	}
+	if err := write(filepath.Join(dir, "build.ninja"), buf.Bytes()); err != nil {
+		return err
+	}
+
+	for i, modules := range shardModules(c.sortedModules(), shards) {
+		buf := &bytes.Buffer{}
+		if err := c.writeModuleActions(newNinjaWriter(buf), modules, nil); err != nil {
+			return err
+		}
+		if err := write(shardFiles[i], buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shardModules distributes the modules that have build actions across shards in order, keeping the
+// variants of each module together and giving each shard about the same number of build statements.
+// Each module is put in the shard that contains the middle of its build statements.
+func shardModules(modules []*moduleInfo, shards int) [][]*moduleInfo {
+	type moduleRun struct {
+		modules []*moduleInfo
+		weight  int
+	}
+
+	var runs []moduleRun
+	total := 0
+	for _, module := range modules {
+		if len(module.actionDefs.variables)+len(module.actionDefs.rules)+len(module.actionDefs.buildDefs) == 0 {
+			continue
+		}
+		if len(runs) == 0 || runs[len(runs)-1].modules[0].group != module.group {
+			runs = append(runs, moduleRun{})
+		}
+		run := &runs[len(runs)-1]
+		run.modules = append(run.modules, module)
+		run.weight += len(module.actionDefs.buildDefs) + 1
+		total += len(module.actionDefs.buildDefs) + 1
+	}
+
+	ret := make([][]*moduleInfo, shards)
+	written := 0
+	for _, run := range runs {
+		shard := (2*written + run.weight) * shards / (2 * total)
+		ret[shard] = append(ret[shard], run.modules...)
+		written += run.weight
+	}
+	return ret
+}
+
+// sortedModules returns all variants of all modules sorted by their unique name and variant.
+func (c *Context) sortedModules() []*moduleInfo {
 	modules := make([]*moduleInfo, 0, len(c.moduleInfo))
 	for _, module := range c.moduleInfo {
 		modules = append(modules, module)
 	}
 	sort.Sort(moduleSorter{modules, c.nameInterface})
+	return modules
+}
 
-	phonys := c.deduplicateOrderOnlyDeps(modules)
-	if err := c.writeLocalBuildActions(nw, phonys); err != nil {
-		return err
+// writeModuleActions writes the build actions of each module in modules, preceded by a comment
+// describing the module, and counts each module that has build actions in progress if it is not
+// nil.
+func (c *Context) writeModuleActions(nw *ninjaWriter, modules []*moduleInfo, progress *progressReporter) error {
+	headerTemplate := template.New("moduleHeader")
+	if _, err := headerTemplate.Parse(moduleHeaderTemplate); err != nil {
+		// This is a programming error.
+		panic(err)
 	}
 
 	buf := bytes.NewBuffer(nil)
@@ -4651,6 +8237,8 @@ func (c *Context) writeAllModuleActions(nw *ninjaWriter) error {
 		if err := nw.BlankLine(); err != nil {
 			return err
 		}
+
+		progress.increment()
 	}
 
 	return nil
@@ -4716,6 +8304,20 @@ func (c *Context) GetEventHandler() *metrics.EventHandler {
 	return c.EventHandler
 }
 
+// SetEventHandler sets a function that is called as each event started with BeginEvent ends,
+// including events nested within other events, with the start and end times of the event, so
+// that tools can report the time taken by each phase.  The name is the period-delimited scope of
+// the event, for example "parse_bp" or "a.b" for an event b nested within an event a.
+func (c *Context) SetEventHandler(handler func(name string, begin, end time.Time)) {
+	if handler == nil {
+		c.EventHandler.SetEndHandler(nil)
+		return
+	}
+	c.EventHandler.SetEndHandler(func(event metrics.Event) {
+		handler(event.Id, event.Start, event.End())
+	})
+}
+
 func (c *Context) BeginEvent(name string) {
 	c.EventHandler.Begin(name)
 }
@@ -4728,6 +8330,11 @@ func (c *Context) SetBeforePrepareBuildActionsHook(hookFn func() error) {
 	c.BeforePrepareBuildActionsHook = hookFn
 }
 
+// SetAfterMutatorsHook sets the AfterMutatorsHook.
+func (c *Context) SetAfterMutatorsHook(hookFn func() error) {
+	c.AfterMutatorsHook = hookFn
+}
+
 // phonyCandidate represents the state of a set of deps that decides its eligibility
 // to be extracted as a phony output
 type phonyCandidate struct {
@@ -4802,6 +8409,18 @@ func scanBuildDef(candidates *sync.Map, b *buildDef) {
 	}
 }
 
+// orderOnlyDedupPhonys returns the phony targets that replace the common sets of order-only
+// dependencies of the build actions of all modules, see deduplicateOrderOnlyDeps.  The build
+// actions are rewritten by the first call after PrepareBuildActions, later calls return the same
+// phonys, as deduplicating the rewritten build actions again would replace the phonys with
+// phonys that depend on them and are never written.
+func (c *Context) orderOnlyDedupPhonys() *localBuildActions {
+	if c.dedupPhonys == nil {
+		c.dedupPhonys = c.deduplicateOrderOnlyDeps(c.sortedModules())
+	}
+	return c.dedupPhonys
+}
+
 // deduplicateOrderOnlyDeps searches for common sets of order-only dependencies across all
 // buildDef instances in the provided moduleInfo instances. Each such
 // common set forms a new buildDef representing a phony output that then becomes
@@ -4811,9 +8430,14 @@ func (c *Context) deduplicateOrderOnlyDeps(modules []*moduleInfo) *localBuildAct
 	defer c.EndEvent("deduplicate_order_only_deps")
 
 	candidates := sync.Map{} //used as map[key]*candidate
-	parallelVisit(modules, unorderedVisitorImpl{}, parallelVisitLimit,
+	parallelVisit(modules, unorderedVisitorImpl{}, c.parallelVisitLimit(),
 		func(m *moduleInfo, pause chan<- pauseSpec) bool {
 			for _, b := range m.actionDefs.buildDefs {
+				// Ninja requires the dyndep file to be a direct input of the build statement, so
+				// its order-only dependencies cannot be moved to a phony.
+				if b.HasDyndep {
+					continue
+				}
 				if len(b.OrderOnly) > 0 || len(b.OrderOnlyStrings) > 0 {
 					scanBuildDef(&candidates, b)
 				}
@@ -4831,6 +8455,10 @@ func (c *Context) deduplicateOrderOnlyDeps(modules []*moduleInfo) *localBuildAct
 		return true
 	})
 
+	if c.indexedDedupPhonyNames {
+		return &localBuildActions{buildDefs: indexDedupPhonys(modules, phonys)}
+	}
+
 	c.EventHandler.Do("sort_phony_builddefs", func() {
 		// sorting for determinism, the phony output names are stable
 		sort.Slice(phonys, func(i int, j int) bool {
@@ -4841,6 +8469,34 @@ func (c *Context) deduplicateOrderOnlyDeps(modules []*moduleInfo) *localBuildAct
 	return &localBuildActions{buildDefs: phonys}
 }
 
+// indexDedupPhonys renames the phonys created by deduplicateOrderOnlyDeps to dedup-<index>, numbered
+// in the order in which the build actions of modules first use them, and returns them in that order.
+// The output of a phony is shared with the build actions that use it, so renaming it also renames
+// their order-only dependency.
+func indexDedupPhonys(modules []*moduleInfo, phonys []*buildDef) []*buildDef {
+	byName := make(map[string]*buildDef, len(phonys))
+	for _, phony := range phonys {
+		byName[phony.OutputStrings[0]] = phony
+	}
+
+	indexed := make([]*buildDef, 0, len(phonys))
+	for _, module := range modules {
+		for _, b := range module.actionDefs.buildDefs {
+			if len(b.OrderOnlyStrings) != 1 {
+				continue
+			}
+			phony, ok := byName[b.OrderOnlyStrings[0]]
+			if !ok {
+				continue
+			}
+			delete(byName, b.OrderOnlyStrings[0])
+			phony.OutputStrings[0] = fmt.Sprintf("dedup-%d", len(indexed))
+			indexed = append(indexed, phony)
+		}
+	}
+	return indexed
+}
+
 func (c *Context) writeLocalBuildActions(nw *ninjaWriter,
 	defs *localBuildActions) error {
 
@@ -4876,7 +8532,7 @@ func (c *Context) writeLocalBuildActions(nw *ninjaWriter,
 			panic(err)
 		}
 
-		err = def.WriteTo(nw, name, c.nameTracker)
+		err = c.ruleDefForWrite(def).WriteTo(nw, name, c.nameTracker)
 		if err != nil {
 			return err
 		}
@@ -4887,9 +8543,24 @@ func (c *Context) writeLocalBuildActions(nw *ninjaWriter,
 		}
 	}
 
+	locals := make(map[Variable]*ninjaString, len(defs.variables))
+	for _, v := range defs.variables {
+		locals[v] = v.value_
+	}
+	lookup := func(v Variable) *ninjaString {
+		if value, ok := locals[v]; ok {
+			return value
+		}
+		return c.globalVariables[v]
+	}
+
 	// Write the build definitions.
 	for _, buildDef := range defs.buildDefs {
-		err := buildDef.WriteTo(nw, c.nameTracker)
+		buildDef, err := c.buildDefForWrite(buildDef, lookup)
+		if err != nil {
+			return err
+		}
+		err = buildDef.WriteTo(nw, c.nameTracker)
 		if err != nil {
 			return err
 		}
@@ -5269,10 +8940,5 @@ func (pi *PackageIncludes) MatchesIncludeTags(ctx *Context) bool {
 	if len(pi.MatchAll()) == 0 {
 		ctx.ModuleErrorf(pi, "Match_all must be a non-empty list")
 	}
-	for _, includeTag := range pi.MatchAll() {
-		if !ctx.ContainsIncludeTag(includeTag) {
-			return false
-		}
-	}
-	return true
+	return ctx.includeTags.containsAll(pi.MatchAll())
 }
@@ -16,18 +16,29 @@ package blueprint
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"hash/fnv"
+	"io"
+	"math/rand"
+	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unsafe"
 
 	"github.com/google/blueprint/parser"
+	"github.com/google/blueprint/proptools"
 )
 
 type Walker interface {
@@ -176,88 +187,303 @@ func TestContextParse(t *testing.T) {
 	}
 }
 
-// > |===B---D       - represents a non-walkable edge
-// > A               = represents a walkable edge
-// > |===C===E---G
-// >     |       |   A should not be visited because it's the root node.
-// >     |===F===|   B, D and E should not be walked.
-func TestWalkDeps(t *testing.T) {
+func TestModuleType(t *testing.T) {
 	ctx := NewContext()
+	ctx.RegisterModuleType("foo_module", newFooModule)
+	ctx.RegisterModuleType("bar_module", newBarModule)
+	ctx.RegisterTopDownMutator("create", func(mctx TopDownMutatorContext) {
+		if mctx.ModuleName() == "MyFooModule" {
+			mctx.CreateModule(newBarModule, "", &struct{ Name string }{"Created"})
+		}
+	})
 	ctx.MockFileSystem(map[string][]byte{
 		"Android.bp": []byte(`
 			foo_module {
-			    name: "A",
-			    deps: ["B", "C"],
+			    name: "MyFooModule",
 			}
 
 			bar_module {
-			    name: "B",
-			    deps: ["D"],
+			    name: "MyBarModule",
 			}
+		`),
+	})
 
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected dep errors: %v", errs)
+	}
+
+	for name, want := range map[string]string{
+		"MyFooModule": "foo_module",
+		"MyBarModule": "bar_module",
+		"Created":     "",
+	} {
+		module := ctx.moduleGroupFromName(name, nil).modules.firstModule().logicModule
+		if got := ctx.ModuleType(module); got != want {
+			t.Errorf("expected module type of %q to be %q, got %q", name, want, got)
+		}
+	}
+
+	if got := ctx.ModuleType(&fooModule{}); got != "" {
+		t.Errorf("expected no module type for a module that is not in the context, got %q", got)
+	}
+}
+
+func TestModuleProperties(t *testing.T) {
+	ctx := NewContext()
+	ctx.RegisterModuleType("foo_module", newFooModule)
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
 			foo_module {
-			    name: "C",
-			    deps: ["E", "F"],
+			    name: "MyFooModule",
+			    foo: "abc",
 			}
+		`),
+	})
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+
+	module := ctx.moduleGroupFromName("MyFooModule", nil).modules.firstModule().logicModule.(*fooModule)
+	props, err := ctx.ModuleProperties(module)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{&module.properties, &module.SimpleName.Properties}
+	if len(props) != len(want) {
+		t.Fatalf("expected %d property structs, got %d", len(want), len(props))
+	}
+	for i := range props {
+		if props[i] != want[i] {
+			t.Errorf("expected property struct %d to be %p, got %p", i, want[i], props[i])
+		}
+	}
+
+	got := reflect.ValueOf(props[0]).Elem().FieldByName("Foo").String()
+	if got != "abc" {
+		t.Errorf("expected foo to be %q, got %q", "abc", got)
+	}
 
+	if _, err := ctx.ModuleProperties(&fooModule{}); err == nil {
+		t.Errorf("expected an error for a module that is not in the context")
+	}
+}
+
+func TestModuleVariant(t *testing.T) {
+	ctx := NewContext()
+	ctx.RegisterModuleType("foo_module", newFooModule)
+	ctx.RegisterBottomUpMutator("arch", func(mctx BottomUpMutatorContext) {
+		if mctx.ModuleName() == "A" {
+			mctx.CreateVariations("x86", "arm")
+			mctx.CreateAliasVariation("common", "arm")
+		}
+	})
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
 			foo_module {
-			    name: "D",
+			    name: "A",
 			}
 
-			bar_module {
-			    name: "E",
-			    deps: ["G"],
+			foo_module {
+			    name: "B",
 			}
+		`),
+	})
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected dep errors: %v", errs)
+	}
+
+	testCases := []struct {
+		name       string
+		variations map[string]string
+		found      bool
+		want       string
+	}{
+		{name: "A", variations: map[string]string{"arch": "x86"}, found: true, want: "x86"},
+		{name: "A", variations: map[string]string{"arch": "arm"}, found: true, want: "arm"},
+		{name: "A", variations: map[string]string{"arch": "common"}, found: true, want: "arm"},
+		{name: "A", variations: map[string]string{"arch": "mips"}},
+		{name: "A", variations: map[string]string{"arch": "x86", "os": "linux"}},
+		{name: "A", variations: nil},
+		{name: "B", variations: nil, found: true, want: ""},
+		{name: "B", variations: map[string]string{"arch": "x86"}},
+		{name: "C", variations: nil},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s%v", tc.name, tc.variations), func(t *testing.T) {
+			module, found := ctx.ModuleVariant(tc.name, tc.variations)
+			if found != tc.found {
+				t.Fatalf("expected found to be %v, got %v", tc.found, found)
+			}
+			if !found {
+				return
+			}
+			if name := ctx.ModuleName(module); name != tc.name {
+				t.Errorf("expected module %q, got %q", tc.name, name)
+			}
+			if subDir := ctx.ModuleSubDir(module); subDir != tc.want {
+				t.Errorf("expected variant %q, got %q", tc.want, subDir)
+			}
+		})
+	}
+}
 
+func TestVisitAllModuleGroups(t *testing.T) {
+	ctx := NewContext()
+	ctx.RegisterModuleType("foo_module", newFooModule)
+	ctx.RegisterBottomUpMutator("arch", func(mctx BottomUpMutatorContext) {
+		if mctx.ModuleName() == "B" {
+			mctx.CreateVariations("x86", "arm")
+			mctx.CreateAliasVariation("common", "arm")
+		}
+	})
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
 			foo_module {
-			    name: "F",
-			    deps: ["G"],
+			    name: "B",
 			}
 
 			foo_module {
-			    name: "G",
+			    name: "A",
 			}
 		`),
 	})
 
-	ctx.RegisterModuleType("foo_module", newFooModule)
-	ctx.RegisterModuleType("bar_module", newBarModule)
-	ctx.RegisterBottomUpMutator("deps", depsMutator)
 	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
 	if len(errs) > 0 {
-		t.Errorf("unexpected parse errors:")
-		for _, err := range errs {
-			t.Errorf("  %s", err)
-		}
-		t.FailNow()
+		t.Fatalf("unexpected parse errors: %v", errs)
 	}
-
 	_, errs = ctx.ResolveDependencies(nil)
 	if len(errs) > 0 {
-		t.Errorf("unexpected dep errors:")
-		for _, err := range errs {
-			t.Errorf("  %s", err)
+		t.Fatalf("unexpected dep errors: %v", errs)
+	}
+
+	var got []string
+	ctx.VisitAllModuleGroups(func(name string, variants []Module) {
+		var subDirs []string
+		for _, variant := range variants {
+			if ctx.ModuleName(variant) != name {
+				t.Errorf("expected variant of %q, got %q", name, ctx.ModuleName(variant))
+			}
+			subDirs = append(subDirs, ctx.ModuleSubDir(variant))
 		}
-		t.FailNow()
+		got = append(got, fmt.Sprintf("%s%q", name, subDirs))
+	})
+	want := []string{`A[""]`, `B["x86" "arm"]`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected groups %q, got %q", want, got)
 	}
+}
 
-	topModule := ctx.moduleGroupFromName("A", nil).modules.firstModule()
-	outputDown, outputUp := walkDependencyGraph(ctx, topModule, false)
-	if outputDown != "BCEFG" {
-		t.Errorf("unexpected walkDeps behaviour: %s\ndown should be: BCEFG", outputDown)
+func TestParseString(t *testing.T) {
+	ctx := NewContext()
+
+	modules, errs := ctx.ParseString("dir", "Blueprints", `
+		foo_module {
+		    name: "MyFooModule",
+		}
+
+		x = "y"
+
+		bar_module {
+		    name: "MyBarModule",
+		}
+	`)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
 	}
-	if outputUp != "BEGFC" {
-		t.Errorf("unexpected walkDeps behaviour: %s\nup should be: BEGFC", outputUp)
+
+	var got []string
+	for _, m := range modules {
+		got = append(got, m.Type+":"+m.Pos().String())
+	}
+	want := []string{"foo_module:dir/Blueprints:2:3", "bar_module:dir/Blueprints:8:3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted modules %q, got %q", want, got)
+	}
+
+	_, errs = ctx.ParseString("dir", "Blueprints", `
+		foo_module {
+		    name: "MyFooModule",
+	`)
+	if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), "dir/Blueprints:4:") {
+		t.Errorf("wanted a single error at dir/Blueprints:4, got %q", errs)
+	}
+	if len(ctx.moduleInfo) != 0 {
+		t.Errorf("ParseString should not add modules to the context")
 	}
 }
 
-// > |===B---D           - represents a non-walkable edge
-// > A                   = represents a walkable edge
-// > |===C===E===\       A should not be visited because it's the root node.
-// >     |       |       B, D should not be walked.
-// >     |===F===G===H   G should be visited multiple times
-// >         \===/       H should only be visited once
-func TestWalkDepsDuplicates(t *testing.T) {
+type valueTypeTestModule struct {
+	SimpleName
+	properties struct {
+		Timeout *int64 `blueprint_value_type:"duration"`
+	}
+}
+
+func newValueTypeTestModule() (Module, []interface{}) {
+	m := &valueTypeTestModule{}
+	return m, []interface{}{&m.SimpleName.Properties, &m.properties}
+}
+
+func (m *valueTypeTestModule) GenerateBuildActions(ModuleContext) {}
+
+func TestRegisterValueType(t *testing.T) {
+	ctx := NewContext()
+	ctx.RegisterModuleType("test", newValueTypeTestModule)
+	ctx.RegisterValueType("duration", func(s string) (interface{}, error) {
+		return time.ParseDuration(s)
+	})
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			test {
+			    name: "good",
+			    timeout: "10s",
+			}
+			test {
+			    name: "bad",
+			    timeout: "soon",
+			}
+		`),
+	})
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, got %q", errs)
+	}
+	if _, ok := errs[0].(*PropertyError); !ok {
+		t.Errorf("expected a *PropertyError, got %T", errs[0])
+	}
+	expected := `Android.bp:8:17: module "bad": timeout: invalid duration value "soon" for property "timeout": ` +
+		`time: invalid duration "soon"`
+	if errs[0].Error() != expected {
+		t.Errorf("expected error %q, got %q", expected, errs[0].Error())
+	}
+
+	good := ctx.moduleGroupFromName("good", nil).modules.firstModule().logicModule.(*valueTypeTestModule)
+	if timeout := good.properties.Timeout; timeout == nil || time.Duration(*timeout) != 10*time.Second {
+		t.Errorf("expected timeout of 10s, got %v", timeout)
+	}
+}
+
+// > |===B---D       - represents a non-walkable edge
+// > A               = represents a walkable edge
+// > |===C===E---G
+// >     |       |   A should not be visited because it's the root node.
+// >     |===F===|   B, D and E should not be walked.
+func TestWalkDeps(t *testing.T) {
 	ctx := NewContext()
 	ctx.MockFileSystem(map[string][]byte{
 		"Android.bp": []byte(`
@@ -280,23 +506,18 @@ func TestWalkDepsDuplicates(t *testing.T) {
 			    name: "D",
 			}
 
-			foo_module {
+			bar_module {
 			    name: "E",
 			    deps: ["G"],
 			}
 
 			foo_module {
 			    name: "F",
-			    deps: ["G", "G"],
+			    deps: ["G"],
 			}
 
 			foo_module {
 			    name: "G",
-				deps: ["H"],
-			}
-
-			foo_module {
-			    name: "H",
 			}
 		`),
 	})
@@ -323,1242 +544,4593 @@ func TestWalkDepsDuplicates(t *testing.T) {
 	}
 
 	topModule := ctx.moduleGroupFromName("A", nil).modules.firstModule()
-	outputDown, outputUp := walkDependencyGraph(ctx, topModule, true)
-	if outputDown != "BCEGHFGG" {
-		t.Errorf("unexpected walkDeps behaviour: %s\ndown should be: BCEGHFGG", outputDown)
+	outputDown, outputUp := walkDependencyGraph(ctx, topModule, false)
+	if outputDown != "BCEFG" {
+		t.Errorf("unexpected walkDeps behaviour: %s\ndown should be: BCEFG", outputDown)
 	}
-	if outputUp != "BHGEGGFC" {
-		t.Errorf("unexpected walkDeps behaviour: %s\nup should be: BHGEGGFC", outputUp)
+	if outputUp != "BEGFC" {
+		t.Errorf("unexpected walkDeps behaviour: %s\nup should be: BEGFC", outputUp)
 	}
 }
 
-// >                     - represents a non-walkable edge
+// > |===B---D           - represents a non-walkable edge
 // > A                   = represents a walkable edge
-// > |===B-------\       A should not be visited because it's the root node.
-// >     |       |       B -> D should not be walked.
-// >     |===C===D===E   B -> C -> D -> E should be walked
-func TestWalkDepsDuplicates_IgnoreFirstPath(t *testing.T) {
+// > |===C===E===\       A should not be visited because it's the root node.
+// >     |       |       B, D should not be walked.
+// >     |===F===G===H   G should be visited multiple times
+// >         \===/       H should only be visited once
+func TestBlueprintFilesForTarget(t *testing.T) {
 	ctx := NewContext()
 	ctx.MockFileSystem(map[string][]byte{
 		"Android.bp": []byte(`
+			subdirs = ["*"]
 			foo_module {
 			    name: "A",
-			    deps: ["B"],
+			    deps: ["B", "C"],
 			}
-
+		`),
+		"b/Android.bp": []byte(`
 			foo_module {
 			    name: "B",
 			    deps: ["C"],
-			    ignored_deps: ["D"],
 			}
-
 			foo_module {
-			    name: "C",
-			    deps: ["D"],
+			    name: "B2",
 			}
-
+		`),
+		"c/Android.bp": []byte(`
 			foo_module {
-			    name: "D",
-			    deps: ["E"],
+			    name: "C",
 			}
-
+		`),
+		"d/Android.bp": []byte(`
 			foo_module {
-			    name: "E",
+			    name: "D",
+			    deps: ["A"],
 			}
 		`),
 	})
 
 	ctx.RegisterModuleType("foo_module", newFooModule)
-	ctx.RegisterModuleType("bar_module", newBarModule)
 	ctx.RegisterBottomUpMutator("deps", depsMutator)
+
 	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
 	if len(errs) > 0 {
-		t.Errorf("unexpected parse errors:")
-		for _, err := range errs {
-			t.Errorf("  %s", err)
-		}
-		t.FailNow()
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+
+	if _, err := ctx.BlueprintFilesForTarget("A"); err == nil {
+		t.Errorf("expected an error before ResolveDependencies")
 	}
 
 	_, errs = ctx.ResolveDependencies(nil)
 	if len(errs) > 0 {
-		t.Errorf("unexpected dep errors:")
-		for _, err := range errs {
-			t.Errorf("  %s", err)
-		}
-		t.FailNow()
+		t.Fatalf("unexpected dep errors: %v", errs)
 	}
 
-	topModule := ctx.moduleGroupFromName("A", nil).modules.firstModule()
-	outputDown, outputUp := walkDependencyGraph(ctx, topModule, true)
-	expectedDown := "BDCDE"
-	if outputDown != expectedDown {
-		t.Errorf("unexpected walkDeps behaviour: %s\ndown should be: %s", outputDown, expectedDown)
+	testCases := []struct {
+		name  string
+		files []string
+	}{
+		{"A", []string{"Android.bp", "b/Android.bp", "c/Android.bp"}},
+		{"B", []string{"b/Android.bp", "c/Android.bp"}},
+		{"C", []string{"c/Android.bp"}},
+		{"D", []string{"Android.bp", "b/Android.bp", "c/Android.bp", "d/Android.bp"}},
 	}
-	expectedUp := "DEDCB"
-	if outputUp != expectedUp {
-		t.Errorf("unexpected walkDeps behaviour: %s\nup should be: %s", outputUp, expectedUp)
+	for _, tc := range testCases {
+		files, err := ctx.BlueprintFilesForTarget(tc.name)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", tc.name, err)
+		} else if !reflect.DeepEqual(files, tc.files) {
+			t.Errorf("%s: expected files %q, got %q", tc.name, tc.files, files)
+		}
+	}
+
+	if _, err := ctx.BlueprintFilesForTarget("missing"); err == nil {
+		t.Errorf("expected an error for a missing module")
 	}
 }
 
-func TestCreateModule(t *testing.T) {
-	ctx := newContext()
+func TestModuleBlobs(t *testing.T) {
+	ctx := NewContext()
 	ctx.MockFileSystem(map[string][]byte{
 		"Android.bp": []byte(`
 			foo_module {
 			    name: "A",
-			    deps: ["B", "C"],
 			}
-		`),
-	})
-
-	ctx.RegisterTopDownMutator("create", createTestMutator)
-	ctx.RegisterBottomUpMutator("deps", depsMutator)
+			bar_module {
+			    name: "B",
+			}
+		`),
+	})
 
 	ctx.RegisterModuleType("foo_module", newFooModule)
 	ctx.RegisterModuleType("bar_module", newBarModule)
+
 	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
 	if len(errs) > 0 {
-		t.Errorf("unexpected parse errors:")
-		for _, err := range errs {
-			t.Errorf("  %s", err)
-		}
-		t.FailNow()
+		t.Fatalf("unexpected parse errors: %v", errs)
 	}
-
 	_, errs = ctx.ResolveDependencies(nil)
 	if len(errs) > 0 {
-		t.Errorf("unexpected dep errors:")
-		for _, err := range errs {
-			t.Errorf("  %s", err)
-		}
-		t.FailNow()
+		t.Fatalf("unexpected dep errors: %v", errs)
 	}
 
-	a := ctx.moduleGroupFromName("A", nil).modules.firstModule().logicModule.(*fooModule)
-	b := ctx.moduleGroupFromName("B", nil).modules.firstModule().logicModule.(*barModule)
-	c := ctx.moduleGroupFromName("C", nil).modules.firstModule().logicModule.(*barModule)
-	d := ctx.moduleGroupFromName("D", nil).modules.firstModule().logicModule.(*fooModule)
+	a := ctx.moduleGroupFromName("A", nil).modules.firstModule().logicModule
+	b := ctx.moduleGroupFromName("B", nil).modules.firstModule().logicModule
 
-	checkDeps := func(m Module, expected string) {
-		var deps []string
-		ctx.VisitDirectDeps(m, func(m Module) {
-			deps = append(deps, ctx.ModuleName(m))
-		})
-		got := strings.Join(deps, ",")
-		if got != expected {
-			t.Errorf("unexpected %q dependencies, got %q expected %q",
-				ctx.ModuleName(m), got, expected)
-		}
+	ctx.SetModuleBlob(a, "ast", []byte("a1"))
+	ctx.SetModuleBlob(a, "ast", []byte("a2"))
+	ctx.SetModuleBlob(b, "ast", []byte("b"))
+
+	if data, ok := ctx.GetModuleBlob(a, "ast"); !ok || string(data) != "a2" {
+		t.Errorf("expected blob %q for A, got %q, %v", "a2", data, ok)
+	}
+	if data, ok := ctx.GetModuleBlob(b, "ast"); !ok || string(data) != "b" {
+		t.Errorf("expected blob %q for B, got %q, %v", "b", data, ok)
+	}
+	if _, ok := ctx.GetModuleBlob(a, "missing"); ok {
+		t.Errorf("expected no blob for a missing key")
 	}
 
-	checkDeps(a, "B,C")
-	checkDeps(b, "D")
-	checkDeps(c, "D")
-	checkDeps(d, "")
+	ctx.ClearModuleBlobs()
+	if _, ok := ctx.GetModuleBlob(a, "ast"); ok {
+		t.Errorf("expected no blob after ClearModuleBlobs")
+	}
 }
 
-func createTestMutator(ctx TopDownMutatorContext) {
-	type props struct {
-		Name string
-		Deps []string
+type enabledTestModule struct {
+	SimpleName
+	properties struct {
+		Deps          []string
+		Optional_deps []string
 	}
 
-	ctx.CreateModule(newBarModule, "new_bar", &props{
-		Name: "B",
-		Deps: []string{"D"},
-	})
+	generated   bool
+	enabledDeps []string
+}
 
-	ctx.CreateModule(newBarModule, "new_bar", &props{
-		Name: "C",
-		Deps: []string{"D"},
-	})
+func newEnabledTestModule() (Module, []interface{}) {
+	m := &enabledTestModule{}
+	return m, []interface{}{&m.properties, &m.SimpleName.Properties}
+}
 
-	ctx.CreateModule(newFooModule, "new_foo", &props{
-		Name: "D",
+func (m *enabledTestModule) GenerateBuildActions(ctx ModuleContext) {
+	m.generated = true
+	ctx.VisitDirectDeps(func(dep Module) {
+		if ctx.OtherModuleEnabled(dep) {
+			m.enabledDeps = append(m.enabledDeps, ctx.OtherModuleName(dep))
+		}
 	})
 }
 
-func TestWalkFileOrder(t *testing.T) {
-	// Run the test once to see how long it normally takes
-	start := time.Now()
-	doTestWalkFileOrder(t, time.Duration(0))
-	duration := time.Since(start)
+type optionalDepsTag struct {
+	BaseDependencyTag
+}
 
-	// Run the test again, but put enough of a sleep into each visitor to detect ordering
-	// problems if they exist
-	doTestWalkFileOrder(t, duration)
+func (optionalDepsTag) OptionalDependency() bool { return true }
+
+func enabledTestDepsMutator(ctx BottomUpMutatorContext) {
+	m := ctx.Module().(*enabledTestModule)
+	ctx.AddDependency(m, nil, m.properties.Deps...)
+	ctx.AddDependency(m, optionalDepsTag{}, m.properties.Optional_deps...)
 }
 
-// test that WalkBlueprintsFiles calls asyncVisitor in the right order
-func doTestWalkFileOrder(t *testing.T, sleepDuration time.Duration) {
-	// setup mock context
-	ctx := newContext()
-	mockFiles := map[string][]byte{
-		"Android.bp": []byte(`
-			sample_module {
-			    name: "a",
-			}
-		`),
-		"dir1/Android.bp": []byte(`
-			sample_module {
-			    name: "b",
+func TestEnabledProperty(t *testing.T) {
+	run := func(t *testing.T, bp string, allowMissingDependencies bool) (*Context, []error) {
+		t.Helper()
+		ctx := NewContext()
+		ctx.RegisterModuleType("test", newEnabledTestModule)
+		ctx.RegisterBottomUpMutator("deps", enabledTestDepsMutator)
+		ctx.SetAllowMissingDependencies(allowMissingDependencies)
+		ctx.MockFileSystem(map[string][]byte{
+			"Android.bp": []byte(`
+				subdirs = ["*"]
+			` + bp),
+			"b/Android.bp": []byte(`
+				test {
+				    name: "B",
+				    enabled: false,
+				}
+			`),
+		})
+
+		_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected parse errors: %v", errs)
+		}
+		_, errs = ctx.ResolveDependencies(nil)
+		if len(errs) > 0 {
+			return ctx, errs
+		}
+		_, errs = ctx.PrepareBuildActions(nil)
+		return ctx, errs
+	}
+
+	module := func(ctx *Context, name string) *enabledTestModule {
+		return ctx.moduleGroupFromName(name, nil).modules.firstModule().logicModule.(*enabledTestModule)
+	}
+
+	t.Run("optional", func(t *testing.T) {
+		ctx, errs := run(t, `
+			test {
+			    name: "A",
+			    deps: ["C"],
+			    optional_deps: ["B"],
 			}
-		`),
-		"dir1/dir2/Android.bp": []byte(`
-			sample_module {
-			    name: "c",
+			test {
+			    name: "C",
+			    enabled: true,
 			}
-		`),
-	}
-	ctx.MockFileSystem(mockFiles)
+		`, false)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
 
-	// prepare to monitor the visit order
-	visitOrder := []string{}
-	visitLock := sync.Mutex{}
-	correctVisitOrder := []string{"Android.bp", "dir1/Android.bp", "dir1/dir2/Android.bp"}
+		if !module(ctx, "A").generated || !module(ctx, "C").generated {
+			t.Errorf("expected enabled modules to be generated")
+		}
+		if module(ctx, "B").generated {
+			t.Errorf("expected disabled module not to be generated")
+		}
+		if g, w := module(ctx, "A").enabledDeps, []string{"C"}; !reflect.DeepEqual(g, w) {
+			t.Errorf("expected enabled deps %q, got %q", w, g)
+		}
+	})
 
-	// sleep longer when processing the earlier files
-	chooseSleepDuration := func(fileName string) (duration time.Duration) {
-		duration = time.Duration(0)
-		for i := len(correctVisitOrder) - 1; i >= 0; i-- {
-			if fileName == correctVisitOrder[i] {
-				return duration
+	t.Run("depends on disabled module", func(t *testing.T) {
+		_, errs := run(t, `
+			test {
+			    name: "A",
+			    deps: ["B"],
 			}
-			duration = duration + sleepDuration
+		`, false)
+		expected := `Android.bp:4:4: module "A" depends on disabled module "B"; "B" was defined in file [b/Android.bp], but was disabled by its "enabled" property`
+		if len(errs) != 1 || errs[0].Error() != expected {
+			t.Errorf("expected error %q, got %q", expected, errs)
 		}
-		panic("unrecognized file name " + fileName)
-	}
+	})
 
-	visitor := func(file *parser.File) {
-		time.Sleep(chooseSleepDuration(file.Name))
-		visitLock.Lock()
-		defer visitLock.Unlock()
-		visitOrder = append(visitOrder, file.Name)
-	}
-	keys := []string{"Android.bp", "dir1/Android.bp", "dir1/dir2/Android.bp"}
+	t.Run("disabled module depends on disabled module", func(t *testing.T) {
+		_, errs := run(t, `
+			test {
+			    name: "A",
+			    deps: ["B"],
+			    enabled: false,
+			}
+		`, false)
+		if len(errs) > 0 {
+			t.Errorf("unexpected errors: %v", errs)
+		}
+	})
 
-	// visit the blueprints files
-	ctx.WalkBlueprintsFiles(".", keys, visitor)
+	t.Run("allow missing dependencies", func(t *testing.T) {
+		_, errs := run(t, `
+			test {
+			    name: "A",
+			    deps: ["B"],
+			}
+		`, true)
+		// The disabled module is reported as a missing dependency when GenerateBuildActions
+		// doesn't handle it.
+		expected := `Android.bp:4:4: module "A" depends on disabled module "B"; "B" was defined in file [b/Android.bp], but was disabled by its "enabled" property`
+		if len(errs) != 1 || errs[0].Error() != expected {
+			t.Errorf("expected error %q, got %q", expected, errs)
+		}
+	})
+}
 
-	// check the order
-	if !reflect.DeepEqual(visitOrder, correctVisitOrder) {
-		t.Errorf("Incorrect visit order; expected %v, got %v", correctVisitOrder, visitOrder)
+type ownEnabledTestModule struct {
+	SimpleName
+	properties struct {
+		Enabled   string
+		Test_data bool
 	}
 }
 
-// test that WalkBlueprintsFiles reports syntax errors
-func TestWalkingWithSyntaxError(t *testing.T) {
-	// setup mock context
-	ctx := newContext()
-	mockFiles := map[string][]byte{
+func newOwnEnabledTestModule() (Module, []interface{}) {
+	m := &ownEnabledTestModule{}
+	return m, []interface{}{&m.SimpleName.Properties, &m.properties}
+}
+
+func (m *ownEnabledTestModule) GenerateBuildActions(ModuleContext) {}
+
+func TestCommonPropertiesDeclaredByModuleType(t *testing.T) {
+	ctx := NewContext()
+	ctx.RegisterModuleType("test", newOwnEnabledTestModule)
+	ctx.MockFileSystem(map[string][]byte{
 		"Android.bp": []byte(`
-			sample_module {
-			    name: "a" "b",
-			}
-		`),
-		"dir1/Android.bp": []byte(`
-			sample_module {
-			    name: "b",
-		`),
-		"dir1/dir2/Android.bp": []byte(`
-			sample_module {
-			    name: "c",
+			test {
+			    name: "A",
+			    enabled: "never",
+			    test_data: true,
+			    common: true,
 			}
 		`),
-	}
-	ctx.MockFileSystem(mockFiles)
-
-	keys := []string{"Android.bp", "dir1/Android.bp", "dir1/dir2/Android.bp"}
+	})
 
-	// visit the blueprints files
-	_, errs := ctx.WalkBlueprintsFiles(".", keys, func(file *parser.File) {})
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
 
-	expectedErrs := []error{
-		errors.New(`Android.bp:3:18: expected "}", found String`),
-		errors.New(`dir1/Android.bp:4:3: expected "}", found EOF`),
+	// The module type's own enabled and test_data properties are used instead of the common
+	// ones, while the common property it doesn't declare is still supported.
+	module := ctx.moduleGroupFromName("A", nil).modules.firstModule()
+	m := module.logicModule.(*ownEnabledTestModule)
+	if m.properties.Enabled != "never" || !m.properties.Test_data {
+		t.Errorf("expected the module type's own properties to be set, got %+v", m.properties)
 	}
-	if fmt.Sprintf("%s", expectedErrs) != fmt.Sprintf("%s", errs) {
-		t.Errorf("Incorrect errors; expected:\n%s\ngot:\n%s", expectedErrs, errs)
+	if module.disabled || module.testData != nil {
+		t.Errorf("expected the common enabled and test_data properties not to be set")
+	}
+	if !module.common {
+		t.Errorf("expected the common property to be set")
 	}
-
 }
 
-func TestParseFailsForModuleWithoutName(t *testing.T) {
+func TestWalkDepsDuplicates(t *testing.T) {
 	ctx := NewContext()
 	ctx.MockFileSystem(map[string][]byte{
 		"Android.bp": []byte(`
 			foo_module {
 			    name: "A",
+			    deps: ["B", "C"],
 			}
 
 			bar_module {
-			    deps: ["A"],
+			    name: "B",
+			    deps: ["D"],
+			}
+
+			foo_module {
+			    name: "C",
+			    deps: ["E", "F"],
+			}
+
+			foo_module {
+			    name: "D",
+			}
+
+			foo_module {
+			    name: "E",
+			    deps: ["G"],
+			}
+
+			foo_module {
+			    name: "F",
+			    deps: ["G", "G"],
+			}
+
+			foo_module {
+			    name: "G",
+				deps: ["H"],
+			}
+
+			foo_module {
+			    name: "H",
 			}
 		`),
 	})
+
 	ctx.RegisterModuleType("foo_module", newFooModule)
 	ctx.RegisterModuleType("bar_module", newBarModule)
-
+	ctx.RegisterBottomUpMutator("deps", depsMutator)
 	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Errorf("unexpected parse errors:")
+		for _, err := range errs {
+			t.Errorf("  %s", err)
+		}
+		t.FailNow()
+	}
 
-	expectedErrs := []error{
-		errors.New(`Android.bp:6:4: property 'name' is missing from a module`),
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Errorf("unexpected dep errors:")
+		for _, err := range errs {
+			t.Errorf("  %s", err)
+		}
+		t.FailNow()
 	}
-	if fmt.Sprintf("%s", expectedErrs) != fmt.Sprintf("%s", errs) {
-		t.Errorf("Incorrect errors; expected:\n%s\ngot:\n%s", expectedErrs, errs)
+
+	topModule := ctx.moduleGroupFromName("A", nil).modules.firstModule()
+	outputDown, outputUp := walkDependencyGraph(ctx, topModule, true)
+	if outputDown != "BCEGHFGG" {
+		t.Errorf("unexpected walkDeps behaviour: %s\ndown should be: BCEGHFGG", outputDown)
+	}
+	if outputUp != "BHGEGGFC" {
+		t.Errorf("unexpected walkDeps behaviour: %s\nup should be: BHGEGGFC", outputUp)
 	}
 }
 
-func Test_findVariant(t *testing.T) {
-	module := &moduleInfo{
-		variant: variant{
-			name: "normal_local",
-			variations: variationMap{
-				"normal": "normal",
-				"local":  "local",
-			},
-			dependencyVariations: variationMap{
-				"normal": "normal",
-			},
-		},
+// >                     - represents a non-walkable edge
+// > A                   = represents a walkable edge
+// > |===B-------\       A should not be visited because it's the root node.
+// >     |       |       B -> D should not be walked.
+// >     |===C===D===E   B -> C -> D -> E should be walked
+func TestWalkDepsDuplicates_IgnoreFirstPath(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			foo_module {
+			    name: "A",
+			    deps: ["B"],
+			}
+
+			foo_module {
+			    name: "B",
+			    deps: ["C"],
+			    ignored_deps: ["D"],
+			}
+
+			foo_module {
+			    name: "C",
+			    deps: ["D"],
+			}
+
+			foo_module {
+			    name: "D",
+			    deps: ["E"],
+			}
+
+			foo_module {
+			    name: "E",
+			}
+		`),
+	})
+
+	ctx.RegisterModuleType("foo_module", newFooModule)
+	ctx.RegisterModuleType("bar_module", newBarModule)
+	ctx.RegisterBottomUpMutator("deps", depsMutator)
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Errorf("unexpected parse errors:")
+		for _, err := range errs {
+			t.Errorf("  %s", err)
+		}
+		t.FailNow()
 	}
 
-	type alias struct {
-		variant variant
-		target  int
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Errorf("unexpected dep errors:")
+		for _, err := range errs {
+			t.Errorf("  %s", err)
+		}
+		t.FailNow()
 	}
 
-	makeDependencyGroup := func(in ...interface{}) *moduleGroup {
-		group := &moduleGroup{
-			name: "dep",
+	topModule := ctx.moduleGroupFromName("A", nil).modules.firstModule()
+	outputDown, outputUp := walkDependencyGraph(ctx, topModule, true)
+	expectedDown := "BDCDE"
+	if outputDown != expectedDown {
+		t.Errorf("unexpected walkDeps behaviour: %s\ndown should be: %s", outputDown, expectedDown)
+	}
+	expectedUp := "DEDCB"
+	if outputUp != expectedUp {
+		t.Errorf("unexpected walkDeps behaviour: %s\nup should be: %s", outputUp, expectedUp)
+	}
+}
+
+func TestCreateModule(t *testing.T) {
+	ctx := newContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			foo_module {
+			    name: "A",
+			    deps: ["B", "C"],
+			}
+		`),
+	})
+
+	ctx.RegisterTopDownMutator("create", createTestMutator)
+	ctx.RegisterBottomUpMutator("deps", depsMutator)
+
+	var created []string
+	ctx.RegisterModuleCreatedHook(func(m Module, creator string) {
+		created = append(created, ctx.ModuleName(m)+":"+creator)
+	})
+
+	ctx.RegisterModuleType("foo_module", newFooModule)
+	ctx.RegisterModuleType("bar_module", newBarModule)
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Errorf("unexpected parse errors:")
+		for _, err := range errs {
+			t.Errorf("  %s", err)
 		}
-		for _, x := range in {
-			switch m := x.(type) {
-			case *moduleInfo:
-				m.group = group
-				group.modules = append(group.modules, m)
-			case alias:
-				// aliases may need to target modules that haven't been processed
-				// yet, put an empty alias in for now.
-				group.modules = append(group.modules, nil)
-			default:
-				t.Fatalf("unexpected type %T", x)
+		t.FailNow()
+	}
+
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Errorf("unexpected dep errors:")
+		for _, err := range errs {
+			t.Errorf("  %s", err)
+		}
+		t.FailNow()
+	}
+
+	a := ctx.moduleGroupFromName("A", nil).modules.firstModule().logicModule.(*fooModule)
+	b := ctx.moduleGroupFromName("B", nil).modules.firstModule().logicModule.(*barModule)
+	c := ctx.moduleGroupFromName("C", nil).modules.firstModule().logicModule.(*barModule)
+	d := ctx.moduleGroupFromName("D", nil).modules.firstModule().logicModule.(*fooModule)
+
+	checkDeps := func(m Module, expected string) {
+		var deps []string
+		ctx.VisitDirectDeps(m, func(m Module) {
+			deps = append(deps, ctx.ModuleName(m))
+		})
+		got := strings.Join(deps, ",")
+		if got != expected {
+			t.Errorf("unexpected %q dependencies, got %q expected %q",
+				ctx.ModuleName(m), got, expected)
+		}
+	}
+
+	checkDeps(a, "B,C")
+	checkDeps(b, "D")
+	checkDeps(c, "D")
+	checkDeps(d, "")
+
+	if w := []string{"B:create", "C:create", "D:create"}; !reflect.DeepEqual(created, w) {
+		t.Errorf("expected module created hook calls %q, got %q", w, created)
+	}
+
+	if _, _, ok := ctx.ModuleCreator(a); ok {
+		t.Errorf("expected no creator for A")
+	}
+	for _, m := range []Module{b, c, d} {
+		creator, mutator, ok := ctx.ModuleCreator(m)
+		if !ok || creator != a || mutator != "create" {
+			t.Errorf("expected %s to be created by A in mutator create, got %v %q %v",
+				ctx.ModuleName(m), creator, mutator, ok)
+		}
+	}
+}
+
+func TestCreateModuleInDirectory(t *testing.T) {
+	ctx := newContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			foo_module {
+			    name: "A",
 			}
+
+			foo_module {
+			    name: "D",
+			    deps: ["C"],
+			}
+		`),
+	})
+
+	ctx.RegisterModuleType("foo_module", newFooModule)
+	ctx.RegisterTopDownMutator("create", func(mctx TopDownMutatorContext) {
+		if mctx.ModuleName() != "A" {
+			return
+		}
+		type props struct {
+			Name string
 		}
+		mctx.CreateModuleInDirectory(newBarModule, "new_bar", "allowed/dir", &props{Name: "B"})
+		mctx.CreateModuleInDirectory(newBarModule, "new_bar", "skipped/dir", &props{Name: "C"})
+	})
+	ctx.RegisterBottomUpMutator("deps", depsMutator)
+	ctx.AddSourceRootDirs("-skipped")
 
-		for i, x := range in {
-			switch m := x.(type) {
-			case *moduleInfo:
-				// already added in the first pass
-			case alias:
-				group.modules[i] = &moduleAlias{
-					variant: m.variant,
-					target:  group.modules[m.target].moduleOrAliasTarget(),
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+
+	_, errs = ctx.ResolveDependencies(nil)
+	expectedErrs := []string{
+		`Android.bp:6:4: module "D" depends on skipped module "C"; "C" was defined in files(s) [skipped/dir/Android.bp], but was skipped for reason(s) ["skipped/dir/Android.bp" is a descendant of "skipped", and that path prefix was not included in PRODUCT_SOURCE_ROOT_DIRS]; dependency path: D -> C`,
+	}
+	var actualErrs []string
+	for _, err := range errs {
+		actualErrs = append(actualErrs, err.Error())
+	}
+	if !reflect.DeepEqual(expectedErrs, actualErrs) {
+		t.Errorf("expected errors %q, got %q", expectedErrs, actualErrs)
+	}
+
+	b := ctx.moduleGroupFromName("B", nil)
+	if b == nil {
+		t.Fatalf("expected module B to be created")
+	}
+	if g, w := ctx.BlueprintFile(b.modules.firstModule().logicModule), "allowed/dir/Android.bp"; g != w {
+		t.Errorf("expected B to be attributed to %q, got %q", w, g)
+	}
+	if ctx.moduleGroupFromName("C", nil) != nil {
+		t.Errorf("expected module C to be skipped")
+	}
+}
+
+func TestModuleCreatorVariants(t *testing.T) {
+	run := func(t *testing.T, prune bool) *Context {
+		t.Helper()
+		ctx := newContext()
+		ctx.MockFileSystem(map[string][]byte{
+			"Android.bp": []byte(`
+				foo_module {
+				    name: "A",
 				}
-			default:
-				t.Fatalf("unexpected type %T", x)
+			`),
+		})
+		ctx.RegisterModuleType("foo_module", newFooModule)
+		ctx.RegisterModuleType("bar_module", newBarModule)
+		ctx.RegisterTopDownMutator("create", createTestMutator)
+		// The creator A and the created module B are split by the same mutator.
+		ctx.RegisterBottomUpMutator("split", func(mctx BottomUpMutatorContext) {
+			if name := mctx.ModuleName(); name == "A" || name == "B" {
+				mctx.CreateVariations("x", "y")
 			}
+		})
+		if prune {
+			ctx.RegisterBottomUpMutator("prune", func(mctx BottomUpMutatorContext) {
+				if mctx.ModuleName() == "A" {
+					mctx.PruneVariant()
+				}
+			})
 		}
 
-		return group
+		_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+		if len(errs) == 0 {
+			_, errs = ctx.ResolveDependencies(nil)
+		}
+		if len(errs) > 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+		return ctx
 	}
 
-	tests := []struct {
-		name         string
-		possibleDeps *moduleGroup
-		variations   []Variation
-		far          bool
-		reverse      bool
-		want         string
-	}{
-		{
-			name: "AddVariationDependencies(nil)",
-			// A dependency that matches the non-local variations of the module
-			possibleDeps: makeDependencyGroup(
-				&moduleInfo{
-					variant: variant{
-						name: "normal",
-						variations: variationMap{
-							"normal": "normal",
-						},
-					},
-				},
-			),
-			variations: nil,
-			far:        false,
-			reverse:    false,
-			want:       "normal",
-		},
-		{
-			name: "AddVariationDependencies(nil) to alias",
-			// A dependency with an alias that matches the non-local variations of the module
-			possibleDeps: makeDependencyGroup(
-				alias{
-					variant: variant{
-						name: "normal",
-						variations: variationMap{
-							"normal": "normal",
-						},
-					},
-					target: 1,
-				},
-				&moduleInfo{
-					variant: variant{
-						name: "normal_a",
-						variations: variationMap{
-							"normal": "normal",
-							"a":      "a",
-						},
-					},
-				},
-			),
-			variations: nil,
-			far:        false,
-			reverse:    false,
-			want:       "normal_a",
+	created := func(ctx *Context) []Module {
+		var modules []Module
+		for _, name := range []string{"B", "C"} {
+			for _, moduleOrAlias := range ctx.moduleGroupFromName(name, nil).modules {
+				modules = append(modules, moduleOrAlias.module().logicModule)
+			}
+		}
+		return modules
+	}
+
+	t.Run("split", func(t *testing.T) {
+		ctx := run(t, false)
+		a := ctx.moduleGroupFromName("A", nil).moduleByVariantName("x").logicModule
+		for _, m := range created(ctx) {
+			creator, mutator, ok := ctx.ModuleCreator(m)
+			if !ok || creator != a || mutator != "create" {
+				t.Errorf("expected %s %q to be created by the first variant of A in mutator create, got %v %q %v",
+					ctx.ModuleName(m), ctx.ModuleVariantName(m), creator, mutator, ok)
+			}
+		}
+	})
+
+	t.Run("pruned", func(t *testing.T) {
+		ctx := run(t, true)
+		for _, m := range created(ctx) {
+			if creator, _, ok := ctx.ModuleCreator(m); ok {
+				t.Errorf("expected no creator for %s %q, got %v",
+					ctx.ModuleName(m), ctx.ModuleVariantName(m), creator)
+			}
+		}
+	})
+}
+
+func createTestMutator(ctx TopDownMutatorContext) {
+	type props struct {
+		Name string
+		Deps []string
+	}
+
+	ctx.CreateModule(newBarModule, "new_bar", &props{
+		Name: "B",
+		Deps: []string{"D"},
+	})
+
+	ctx.CreateModule(newBarModule, "new_bar", &props{
+		Name: "C",
+		Deps: []string{"D"},
+	})
+
+	ctx.CreateModule(newFooModule, "new_foo", &props{
+		Name: "D",
+	})
+}
+
+func TestModuleInitHook(t *testing.T) {
+	ctx := newContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			foo_module {
+				name: "A",
+				foo: "a",
+			}
+
+			foo_module {
+				name: "B",
+				deps: ["A"],
+			}
+
+			bar_module {
+				name: "C",
+			}
+		`),
+	})
+
+	ctx.RegisterModuleType("foo_module", newFooModule)
+	ctx.RegisterModuleType("bar_module", newBarModule)
+
+	var visited []string
+	ctx.RegisterModuleInitHook(func(mctx ModuleInitContext) {
+		visited = append(visited, mctx.ModuleType()+":"+mctx.ModuleName())
+		if foo, ok := mctx.Module().(*fooModule); ok && foo.properties.Foo == "" {
+			mctx.PropertyErrorf("foo", "must be set")
+		}
+	})
+	ctx.RegisterModuleInitHook(func(mctx ModuleInitContext) {
+		if mctx.BlueprintsFile() != "Android.bp" {
+			mctx.ModuleErrorf("unexpected Blueprints file %q", mctx.BlueprintsFile())
+		}
+	})
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+
+	expectedErrs := []string{
+		`Android.bp:7:4: module "B": foo: must be set`,
+	}
+	var actualErrs []string
+	for _, err := range errs {
+		actualErrs = append(actualErrs, err.Error())
+	}
+	if !reflect.DeepEqual(expectedErrs, actualErrs) {
+		t.Errorf("expected errors %q, got %q", expectedErrs, actualErrs)
+	}
+
+	expectedVisited := []string{"foo_module:A", "foo_module:B", "bar_module:C"}
+	if !reflect.DeepEqual(expectedVisited, visited) {
+		t.Errorf("expected hook to visit %q, got %q", expectedVisited, visited)
+	}
+}
+
+func TestWalkFileOrder(t *testing.T) {
+	// Run the test once to see how long it normally takes
+	start := time.Now()
+	doTestWalkFileOrder(t, time.Duration(0))
+	duration := time.Since(start)
+
+	// Run the test again, but put enough of a sleep into each visitor to detect ordering
+	// problems if they exist
+	doTestWalkFileOrder(t, duration)
+}
+
+// test that WalkBlueprintsFiles calls asyncVisitor in the right order
+func doTestWalkFileOrder(t *testing.T, sleepDuration time.Duration) {
+	// setup mock context
+	ctx := newContext()
+	mockFiles := map[string][]byte{
+		"Android.bp": []byte(`
+			sample_module {
+			    name: "a",
+			}
+		`),
+		"dir1/Android.bp": []byte(`
+			sample_module {
+			    name: "b",
+			}
+		`),
+		"dir1/dir2/Android.bp": []byte(`
+			sample_module {
+			    name: "c",
+			}
+		`),
+	}
+	ctx.MockFileSystem(mockFiles)
+
+	// prepare to monitor the visit order
+	visitOrder := []string{}
+	visitLock := sync.Mutex{}
+	correctVisitOrder := []string{"Android.bp", "dir1/Android.bp", "dir1/dir2/Android.bp"}
+
+	// sleep longer when processing the earlier files
+	chooseSleepDuration := func(fileName string) (duration time.Duration) {
+		duration = time.Duration(0)
+		for i := len(correctVisitOrder) - 1; i >= 0; i-- {
+			if fileName == correctVisitOrder[i] {
+				return duration
+			}
+			duration = duration + sleepDuration
+		}
+		panic("unrecognized file name " + fileName)
+	}
+
+	visitor := func(file *parser.File) {
+		time.Sleep(chooseSleepDuration(file.Name))
+		visitLock.Lock()
+		defer visitLock.Unlock()
+		visitOrder = append(visitOrder, file.Name)
+	}
+	keys := []string{"Android.bp", "dir1/Android.bp", "dir1/dir2/Android.bp"}
+
+	// visit the blueprints files
+	ctx.WalkBlueprintsFiles(".", keys, visitor)
+
+	// check the order
+	if !reflect.DeepEqual(visitOrder, correctVisitOrder) {
+		t.Errorf("Incorrect visit order; expected %v, got %v", correctVisitOrder, visitOrder)
+	}
+}
+
+// concurrentParseMockFiles returns a mock filesystem with numDirs Blueprints files that each define
+// two modules, and the names of the modules in the order they should be registered.
+func concurrentParseMockFiles(numDirs int) (map[string][]byte, []string) {
+	files := make(map[string][]byte)
+	var names []string
+	for i := 0; i < numDirs; i++ {
+		dir := fmt.Sprintf("dir%03d", i)
+		files[dir+"/Android.bp"] = []byte(fmt.Sprintf(`
+			foo_module {
+			    name: "%[1]s_b",
+			}
+			foo_module {
+			    name: "%[1]s_a",
+			}
+		`, dir))
+		names = append(names, dir+"_b", dir+"_a")
+	}
+	return files, names
+}
+
+func TestConcurrentParse(t *testing.T) {
+	for _, n := range []int{0, 1, 4} {
+		t.Run(strconv.Itoa(n), func(t *testing.T) {
+			// Parse several times, the files are listed in map iteration order and finish parsing
+			// in an order that depends on scheduling.
+			for i := 0; i < 10; i++ {
+				files, want := concurrentParseMockFiles(20)
+				ctx := NewContext()
+				ctx.SetConcurrentParse(n)
+				ctx.RegisterModuleType("foo_module", newFooModule)
+				ctx.MockFileSystem(files)
+
+				_, errs := ctx.ParseBlueprintsFiles(MockModuleListFile, nil)
+				if len(errs) > 0 {
+					t.Fatalf("unexpected parse errors: %v", errs)
+				}
+
+				var got []string
+				for _, group := range ctx.moduleGroups {
+					got = append(got, group.name)
+				}
+				if n == 0 {
+					// Without a limit the registration order is left as parsed.
+					sort.Strings(got)
+					sort.Strings(want)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("expected modules to be registered in order %q, got %q", want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestParseFileListCtxCanceled(t *testing.T) {
+	files, all := concurrentParseMockFiles(500)
+	ctx := NewContext()
+	ctx.SetConcurrentParse(1)
+	ctx.MockFileSystem(files)
+
+	goCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var created int32
+	ctx.RegisterModuleType("foo_module", func() (Module, []interface{}) {
+		// Cancel while the tenth module is being created.
+		if atomic.AddInt32(&created, 1) == 10 {
+			cancel()
+		}
+		return newFooModule()
+	})
+
+	paths, err := ctx.ListModulePaths(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, errs := ctx.ParseFileListCtx(goCtx, ".", paths, nil)
+	if len(errs) != 1 || !errors.Is(errs[0], ErrParseCanceled) {
+		t.Fatalf("expected only ErrParseCanceled, got %v", errs)
+	}
+	if n := len(ctx.moduleGroups); n >= len(all)/2 {
+		t.Errorf("expected parsing to stop early, but %d of %d modules were added", n, len(all))
+	}
+}
+
+func BenchmarkParseFileList(b *testing.B) {
+	for _, n := range []int{1, 4, 0} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			files, _ := concurrentParseMockFiles(500)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				ctx := NewContext()
+				ctx.SetConcurrentParse(n)
+				ctx.RegisterModuleType("foo_module", newFooModule)
+				ctx.MockFileSystem(files)
+				if _, errs := ctx.ParseBlueprintsFiles(MockModuleListFile, nil); len(errs) > 0 {
+					b.Fatalf("unexpected parse errors: %v", errs)
+				}
+			}
+		})
+	}
+}
+
+func TestListModulePathsGzip(t *testing.T) {
+	list := "Android.bp\ndir1/Android.bp\ndir1/dir2/Android.bp\n"
+
+	gzipped := &bytes.Buffer{}
+	w := gzip.NewWriter(gzipped)
+	if _, err := w.Write([]byte(list)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{
+		"Android.bp":       nil,
+		"list":             []byte(list),
+		"list.gz":          gzipped.Bytes(),
+		"list_without_ext": gzipped.Bytes(),
+		"corrupt.gz":       []byte(list),
+	}
+
+	listModulePaths := func(listFile string) ([]string, error) {
+		ctx := NewContext()
+		ctx.MockFileSystem(files)
+		ctx.SetModuleListFile(listFile)
+		return ctx.ListModulePaths("base")
+	}
+
+	want, err := listModulePaths("list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, w := want, []string{"base/Android.bp", "base/dir1/Android.bp", "base/dir1/dir2/Android.bp"}; !reflect.DeepEqual(g, w) {
+		t.Fatalf("expected paths %q, got %q", w, g)
+	}
+
+	for _, listFile := range []string{"list.gz", "list_without_ext"} {
+		got, err := listModulePaths(listFile)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", listFile, err)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected paths %q, got %q", listFile, want, got)
+		}
+	}
+
+	if _, err := listModulePaths("corrupt.gz"); err == nil {
+		t.Errorf("expected an error for a corrupt gzip module list file")
+	}
+}
+
+func TestSetBlueprintsFileNames(t *testing.T) {
+	list := "Android.bp\nBUILD.bp\ndir1/module.bp\ndir1/Blueprints\ndir2/BUILD.bp.bak\n"
+	files := map[string][]byte{
+		MockModuleListFile:  []byte(list),
+		"Android.bp":        []byte(`foo_module { name: "android" }`),
+		"BUILD.bp":          []byte(`foo_module { name: "build" }`),
+		"dir1/module.bp":    []byte(`foo_module { name: "module" }`),
+		"dir1/Blueprints":   []byte(`foo_module { name: "blueprints" }`),
+		"dir2/BUILD.bp.bak": []byte(`foo_module { name: "bak" }`),
+	}
+
+	t.Run("default", func(t *testing.T) {
+		ctx := NewContext()
+		ctx.MockFileSystem(files)
+		got, err := ctx.ListModulePaths(".")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"Android.bp", "BUILD.bp", "dir1/module.bp", "dir1/Blueprints", "dir2/BUILD.bp.bak"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected paths %q, got %q", want, got)
+		}
+	})
+
+	t.Run("configured", func(t *testing.T) {
+		ctx := NewContext()
+		ctx.RegisterModuleType("foo_module", newFooModule)
+		ctx.SetBlueprintsFileNames([]string{"BUILD.bp", "module.bp"})
+		ctx.MockFileSystem(files)
+
+		got, err := ctx.ListModulePaths(".")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"BUILD.bp", "dir1/module.bp"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("expected paths %q, got %q", want, got)
+		}
+
+		var walked []string
+		var walkedLock sync.Mutex
+		_, errs := ctx.WalkBlueprintsFiles(".", []string{"Android.bp", "BUILD.bp", "dir1/module.bp", "dir2/BUILD.bp.bak"},
+			func(file *parser.File) {
+				walkedLock.Lock()
+				defer walkedLock.Unlock()
+				walked = append(walked, file.Name)
+			})
+		if len(errs) > 0 {
+			t.Fatalf("unexpected walk errors: %v", errs)
+		}
+		sort.Strings(walked)
+		if want := []string{"BUILD.bp", "dir1/module.bp"}; !reflect.DeepEqual(walked, want) {
+			t.Errorf("expected to walk %q, got %q", want, walked)
+		}
+
+		_, errs = ctx.ParseBlueprintsFiles(MockModuleListFile, nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected parse errors: %v", errs)
+		}
+		var modules []string
+		for _, group := range ctx.moduleGroups {
+			modules = append(modules, group.name)
+		}
+		sort.Strings(modules)
+		if want := []string{"build", "module"}; !reflect.DeepEqual(modules, want) {
+			t.Errorf("expected modules %q, got %q", want, modules)
+		}
+	})
+}
+
+// test that WalkBlueprintsFiles reports syntax errors
+func TestWalkingWithSyntaxError(t *testing.T) {
+	// setup mock context
+	ctx := newContext()
+	mockFiles := map[string][]byte{
+		"Android.bp": []byte(`
+			sample_module {
+			    name: "a" "b",
+			}
+		`),
+		"dir1/Android.bp": []byte(`
+			sample_module {
+			    name: "b",
+		`),
+		"dir1/dir2/Android.bp": []byte(`
+			sample_module {
+			    name: "c",
+			}
+		`),
+	}
+	ctx.MockFileSystem(mockFiles)
+
+	keys := []string{"Android.bp", "dir1/Android.bp", "dir1/dir2/Android.bp"}
+
+	// visit the blueprints files
+	_, errs := ctx.WalkBlueprintsFiles(".", keys, func(file *parser.File) {})
+
+	expectedErrs := []error{
+		errors.New(`Android.bp:3:18: expected "}", found String`),
+		errors.New(`dir1/Android.bp:4:3: expected "}", found EOF`),
+	}
+	if fmt.Sprintf("%s", expectedErrs) != fmt.Sprintf("%s", errs) {
+		t.Errorf("Incorrect errors; expected:\n%s\ngot:\n%s", expectedErrs, errs)
+	}
+
+}
+
+func TestParseReaders(t *testing.T) {
+	t.Run("modules", func(t *testing.T) {
+		ctx := NewContext()
+		ctx.RegisterModuleType("foo_module", newFooModule)
+		ctx.RegisterModuleType("bar_module", newBarModule)
+		ctx.RegisterBottomUpMutator("deps", depsMutator)
+
+		deps, errs := ctx.ParseReaders(".", map[string]io.Reader{
+			"gen/Android.bp": strings.NewReader(`
+				foo_module {
+				    name: "A",
+				    deps: ["B"],
+				}
+			`),
+			"gen/dir/Android.bp": strings.NewReader(`
+				bar_module {
+				    name: "B",
+				}
+			`),
+		}, nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected parse errors: %v", errs)
+		}
+		if len(deps) > 0 {
+			t.Errorf("expected no deps, got %q", deps)
+		}
+		_, errs = ctx.ResolveDependencies(nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected dep errors: %v", errs)
+		}
+
+		b := ctx.moduleGroupFromName("B", nil).modules.firstModule().logicModule
+		if g, w := ctx.BlueprintFile(b), "gen/dir/Android.bp"; g != w {
+			t.Errorf("expected Blueprints file %q, got %q", w, g)
+		}
+	})
+
+	t.Run("syntax error", func(t *testing.T) {
+		ctx := newContext()
+		_, errs := ctx.ParseReaders(".", map[string]io.Reader{
+			"Android.bp": strings.NewReader(`
+			sample_module {
+			    name: "a" "b",
+			}
+		`),
+			"dir1/Android.bp": strings.NewReader(`
+			sample_module {
+			    name: "b",
+		`),
+		}, nil)
+
+		expectedErrs := []error{
+			errors.New(`Android.bp:3:18: expected "}", found String`),
+			errors.New(`dir1/Android.bp:4:3: expected "}", found EOF`),
+		}
+		if fmt.Sprintf("%s", expectedErrs) != fmt.Sprintf("%s", errs) {
+			t.Errorf("Incorrect errors; expected:\n%s\ngot:\n%s", expectedErrs, errs)
+		}
+	})
+}
+
+func TestParseFailsForModuleWithoutName(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			foo_module {
+			    name: "A",
+			}
+
+			bar_module {
+			    deps: ["A"],
+			}
+		`),
+	})
+	ctx.RegisterModuleType("foo_module", newFooModule)
+	ctx.RegisterModuleType("bar_module", newBarModule)
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+
+	expectedErrs := []error{
+		errors.New(`Android.bp:6:4: property 'name' is missing from a module`),
+	}
+	if fmt.Sprintf("%s", expectedErrs) != fmt.Sprintf("%s", errs) {
+		t.Errorf("Incorrect errors; expected:\n%s\ngot:\n%s", expectedErrs, errs)
+	}
+}
+
+func Test_findVariant(t *testing.T) {
+	module := &moduleInfo{
+		variant: variant{
+			name: "normal_local",
+			variations: variationMap{
+				"normal": "normal",
+				"local":  "local",
+			},
+			dependencyVariations: variationMap{
+				"normal": "normal",
+			},
+		},
+	}
+
+	type alias struct {
+		variant variant
+		target  int
+	}
+
+	makeDependencyGroup := func(in ...interface{}) *moduleGroup {
+		group := &moduleGroup{
+			name: "dep",
+		}
+		for _, x := range in {
+			switch m := x.(type) {
+			case *moduleInfo:
+				m.group = group
+				group.modules = append(group.modules, m)
+			case alias:
+				// aliases may need to target modules that haven't been processed
+				// yet, put an empty alias in for now.
+				group.modules = append(group.modules, nil)
+			default:
+				t.Fatalf("unexpected type %T", x)
+			}
+		}
+
+		for i, x := range in {
+			switch m := x.(type) {
+			case *moduleInfo:
+				// already added in the first pass
+			case alias:
+				group.modules[i] = &moduleAlias{
+					variant: m.variant,
+					target:  group.modules[m.target].moduleOrAliasTarget(),
+				}
+			default:
+				t.Fatalf("unexpected type %T", x)
+			}
+		}
+
+		return group
+	}
+
+	tests := []struct {
+		name         string
+		possibleDeps *moduleGroup
+		variations   []Variation
+		far          bool
+		closest      bool
+		reverse      bool
+		want         string
+	}{
+		{
+			name: "AddVariationDependencies(nil)",
+			// A dependency that matches the non-local variations of the module
+			possibleDeps: makeDependencyGroup(
+				&moduleInfo{
+					variant: variant{
+						name: "normal",
+						variations: variationMap{
+							"normal": "normal",
+						},
+					},
+				},
+			),
+			variations: nil,
+			far:        false,
+			reverse:    false,
+			want:       "normal",
+		},
+		{
+			name: "AddVariationDependencies(nil) to alias",
+			// A dependency with an alias that matches the non-local variations of the module
+			possibleDeps: makeDependencyGroup(
+				alias{
+					variant: variant{
+						name: "normal",
+						variations: variationMap{
+							"normal": "normal",
+						},
+					},
+					target: 1,
+				},
+				&moduleInfo{
+					variant: variant{
+						name: "normal_a",
+						variations: variationMap{
+							"normal": "normal",
+							"a":      "a",
+						},
+					},
+				},
+			),
+			variations: nil,
+			far:        false,
+			reverse:    false,
+			want:       "normal_a",
+		},
+		{
+			name: "AddVariationDependencies(a)",
+			// A dependency with local variations
+			possibleDeps: makeDependencyGroup(
+				&moduleInfo{
+					variant: variant{
+						name: "normal_a",
+						variations: variationMap{
+							"normal": "normal",
+							"a":      "a",
+						},
+					},
+				},
+			),
+			variations: []Variation{{"a", "a"}},
+			far:        false,
+			reverse:    false,
+			want:       "normal_a",
+		},
+		{
+			name: "AddFarVariationDependencies(far)",
+			// A dependency with far variations
+			possibleDeps: makeDependencyGroup(
+				&moduleInfo{
+					variant: variant{
+						name:       "",
+						variations: nil,
+					},
+				},
+				&moduleInfo{
+					variant: variant{
+						name: "far",
+						variations: variationMap{
+							"far": "far",
+						},
+					},
+				},
+			),
+			variations: []Variation{{"far", "far"}},
+			far:        true,
+			reverse:    false,
+			want:       "far",
+		},
+		{
+			name: "AddFarVariationDependencies(far) to alias",
+			// A dependency with far variations and aliases
+			possibleDeps: makeDependencyGroup(
+				alias{
+					variant: variant{
+						name: "far",
+						variations: variationMap{
+							"far": "far",
+						},
+					},
+					target: 2,
+				},
+				&moduleInfo{
+					variant: variant{
+						name: "far_a",
+						variations: variationMap{
+							"far": "far",
+							"a":   "a",
+						},
+					},
+				},
+				&moduleInfo{
+					variant: variant{
+						name: "far_b",
+						variations: variationMap{
+							"far": "far",
+							"b":   "b",
+						},
+					},
+				},
+			),
+			variations: []Variation{{"far", "far"}},
+			far:        true,
+			reverse:    false,
+			want:       "far_b",
+		},
+		{
+			name: "AddFarVariationDependencies(far, b) to missing",
+			// A dependency with far variations and aliases
+			possibleDeps: makeDependencyGroup(
+				alias{
+					variant: variant{
+						name: "far",
+						variations: variationMap{
+							"far": "far",
+						},
+					},
+					target: 1,
+				},
+				&moduleInfo{
+					variant: variant{
+						name: "far_a",
+						variations: variationMap{
+							"far": "far",
+							"a":   "a",
+						},
+					},
+				},
+			),
+			variations: []Variation{{"far", "far"}, {"a", "b"}},
+			far:        true,
+			reverse:    false,
+			want:       "nil",
+		},
+		{
+			name: "AddFarVariationDependencies(far) with several matches",
+			// The first of several dependencies with far variations
+			possibleDeps: makeDependencyGroup(
+				&moduleInfo{
+					variant: variant{
+						name: "far_a_b",
+						variations: variationMap{
+							"far": "far",
+							"a":   "a",
+							"b":   "b",
+						},
+					},
+				},
+				&moduleInfo{
+					variant: variant{
+						name: "far_a",
+						variations: variationMap{
+							"far": "far",
+							"a":   "a",
+						},
+					},
+				},
+			),
+			variations: []Variation{{"far", "far"}},
+			far:        true,
+			reverse:    false,
+			want:       "far_a_b",
+		},
+		{
+			name: "AddClosestFarVariationDependencies(far)",
+			// The dependency with the fewest other variations
+			possibleDeps: makeDependencyGroup(
+				&moduleInfo{
+					variant: variant{
+						name: "far_a_b",
+						variations: variationMap{
+							"far": "far",
+							"a":   "a",
+							"b":   "b",
+						},
+					},
+				},
+				&moduleInfo{
+					variant: variant{
+						name: "far_a",
+						variations: variationMap{
+							"far": "far",
+							"a":   "a",
+						},
+					},
+				},
+			),
+			variations: []Variation{{"far", "far"}},
+			far:        true,
+			closest:    true,
+			reverse:    false,
+			want:       "far_a",
+		},
+		{
+			name: "AddClosestFarVariationDependencies(far, b) to missing",
+			// A dependency without the requested far variations
+			possibleDeps: makeDependencyGroup(
+				&moduleInfo{
+					variant: variant{
+						name: "far_a",
+						variations: variationMap{
+							"far": "far",
+							"a":   "a",
+						},
+					},
+				},
+			),
+			variations: []Variation{{"far", "far"}, {"a", "b"}},
+			far:        true,
+			closest:    true,
+			reverse:    false,
+			want:       "nil",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *moduleInfo
+			if tt.closest {
+				got, _ = findClosestVariant(tt.possibleDeps, tt.variations)
+			} else {
+				got, _ = findVariant(module, tt.possibleDeps, tt.variations, tt.far, tt.reverse)
+			}
+			if g, w := got == nil, tt.want == "nil"; g != w {
+				t.Fatalf("findVariant() got = %v, want %v", got, tt.want)
+			}
+			if got != nil {
+				if g, w := got.String(), fmt.Sprintf("module %q variant %q", "dep", tt.want); g != w {
+					t.Errorf("findVariant() got = %v, want %v", g, w)
+				}
+			}
+		})
+	}
+}
+
+func Test_parallelVisit(t *testing.T) {
+	addDep := func(from, to *moduleInfo) {
+		from.directDeps = append(from.directDeps, depInfo{to, nil})
+		from.forwardDeps = append(from.forwardDeps, to)
+		to.reverseDeps = append(to.reverseDeps, from)
+	}
+
+	create := func(name string) *moduleInfo {
+		m := &moduleInfo{
+			group: &moduleGroup{
+				name: name,
+			},
+		}
+		m.group.modules = modulesOrAliases{m}
+		return m
+	}
+	moduleA := create("A")
+	moduleB := create("B")
+	moduleC := create("C")
+	moduleD := create("D")
+	moduleE := create("E")
+	moduleF := create("F")
+	moduleG := create("G")
+
+	// A depends on B, B depends on C.  Nothing depends on D through G, and they don't depend on
+	// anything.
+	addDep(moduleA, moduleB)
+	addDep(moduleB, moduleC)
+
+	t.Run("no modules", func(t *testing.T) {
+		errs := parallelVisit(nil, bottomUpVisitorImpl{}, 1,
+			func(module *moduleInfo, pause chan<- pauseSpec) bool {
+				panic("unexpected call to visitor")
+			})
+		if errs != nil {
+			t.Errorf("expected no errors, got %q", errs)
+		}
+	})
+	t.Run("bottom up", func(t *testing.T) {
+		order := ""
+		errs := parallelVisit([]*moduleInfo{moduleA, moduleB, moduleC}, bottomUpVisitorImpl{}, 1,
+			func(module *moduleInfo, pause chan<- pauseSpec) bool {
+				order += module.group.name
+				return false
+			})
+		if errs != nil {
+			t.Errorf("expected no errors, got %q", errs)
+		}
+		if g, w := order, "CBA"; g != w {
+			t.Errorf("expected order %q, got %q", w, g)
+		}
+	})
+	t.Run("pause", func(t *testing.T) {
+		order := ""
+		errs := parallelVisit([]*moduleInfo{moduleA, moduleB, moduleC, moduleD}, bottomUpVisitorImpl{}, 1,
+			func(module *moduleInfo, pause chan<- pauseSpec) bool {
+				if module == moduleC {
+					// Pause module C on module D
+					unpause := make(chan struct{})
+					pause <- pauseSpec{moduleC, moduleD, unpause}
+					<-unpause
+				}
+				order += module.group.name
+				return false
+			})
+		if errs != nil {
+			t.Errorf("expected no errors, got %q", errs)
+		}
+		if g, w := order, "DCBA"; g != w {
+			t.Errorf("expected order %q, got %q", w, g)
+		}
+	})
+	t.Run("cancel", func(t *testing.T) {
+		order := ""
+		errs := parallelVisit([]*moduleInfo{moduleA, moduleB, moduleC}, bottomUpVisitorImpl{}, 1,
+			func(module *moduleInfo, pause chan<- pauseSpec) bool {
+				order += module.group.name
+				// Cancel in module B
+				return module == moduleB
+			})
+		if errs != nil {
+			t.Errorf("expected no errors, got %q", errs)
+		}
+		if g, w := order, "CB"; g != w {
+			t.Errorf("expected order %q, got %q", w, g)
+		}
+	})
+	t.Run("pause and cancel", func(t *testing.T) {
+		order := ""
+		errs := parallelVisit([]*moduleInfo{moduleA, moduleB, moduleC, moduleD}, bottomUpVisitorImpl{}, 1,
+			func(module *moduleInfo, pause chan<- pauseSpec) bool {
+				if module == moduleC {
+					// Pause module C on module D
+					unpause := make(chan struct{})
+					pause <- pauseSpec{moduleC, moduleD, unpause}
+					<-unpause
+				}
+				order += module.group.name
+				// Cancel in module D
+				return module == moduleD
+			})
+		if errs != nil {
+			t.Errorf("expected no errors, got %q", errs)
+		}
+		if g, w := order, "D"; g != w {
+			t.Errorf("expected order %q, got %q", w, g)
+		}
+	})
+	t.Run("parallel", func(t *testing.T) {
+		order := ""
+		errs := parallelVisit([]*moduleInfo{moduleA, moduleB, moduleC}, bottomUpVisitorImpl{}, 3,
+			func(module *moduleInfo, pause chan<- pauseSpec) bool {
+				order += module.group.name
+				return false
+			})
+		if errs != nil {
+			t.Errorf("expected no errors, got %q", errs)
+		}
+		if g, w := order, "CBA"; g != w {
+			t.Errorf("expected order %q, got %q", w, g)
+		}
+	})
+	t.Run("pause existing", func(t *testing.T) {
+		order := ""
+		errs := parallelVisit([]*moduleInfo{moduleA, moduleB, moduleC}, bottomUpVisitorImpl{}, 3,
+			func(module *moduleInfo, pause chan<- pauseSpec) bool {
+				if module == moduleA {
+					// Pause module A on module B (an existing dependency)
+					unpause := make(chan struct{})
+					pause <- pauseSpec{moduleA, moduleB, unpause}
+					<-unpause
+				}
+				order += module.group.name
+				return false
+			})
+		if errs != nil {
+			t.Errorf("expected no errors, got %q", errs)
+		}
+		if g, w := order, "CBA"; g != w {
+			t.Errorf("expected order %q, got %q", w, g)
+		}
+	})
+	t.Run("cycle", func(t *testing.T) {
+		errs := parallelVisit([]*moduleInfo{moduleA, moduleB, moduleC}, bottomUpVisitorImpl{}, 3,
+			func(module *moduleInfo, pause chan<- pauseSpec) bool {
+				if module == moduleC {
+					// Pause module C on module A (a dependency cycle)
+					unpause := make(chan struct{})
+					pause <- pauseSpec{moduleC, moduleA, unpause}
+					<-unpause
+				}
+				return false
+			})
+		want := []string{
+			`encountered dependency cycle`,
+			`module "C" depends on module "A"`,
+			`module "A" depends on module "B"`,
+			`module "B" depends on module "C"`,
+		}
+		for i := range want {
+			if len(errs) <= i {
+				t.Errorf("missing error %s", want[i])
+			} else if !strings.Contains(errs[i].Error(), want[i]) {
+				t.Errorf("expected error %s, got %s", want[i], errs[i])
+			}
+		}
+		if len(errs) > len(want) {
+			for _, err := range errs[len(want):] {
+				t.Errorf("unexpected error %s", err.Error())
+			}
+		}
+	})
+	t.Run("pause cycle", func(t *testing.T) {
+		errs := parallelVisit([]*moduleInfo{moduleA, moduleB, moduleC, moduleD}, bottomUpVisitorImpl{}, 3,
+			func(module *moduleInfo, pause chan<- pauseSpec) bool {
+				if module == moduleC {
+					// Pause module C on module D
+					unpause := make(chan struct{})
+					pause <- pauseSpec{moduleC, moduleD, unpause}
+					<-unpause
+				}
+				if module == moduleD {
+					// Pause module D on module C (a pause cycle)
+					unpause := make(chan struct{})
+					pause <- pauseSpec{moduleD, moduleC, unpause}
+					<-unpause
+				}
+				return false
+			})
+		want := []string{
+			`encountered dependency cycle`,
+			`module "D" depends on module "C"`,
+			`module "C" depends on module "D"`,
+		}
+		for i := range want {
+			if len(errs) <= i {
+				t.Errorf("missing error %s", want[i])
+			} else if !strings.Contains(errs[i].Error(), want[i]) {
+				t.Errorf("expected error %s, got %s", want[i], errs[i])
+			}
+		}
+		if len(errs) > len(want) {
+			for _, err := range errs[len(want):] {
+				t.Errorf("unexpected error %s", err.Error())
+			}
+		}
+	})
+	t.Run("pause cycle with deps", func(t *testing.T) {
+		pauseDeps := map[*moduleInfo]*moduleInfo{
+			// F and G form a pause cycle
+			moduleF: moduleG,
+			moduleG: moduleF,
+			// D depends on E which depends on the pause cycle, making E the first alphabetical
+			// entry in pauseMap, which is not part of the cycle.
+			moduleD: moduleE,
+			moduleE: moduleF,
+		}
+		errs := parallelVisit([]*moduleInfo{moduleD, moduleE, moduleF, moduleG}, bottomUpVisitorImpl{}, 4,
+			func(module *moduleInfo, pause chan<- pauseSpec) bool {
+				if dep, ok := pauseDeps[module]; ok {
+					unpause := make(chan struct{})
+					pause <- pauseSpec{module, dep, unpause}
+					<-unpause
+				}
+				return false
+			})
+		want := []string{
+			`encountered dependency cycle`,
+			`module "G" depends on module "F"`,
+			`module "F" depends on module "G"`,
+		}
+		for i := range want {
+			if len(errs) <= i {
+				t.Errorf("missing error %s", want[i])
+			} else if !strings.Contains(errs[i].Error(), want[i]) {
+				t.Errorf("expected error %s, got %s", want[i], errs[i])
+			}
+		}
+		if len(errs) > len(want) {
+			for _, err := range errs[len(want):] {
+				t.Errorf("unexpected error %s", err.Error())
+			}
+		}
+	})
+	t.Run("tie-break", func(t *testing.T) {
+		createVariant := func(name, variant string) *moduleInfo {
+			m := create(name)
+			m.variant.name = variant
+			return m
+		}
+		modules := []*moduleInfo{
+			createVariant("Z", ""),
+			createVariant("Y", "b"),
+			createVariant("Y", "a"),
+			createVariant("X", ""),
+			moduleG,
+			moduleF,
+			moduleE,
+		}
+		rnd := rand.New(rand.NewSource(1))
+		for i := 0; i < 100; i++ {
+			rnd.Shuffle(len(modules), func(i, j int) { modules[i], modules[j] = modules[j], modules[i] })
+			var order []string
+			errs := parallelVisit(modules, bottomUpVisitorImpl{}, 1,
+				func(module *moduleInfo, pause chan<- pauseSpec) bool {
+					order = append(order, module.group.name+module.variant.name)
+					return false
+				})
+			if errs != nil {
+				t.Fatalf("expected no errors, got %q", errs)
+			}
+			if g, w := strings.Join(order, ","), "E,F,G,X,Ya,Yb,Z"; g != w {
+				t.Fatalf("expected order %q, got %q", w, g)
+			}
+		}
+	})
+	t.Run("deterministic pause cycle", func(t *testing.T) {
+		pauseDeps := map[*moduleInfo]*moduleInfo{
+			// D and E form a pause cycle, and so do F and G.
+			moduleD: moduleE,
+			moduleE: moduleD,
+			moduleF: moduleG,
+			moduleG: moduleF,
+		}
+		modules := []*moduleInfo{moduleG, moduleF, moduleE, moduleD}
+		rnd := rand.New(rand.NewSource(1))
+		var first string
+		for i := 0; i < 100; i++ {
+			rnd.Shuffle(len(modules), func(i, j int) { modules[i], modules[j] = modules[j], modules[i] })
+			errs := parallelVisit(modules, bottomUpVisitorImpl{}, 4,
+				func(module *moduleInfo, pause chan<- pauseSpec) bool {
+					unpause := make(chan struct{})
+					pause <- pauseSpec{module, pauseDeps[module], unpause}
+					<-unpause
+					return false
+				})
+			var msgs []string
+			for _, err := range errs {
+				msgs = append(msgs, err.Error())
+			}
+			got := strings.Join(msgs, "\n")
+			if i == 0 {
+				first = got
+				if !strings.Contains(got, `module "D" depends on module "E"`) {
+					t.Fatalf("expected the cycle between D and E to be reported, got:\n%s", got)
+				}
+			} else if got != first {
+				t.Fatalf("expected identical errors on every run, got:\n%s\nand:\n%s", first, got)
+			}
+		}
+	})
+	t.Run("pause cycle handler", func(t *testing.T) {
+		var cycles [][]string
+		onCycle := func(cycle []*moduleInfo) []error {
+			var names []string
+			for _, module := range dependencyCycleChain(cycle) {
+				names = append(names, module.group.name)
+			}
+			cycles = append(cycles, names)
+			return nil
+		}
+		order := ""
+		errs := parallelVisitWithCycleHandler([]*moduleInfo{moduleA, moduleB, moduleC}, bottomUpVisitorImpl{}, 3,
+			onCycle,
+			func(module *moduleInfo, pause chan<- pauseSpec) bool {
+				if module == moduleC {
+					// Pause module C on module A (a dependency cycle)
+					unpause := make(chan struct{})
+					pause <- pauseSpec{moduleC, moduleA, unpause}
+					<-unpause
+				}
+				order += module.group.name
+				return false
+			})
+		if errs != nil {
+			t.Errorf("expected no errors, got %q", errs)
+		}
+		if g, w := order, "CBA"; g != w {
+			t.Errorf("expected order %q, got %q", w, g)
+		}
+		if w := [][]string{{"A", "B", "C"}}; !reflect.DeepEqual(cycles, w) {
+			t.Errorf("expected cycles %q, got %q", w, cycles)
+		}
+	})
+}
+
+// concurrencyTracker records the maximum number of concurrent calls between enter and exit.
+type concurrencyTracker struct {
+	lock   sync.Mutex
+	active int
+	max    int
+}
+
+func (c *concurrencyTracker) enter() {
+	c.lock.Lock()
+	c.active++
+	if c.active > c.max {
+		c.max = c.active
+	}
+	c.lock.Unlock()
+}
+
+func (c *concurrencyTracker) exit() {
+	c.lock.Lock()
+	c.active--
+	c.lock.Unlock()
+}
+
+func TestSetParallelism(t *testing.T) {
+	const parallelism = 3
+
+	t.Run("parallelVisit", func(t *testing.T) {
+		var modules []*moduleInfo
+		for i := 0; i < 20; i++ {
+			m := &moduleInfo{group: &moduleGroup{name: strconv.Itoa(i)}}
+			m.group.modules = modulesOrAliases{m}
+			modules = append(modules, m)
+		}
+		tracker := &concurrencyTracker{}
+		errs := parallelVisit(modules, bottomUpVisitorImpl{}, parallelism,
+			func(module *moduleInfo, pause chan<- pauseSpec) bool {
+				tracker.enter()
+				defer tracker.exit()
+				time.Sleep(time.Millisecond)
+				return false
+			})
+		if errs != nil {
+			t.Errorf("expected no errors, got %q", errs)
+		}
+		if tracker.max > parallelism {
+			t.Errorf("expected at most %d concurrent visitors, got %d", parallelism, tracker.max)
+		}
+	})
+
+	t.Run("mutator", func(t *testing.T) {
+		var bp strings.Builder
+		for i := 0; i < 20; i++ {
+			fmt.Fprintf(&bp, "bar_module {\n    name: \"M%d\",\n}\n", i)
+		}
+		ctx := NewContext()
+		ctx.MockFileSystem(map[string][]byte{
+			"Android.bp": []byte(bp.String()),
+		})
+		ctx.RegisterModuleType("bar_module", newBarModule)
+		tracker := &concurrencyTracker{}
+		ctx.RegisterBottomUpMutator("track", func(ctx BottomUpMutatorContext) {
+			tracker.enter()
+			defer tracker.exit()
+			time.Sleep(time.Millisecond)
+		}).Parallel()
+		ctx.SetParallelism(parallelism)
+
+		_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected parse errors: %v", errs)
+		}
+		_, errs = ctx.ResolveDependencies(nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected dep errors: %v", errs)
+		}
+		if tracker.max > parallelism {
+			t.Errorf("expected at most %d concurrent visitors, got %d", parallelism, tracker.max)
+		}
+		if tracker.max < 2 {
+			t.Errorf("expected modules to be visited concurrently, got at most %d", tracker.max)
+		}
+	})
+}
+
+func TestDependencyCycleHandler(t *testing.T) {
+	bp := `
+		foo_module {
+		    name: "A",
+		    deps: ["B"],
+		}
+		foo_module {
+		    name: "B",
+		    deps: ["C"],
+		}
+		foo_module {
+		    name: "C",
+		    deps: ["A", "D"],
+		}
+		bar_module {
+		    name: "D",
+		}
+	`
+
+	run := func(t *testing.T, handler func(cycle []Module) error) (*Context, []error) {
+		ctx := NewContext()
+		ctx.MockFileSystem(map[string][]byte{
+			"Android.bp": []byte(bp),
+		})
+		ctx.RegisterModuleType("foo_module", newFooModule)
+		ctx.RegisterModuleType("bar_module", newBarModule)
+		ctx.RegisterBottomUpMutator("deps", depsMutator)
+		ctx.SetDependencyCycleHandler(handler)
+
+		_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected parse errors: %v", errs)
+		}
+		_, errs = ctx.ResolveDependencies(nil)
+		return ctx, errs
+	}
+
+	t.Run("break", func(t *testing.T) {
+		var cycles [][]string
+		ctx, errs := run(t, func(cycle []Module) error {
+			var names []string
+			for _, module := range cycle {
+				names = append(names, module.Name())
+			}
+			cycles = append(cycles, names)
+			return nil
+		})
+		if len(errs) > 0 {
+			t.Fatalf("unexpected dep errors: %v", errs)
+		}
+		if w := [][]string{{"A", "B", "C"}}; !reflect.DeepEqual(cycles, w) {
+			t.Errorf("expected cycles %q, got %q", w, cycles)
+		}
+
+		// The dependency of C on A closed the cycle and was removed.
+		c := ctx.moduleGroupFromName("C", nil).modules.firstModule().logicModule
+		var deps []string
+		ctx.VisitDirectDeps(c, func(dep Module) {
+			deps = append(deps, dep.Name())
+		})
+		if w := []string{"D"}; !reflect.DeepEqual(deps, w) {
+			t.Errorf("expected deps of C %q, got %q", w, deps)
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		_, errs := run(t, func(cycle []Module) error {
+			return fmt.Errorf("cycle of %d modules", len(cycle))
+		})
+		var msgs []string
+		for _, err := range errs {
+			msgs = append(msgs, err.Error())
+		}
+		want := []string{
+			`encountered dependency cycle`,
+			`depends on`,
+			`depends on`,
+			`depends on`,
+			`cycle of 3 modules`,
+		}
+		if len(msgs) != len(want) {
+			t.Fatalf("expected errors %q, got %q", want, msgs)
+		}
+		for i := range want {
+			if !strings.Contains(msgs[i], want[i]) {
+				t.Errorf("expected error %q, got %q", want[i], msgs[i])
+			}
+		}
+	})
+}
+
+func TestPackageIncludes(t *testing.T) {
+	dir1_foo_bp := `
+	blueprint_package_includes {
+		match_all: ["use_dir1"],
+	}
+	foo_module {
+		name: "foo",
+	}
+	`
+	dir2_foo_bp := `
+	blueprint_package_includes {
+		match_all: ["use_dir2"],
+	}
+	foo_module {
+		name: "foo",
+	}
+	`
+	mockFs := map[string][]byte{
+		"dir1/Android.bp": []byte(dir1_foo_bp),
+		"dir2/Android.bp": []byte(dir2_foo_bp),
+	}
+	testCases := []struct {
+		desc        string
+		includeTags []string
+		expectedDir string
+		expectedErr string
+	}{
+		{
+			desc:        "use_dir1 is set, use dir1 foo",
+			includeTags: []string{"use_dir1"},
+			expectedDir: "dir1",
+		},
+		{
+			desc:        "use_dir2 is set, use dir2 foo",
+			includeTags: []string{"use_dir2"},
+			expectedDir: "dir2",
+		},
+		{
+			desc:        "duplicate module error if both use_dir1 and use_dir2 are set",
+			includeTags: []string{"use_dir1", "use_dir2"},
+			expectedDir: "",
+			expectedErr: `module "foo" already defined`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctx := NewContext()
+			// Register mock FS
+			ctx.MockFileSystem(mockFs)
+			// Register module types
+			ctx.RegisterModuleType("foo_module", newFooModule)
+			RegisterPackageIncludesModuleType(ctx)
+			// Add include tags for test case
+			ctx.AddIncludeTags(tc.includeTags...)
+			// Run test
+			_, actualErrs := ctx.ParseFileList(".", []string{"dir1/Android.bp", "dir2/Android.bp"}, nil)
+			// Evaluate
+			if !strings.Contains(fmt.Sprintf("%s", actualErrs), fmt.Sprintf("%s", tc.expectedErr)) {
+				t.Errorf("Expected errors: %s, got errors: %s\n", tc.expectedErr, actualErrs)
+			}
+			if tc.expectedErr != "" {
+				return // expectedDir check not necessary
+			}
+			actualBpFile := ctx.moduleGroupFromName("foo", nil).modules.firstModule().relBlueprintsFile
+			if tc.expectedDir != filepath.Dir(actualBpFile) {
+				t.Errorf("Expected foo from %s, got %s\n", tc.expectedDir, filepath.Dir(actualBpFile))
+			}
+		})
+	}
+
+}
+
+func TestIncludeDecisions(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"dir2/Android.bp": []byte(`
+			blueprint_package_includes {
+			    match_all: ["use_dir2", "extra"],
+			}
+		`),
+		"dir1/Android.bp": []byte(`
+			blueprint_package_includes {
+			    match_all: ["use_dir1"],
+			}
+		`),
+		"dir3/Android.bp": []byte(`
+			foo_module {
+			    name: "foo",
+			}
+		`),
+	})
+	ctx.RegisterModuleType("foo_module", newFooModule)
+	RegisterPackageIncludesModuleType(ctx)
+	ctx.AddIncludeTags("use_dir1", "extra")
+
+	_, errs := ctx.ParseFileList(".", []string{"dir1/Android.bp", "dir2/Android.bp", "dir3/Android.bp"}, nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+
+	want := []IncludeDecision{
+		{
+			Dir:      "dir1",
+			Included: true,
+			MatchAll: []string{"use_dir1"},
+		},
+		{
+			Dir:      "dir2",
+			Included: false,
+			MatchAll: []string{"use_dir2", "extra"},
+			Missing:  []string{"use_dir2"},
+		},
+	}
+	if g := ctx.IncludeDecisions(); !reflect.DeepEqual(g, want) {
+		t.Errorf("expected include decisions %+v, got %+v", want, g)
+	}
+}
+
+func TestReachableUnderTags(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"dir1/Android.bp": []byte(`
+			foo_module {
+			    name: "A",
+			    deps: ["B", "C"],
+			}
+		`),
+		"dir2/Android.bp": []byte(`
+			blueprint_package_includes {
+			    match_all: ["feature"],
+			}
+			bar_module {
+			    name: "B",
+			    deps: ["D"],
+			}
+		`),
+		"dir3/Android.bp": []byte(`
+			bar_module {
+			    name: "C",
+			}
+			bar_module {
+			    name: "D",
+			}
+		`),
+	})
+	ctx.RegisterModuleType("foo_module", newFooModule)
+	ctx.RegisterModuleType("bar_module", newBarModule)
+	ctx.RegisterBottomUpMutator("deps", depsMutator)
+	RegisterPackageIncludesModuleType(ctx)
+	ctx.AddIncludeTags("feature")
+
+	_, errs := ctx.ParseFileList(".", []string{"dir1/Android.bp", "dir2/Android.bp", "dir3/Android.bp"}, nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected dep errors: %v", errs)
+	}
+
+	names := func(modules []Module) []string {
+		var ret []string
+		for _, m := range modules {
+			ret = append(ret, ctx.ModuleName(m))
+		}
+		return ret
+	}
+
+	if g, w := names(ctx.ReachableUnderTags("A", []string{"feature"})), []string{"A", "B", "D", "C"}; !reflect.DeepEqual(g, w) {
+		t.Errorf("expected %q with feature, got %q", w, g)
+	}
+	if g, w := names(ctx.ReachableUnderTags("A", nil)), []string{"A", "C"}; !reflect.DeepEqual(g, w) {
+		t.Errorf("expected %q without feature, got %q", w, g)
+	}
+	if g := ctx.ReachableUnderTags("B", nil); g != nil {
+		t.Errorf("expected excluded root to reach nothing, got %q", names(g))
+	}
+	if g := ctx.ReachableUnderTags("E", nil); g != nil {
+		t.Errorf("expected missing root to reach nothing, got %q", names(g))
+	}
+	if !ctx.ContainsIncludeTag("feature") {
+		t.Errorf("expected the include tags of the Context to be unchanged")
+	}
+}
+
+func TestDeduplicateOrderOnlyDeps(t *testing.T) {
+	fnvHash := func(s string) string {
+		hash := fnv.New64a()
+		hash.Write([]byte(s))
+		return strconv.FormatUint(hash.Sum64(), 16)
+	}
+	for _, indexed := range []bool{false, true} {
+		// dedup returns the name of the phony for the given deps, which is the index-th phony in the
+		// order of first use.
+		dedup := func(deps string, index int) string {
+			if indexed {
+				return fmt.Sprintf("dedup-%d", index)
+			}
+			return "dedup-" + fnvHash(deps)
+		}
+		testDeduplicateOrderOnlyDeps(t, indexed, dedup)
+	}
+}
+
+func testDeduplicateOrderOnlyDeps(t *testing.T, indexed bool, dedup func(deps string, index int) string) {
+	b := func(output string, inputs []string, orderOnlyDeps []string) *buildDef {
+		return &buildDef{
+			OutputStrings:    []string{output},
+			InputStrings:     inputs,
+			OrderOnlyStrings: orderOnlyDeps,
+		}
+	}
+	m := func(bs ...*buildDef) *moduleInfo {
+		return &moduleInfo{actionDefs: localBuildActions{buildDefs: bs}}
+	}
+	type testcase struct {
+		modules        []*moduleInfo
+		expectedPhonys []*buildDef
+		conversions    map[string][]string
+	}
+	testCases := []testcase{{
+		modules: []*moduleInfo{
+			m(b("A", nil, []string{"d"})),
+			m(b("B", nil, []string{"d"})),
+		},
+		expectedPhonys: []*buildDef{
+			b(dedup("d", 0), []string{"d"}, nil),
+		},
+		conversions: map[string][]string{
+			"A": []string{dedup("d", 0)},
+			"B": []string{dedup("d", 0)},
+		},
+	}, {
+		modules: []*moduleInfo{
+			m(b("A", nil, []string{"a"})),
+			m(b("B", nil, []string{"b"})),
+		},
+	}, {
+		modules: []*moduleInfo{
+			m(b("A", nil, []string{"a"})),
+			m(b("B", nil, []string{"b"})),
+			m(b("C", nil, []string{"a"})),
+		},
+		expectedPhonys: []*buildDef{b(dedup("a", 0), []string{"a"}, nil)},
+		conversions: map[string][]string{
+			"A": []string{dedup("a", 0)},
+			"B": []string{"b"},
+			"C": []string{dedup("a", 0)},
+		},
+	}, {
+		modules: []*moduleInfo{
+			m(b("A", nil, []string{"a", "b"}),
+				b("B", nil, []string{"a", "b"})),
+			m(b("C", nil, []string{"a", "c"}),
+				b("D", nil, []string{"a", "c"})),
+		},
+		expectedPhonys: []*buildDef{
+			b(dedup("ab", 0), []string{"a", "b"}, nil),
+			b(dedup("ac", 1), []string{"a", "c"}, nil)},
+		conversions: map[string][]string{
+			"A": []string{dedup("ab", 0)},
+			"B": []string{dedup("ab", 0)},
+			"C": []string{dedup("ac", 1)},
+			"D": []string{dedup("ac", 1)},
+		},
+	}}
+	for index, tc := range testCases {
+		t.Run(fmt.Sprintf("indexed=%v/TestCase-%d", indexed, index), func(t *testing.T) {
+			ctx := NewContext()
+			ctx.SetIndexedDedupPhonyNames(indexed)
+			actualPhonys := ctx.deduplicateOrderOnlyDeps(tc.modules)
+			if len(actualPhonys.variables) != 0 {
+				t.Errorf("No variables expected but found %v", actualPhonys.variables)
+			}
+			if len(actualPhonys.rules) != 0 {
+				t.Errorf("No rules expected but found %v", actualPhonys.rules)
+			}
+			if e, a := len(tc.expectedPhonys), len(actualPhonys.buildDefs); e != a {
+				t.Errorf("Expected %d build statements but got %d", e, a)
+			}
+			for i := 0; i < len(tc.expectedPhonys); i++ {
+				a := actualPhonys.buildDefs[i]
+				e := tc.expectedPhonys[i]
+				if !reflect.DeepEqual(e.Outputs, a.Outputs) {
+					t.Errorf("phonys expected %v but actualPhonys %v", e.Outputs, a.Outputs)
+				}
+				if !reflect.DeepEqual(e.Inputs, a.Inputs) {
+					t.Errorf("phonys expected %v but actualPhonys %v", e.Inputs, a.Inputs)
+				}
+				if indexed && !reflect.DeepEqual(e.OutputStrings, a.OutputStrings) {
+					t.Errorf("phonys expected %v but actualPhonys %v", e.OutputStrings, a.OutputStrings)
+				}
+			}
+			find := func(k string) *buildDef {
+				for _, m := range tc.modules {
+					for _, b := range m.actionDefs.buildDefs {
+						if reflect.DeepEqual(b.OutputStrings, []string{k}) {
+							return b
+						}
+					}
+				}
+				return nil
+			}
+			for k, conversion := range tc.conversions {
+				actual := find(k)
+				if actual == nil {
+					t.Errorf("Couldn't find %s", k)
+				}
+				if !reflect.DeepEqual(actual.OrderOnlyStrings, conversion) {
+					t.Errorf("expected %s.OrderOnly = %v but got %v", k, conversion, actual.OrderOnly)
+				}
+			}
+		})
+	}
+}
+
+func TestSourceRootDirAllowed(t *testing.T) {
+	type pathCase struct {
+		path           string
+		decidingPrefix string
+		allowed        bool
+	}
+	testcases := []struct {
+		desc      string
+		rootDirs  []string
+		pathCases []pathCase
+	}{
+		{
+			desc: "simple case",
+			rootDirs: []string{
+				"a",
+				"b/c/d",
+				"-c",
+				"-d/c/a",
+				"c/some_single_file",
+			},
+			pathCases: []pathCase{
+				{
+					path:           "a",
+					decidingPrefix: "a",
+					allowed:        true,
+				},
+				{
+					path:           "a/b/c",
+					decidingPrefix: "a",
+					allowed:        true,
+				},
+				{
+					path:           "b",
+					decidingPrefix: "",
+					allowed:        true,
+				},
+				{
+					path:           "b/c/d/a",
+					decidingPrefix: "b/c/d",
+					allowed:        true,
+				},
+				{
+					path:           "c",
+					decidingPrefix: "c",
+					allowed:        false,
+				},
+				{
+					path:           "c/a/b",
+					decidingPrefix: "c",
+					allowed:        false,
+				},
+				{
+					path:           "c/some_single_file",
+					decidingPrefix: "c/some_single_file",
+					allowed:        true,
+				},
+				{
+					path:           "d/c/a/abc",
+					decidingPrefix: "d/c/a",
+					allowed:        false,
+				},
+			},
+		},
+		{
+			desc: "root directory order matters",
+			rootDirs: []string{
+				"-a",
+				"a/c/some_allowed_file",
+				"a/b/d/some_allowed_file",
+				"a/b",
+				"a/c",
+				"-a/b/d",
+			},
+			pathCases: []pathCase{
+				{
+					path:           "a",
+					decidingPrefix: "a",
+					allowed:        false,
+				},
+				{
+					path:           "a/some_disallowed_file",
+					decidingPrefix: "a",
+					allowed:        false,
+				},
+				{
+					path:           "a/c/some_allowed_file",
+					decidingPrefix: "a/c/some_allowed_file",
+					allowed:        true,
+				},
+				{
+					path:           "a/b/d/some_allowed_file",
+					decidingPrefix: "a/b/d/some_allowed_file",
+					allowed:        true,
+				},
+				{
+					path:           "a/b/c",
+					decidingPrefix: "a/b",
+					allowed:        true,
+				},
+				{
+					path:           "a/b/c/some_allowed_file",
+					decidingPrefix: "a/b",
+					allowed:        true,
+				},
+				{
+					path:           "a/b/d",
+					decidingPrefix: "a/b/d",
+					allowed:        false,
+				},
+			},
+		},
+		{
+			desc: "wildcard segments",
+			rootDirs: []string{
+				"-vendor/*/tests",
+				"vendor/allowed/tests",
+				"-*/internal",
+				"vendor/*",
+			},
+			pathCases: []pathCase{
+				{
+					path:           "vendor/foo",
+					decidingPrefix: "vendor/*",
+					allowed:        true,
+				},
+				{
+					path:           "vendor/foo/tests",
+					decidingPrefix: "vendor/*/tests",
+					allowed:        false,
+				},
+				{
+					path:           "vendor/foo/tests/bar",
+					decidingPrefix: "vendor/*/tests",
+					allowed:        false,
+				},
+				{
+					path:           "vendor/foo/testsuite",
+					decidingPrefix: "vendor/*/tests",
+					allowed:        false,
+				},
+				{
+					path:           "vendor/foo/bar/tests",
+					decidingPrefix: "vendor/*",
+					allowed:        true,
+				},
+				{
+					path:           "vendor/allowed/tests",
+					decidingPrefix: "vendor/allowed/tests",
+					allowed:        true,
+				},
+				{
+					path:           "device/internal/foo",
+					decidingPrefix: "*/internal",
+					allowed:        false,
+				},
+				{
+					path:           "internal",
+					decidingPrefix: "",
+					allowed:        true,
+				},
+				{
+					path:           "vendor",
+					decidingPrefix: "",
+					allowed:        true,
+				},
+			},
+		},
+	}
+	for _, tc := range testcases {
+		dirs := SourceRootDirs{}
+		dirs.Add(tc.rootDirs...)
+		for _, pc := range tc.pathCases {
+			t.Run(fmt.Sprintf("%s: %s", tc.desc, pc.path), func(t *testing.T) {
+				allowed, decidingPrefix := dirs.SourceRootDirAllowed(pc.path)
+				if allowed != pc.allowed {
+					if pc.allowed {
+						t.Errorf("expected path %q to be allowed, but was not; root allowlist: %q", pc.path, tc.rootDirs)
+					} else {
+						t.Errorf("path %q was allowed unexpectedly; root allowlist: %q", pc.path, tc.rootDirs)
+					}
+				}
+				if decidingPrefix != pc.decidingPrefix {
+					t.Errorf("expected decidingPrefix to be %q, but got %q", pc.decidingPrefix, decidingPrefix)
+				}
+			})
+		}
+	}
+}
+
+func TestSourceRootDirs(t *testing.T) {
+	root_foo_bp := `
+	foo_module {
+		name: "foo",
+		deps: ["foo_dir1", "foo_dir_ignored_special_case"],
+	}
+	`
+	dir1_foo_bp := `
+	foo_module {
+		name: "foo_dir1",
+		deps: ["foo_dir_ignored"],
+	}
+	`
+	dir_ignored_foo_bp := `
+	foo_module {
+		name: "foo_dir_ignored",
+	}
+	`
+	dir_ignored_special_case_foo_bp := `
+	foo_module {
+		name: "foo_dir_ignored_special_case",
+	}
+	`
+	mockFs := map[string][]byte{
+		"Android.bp":                          []byte(root_foo_bp),
+		"dir1/Android.bp":                     []byte(dir1_foo_bp),
+		"dir_ignored/Android.bp":              []byte(dir_ignored_foo_bp),
+		"dir_ignored/special_case/Android.bp": []byte(dir_ignored_special_case_foo_bp),
+	}
+	fileList := []string{}
+	for f := range mockFs {
+		fileList = append(fileList, f)
+	}
+	testCases := []struct {
+		sourceRootDirs       []string
+		expectedModuleDefs   []string
+		unexpectedModuleDefs []string
+		expectedErrs         []string
+	}{
+		{
+			sourceRootDirs: []string{},
+			expectedModuleDefs: []string{
+				"foo",
+				"foo_dir1",
+				"foo_dir_ignored",
+				"foo_dir_ignored_special_case",
+			},
+		},
+		{
+			sourceRootDirs: []string{"-", ""},
+			unexpectedModuleDefs: []string{
+				"foo",
+				"foo_dir1",
+				"foo_dir_ignored",
+				"foo_dir_ignored_special_case",
+			},
+		},
+		{
+			sourceRootDirs: []string{"-"},
+			unexpectedModuleDefs: []string{
+				"foo",
+				"foo_dir1",
+				"foo_dir_ignored",
+				"foo_dir_ignored_special_case",
+			},
+		},
+		{
+			sourceRootDirs: []string{"dir1"},
+			expectedModuleDefs: []string{
+				"foo",
+				"foo_dir1",
+				"foo_dir_ignored",
+				"foo_dir_ignored_special_case",
+			},
 		},
 		{
-			name: "AddVariationDependencies(a)",
-			// A dependency with local variations
-			possibleDeps: makeDependencyGroup(
-				&moduleInfo{
-					variant: variant{
-						name: "normal_a",
-						variations: variationMap{
-							"normal": "normal",
-							"a":      "a",
-						},
-					},
-				},
-			),
-			variations: []Variation{{"a", "a"}},
-			far:        false,
-			reverse:    false,
-			want:       "normal_a",
+			sourceRootDirs: []string{"-dir1"},
+			expectedModuleDefs: []string{
+				"foo",
+				"foo_dir_ignored",
+				"foo_dir_ignored_special_case",
+			},
+			unexpectedModuleDefs: []string{
+				"foo_dir1",
+			},
+			expectedErrs: []string{
+				`Android.bp:2:2: module "foo" depends on skipped module "foo_dir1"; "foo_dir1" was defined in files(s) [dir1/Android.bp], but was skipped for reason(s) ["dir1/Android.bp" is a descendant of "dir1", and that path prefix was not included in PRODUCT_SOURCE_ROOT_DIRS]; dependency path: foo -> foo_dir1`,
+			},
 		},
 		{
-			name: "AddFarVariationDependencies(far)",
-			// A dependency with far variations
-			possibleDeps: makeDependencyGroup(
-				&moduleInfo{
-					variant: variant{
-						name:       "",
-						variations: nil,
-					},
-				},
-				&moduleInfo{
-					variant: variant{
-						name: "far",
-						variations: variationMap{
-							"far": "far",
-						},
-					},
-				},
-			),
-			variations: []Variation{{"far", "far"}},
-			far:        true,
-			reverse:    false,
-			want:       "far",
+			sourceRootDirs: []string{"-", "dir1"},
+			expectedModuleDefs: []string{
+				"foo_dir1",
+			},
+			unexpectedModuleDefs: []string{
+				"foo",
+				"foo_dir_ignored",
+				"foo_dir_ignored_special_case",
+			},
+			expectedErrs: []string{
+				`dir1/Android.bp:2:2: module "foo_dir1" depends on skipped module "foo_dir_ignored"; "foo_dir_ignored" was defined in files(s) [dir_ignored/Android.bp], but was skipped for reason(s) ["dir_ignored/Android.bp" is a descendant of "", and that path prefix was not included in PRODUCT_SOURCE_ROOT_DIRS]; dependency path: foo_dir1 -> foo_dir_ignored`,
+			},
 		},
 		{
-			name: "AddFarVariationDependencies(far) to alias",
-			// A dependency with far variations and aliases
-			possibleDeps: makeDependencyGroup(
-				alias{
-					variant: variant{
-						name: "far",
-						variations: variationMap{
-							"far": "far",
-						},
-					},
-					target: 2,
-				},
-				&moduleInfo{
-					variant: variant{
-						name: "far_a",
-						variations: variationMap{
-							"far": "far",
-							"a":   "a",
-						},
-					},
-				},
-				&moduleInfo{
-					variant: variant{
-						name: "far_b",
-						variations: variationMap{
-							"far": "far",
-							"b":   "b",
-						},
-					},
-				},
-			),
-			variations: []Variation{{"far", "far"}},
-			far:        true,
-			reverse:    false,
-			want:       "far_b",
+			sourceRootDirs: []string{"-", "dir1", "dir_ignored/special_case/Android.bp"},
+			expectedModuleDefs: []string{
+				"foo_dir1",
+				"foo_dir_ignored_special_case",
+			},
+			unexpectedModuleDefs: []string{
+				"foo",
+				"foo_dir_ignored",
+			},
+			expectedErrs: []string{
+				"dir1/Android.bp:2:2: module \"foo_dir1\" depends on skipped module \"foo_dir_ignored\"; \"foo_dir_ignored\" was defined in files(s) [dir_ignored/Android.bp], but was skipped for reason(s) [\"dir_ignored/Android.bp\" is a descendant of \"\", and that path prefix was not included in PRODUCT_SOURCE_ROOT_DIRS]; dependency path: foo_dir1 -> foo_dir_ignored",
+			},
 		},
 		{
-			name: "AddFarVariationDependencies(far, b) to missing",
-			// A dependency with far variations and aliases
-			possibleDeps: makeDependencyGroup(
-				alias{
-					variant: variant{
-						name: "far",
-						variations: variationMap{
-							"far": "far",
-						},
-					},
-					target: 1,
-				},
-				&moduleInfo{
-					variant: variant{
-						name: "far_a",
-						variations: variationMap{
-							"far": "far",
-							"a":   "a",
-						},
-					},
-				},
-			),
-			variations: []Variation{{"far", "far"}, {"a", "b"}},
-			far:        true,
-			reverse:    false,
-			want:       "nil",
+			sourceRootDirs: []string{"-dir_ignored", "dir_ignored/special_case"},
+			expectedModuleDefs: []string{
+				"foo",
+				"foo_dir1",
+				"foo_dir_ignored_special_case",
+			},
+			unexpectedModuleDefs: []string{
+				"foo_dir_ignored",
+			},
+			expectedErrs: []string{
+				`dir1/Android.bp:2:2: module "foo_dir1" depends on skipped module "foo_dir_ignored"; "foo_dir_ignored" was defined in files(s) [dir_ignored/Android.bp], but was skipped for reason(s) ["dir_ignored/Android.bp" is a descendant of "dir_ignored", and that path prefix was not included in PRODUCT_SOURCE_ROOT_DIRS]; dependency path: foo -> foo_dir1 -> foo_dir_ignored`,
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf(`source root dirs are %q`, tc.sourceRootDirs), func(t *testing.T) {
+			ctx := NewContext()
+			ctx.MockFileSystem(mockFs)
+			ctx.RegisterModuleType("foo_module", newFooModule)
+			ctx.RegisterBottomUpMutator("deps", depsMutator)
+			ctx.AddSourceRootDirs(tc.sourceRootDirs...)
+			RegisterPackageIncludesModuleType(ctx)
+			ctx.ParseFileList(".", fileList, nil)
+			_, actualErrs := ctx.ResolveDependencies(nil)
+
+			stringErrs := []string(nil)
+			for _, err := range actualErrs {
+				stringErrs = append(stringErrs, err.Error())
+			}
+			if !reflect.DeepEqual(tc.expectedErrs, stringErrs) {
+				t.Errorf("expected to find errors %v; got %v", tc.expectedErrs, stringErrs)
+			}
+			for _, modName := range tc.expectedModuleDefs {
+				allMods := ctx.moduleGroupFromName(modName, nil)
+				if allMods == nil || len(allMods.modules) != 1 {
+					mods := modulesOrAliases{}
+					if allMods != nil {
+						mods = allMods.modules
+					}
+					t.Errorf("expected to find one definition for module %q, but got %v", modName, mods)
+				}
+			}
+
+			for _, modName := range tc.unexpectedModuleDefs {
+				allMods := ctx.moduleGroupFromName(modName, nil)
+				if allMods != nil {
+					t.Errorf("expected to find no definitions for module %q, but got %v", modName, allMods.modules)
+				}
+			}
+		})
+	}
+}
+
+func TestWorkingDirForCommands(t *testing.T) {
+	def, err := parseRuleParams(makeRuleScope(nil, nil), &RuleParams{
+		Command:     "echo $in > $out",
+		Description: "echo $out",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := NewContext()
+	ctx.SetWorkingDirForCommands("/src/my dir")
+
+	buf := &strings.Builder{}
+	if err := ctx.ruleDefForWrite(def).WriteTo(newNinjaWriter(buf), "r", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "rule r\n" +
+		"    command = cd '/src/my dir' && echo ${in_wd} > ${out_wd}\n" +
+		"    description = echo ${out}\n"
+	if buf.String() != expected {
+		t.Errorf("incorrect rule\nexpected: %q\n     got: %q", expected, buf.String())
+	}
+
+	if def.Variables["command"].Value(nil) != "echo ${in} > ${out}" {
+		t.Errorf("original rule was modified: %q", def.Variables["command"].Value(nil))
+	}
+
+	testCases := []struct {
+		srcDir, dir string
+		valid       bool
+	}{
+		{dir: "", valid: true},
+		{dir: "sub/dir", valid: true},
+		{dir: "../sub", valid: false},
+		{dir: "sub/../dir", valid: false},
+		{srcDir: "/src", dir: "/src/sub", valid: true},
+		{srcDir: "/src", dir: "/other", valid: false},
+	}
+	for _, tc := range testCases {
+		ctx := NewContext()
+		ctx.srcDir = tc.srcDir
+		ctx.SetWorkingDirForCommands(tc.dir)
+		if err := ctx.validateWorkingDirForCommands(); (err == nil) != tc.valid {
+			t.Errorf("srcDir %q dir %q: expected valid=%v, got error %v", tc.srcDir, tc.dir, tc.valid, err)
+		}
+	}
+}
+
+var (
+	workingDirTestPctx = NewPackageContext("github.com/google/blueprint/working_dir_test")
+
+	workingDirTestCcRule = workingDirTestPctx.StaticRule("cc",
+		RuleParams{
+			Command: "cc -MD -MF $out.d -o $out $in",
+			Depfile: "$out.d",
+			Deps:    DepsGCC,
+		})
+
+	workingDirTestLinkRule = workingDirTestPctx.StaticRule("link",
+		RuleParams{
+			Command:        "ld -o $out @$out.rsp",
+			Rspfile:        "$out.rsp",
+			RspfileContent: "$in",
+		})
+)
+
+type workingDirTestModule struct {
+	SimpleName
+	properties struct {
+		Link bool
+	}
+}
+
+func newWorkingDirTestModule() (Module, []interface{}) {
+	m := &workingDirTestModule{}
+	return m, []interface{}{&m.SimpleName.Properties, &m.properties}
+}
+
+func (m *workingDirTestModule) GenerateBuildActions(ctx ModuleContext) {
+	rule := workingDirTestCcRule
+	if m.properties.Link {
+		rule = workingDirTestLinkRule
+	}
+	ctx.Build(workingDirTestPctx, BuildParams{
+		Rule:    rule,
+		Outputs: []string{ctx.ModuleName() + ".out"},
+		Inputs:  []string{ctx.ModuleName() + ".in", "/abs/" + ctx.ModuleName() + ".in"},
+	})
+}
+
+func TestWorkingDirForCommandsPaths(t *testing.T) {
+	run := func(t *testing.T, outDir string) (*Context, []error) {
+		t.Helper()
+		ctx := NewContext()
+		ctx.SetSrcDir("/src")
+		ctx.RegisterModuleType("test", newWorkingDirTestModule)
+		ctx.RegisterSingletonType("out_dir", func() Singleton {
+			return funcSingleton(func(sctx SingletonContext) {
+				sctx.SetOutDir(workingDirTestPctx, outDir)
+			})
+		}, false)
+		ctx.SetWorkingDirForCommands("sub")
+		ctx.MockFileSystem(map[string][]byte{
+			"Android.bp": []byte(`
+				test {
+				    name: "foo",
+				}
+				test {
+				    name: "bar",
+				    link: true,
+				}
+			`),
+		})
+
+		_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected parse errors: %v", errs)
+		}
+		_, errs = ctx.ResolveDependencies(nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected dep errors: %v", errs)
+		}
+		_, errs = ctx.PrepareBuildActions(nil)
+		return ctx, errs
+	}
+
+	t.Run("depfile and rspfile", func(t *testing.T) {
+		ctx, errs := run(t, "out")
+		if len(errs) > 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+
+		buf := &strings.Builder{}
+		if err := ctx.WriteBuildFile(buf); err != nil {
+			t.Fatal(err)
+		}
+		out := buf.String()
+
+		// Ninja reads the depfile and writes the rspfile at the paths relative to the directory it
+		// runs in, the command refers to the same files with absolute paths after the cd.
+		for _, want := range []string{
+			"    command = cd sub && cc -MD -MF ${out_wd}.d -o ${out_wd} ${in_wd}\n" +
+				"    depfile = ${out}.d\n",
+			"    command = cd sub && ld -o ${out_wd} @${out_wd}.rsp\n",
+			"    rspfile = ${out}.rsp\n" +
+				"    rspfile_content = ${in_wd}\n",
+			"build foo.out: g.working_dir_test.cc foo.in /abs/foo.in\n" +
+				"    in_wd = /src/foo.in /abs/foo.in\n" +
+				"    out_wd = /src/foo.out\n",
+			"build bar.out: g.working_dir_test.link bar.in /abs/bar.in\n" +
+				"    in_wd = /src/bar.in /abs/bar.in\n" +
+				"    out_wd = /src/bar.out\n",
+		} {
+			if !strings.Contains(out, want) {
+				t.Errorf("expected %q in:\n%s", want, out)
+			}
+		}
+	})
+
+	t.Run("inside build dir", func(t *testing.T) {
+		_, errs := run(t, "sub")
+		expected := `working directory for commands "sub" is inside the build directory "sub"`
+		if len(errs) != 1 || errs[0].Error() != expected {
+			t.Errorf("expected error %q, got %v", expected, errs)
+		}
+	})
+}
+
+var (
+	restatTestPctx = NewPackageContext("github.com/google/blueprint/restat_test")
+
+	_ = restatTestPctx.StaticVariable("globCmd", "out/bin/bpglob")
+
+	restatTestGlobRule = restatTestPctx.StaticRule("glob",
+		RuleParams{
+			Command: "$globCmd -o $out $args",
+			Restat:  true,
 		},
+		"args")
+
+	restatTestCopyRule = restatTestPctx.StaticRule("copy",
+		RuleParams{
+			Command: "cp $in $out",
+			Restat:  true,
+		})
+)
+
+type restatTestModule struct {
+	SimpleName
+}
+
+func newRestatTestModule() (Module, []interface{}) {
+	m := &restatTestModule{}
+	return m, []interface{}{&m.SimpleName.Properties}
+}
+
+func (m *restatTestModule) GenerateBuildActions(ctx ModuleContext) {
+	ctx.Variable(restatTestPctx, "tool", "out/bin/gen")
+	writeIfChanged := ctx.Rule(restatTestPctx, "write_if_changed", RuleParams{
+		Command: "$tool > $out.tmp && if cmp -s $out.tmp $out; then rm $out.tmp; else mv $out.tmp $out; fi",
+		Restat:  true,
+	})
+	alwaysWrite := ctx.Rule(restatTestPctx, "always_write", RuleParams{
+		Command: "$tool > $out",
+		Restat:  true,
+	})
+	notRestat := ctx.Rule(restatTestPctx, "not_restat", RuleParams{
+		Command: "echo > $out",
+	})
+
+	for i, rule := range []Rule{restatTestGlobRule, restatTestCopyRule, writeIfChanged, alwaysWrite, notRestat} {
+		ctx.Build(restatTestPctx, BuildParams{
+			Rule:    rule,
+			Outputs: []string{fmt.Sprintf("out%d", i)},
+			Inputs:  []string{"in"},
+		})
 	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got, _ := findVariant(module, tt.possibleDeps, tt.variations, tt.far, tt.reverse)
-			if g, w := got == nil, tt.want == "nil"; g != w {
-				t.Fatalf("findVariant() got = %v, want %v", got, tt.want)
+}
+
+func TestWarnOnIneffectiveRestat(t *testing.T) {
+	ctx := NewContext()
+	ctx.RegisterModuleType("test", newRestatTestModule)
+	ctx.SetWarnOnIneffectiveRestat(true)
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			test {
+			    name: "foo",
+			}
+		`),
+	})
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected dep errors: %v", errs)
+	}
+	_, errs = ctx.PrepareBuildActions(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected build action errors: %v", errs)
+	}
+
+	var got []string
+	for _, w := range ctx.Warnings() {
+		got = append(got, w.Error())
+	}
+	want := []string{
+		"rule g.restat_test.copy sets restat but its command always rewrites its outputs: cp ${in} ${out}",
+		"rule m.foo_.always_write sets restat but its command always rewrites its outputs: out/bin/gen > ${out}",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted warnings %q, got %q", want, got)
+	}
+}
+
+type noCacheTestModule struct {
+	SimpleName
+}
+
+func newNoCacheTestModule() (Module, []interface{}) {
+	m := &noCacheTestModule{}
+	return m, []interface{}{&m.SimpleName.Properties}
+}
+
+func (m *noCacheTestModule) GenerateBuildActions(ctx ModuleContext) {
+	ctx.Build(restatTestPctx, BuildParams{
+		Rule:    restatTestCopyRule,
+		Outputs: []string{"cached"},
+		Inputs:  []string{"in"},
+	})
+	ctx.Build(restatTestPctx, BuildParams{
+		Rule:    restatTestCopyRule,
+		Outputs: []string{"scratch"},
+		Inputs:  []string{"in"},
+		NoCache: true,
+	})
+}
+
+func TestNoCacheInJSONActions(t *testing.T) {
+	ctx := NewContext()
+	ctx.RegisterModuleType("test", newNoCacheTestModule)
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			test {
+			    name: "foo",
+			}
+		`),
+	})
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected dep errors: %v", errs)
+	}
+	_, errs = ctx.PrepareBuildActions(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected build action errors: %v", errs)
+	}
+
+	graph, actions := &bytes.Buffer{}, &bytes.Buffer{}
+	ctx.PrintJSONGraphAndActions(graph, actions)
+
+	var modules []struct {
+		Module struct {
+			Actions []JSONAction
+		}
+	}
+	if err := json.Unmarshal(actions.Bytes(), &modules); err != nil {
+		t.Fatal(err)
+	}
+	if len(modules) != 1 {
+		t.Fatalf("expected 1 module, got %d", len(modules))
+	}
+
+	noCache := make(map[string]bool)
+	for _, a := range modules[0].Module.Actions {
+		for _, o := range a.Outputs {
+			noCache[o] = a.NoCache
+		}
+	}
+	want := map[string]bool{"cached": false, "scratch": true}
+	if !reflect.DeepEqual(noCache, want) {
+		t.Errorf("expected NoCache %v, got %v", want, noCache)
+	}
+	if strings.Count(actions.String(), `"NoCache"`) != 1 {
+		t.Errorf("expected NoCache to only be written for the scratch action:\n%s", actions.String())
+	}
+}
+
+func TestWriteDependencyGraphJSON(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			foo_module {
+			    name: "B",
+			    deps: ["A"],
+			    ignored_deps: ["C"],
+			}
+		`),
+		"dir/Android.bp": []byte(`
+			bar_module {
+			    name: "A",
+			}
+			bar_module {
+			    name: "C",
+			}
+		`),
+	})
+	ctx.RegisterModuleType("foo_module", newFooModule)
+	ctx.RegisterModuleType("bar_module", newBarModule)
+	ctx.RegisterBottomUpMutator("deps", depsMutator)
+	ctx.RegisterBottomUpMutator("variants", func(mctx BottomUpMutatorContext) {
+		if mctx.ModuleName() == "A" {
+			mctx.CreateVariations("y", "x")
+		}
+	})
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected dep errors: %v", errs)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := ctx.WriteDependencyGraphJSON(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `[
+	{
+		"Name": "A",
+		"Variant": "x",
+		"Blueprint": "dir/Android.bp",
+		"Deps": []
+	},
+	{
+		"Name": "A",
+		"Variant": "y",
+		"Blueprint": "dir/Android.bp",
+		"Deps": []
+	},
+	{
+		"Name": "B",
+		"Variant": "",
+		"Blueprint": "Android.bp",
+		"Deps": [
+			{
+				"Name": "C",
+				"Variant": "",
+				"Tag": "blueprint.walkerDepsTag"
+			},
+			{
+				"Name": "A",
+				"Variant": "y",
+				"Tag": "blueprint.walkerDepsTag"
+			}
+		]
+	},
+	{
+		"Name": "C",
+		"Variant": "",
+		"Blueprint": "dir/Android.bp",
+		"Deps": []
+	}
+]
+`
+	if g := buf.String(); g != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, g)
+	}
+}
+
+type directoryOutputTestModule struct {
+	SimpleName
+	properties struct {
+		Outputs           []string
+		Directory_outputs []string
+		Inputs            []string
+		Order_only        []string
+		Dyndep            string
+	}
+}
+
+func newDirectoryOutputTestModule() (Module, []interface{}) {
+	m := &directoryOutputTestModule{}
+	return m, []interface{}{&m.SimpleName.Properties, &m.properties}
+}
+
+func (m *directoryOutputTestModule) GenerateBuildActions(ctx ModuleContext) {
+	ctx.Build(restatTestPctx, BuildParams{
+		Rule:             restatTestCopyRule,
+		Outputs:          m.properties.Outputs,
+		DirectoryOutputs: m.properties.Directory_outputs,
+		Inputs:           m.properties.Inputs,
+		OrderOnly:        m.properties.Order_only,
+		Dyndep:           m.properties.Dyndep,
+	})
+}
+
+func TestDirectoryOutputs(t *testing.T) {
+	run := func(t *testing.T, bp string) (*Context, []error) {
+		t.Helper()
+		ctx := NewContext()
+		ctx.RegisterModuleType("test", newDirectoryOutputTestModule)
+		ctx.MockFileSystem(map[string][]byte{
+			"Android.bp": []byte(bp),
+		})
+
+		_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected parse errors: %v", errs)
+		}
+		_, errs = ctx.ResolveDependencies(nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected dep errors: %v", errs)
+		}
+		_, errs = ctx.PrepareBuildActions(nil)
+		return ctx, errs
+	}
+
+	t.Run("order-only", func(t *testing.T) {
+		ctx, errs := run(t, `
+			test {
+			    name: "package",
+			    outputs: ["package.stamp"],
+			    directory_outputs: ["package"],
+			}
+			test {
+			    name: "user",
+			    outputs: ["user.out"],
+			    inputs: ["user.in"],
+			    order_only: ["package", "package.stamp"],
+			}
+			test {
+			    name: "dyndep_user",
+			    outputs: ["dyndep_user.out"],
+			    inputs: ["package/lib.so"],
+			    dyndep: "dyndep_user.dd",
+			}
+		`)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+
+		buf := &strings.Builder{}
+		if err := ctx.WriteBuildFile(buf); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{
+			"build package.stamp | package: g.restat_test.copy\n",
+			"build dyndep_user.out: g.restat_test.copy package/lib.so || dyndep_user.dd\n    dyndep = dyndep_user.dd\n",
+		} {
+			if !strings.Contains(buf.String(), want) {
+				t.Errorf("missing %q in:\n%s", want, buf.String())
+			}
+		}
+
+		targets, err := ctx.AllTargets()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := targets["package"]; !ok {
+			t.Errorf("expected directory output in AllTargets, got %q", targets)
+		}
+
+		graph, actions := &bytes.Buffer{}, &bytes.Buffer{}
+		ctx.PrintJSONGraphAndActions(graph, actions)
+		var modules []struct {
+			Name   string
+			Module struct {
+				Actions []JSONAction
+			}
+		}
+		if err := json.Unmarshal(actions.Bytes(), &modules); err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range modules {
+			if m.Name != "package" {
+				continue
+			}
+			a := m.Module.Actions[0]
+			if !reflect.DeepEqual(a.Outputs, []string{"package.stamp"}) ||
+				!reflect.DeepEqual(a.DirectoryOutputs, []string{"package"}) {
+				t.Errorf("expected outputs [package.stamp] and directory outputs [package], got %q and %q",
+					a.Outputs, a.DirectoryOutputs)
+			}
+		}
+	})
+
+	t.Run("shared dyndep", func(t *testing.T) {
+		ctx, errs := run(t, `
+			test {
+			    name: "a",
+			    outputs: ["a.out"],
+			    dyndep: "x.dd",
+			}
+			test {
+			    name: "b",
+			    outputs: ["b.out"],
+			    dyndep: "x.dd",
+			}
+		`)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+
+		buf := &strings.Builder{}
+		if err := ctx.WriteBuildFile(buf); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{
+			"build a.out: g.restat_test.copy || x.dd\n    dyndep = x.dd\n",
+			"build b.out: g.restat_test.copy || x.dd\n    dyndep = x.dd\n",
+		} {
+			if !strings.Contains(buf.String(), want) {
+				t.Errorf("missing %q in:\n%s", want, buf.String())
+			}
+		}
+		if strings.Contains(buf.String(), "dedup-") {
+			t.Errorf("expected the order-only dependencies of dyndep users not to be deduplicated:\n%s",
+				buf.String())
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		_, errs := run(t, `
+			test {
+			    name: "package",
+			    outputs: ["package.stamp"],
+			    directory_outputs: ["package"],
+			}
+			test {
+			    name: "other_package",
+			    outputs: ["other_package.stamp"],
+			    directory_outputs: ["package"],
+			}
+			test {
+			    name: "inside",
+			    outputs: ["package/lib.so"],
+			}
+			test {
+			    name: "user",
+			    outputs: ["user.out"],
+			    inputs: ["package"],
+			}
+		`)
+		var got []string
+		for _, err := range errs {
+			got = append(got, err.Error())
+		}
+		want := []string{
+			`Android.bp:2:4: module "package": directory output "package" is also created by module "other_package"`,
+			`Android.bp:12:4: module "inside": output "package/lib.so" is inside directory output "package" of module "other_package"`,
+			`Android.bp:16:4: module "user": input "package" uses directory output "package" of module "other_package", which must be an order-only dependency or a validation unless a Dyndep is set`,
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected errors %q, got %q", want, got)
+		}
+	})
+}
+
+func TestNinjaPostProcessor(t *testing.T) {
+	run := func(t *testing.T, postProcessors ...NinjaPostProcessor) (string, error) {
+		t.Helper()
+		ctx := NewContext()
+		ctx.RegisterModuleType("test", newNoCacheTestModule)
+		for _, postProcessor := range postProcessors {
+			ctx.RegisterNinjaPostProcessor(postProcessor)
+		}
+		ctx.MockFileSystem(map[string][]byte{
+			"Android.bp": []byte(`
+				test {
+				    name: "foo",
+				}
+			`),
+		})
+
+		_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected parse errors: %v", errs)
+		}
+		_, errs = ctx.ResolveDependencies(nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected dep errors: %v", errs)
+		}
+		_, errs = ctx.PrepareBuildActions(nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected build action errors: %v", errs)
+		}
+
+		buf := &strings.Builder{}
+		err := ctx.WriteBuildFile(buf)
+		return buf.String(), err
+	}
+
+	unprocessed, err := run(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("in order", func(t *testing.T) {
+		out, err := run(t,
+			func(manifest []byte) ([]byte, error) {
+				return bytes.ReplaceAll(manifest, []byte("command = cp "), []byte("command = sccache cp ")), nil
+			},
+			func(manifest []byte) ([]byte, error) {
+				if !bytes.Contains(manifest, []byte("sccache")) {
+					return nil, fmt.Errorf("expected the output of the first post-processor")
+				}
+				return append(manifest, "# post-processed\n"...), nil
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := strings.ReplaceAll(unprocessed, "command = cp ", "command = sccache cp ") + "# post-processed\n"
+		if out != want {
+			t.Errorf("expected post-processed manifest:\n%s\ngot:\n%s", want, out)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		out, err := run(t, func(manifest []byte) ([]byte, error) {
+			return nil, fmt.Errorf("invalid manifest")
+		})
+		if err == nil || err.Error() != "ninja post-processor 0: invalid manifest" {
+			t.Errorf("expected post-processor error, got %v", err)
+		}
+		if out != "" {
+			t.Errorf("expected nothing to be written, got:\n%s", out)
+		}
+	})
+}
+
+type sliceDepsTag struct {
+	BaseDependencyTag
+	names []string
+}
+
+type interfaceDepsTag struct {
+	BaseDependencyTag
+	value interface{}
+}
+
+func TestInternTag(t *testing.T) {
+	// tagData returns the pointer to the value boxed in the interface.
+	tagData := func(tag DependencyTag) unsafe.Pointer {
+		return (*[2]unsafe.Pointer)(unsafe.Pointer(&tag))[1]
+	}
+
+	ctx := NewContext()
+
+	a := ctx.InternTag(walkerDepsTag{follow: true})
+	b := ctx.InternTag(walkerDepsTag{follow: true})
+	c := ctx.InternTag(walkerDepsTag{follow: false})
+
+	if a != b || tagData(a) != tagData(b) {
+		t.Errorf("expected equal tags to be interned to the same instance")
+	}
+	if a == c {
+		t.Errorf("expected different tags to stay different")
+	}
+
+	slice := sliceDepsTag{names: []string{"a"}}
+	if got := ctx.InternTag(slice).(sliceDepsTag); !reflect.DeepEqual(got, slice) {
+		t.Errorf("expected non-comparable tag to be returned unchanged, got %v", got)
+	}
+
+	iface := interfaceDepsTag{value: []string{"a"}}
+	if got := ctx.InternTag(iface).(interfaceDepsTag); !reflect.DeepEqual(got, iface) {
+		t.Errorf("expected tag holding a non-comparable value to be returned unchanged, got %v", got)
+	}
+
+	if ctx.InternTag(nil) != nil {
+		t.Errorf("expected nil tag to be returned unchanged")
+	}
+}
+
+type crashTestModule struct {
+	fooModule
+}
+
+func newCrashTestModule() (Module, []interface{}) {
+	m := &crashTestModule{}
+	return m, []interface{}{&m.properties, &m.SimpleName.Properties}
+}
+
+func (m *crashTestModule) GenerateBuildActions(ModuleContext) {
+	panic("crash")
+}
+
+func TestModuleProcessingLimit(t *testing.T) {
+	run := func(t *testing.T, limit int, bType string) (string, []error, *Context) {
+		t.Helper()
+		ctx := NewContext()
+		ctx.MockFileSystem(map[string][]byte{
+			"Android.bp": []byte(`
+				foo_module {
+				    name: "A",
+				    deps: ["B"],
+				}
+				` + bType + ` {
+				    name: "B",
+				    deps: ["C"],
+				}
+				foo_module {
+				    name: "C",
+				}
+			`),
+		})
+		ctx.RegisterModuleType("foo_module", newFooModule)
+		ctx.RegisterModuleType("crash_module", newCrashTestModule)
+		ctx.RegisterBottomUpMutator("deps", depsMutator)
+		ctx.SetModuleProcessingLimit(limit)
+		log := &strings.Builder{}
+		ctx.moduleProcessingLog = log
+
+		_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected parse errors: %v", errs)
+		}
+		_, errs = ctx.ResolveDependencies(nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected dep errors: %v", errs)
+		}
+
+		_, errs = ctx.PrepareBuildActions(nil)
+		return log.String(), errs, ctx
+	}
+
+	expectedLog := `processing module 1 of 3: module "C" in Android.bp` + "\n" +
+		`processing module 2 of 3: module "B" in Android.bp` + "\n"
+
+	t.Run("limit", func(t *testing.T) {
+		log, errs, ctx := run(t, 2, "foo_module")
+		expectedErr := "stopped after processing 2 of 3 modules because of SetModuleProcessingLimit"
+		if len(errs) != 1 || errs[0].Error() != expectedErr {
+			t.Errorf("expected error %q, got %q", expectedErr, errs)
+		}
+		if log != expectedLog {
+			t.Errorf("expected log %q, got %q", expectedLog, log)
+		}
+
+		for name, processed := range map[string]bool{"A": false, "B": true, "C": true} {
+			module := ctx.moduleGroupFromName(name, nil).modules.firstModule()
+			if module.startedGenerateBuildActions != processed {
+				t.Errorf("expected module %s processed=%v", name, processed)
+			}
+		}
+	})
+
+	t.Run("crash", func(t *testing.T) {
+		// The module that crashes is the last one in the log.
+		log, errs, _ := run(t, 3, "crash_module")
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), "crash") {
+			t.Errorf("expected the crash of B, got %q", errs)
+		}
+		if log != expectedLog {
+			t.Errorf("expected log %q, got %q", expectedLog, log)
+		}
+	})
+}
+
+type hangingTestModule struct {
+	SimpleName
+	release chan struct{}
+}
+
+func (m *hangingTestModule) GenerateBuildActions(ModuleContext) {
+	if m.Name() == "hang" {
+		<-m.release
+	}
+}
+
+func TestModuleGenerateTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			hanging_module {
+			    name: "ok",
 			}
-			if got != nil {
-				if g, w := got.String(), fmt.Sprintf("module %q variant %q", "dep", tt.want); g != w {
-					t.Errorf("findVariant() got = %v, want %v", g, w)
-				}
+			hanging_module {
+			    name: "hang",
 			}
-		})
+		`),
+	})
+	ctx.RegisterModuleType("hanging_module", func() (Module, []interface{}) {
+		module := &hangingTestModule{release: release}
+		return module, []interface{}{&module.SimpleName.Properties}
+	})
+	ctx.SetModuleGenerateTimeout(10 * time.Millisecond)
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected dep errors: %v", errs)
 	}
-}
 
-func Test_parallelVisit(t *testing.T) {
-	addDep := func(from, to *moduleInfo) {
-		from.directDeps = append(from.directDeps, depInfo{to, nil})
-		from.forwardDeps = append(from.forwardDeps, to)
-		to.reverseDeps = append(to.reverseDeps, from)
+	_, errs = ctx.PrepareBuildActions(nil)
+	expectedErr := `Android.bp:5:4: module "hang": GenerateBuildActions did not finish within 10ms`
+	if len(errs) != 1 || errs[0].Error() != expectedErr {
+		t.Errorf("expected error %q, got %q", expectedErr, errs)
 	}
+}
 
-	create := func(name string) *moduleInfo {
-		m := &moduleInfo{
-			group: &moduleGroup{
-				name: name,
-			},
+func TestErrorSink(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			foo_module {
+			    name: "A",
+			    deps: ["missing1"],
+			}
+			foo_module {
+			    name: "B",
+			    deps: ["missing2"],
+			}
+			unknown_module {
+			    name: "C",
+			}
+		`),
+	})
+	ctx.RegisterModuleType("foo_module", newFooModule)
+	ctx.RegisterBottomUpMutator("deps", depsMutator)
+
+	var sunk []string
+	ctx.SetErrorSink(func(err error) {
+		sunk = append(sunk, err.Error())
+	})
+
+	toStrings := func(errs []error) []string {
+		var ret []string
+		for _, err := range errs {
+			ret = append(ret, err.Error())
 		}
-		m.group.modules = modulesOrAliases{m}
-		return m
+		return ret
 	}
-	moduleA := create("A")
-	moduleB := create("B")
-	moduleC := create("C")
-	moduleD := create("D")
-	moduleE := create("E")
-	moduleF := create("F")
-	moduleG := create("G")
 
-	// A depends on B, B depends on C.  Nothing depends on D through G, and they don't depend on
-	// anything.
-	addDep(moduleA, moduleB)
-	addDep(moduleB, moduleC)
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 parse error, got %q", errs)
+	}
+	if !reflect.DeepEqual(sunk, toStrings(errs)) {
+		t.Errorf("expected sunk parse errors %q, got %q", toStrings(errs), sunk)
+	}
 
-	t.Run("no modules", func(t *testing.T) {
-		errs := parallelVisit(nil, bottomUpVisitorImpl{}, 1,
-			func(module *moduleInfo, pause chan<- pauseSpec) bool {
-				panic("unexpected call to visitor")
-			})
-		if errs != nil {
-			t.Errorf("expected no errors, got %q", errs)
+	sunk = nil
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) == 0 {
+		t.Fatalf("expected dependency errors")
+	}
+	if want := toStrings(errs); !reflect.DeepEqual(sunk, want) {
+		t.Errorf("expected sunk dependency errors %q, got %q", want, sunk)
+	}
+}
+
+func TestFailFast(t *testing.T) {
+	run := func(failFast bool) (sunk []string, errs []error) {
+		ctx := NewContext()
+		ctx.MockFileSystem(map[string][]byte{
+			"Android.bp": []byte(`
+				unknown_module {
+				    name: "A",
+				}
+				unknown_module {
+				    name: "B",
+				}
+			`),
+		})
+		ctx.SetFailFast(failFast)
+		ctx.SetErrorSink(func(err error) {
+			sunk = append(sunk, err.Error())
+		})
+
+		_, errs = ctx.ParseBlueprintsFiles("Android.bp", nil)
+		return sunk, errs
+	}
+
+	t.Run("default", func(t *testing.T) {
+		_, errs := run(false)
+		if len(errs) != 2 {
+			t.Errorf("expected 2 errors, got %q", errs)
 		}
 	})
-	t.Run("bottom up", func(t *testing.T) {
-		order := ""
-		errs := parallelVisit([]*moduleInfo{moduleA, moduleB, moduleC}, bottomUpVisitorImpl{}, 1,
-			func(module *moduleInfo, pause chan<- pauseSpec) bool {
-				order += module.group.name
-				return false
-			})
-		if errs != nil {
-			t.Errorf("expected no errors, got %q", errs)
+
+	t.Run("fail fast", func(t *testing.T) {
+		sunk, errs := run(true)
+		if len(errs) != 1 {
+			t.Fatalf("expected 1 error, got %q", errs)
 		}
-		if g, w := order, "CBA"; g != w {
-			t.Errorf("expected order %q, got %q", w, g)
+		if want := []string{errs[0].Error()}; !reflect.DeepEqual(sunk, want) {
+			t.Errorf("expected sunk errors %q, got %q", want, sunk)
 		}
 	})
-	t.Run("pause", func(t *testing.T) {
-		order := ""
-		errs := parallelVisit([]*moduleInfo{moduleA, moduleB, moduleC, moduleD}, bottomUpVisitorImpl{}, 1,
-			func(module *moduleInfo, pause chan<- pauseSpec) bool {
-				if module == moduleC {
-					// Pause module C on module D
-					unpause := make(chan struct{})
-					pause <- pauseSpec{moduleC, moduleD, unpause}
-					<-unpause
-				}
-				order += module.group.name
-				return false
-			})
-		if errs != nil {
-			t.Errorf("expected no errors, got %q", errs)
-		}
-		if g, w := order, "DCBA"; g != w {
-			t.Errorf("expected order %q, got %q", w, g)
-		}
+}
+
+func TestValidateNoSelfDependency(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			foo_module {
+			    name: "A",
+			    deps: ["B"],
+			}
+			foo_module {
+			    name: "B",
+			}
+		`),
 	})
-	t.Run("cancel", func(t *testing.T) {
-		order := ""
-		errs := parallelVisit([]*moduleInfo{moduleA, moduleB, moduleC}, bottomUpVisitorImpl{}, 1,
-			func(module *moduleInfo, pause chan<- pauseSpec) bool {
-				order += module.group.name
-				// Cancel in module B
-				return module == moduleB
-			})
-		if errs != nil {
-			t.Errorf("expected no errors, got %q", errs)
-		}
-		if g, w := order, "CB"; g != w {
-			t.Errorf("expected order %q, got %q", w, g)
+	ctx.RegisterModuleType("foo_module", newFooModule)
+	ctx.RegisterBottomUpMutator("deps", depsMutator)
+	ctx.RegisterBottomUpMutator("replace", func(mctx BottomUpMutatorContext) {
+		if mctx.ModuleName() == "A" {
+			// Replacing A's dependency on B with A makes A depend on itself.
+			mctx.ReplaceDependencies("B")
 		}
 	})
-	t.Run("pause and cancel", func(t *testing.T) {
-		order := ""
-		errs := parallelVisit([]*moduleInfo{moduleA, moduleB, moduleC, moduleD}, bottomUpVisitorImpl{}, 1,
-			func(module *moduleInfo, pause chan<- pauseSpec) bool {
-				if module == moduleC {
-					// Pause module C on module D
-					unpause := make(chan struct{})
-					pause <- pauseSpec{moduleC, moduleD, unpause}
-					<-unpause
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, got %q", errs)
+	}
+	if g, w := errs[0].Error(), `Android.bp:2:4: module "A" depends on itself`; g != w {
+		t.Errorf("expected error %q, got %q", w, g)
+	}
+}
+
+func TestStrictPropertyNames(t *testing.T) {
+	run := func(t *testing.T, strict bool) []error {
+		ctx := NewContext()
+		ctx.RegisterModuleType("foo_module", newFooModule)
+		ctx.SetStrictPropertyNames(strict)
+		ctx.MockFileSystem(map[string][]byte{
+			"Android.bp": []byte(`
+				foo_module {
+				    name: "A",
+				    dpes: ["B"],
 				}
-				order += module.group.name
-				// Cancel in module D
-				return module == moduleD
-			})
-		if errs != nil {
-			t.Errorf("expected no errors, got %q", errs)
-		}
-		if g, w := order, "D"; g != w {
-			t.Errorf("expected order %q, got %q", w, g)
+			`),
+		})
+		_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+		return errs
+	}
+
+	t.Run("default", func(t *testing.T) {
+		errs := run(t, false)
+		want := `Android.bp:4:13: unrecognized property "dpes"`
+		if len(errs) != 1 || errs[0].Error() != want {
+			t.Errorf("expected error %q, got %q", want, errs)
 		}
 	})
-	t.Run("parallel", func(t *testing.T) {
-		order := ""
-		errs := parallelVisit([]*moduleInfo{moduleA, moduleB, moduleC}, bottomUpVisitorImpl{}, 3,
-			func(module *moduleInfo, pause chan<- pauseSpec) bool {
-				order += module.group.name
-				return false
-			})
-		if errs != nil {
-			t.Errorf("expected no errors, got %q", errs)
+
+	t.Run("strict", func(t *testing.T) {
+		errs := run(t, true)
+		want := `Android.bp:4:13: module "A": dpes: unrecognized property of module type "foo_module"`
+		if len(errs) != 1 || errs[0].Error() != want {
+			t.Fatalf("expected error %q, got %q", want, errs)
 		}
-		if g, w := order, "CBA"; g != w {
-			t.Errorf("expected order %q, got %q", w, g)
+		if _, ok := errs[0].(*PropertyError); !ok {
+			t.Errorf("expected a *PropertyError, got %T", errs[0])
 		}
 	})
-	t.Run("pause existing", func(t *testing.T) {
-		order := ""
-		errs := parallelVisit([]*moduleInfo{moduleA, moduleB, moduleC}, bottomUpVisitorImpl{}, 3,
-			func(module *moduleInfo, pause chan<- pauseSpec) bool {
-				if module == moduleA {
-					// Pause module A on module B (an existing dependency)
-					unpause := make(chan struct{})
-					pause <- pauseSpec{moduleA, moduleB, unpause}
-					<-unpause
+}
+
+func TestAllowedDependencyTags(t *testing.T) {
+	run := func(t *testing.T, allowed []string) []error {
+		ctx := NewContext()
+		ctx.MockFileSystem(map[string][]byte{
+			"Android.bp": []byte(`
+				foo_module {
+				    name: "A",
+				    deps: ["B"],
 				}
-				order += module.group.name
-				return false
-			})
-		if errs != nil {
-			t.Errorf("expected no errors, got %q", errs)
-		}
-		if g, w := order, "CBA"; g != w {
-			t.Errorf("expected order %q, got %q", w, g)
-		}
-	})
-	t.Run("cycle", func(t *testing.T) {
-		errs := parallelVisit([]*moduleInfo{moduleA, moduleB, moduleC}, bottomUpVisitorImpl{}, 3,
-			func(module *moduleInfo, pause chan<- pauseSpec) bool {
-				if module == moduleC {
-					// Pause module C on module A (a dependency cycle)
-					unpause := make(chan struct{})
-					pause <- pauseSpec{moduleC, moduleA, unpause}
-					<-unpause
+				foo_module {
+				    name: "B",
+				    deps: ["C"],
 				}
-				return false
-			})
-		want := []string{
-			`encountered dependency cycle`,
-			`module "C" depends on module "A"`,
-			`module "A" depends on module "B"`,
-			`module "B" depends on module "C"`,
-		}
-		for i := range want {
-			if len(errs) <= i {
-				t.Errorf("missing error %s", want[i])
-			} else if !strings.Contains(errs[i].Error(), want[i]) {
-				t.Errorf("expected error %s, got %s", want[i], errs[i])
+				foo_module {
+				    name: "C",
+				}
+			`),
+		})
+		ctx.RegisterModuleType("foo_module", newFooModule)
+		ctx.RegisterBottomUpMutator("deps", depsMutator)
+		ctx.RegisterBottomUpMutator("optional", func(mctx BottomUpMutatorContext) {
+			if mctx.ModuleName() == "A" {
+				mctx.AddDependency(mctx.Module(), optionalDepsTag{}, "C")
 			}
+		})
+		ctx.SetAllowedDependencyTags(allowed)
+
+		_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected parse errors: %v", errs)
 		}
-		if len(errs) > len(want) {
-			for _, err := range errs[len(want):] {
-				t.Errorf("unexpected error %s", err.Error())
-			}
+		_, errs = ctx.ResolveDependencies(nil)
+		return errs
+	}
+
+	t.Run("unrestricted", func(t *testing.T) {
+		if errs := run(t, nil); len(errs) > 0 {
+			t.Errorf("unexpected errors: %q", errs)
 		}
-	})
-	t.Run("pause cycle", func(t *testing.T) {
-		errs := parallelVisit([]*moduleInfo{moduleA, moduleB, moduleC, moduleD}, bottomUpVisitorImpl{}, 3,
-			func(module *moduleInfo, pause chan<- pauseSpec) bool {
-				if module == moduleC {
-					// Pause module C on module D
-					unpause := make(chan struct{})
-					pause <- pauseSpec{moduleC, moduleD, unpause}
-					<-unpause
-				}
-				if module == moduleD {
-					// Pause module D on module C (a pause cycle)
-					unpause := make(chan struct{})
-					pause <- pauseSpec{moduleD, moduleC, unpause}
-					<-unpause
-				}
-				return false
-			})
-		want := []string{
-			`encountered dependency cycle`,
-			`module "D" depends on module "C"`,
-			`module "C" depends on module "D"`,
+	})
+
+	t.Run("allowed", func(t *testing.T) {
+		if errs := run(t, []string{"blueprint.walkerDepsTag", "blueprint.optionalDepsTag"}); len(errs) > 0 {
+			t.Errorf("unexpected errors: %q", errs)
 		}
-		for i := range want {
-			if len(errs) <= i {
-				t.Errorf("missing error %s", want[i])
-			} else if !strings.Contains(errs[i].Error(), want[i]) {
-				t.Errorf("expected error %s, got %s", want[i], errs[i])
-			}
+	})
+
+	t.Run("disallowed", func(t *testing.T) {
+		errs := run(t, []string{"blueprint.walkerDepsTag"})
+		if len(errs) != 1 {
+			t.Fatalf("expected 1 error, got %q", errs)
 		}
-		if len(errs) > len(want) {
-			for _, err := range errs[len(want):] {
-				t.Errorf("unexpected error %s", err.Error())
+		w := `Android.bp:2:5: module "A" depends on module "C" with disallowed dependency tag type blueprint.optionalDepsTag`
+		if g := errs[0].Error(); g != w {
+			t.Errorf("expected error %q, got %q", w, g)
+		}
+	})
+}
+
+var commonVariantTestProvider = NewMutatorProvider[int]("arch")
+
+func TestCommonVariant(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			foo_module {
+			    name: "bin",
+			    deps: ["lib", "data"],
+			}
+			foo_module {
+			    name: "lib",
+			    deps: ["data"],
 			}
+			foo_module {
+			    name: "data",
+			    common: true,
+			}
+		`),
+	})
+	ctx.RegisterModuleType("foo_module", newFooModule)
+	ctx.RegisterBottomUpMutator("deps", depsMutator)
+	ctx.RegisterBottomUpMutator("arch", func(mctx BottomUpMutatorContext) {
+		variants := mctx.CreateVariations("arm", "x86")
+		if mctx.ModuleName() == "data" && (variants[0] != mctx.Module() || variants[1] != mctx.Module()) {
+			panic(fmt.Errorf("expected the common module to be returned for every variation"))
 		}
+		// The provider can only be set once on the common module, which is every variation.
+		mctx.SetVariationProvider(variants[1], commonVariantTestProvider, 1)
 	})
-	t.Run("pause cycle with deps", func(t *testing.T) {
-		pauseDeps := map[*moduleInfo]*moduleInfo{
-			// F and G form a pause cycle
-			moduleF: moduleG,
-			moduleG: moduleF,
-			// D depends on E which depends on the pause cycle, making E the first alphabetical
-			// entry in pauseMap, which is not part of the cycle.
-			moduleD: moduleE,
-			moduleE: moduleF,
+	ctx.RegisterBottomUpMutator("late_deps", func(mctx BottomUpMutatorContext) {
+		if mctx.ModuleName() == "lib" {
+			arch, _ := mctx.Variation("arch")
+			mctx.AddVariationDependencies([]Variation{{"arch", arch}}, walkerDepsTag{}, "data")
 		}
-		errs := parallelVisit([]*moduleInfo{moduleD, moduleE, moduleF, moduleG}, bottomUpVisitorImpl{}, 4,
-			func(module *moduleInfo, pause chan<- pauseSpec) bool {
-				if dep, ok := pauseDeps[module]; ok {
-					unpause := make(chan struct{})
-					pause <- pauseSpec{module, dep, unpause}
-					<-unpause
+	})
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) == 0 {
+		_, errs = ctx.ResolveDependencies(nil)
+	}
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	dataGroup := ctx.moduleGroupFromName("data", nil)
+	if len(dataGroup.modules) != 1 {
+		t.Fatalf("expected a single variant of data, got %d", len(dataGroup.modules))
+	}
+	data := dataGroup.modules.firstModule()
+	if g, ok := ctx.ModuleProvider(data.logicModule, commonVariantTestProvider); !ok || g != 1 {
+		t.Errorf("expected the provider of the common module to be 1, got %v", g)
+	}
+
+	for _, name := range []string{"bin", "lib"} {
+		for _, arch := range []string{"arm", "x86"} {
+			module := ctx.moduleGroupFromName(name, nil).moduleByVariantName(arch)
+			if module == nil {
+				t.Fatalf("missing %s variant of %s", arch, name)
+			}
+			dataDeps := 0
+			for _, dep := range module.directDeps {
+				if dep.module.Name() == "data" {
+					dataDeps++
+					if dep.module != data {
+						t.Errorf("expected %s{%s} to depend on the common variant of data", name, arch)
+					}
+				} else if dep.module.variant.name != arch {
+					t.Errorf("expected %s{%s} to depend on the %s variant of %s, got %q",
+						name, arch, arch, dep.module.Name(), dep.module.variant.name)
 				}
-				return false
-			})
-		want := []string{
-			`encountered dependency cycle`,
-			`module "G" depends on module "F"`,
-			`module "F" depends on module "G"`,
-		}
-		for i := range want {
-			if len(errs) <= i {
-				t.Errorf("missing error %s", want[i])
-			} else if !strings.Contains(errs[i].Error(), want[i]) {
-				t.Errorf("expected error %s, got %s", want[i], errs[i])
 			}
-		}
-		if len(errs) > len(want) {
-			for _, err := range errs[len(want):] {
-				t.Errorf("unexpected error %s", err.Error())
+			if w := map[string]int{"bin": 1, "lib": 2}[name]; dataDeps != w {
+				t.Errorf("expected %s{%s} to have %d dependencies on data, got %d", name, arch, w, dataDeps)
 			}
 		}
+	}
+}
+
+func TestWriteBuildFileTo(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			test {
+			    name: "foo",
+			    stamp: true,
+			}
+		`),
 	})
+	ctx.RegisterModuleType("test", stampTestModuleFactory)
+
+	_, errs := ctx.ParseFileList(".", []string{"Android.bp"}, nil)
+	if len(errs) == 0 {
+		_, errs = ctx.ResolveDependencies(nil)
+	}
+	if len(errs) == 0 {
+		_, errs = ctx.PrepareBuildActions(nil)
+	}
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	full := &strings.Builder{}
+	if err := ctx.WriteBuildFile(full); err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(sections SectionMask) string {
+		// Use a writer without WriteString to exercise the buffered path.
+		buf := &bytes.Buffer{}
+		if err := ctx.WriteBuildFileTo(struct{ io.Writer }{buf}, sections); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	if g := write(SectionAll); g != full.String() {
+		t.Errorf("expected SectionAll to match WriteBuildFile, got:\n%s\nwant:\n%s", g, full.String())
+	}
+
+	rules := write(SectionRules)
+	if !strings.Contains(rules, "\nrule g.blueprint.touch\n") {
+		t.Errorf("missing rule in:\n%s", rules)
+	}
+	if strings.Contains(rules, "foo.stamp") || strings.Contains(rules, "ninja_required_version") {
+		t.Errorf("unexpected sections in:\n%s", rules)
+	}
+
+	modules := write(SectionModules)
+	if !strings.Contains(modules, "build foo.stamp: g.blueprint.touch dep\n") {
+		t.Errorf("missing module build actions in:\n%s", modules)
+	}
+	if strings.Contains(modules, "\nrule ") {
+		t.Errorf("unexpected rules in:\n%s", modules)
+	}
 }
 
-func TestPackageIncludes(t *testing.T) {
-	dir1_foo_bp := `
-	blueprint_package_includes {
-		match_all: ["use_dir1"],
+func TestWriteBuildFileTwiceDeduplicatesOnce(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			test {
+			    name: "a",
+			    outputs: ["a.out"],
+			    order_only: ["x", "y"],
+			}
+			test {
+			    name: "b",
+			    outputs: ["b.out"],
+			    order_only: ["x", "y"],
+			}
+		`),
+	})
+	ctx.RegisterModuleType("test", newDirectoryOutputTestModule)
+
+	_, errs := ctx.ParseFileList(".", []string{"Android.bp"}, nil)
+	if len(errs) == 0 {
+		_, errs = ctx.ResolveDependencies(nil)
 	}
-	foo_module {
-		name: "foo",
+	if len(errs) == 0 {
+		_, errs = ctx.PrepareBuildActions(nil)
 	}
-	`
-	dir2_foo_bp := `
-	blueprint_package_includes {
-		match_all: ["use_dir2"],
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
 	}
-	foo_module {
-		name: "foo",
+
+	first := &strings.Builder{}
+	if err := ctx.WriteBuildFile(first); err != nil {
+		t.Fatal(err)
 	}
-	`
-	mockFs := map[string][]byte{
-		"dir1/Android.bp": []byte(dir1_foo_bp),
-		"dir2/Android.bp": []byte(dir2_foo_bp),
+	second := &strings.Builder{}
+	if err := ctx.WriteBuildFile(second); err != nil {
+		t.Fatal(err)
 	}
-	testCases := []struct {
-		desc        string
-		includeTags []string
-		expectedDir string
-		expectedErr string
-	}{
-		{
-			desc:        "use_dir1 is set, use dir1 foo",
-			includeTags: []string{"use_dir1"},
-			expectedDir: "dir1",
-		},
-		{
-			desc:        "use_dir2 is set, use dir2 foo",
-			includeTags: []string{"use_dir2"},
-			expectedDir: "dir2",
-		},
-		{
-			desc:        "duplicate module error if both use_dir1 and use_dir2 are set",
-			includeTags: []string{"use_dir1", "use_dir2"},
-			expectedDir: "",
-			expectedErr: `module "foo" already defined`,
-		},
+	if first.String() != second.String() {
+		t.Errorf("expected the second write to match the first, got:\n%s\nwant:\n%s", second, first)
 	}
-	for _, tc := range testCases {
-		t.Run(tc.desc, func(t *testing.T) {
-			ctx := NewContext()
-			// Register mock FS
-			ctx.MockFileSystem(mockFs)
-			// Register module types
-			ctx.RegisterModuleType("foo_module", newFooModule)
-			RegisterPackageIncludesModuleType(ctx)
-			// Add include tags for test case
-			ctx.AddIncludeTags(tc.includeTags...)
-			// Run test
-			_, actualErrs := ctx.ParseFileList(".", []string{"dir1/Android.bp", "dir2/Android.bp"}, nil)
-			// Evaluate
-			if !strings.Contains(fmt.Sprintf("%s", actualErrs), fmt.Sprintf("%s", tc.expectedErr)) {
-				t.Errorf("Expected errors: %s, got errors: %s\n", tc.expectedErr, actualErrs)
+
+	phonys := regexp.MustCompile(`\bbuild (dedup-\w+): phony x y\n`).FindAllStringSubmatch(first.String(), -1)
+	if len(phonys) != 1 {
+		t.Fatalf("expected 1 phony for the order-only dependencies, got %q in:\n%s", phonys, first)
+	}
+	for _, module := range []string{"a", "b"} {
+		want := fmt.Sprintf("build %s.out: g.restat_test.copy || %s\n", module, phonys[0][1])
+		if !strings.Contains(first.String(), want) {
+			t.Errorf("missing %q in:\n%s", want, first)
+		}
+	}
+}
+
+func TestDependencyRewriter(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			foo_module {
+			    name: "A",
 			}
-			if tc.expectedErr != "" {
-				return // expectedDir check not necessary
+			foo_module {
+			    name: "libfoo",
 			}
-			actualBpFile := ctx.moduleGroupFromName("foo", nil).modules.firstModule().relBlueprintsFile
-			if tc.expectedDir != filepath.Dir(actualBpFile) {
-				t.Errorf("Expected foo from %s, got %s\n", tc.expectedDir, filepath.Dir(actualBpFile))
+			foo_module {
+			    name: "libfoo_v2",
 			}
-		})
+			foo_module {
+			    name: "libbar",
+			}
+		`),
+	})
+	ctx.RegisterModuleType("foo_module", newFooModule)
+	ctx.RegisterBottomUpMutator("arch", func(mctx BottomUpMutatorContext) {
+		mctx.CreateVariations("arm", "x86")
+	})
+	ctx.RegisterBottomUpMutator("deps", func(mctx BottomUpMutatorContext) {
+		if mctx.ModuleName() == "A" {
+			arch, _ := mctx.Variation("arch")
+			mctx.AddVariationDependencies([]Variation{{"arch", arch}}, walkerDepsTag{}, "libfoo", "libbar")
+		}
+	})
+	ctx.RegisterDependencyRewriter(func(from Module, tag DependencyTag, name string) string {
+		if name == "libfoo" {
+			return "libfoo_v2"
+		}
+		return name
+	})
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) == 0 {
+		_, errs = ctx.ResolveDependencies(nil)
+	}
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	for _, arch := range []string{"arm", "x86"} {
+		a := ctx.moduleGroupFromName("A", nil).moduleByVariantName(arch)
+		var deps []string
+		for _, dep := range a.directDeps {
+			deps = append(deps, dep.module.Name()+"{"+dep.module.variant.name+"}")
+		}
+		if w := []string{"libfoo_v2{" + arch + "}", "libbar{" + arch + "}"}; !reflect.DeepEqual(deps, w) {
+			t.Errorf("expected A{%s} to depend on %q, got %q", arch, w, deps)
+		}
+	}
+}
+
+func TestSidecarDepsLoader(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			foo_module {
+			    name: "A",
+			}
+			foo_module {
+			    name: "B",
+			}
+		`),
+	})
+	ctx.RegisterModuleType("foo_module", newFooModule)
+	ctx.RegisterSidecarDepsLoader(func(bpPath string) (map[string][]string, []string, error) {
+		sidecar := filepath.Join(filepath.Dir(bpPath), "deps.json")
+		return map[string][]string{"A": {"B"}}, []string{sidecar}, nil
+	})
+
+	deps, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+	if !reflect.DeepEqual(deps, []string{"Android.bp", "deps.json"}) {
+		t.Errorf("expected the sidecar file in the dependencies, got %q", deps)
+	}
+
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected dep errors: %v", errs)
+	}
+
+	a := ctx.moduleGroupFromName("A", nil).modules.firstModule()
+	if len(a.directDeps) != 1 || a.directDeps[0].module.Name() != "B" ||
+		a.directDeps[0].tag != (SidecarDependencyTag{}) {
+		t.Errorf("expected A to depend on B with a SidecarDependencyTag, got %v", a.directDeps)
+	}
+}
+
+func TestModuleVariantName(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			foo_module {
+			    name: "A",
+			}
+		`),
+	})
+	ctx.RegisterModuleType("foo_module", newFooModule)
+	ctx.RegisterBottomUpMutator("arch", func(mctx BottomUpMutatorContext) {
+		mctx.CreateVariations("arm", "x86")
+	})
+	ctx.RegisterBottomUpMutator("link", func(mctx BottomUpMutatorContext) {
+		mctx.CreateLocalVariations("shared", "static")
+	})
+	ctx.RegisterBottomUpMutator("error", func(mctx BottomUpMutatorContext) {
+		arch, _ := mctx.Variation("arch")
+		link, _ := mctx.Variation("link")
+		if arch == "x86" && link == "static" {
+			mctx.ModuleErrorf("oops")
+		}
+	})
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, got %q", errs)
 	}
 
+	var names []string
+	ctx.VisitAllModuleVariants(ctx.moduleGroupFromName("A", nil).modules.firstModule().logicModule,
+		func(module Module) {
+			names = append(names, ctx.ModuleVariantName(module))
+		})
+
+	if w := fmt.Sprintf("module %q variant %q: oops", "A", names[3]); !strings.Contains(errs[0].Error(), w) {
+		t.Errorf("expected error %q to contain %q", errs[0], w)
+	}
+	if w := []string{"arm_shared", "arm_static", "x86_shared", "x86_static"}; !reflect.DeepEqual(names, w) {
+		t.Errorf("expected variant names %q, got %q", w, names)
+	}
 }
 
-func TestDeduplicateOrderOnlyDeps(t *testing.T) {
-	b := func(output string, inputs []string, orderOnlyDeps []string) *buildDef {
-		return &buildDef{
-			OutputStrings:    []string{output},
-			InputStrings:     inputs,
-			OrderOnlyStrings: orderOnlyDeps,
-		}
+func TestDefaultHeavyRulePool(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			test {
+			    name: "foo",
+			    stamp: true,
+			}
+		`),
+	})
+	ctx.RegisterModuleType("test", stampTestModuleFactory)
+	var rules []RuleInfo
+	ctx.SetDefaultHeavyRulePool(func(rule RuleInfo) bool {
+		rules = append(rules, rule)
+		return strings.HasPrefix(rule.Command, "touch")
+	}, 2)
+
+	_, errs := ctx.ParseFileList(".", []string{"Android.bp"}, nil)
+	if len(errs) == 0 {
+		_, errs = ctx.ResolveDependencies(nil)
 	}
-	m := func(bs ...*buildDef) *moduleInfo {
-		return &moduleInfo{actionDefs: localBuildActions{buildDefs: bs}}
+	if len(errs) == 0 {
+		_, errs = ctx.PrepareBuildActions(nil)
 	}
-	type testcase struct {
-		modules        []*moduleInfo
-		expectedPhonys []*buildDef
-		conversions    map[string][]string
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
 	}
-	fnvHash := func(s string) string {
-		hash := fnv.New64a()
-		hash.Write([]byte(s))
-		return strconv.FormatUint(hash.Sum64(), 16)
+
+	if len(rules) != 1 || rules[0].Name != "g.blueprint.touch" {
+		t.Errorf("expected the predicate to be called with g.blueprint.touch, got %+v", rules)
 	}
-	testCases := []testcase{{
-		modules: []*moduleInfo{
-			m(b("A", nil, []string{"d"})),
-			m(b("B", nil, []string{"d"})),
-		},
-		expectedPhonys: []*buildDef{
-			b("dedup-"+fnvHash("d"), []string{"d"}, nil),
-		},
-		conversions: map[string][]string{
-			"A": []string{"dedup-" + fnvHash("d")},
-			"B": []string{"dedup-" + fnvHash("d")},
-		},
-	}, {
-		modules: []*moduleInfo{
-			m(b("A", nil, []string{"a"})),
-			m(b("B", nil, []string{"b"})),
-		},
-	}, {
-		modules: []*moduleInfo{
-			m(b("A", nil, []string{"a"})),
-			m(b("B", nil, []string{"b"})),
-			m(b("C", nil, []string{"a"})),
-		},
-		expectedPhonys: []*buildDef{b("dedup-"+fnvHash("a"), []string{"a"}, nil)},
-		conversions: map[string][]string{
-			"A": []string{"dedup-" + fnvHash("a")},
-			"B": []string{"b"},
-			"C": []string{"dedup-" + fnvHash("a")},
-		},
-	}, {
-		modules: []*moduleInfo{
-			m(b("A", nil, []string{"a", "b"}),
-				b("B", nil, []string{"a", "b"})),
-			m(b("C", nil, []string{"a", "c"}),
-				b("D", nil, []string{"a", "c"})),
-		},
-		expectedPhonys: []*buildDef{
-			b("dedup-"+fnvHash("ab"), []string{"a", "b"}, nil),
-			b("dedup-"+fnvHash("ac"), []string{"a", "c"}, nil)},
-		conversions: map[string][]string{
-			"A": []string{"dedup-" + fnvHash("ab")},
-			"B": []string{"dedup-" + fnvHash("ab")},
-			"C": []string{"dedup-" + fnvHash("ac")},
-			"D": []string{"dedup-" + fnvHash("ac")},
-		},
-	}}
-	for index, tc := range testCases {
-		t.Run(fmt.Sprintf("TestCase-%d", index), func(t *testing.T) {
-			ctx := NewContext()
-			actualPhonys := ctx.deduplicateOrderOnlyDeps(tc.modules)
-			if len(actualPhonys.variables) != 0 {
-				t.Errorf("No variables expected but found %v", actualPhonys.variables)
-			}
-			if len(actualPhonys.rules) != 0 {
-				t.Errorf("No rules expected but found %v", actualPhonys.rules)
-			}
-			if e, a := len(tc.expectedPhonys), len(actualPhonys.buildDefs); e != a {
-				t.Errorf("Expected %d build statements but got %d", e, a)
-			}
-			for i := 0; i < len(tc.expectedPhonys); i++ {
-				a := actualPhonys.buildDefs[i]
-				e := tc.expectedPhonys[i]
-				if !reflect.DeepEqual(e.Outputs, a.Outputs) {
-					t.Errorf("phonys expected %v but actualPhonys %v", e.Outputs, a.Outputs)
-				}
-				if !reflect.DeepEqual(e.Inputs, a.Inputs) {
-					t.Errorf("phonys expected %v but actualPhonys %v", e.Inputs, a.Inputs)
-				}
-			}
-			find := func(k string) *buildDef {
-				for _, m := range tc.modules {
-					for _, b := range m.actionDefs.buildDefs {
-						if reflect.DeepEqual(b.OutputStrings, []string{k}) {
-							return b
-						}
-					}
-				}
-				return nil
-			}
-			for k, conversion := range tc.conversions {
-				actual := find(k)
-				if actual == nil {
-					t.Errorf("Couldn't find %s", k)
-				}
-				if !reflect.DeepEqual(actual.OrderOnlyStrings, conversion) {
-					t.Errorf("expected %s.OrderOnly = %v but got %v", k, conversion, actual.OrderOnly)
-				}
-			}
-		})
+
+	buf := &strings.Builder{}
+	if err := ctx.WriteBuildFile(buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "\npool heavy\n    depth = 2\n") {
+		t.Errorf("missing heavy pool in:\n%s", out)
+	}
+	if !strings.Contains(out, "\nrule g.blueprint.touch\n    pool = heavy\n") {
+		t.Errorf("expected g.blueprint.touch to be in the heavy pool:\n%s", out)
 	}
 }
 
-func TestSourceRootDirAllowed(t *testing.T) {
-	type pathCase struct {
-		path           string
-		decidingPrefix string
-		allowed        bool
+func TestCheckSingletonsRan(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": nil,
+	})
+	ctx.RegisterSingletonType("serial", addNinjaDepsTestSingletonFactory, false)
+	ctx.RegisterSingletonType("parallel", addNinjaDepsTestSingletonFactory, true)
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) == 0 {
+		_, errs = ctx.ResolveDependencies(nil)
 	}
-	testcases := []struct {
-		desc      string
-		rootDirs  []string
-		pathCases []pathCase
-	}{
-		{
-			desc: "simple case",
-			rootDirs: []string{
-				"a",
-				"b/c/d",
-				"-c",
-				"-d/c/a",
-				"c/some_single_file",
-			},
-			pathCases: []pathCase{
-				{
-					path:           "a",
-					decidingPrefix: "a",
-					allowed:        true,
-				},
-				{
-					path:           "a/b/c",
-					decidingPrefix: "a",
-					allowed:        true,
-				},
-				{
-					path:           "b",
-					decidingPrefix: "",
-					allowed:        true,
-				},
-				{
-					path:           "b/c/d/a",
-					decidingPrefix: "b/c/d",
-					allowed:        true,
-				},
-				{
-					path:           "c",
-					decidingPrefix: "c",
-					allowed:        false,
-				},
-				{
-					path:           "c/a/b",
-					decidingPrefix: "c",
-					allowed:        false,
-				},
-				{
-					path:           "c/some_single_file",
-					decidingPrefix: "c/some_single_file",
-					allowed:        true,
-				},
-				{
-					path:           "d/c/a/abc",
-					decidingPrefix: "d/c/a",
-					allowed:        false,
-				},
-			},
-		},
-		{
-			desc: "root directory order matters",
-			rootDirs: []string{
-				"-a",
-				"a/c/some_allowed_file",
-				"a/b/d/some_allowed_file",
-				"a/b",
-				"a/c",
-				"-a/b/d",
-			},
-			pathCases: []pathCase{
-				{
-					path:           "a",
-					decidingPrefix: "a",
-					allowed:        false,
-				},
-				{
-					path:           "a/some_disallowed_file",
-					decidingPrefix: "a",
-					allowed:        false,
-				},
-				{
-					path:           "a/c/some_allowed_file",
-					decidingPrefix: "a/c/some_allowed_file",
-					allowed:        true,
-				},
-				{
-					path:           "a/b/d/some_allowed_file",
-					decidingPrefix: "a/b/d/some_allowed_file",
-					allowed:        true,
-				},
-				{
-					path:           "a/b/c",
-					decidingPrefix: "a/b",
-					allowed:        true,
-				},
-				{
-					path:           "a/b/c/some_allowed_file",
-					decidingPrefix: "a/b",
-					allowed:        true,
-				},
-				{
-					path:           "a/b/d",
-					decidingPrefix: "a/b/d",
-					allowed:        false,
-				},
-			},
-		},
+	if len(errs) == 0 {
+		_, errs = ctx.PrepareBuildActions(nil)
 	}
-	for _, tc := range testcases {
-		dirs := SourceRootDirs{}
-		dirs.Add(tc.rootDirs...)
-		for _, pc := range tc.pathCases {
-			t.Run(fmt.Sprintf("%s: %s", tc.desc, pc.path), func(t *testing.T) {
-				allowed, decidingPrefix := dirs.SourceRootDirAllowed(pc.path)
-				if allowed != pc.allowed {
-					if pc.allowed {
-						t.Errorf("expected path %q to be allowed, but was not; root allowlist: %q", pc.path, tc.rootDirs)
-					} else {
-						t.Errorf("path %q was allowed unexpectedly; root allowlist: %q", pc.path, tc.rootDirs)
-					}
-				}
-				if decidingPrefix != pc.decidingPrefix {
-					t.Errorf("expected decidingPrefix to be %q, but got %q", pc.decidingPrefix, decidingPrefix)
-				}
-			})
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	// Simulate a singleton that was skipped.
+	for _, info := range ctx.singletonInfo {
+		if info.name == "parallel" {
+			info.generated = 0
 		}
 	}
+
+	errs = ctx.checkSingletonsRan()
+	w := `GenerateBuildActions was called 0 times for singleton "parallel" instead of once, this is an internal error`
+	if len(errs) != 1 || errs[0].Error() != w {
+		t.Errorf("expected error %q, got %q", w, errs)
+	}
 }
 
-func TestSourceRootDirs(t *testing.T) {
-	root_foo_bp := `
-	foo_module {
-		name: "foo",
-		deps: ["foo_dir1", "foo_dir_ignored_special_case"],
+// funcSingleton is a Singleton whose GenerateBuildActions calls the function.
+type funcSingleton func(ctx SingletonContext)
+
+func (f funcSingleton) GenerateBuildActions(ctx SingletonContext) {
+	f(ctx)
+}
+
+func TestPreSingleton(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			test { name: "a", stamps: 1 }
+			test { name: "b", stamps: 2 }
+		`),
+	})
+	ctx.RegisterModuleType("test", newShardTestModule)
+
+	// countBuildDefs returns the number of build statements of each module.
+	countBuildDefs := func(sctx SingletonContext) []string {
+		var counts []string
+		sctx.VisitAllModules(func(m Module) {
+			counts = append(counts, fmt.Sprintf("%s:%d", sctx.ModuleName(m),
+				len(ctx.moduleInfo[m].actionDefs.buildDefs)))
+		})
+		return counts
+	}
+
+	var order []string
+	var preCounts, postCounts []string
+	ctx.RegisterSingletonType("post", func() Singleton {
+		return funcSingleton(func(sctx SingletonContext) {
+			order = append(order, "post")
+			postCounts = countBuildDefs(sctx)
+		})
+	}, false)
+	ctx.RegisterPreSingletonType("pre", func() Singleton {
+		return funcSingleton(func(sctx SingletonContext) {
+			order = append(order, "pre")
+			preCounts = countBuildDefs(sctx)
+		})
+	})
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) == 0 {
+		_, errs = ctx.ResolveDependencies(nil)
 	}
-	`
-	dir1_foo_bp := `
-	foo_module {
-		name: "foo_dir1",
-		deps: ["foo_dir_ignored"],
+	if len(errs) == 0 {
+		_, errs = ctx.PrepareBuildActions(nil)
 	}
-	`
-	dir_ignored_foo_bp := `
-	foo_module {
-		name: "foo_dir_ignored",
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
 	}
-	`
-	dir_ignored_special_case_foo_bp := `
-	foo_module {
-		name: "foo_dir_ignored_special_case",
+
+	if want := []string{"pre", "post"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("expected singletons to run in order %q, got %q", want, order)
 	}
-	`
-	mockFs := map[string][]byte{
-		"Android.bp":                          []byte(root_foo_bp),
-		"dir1/Android.bp":                     []byte(dir1_foo_bp),
-		"dir_ignored/Android.bp":              []byte(dir_ignored_foo_bp),
-		"dir_ignored/special_case/Android.bp": []byte(dir_ignored_special_case_foo_bp),
+	if want := []string{"a:0", "b:0"}; !reflect.DeepEqual(preCounts, want) {
+		t.Errorf("expected the pre-singleton to see modules without build statements %q, got %q", want, preCounts)
 	}
-	fileList := []string{}
-	for f := range mockFs {
-		fileList = append(fileList, f)
+	if want := []string{"a:1", "b:2"}; !reflect.DeepEqual(postCounts, want) {
+		t.Errorf("expected the singleton to see module build statements %q, got %q", want, postCounts)
 	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("expected registering a pre-singleton with the name of a singleton to panic")
+		}
+	}()
+	ctx.RegisterPreSingletonType("post", func() Singleton { return funcSingleton(nil) })
+}
+
+func TestReproducibleCommandPaths(t *testing.T) {
+	ctx := NewContext()
+	ctx.SetSrcDir("/src")
+
 	testCases := []struct {
-		sourceRootDirs       []string
-		expectedModuleDefs   []string
-		unexpectedModuleDefs []string
-		expectedErrs         []string
+		in, out string
 	}{
 		{
-			sourceRootDirs: []string{},
-			expectedModuleDefs: []string{
-				"foo",
-				"foo_dir1",
-				"foo_dir_ignored",
-				"foo_dir_ignored_special_case",
-			},
-		},
-		{
-			sourceRootDirs: []string{"-", ""},
-			unexpectedModuleDefs: []string{
-				"foo",
-				"foo_dir1",
-				"foo_dir_ignored",
-				"foo_dir_ignored_special_case",
-			},
-		},
-		{
-			sourceRootDirs: []string{"-"},
-			unexpectedModuleDefs: []string{
-				"foo",
-				"foo_dir1",
-				"foo_dir_ignored",
-				"foo_dir_ignored_special_case",
-			},
-		},
-		{
-			sourceRootDirs: []string{"dir1"},
-			expectedModuleDefs: []string{
-				"foo",
-				"foo_dir1",
-				"foo_dir_ignored",
-				"foo_dir_ignored_special_case",
-			},
+			in:  "build /src/out/a.o: g.cc /src/a.c\n    depfile = /src/out/a.d\n",
+			out: "build out/a.o: g.cc a.c\n    depfile = out/a.d\n",
 		},
 		{
-			sourceRootDirs: []string{"-dir1"},
-			expectedModuleDefs: []string{
-				"foo",
-				"foo_dir_ignored",
-				"foo_dir_ignored_special_case",
-			},
-			unexpectedModuleDefs: []string{
-				"foo_dir1",
-			},
-			expectedErrs: []string{
-				`Android.bp:2:2: module "foo" depends on skipped module "foo_dir1"; "foo_dir1" was defined in files(s) [dir1/Android.bp], but was skipped for reason(s) ["dir1/Android.bp" is a descendant of "dir1", and that path prefix was not included in PRODUCT_SOURCE_ROOT_DIRS]`,
-			},
+			in:  "command = cc -I/src -I/src/include -o $out $in",
+			out: "command = cc -I. -Iinclude -o $out $in",
 		},
 		{
-			sourceRootDirs: []string{"-", "dir1"},
-			expectedModuleDefs: []string{
-				"foo_dir1",
-			},
-			unexpectedModuleDefs: []string{
-				"foo",
-				"foo_dir_ignored",
-				"foo_dir_ignored_special_case",
-			},
-			expectedErrs: []string{
-				`dir1/Android.bp:2:2: module "foo_dir1" depends on skipped module "foo_dir_ignored"; "foo_dir_ignored" was defined in files(s) [dir_ignored/Android.bp], but was skipped for reason(s) ["dir_ignored/Android.bp" is a descendant of "", and that path prefix was not included in PRODUCT_SOURCE_ROOT_DIRS]`,
-			},
+			in:  "command = cp /src2/a /other/src/b /srcs /src",
+			out: "command = cp /src2/a /other/src/b /srcs .",
 		},
 		{
-			sourceRootDirs: []string{"-", "dir1", "dir_ignored/special_case/Android.bp"},
-			expectedModuleDefs: []string{
-				"foo_dir1",
-				"foo_dir_ignored_special_case",
-			},
-			unexpectedModuleDefs: []string{
-				"foo",
-				"foo_dir_ignored",
-			},
-			expectedErrs: []string{
-				"dir1/Android.bp:2:2: module \"foo_dir1\" depends on skipped module \"foo_dir_ignored\"; \"foo_dir_ignored\" was defined in files(s) [dir_ignored/Android.bp], but was skipped for reason(s) [\"dir_ignored/Android.bp\" is a descendant of \"\", and that path prefix was not included in PRODUCT_SOURCE_ROOT_DIRS]",
-			},
+			in:  "/src/a",
+			out: "a",
 		},
 	}
-	for _, tc := range testCases {
-		t.Run(fmt.Sprintf(`source root dirs are %q`, tc.sourceRootDirs), func(t *testing.T) {
-			ctx := NewContext()
-			ctx.MockFileSystem(mockFs)
-			ctx.RegisterModuleType("foo_module", newFooModule)
-			ctx.RegisterBottomUpMutator("deps", depsMutator)
-			ctx.AddSourceRootDirs(tc.sourceRootDirs...)
-			RegisterPackageIncludesModuleType(ctx)
-			ctx.ParseFileList(".", fileList, nil)
-			_, actualErrs := ctx.ResolveDependencies(nil)
 
-			stringErrs := []string(nil)
-			for _, err := range actualErrs {
-				stringErrs = append(stringErrs, err.Error())
-			}
-			if !reflect.DeepEqual(tc.expectedErrs, stringErrs) {
-				t.Errorf("expected to find errors %v; got %v", tc.expectedErrs, stringErrs)
+	for _, testCase := range testCases {
+		got, err := ctx.relativizeSrcDirPaths([]byte(testCase.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != testCase.out {
+			t.Errorf("for %q expected %q, got %q", testCase.in, testCase.out, got)
+		}
+	}
+}
+
+type reproducibleTestModule struct {
+	SimpleName
+}
+
+func newReproducibleTestModule() (Module, []interface{}) {
+	m := &reproducibleTestModule{}
+	return m, []interface{}{&m.SimpleName.Properties}
+}
+
+func (m *reproducibleTestModule) GenerateBuildActions(ctx ModuleContext) {
+	ctx.Build(workingDirTestPctx, BuildParams{
+		Rule:    workingDirTestCcRule,
+		Outputs: []string{"/src/out/foo.o"},
+		Inputs:  []string{"/src/foo.c"},
+		Depfile: "/src/out/foo.o.d",
+	})
+}
+
+func TestReproducibleCommandPathsDepfile(t *testing.T) {
+	run := func(t *testing.T, workingDir string) (*Context, []error) {
+		t.Helper()
+		ctx := NewContext()
+		ctx.SetSrcDir("/src")
+		ctx.SetReproducibleCommandPaths(true)
+		ctx.SetWorkingDirForCommands(workingDir)
+		ctx.RegisterModuleType("test", newReproducibleTestModule)
+		ctx.MockFileSystem(map[string][]byte{
+			"Android.bp": []byte(`test { name: "foo" }`),
+		})
+
+		_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected parse errors: %v", errs)
+		}
+		_, errs = ctx.ResolveDependencies(nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected dep errors: %v", errs)
+		}
+		_, errs = ctx.PrepareBuildActions(nil)
+		return ctx, errs
+	}
+
+	t.Run("depfile", func(t *testing.T) {
+		ctx, errs := run(t, "")
+		if len(errs) > 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+
+		buf := &strings.Builder{}
+		if err := ctx.WriteBuildFile(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		// Ninja runs in the source directory, so the relative depfile refers to the same file as the
+		// absolute one, and the depfile of the rule is left referring to $out.
+		for _, want := range []string{
+			"    depfile = ${out}.d\n",
+			"build out/foo.o: g.working_dir_test.cc foo.c\n" +
+				"    depfile = out/foo.o.d\n",
+		} {
+			if !strings.Contains(buf.String(), want) {
+				t.Errorf("expected %q in:\n%s", want, buf.String())
 			}
-			for _, modName := range tc.expectedModuleDefs {
-				allMods := ctx.moduleGroupFromName(modName, nil)
-				if allMods == nil || len(allMods.modules) != 1 {
-					mods := modulesOrAliases{}
-					if allMods != nil {
-						mods = allMods.modules
-					}
-					t.Errorf("expected to find one definition for module %q, but got %v", modName, mods)
+		}
+	})
+
+	t.Run("working dir", func(t *testing.T) {
+		_, errs := run(t, "sub")
+		expected := `reproducible command paths can't be used with working directory for commands "sub", which needs absolute paths`
+		if len(errs) != 1 || errs[0].Error() != expected {
+			t.Errorf("expected error %q, got %v", expected, errs)
+		}
+	})
+}
+
+func TestGlobRuleConcurrencyPool(t *testing.T) {
+	run := func(t *testing.T, stamp bool) string {
+		ctx := NewContext()
+		ctx.MockFileSystem(map[string][]byte{
+			"Android.bp": []byte(fmt.Sprintf(`
+				test {
+				    name: "foo",
+				    stamp: %t,
 				}
+			`, stamp)),
+		})
+		ctx.RegisterModuleType("test", stampTestModuleFactory)
+		// Use the touch rule as the glob rule.
+		ctx.SetGlobRuleConcurrencyPool(Touch, 4)
+
+		_, errs := ctx.ParseFileList(".", []string{"Android.bp"}, nil)
+		if len(errs) == 0 {
+			_, errs = ctx.ResolveDependencies(nil)
+		}
+		if len(errs) == 0 {
+			_, errs = ctx.PrepareBuildActions(nil)
+		}
+		if len(errs) > 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+
+		buf := &strings.Builder{}
+		if err := ctx.WriteBuildFile(buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	t.Run("used", func(t *testing.T) {
+		out := run(t, true)
+		if g := strings.Count(out, "\npool glob\n    depth = 4\n"); g != 1 {
+			t.Errorf("expected the glob pool to be declared once, got %d:\n%s", g, out)
+		}
+		if !strings.Contains(out, "\nrule g.blueprint.touch\n    pool = glob\n") {
+			t.Errorf("expected g.blueprint.touch to be in the glob pool:\n%s", out)
+		}
+	})
+
+	t.Run("unused", func(t *testing.T) {
+		if out := run(t, false); strings.Contains(out, "pool glob") {
+			t.Errorf("unexpected glob pool in:\n%s", out)
+		}
+	})
+}
+
+type shardTestModule struct {
+	SimpleName
+	properties struct {
+		Stamps *int64
+	}
+}
+
+func newShardTestModule() (Module, []interface{}) {
+	m := &shardTestModule{}
+	return m, []interface{}{&m.SimpleName.Properties, &m.properties}
+}
+
+func (m *shardTestModule) GenerateBuildActions(ctx ModuleContext) {
+	for i := 0; i < proptools.Int(m.properties.Stamps); i++ {
+		ctx.Stamp(fmt.Sprintf("%s_%s_%d.stamp", ctx.ModuleName(), ctx.ModuleSubDir(), i), "dep")
+	}
+}
+
+func TestWriteBuildFileSharded(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			test { name: "a", stamps: 3 }
+			test { name: "b", stamps: 1 }
+			test { name: "c", stamps: 4 }
+			test { name: "d", stamps: 0 }
+			test { name: "e", stamps: 2 }
+			test { name: "f", stamps: 5 }
+		`),
+	})
+	ctx.RegisterModuleType("test", newShardTestModule)
+	ctx.RegisterBottomUpMutator("variants", func(mctx BottomUpMutatorContext) {
+		if mctx.ModuleName() == "c" || mctx.ModuleName() == "f" {
+			mctx.CreateVariations("x", "y")
+		}
+	})
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected dep errors: %v", errs)
+	}
+	_, errs = ctx.PrepareBuildActions(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected build action errors: %v", errs)
+	}
+
+	dir := t.TempDir()
+	const shards = 3
+	if err := ctx.WriteBuildFileSharded(dir, shards); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(file string) string {
+		t.Helper()
+		contents, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(contents)
+	}
+
+	top := read("build.ninja")
+	for i := 0; i < shards; i++ {
+		if !strings.Contains(top, fmt.Sprintf("subninja %s\n", filepath.Join(dir, fmt.Sprintf("build.%d.ninja", i)))) {
+			t.Errorf("missing subninja statement for shard %d in:\n%s", i, top)
+		}
+	}
+	if !strings.Contains(top, "\nrule g.blueprint.touch\n") {
+		t.Errorf("expected rules to stay in the top-level file:\n%s", top)
+	}
+	if strings.Contains(top, ".stamp") {
+		t.Errorf("unexpected module build actions in the top-level file:\n%s", top)
+	}
+
+	// Every build statement appears in exactly one shard, and the variants of a module are in the
+	// same shard.
+	seen := make(map[string]int)
+	moduleShards := make(map[string]int)
+	var nonEmpty int
+	for i := 0; i < shards; i++ {
+		contents := read(fmt.Sprintf("build.%d.ninja", i))
+		if strings.Contains(contents, "build ") {
+			nonEmpty++
+		}
+		for _, line := range strings.Split(contents, "\n") {
+			output, ok := strings.CutPrefix(line, "build ")
+			if !ok {
+				continue
 			}
+			output, _, _ = strings.Cut(output, ":")
+			seen[output]++
+			module, _, _ := strings.Cut(output, "_")
+			if shard, exists := moduleShards[module]; exists && shard != i {
+				t.Errorf("module %q is split across shards %d and %d", module, shard, i)
+			}
+			moduleShards[module] = i
+		}
+	}
 
-			for _, modName := range tc.unexpectedModuleDefs {
-				allMods := ctx.moduleGroupFromName(modName, nil)
-				if allMods != nil {
-					t.Errorf("expected to find no definitions for module %q, but got %v", modName, allMods.modules)
-				}
+	want := map[string]int{}
+	for module, stamps := range map[string]int{"a_": 3, "b_": 1, "c_x": 4, "c_y": 4, "e_": 2, "f_x": 5, "f_y": 5} {
+		for i := 0; i < stamps; i++ {
+			want[fmt.Sprintf("%s_%d.stamp", module, i)] = 1
+		}
+	}
+	if !reflect.DeepEqual(seen, want) {
+		t.Errorf("expected build statements %v, got %v", want, seen)
+	}
+	if nonEmpty != shards {
+		t.Errorf("expected build statements in all %d shards, got %d", shards, nonEmpty)
+	}
+}
+
+func TestSubninjaPerDirectory(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			test {
+			    name: "foo",
+			    stamp: true,
+			}
+			test {
+			    name: "empty",
 			}
+		`),
+		"dir/Android.bp": []byte(`
+			test {
+			    name: "bar",
+			    stamp: true,
+			}
+		`),
+	})
+	ctx.RegisterModuleType("test", stampTestModuleFactory)
+	ctx.RegisterSingletonType("out_dir", func() Singleton {
+		return funcSingleton(func(sctx SingletonContext) {
+			sctx.SetOutDir(restatTestPctx, "out")
 		})
+	}, false)
+	ctx.SetSubninjaPerDirectory(true)
+
+	_, errs := ctx.ParseFileList(".", []string{"Android.bp", "dir/Android.bp"}, nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected dep errors: %v", errs)
+	}
+	_, errs = ctx.PrepareBuildActions(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected build action errors: %v", errs)
+	}
+
+	buf := &strings.Builder{}
+	if err := ctx.WriteBuildFile(buf); err != nil {
+		t.Fatal(err)
+	}
+	top := buf.String()
+
+	files := make(map[string]string)
+	err := ctx.WriteDirectoryBuildFiles(func(file string, contents []byte) error {
+		files[file] = string(contents)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(top, "subninja out/subninja/modules.ninja\nsubninja out/subninja/dir/modules.ninja\n") {
+		t.Errorf("missing subninja statements in:\n%s", top)
+	}
+	if !strings.Contains(top, "\nrule g.blueprint.touch\n") {
+		t.Errorf("expected rules to stay in the top-level file:\n%s", top)
+	}
+	if strings.Contains(top, "foo.stamp") || strings.Contains(top, "bar.stamp") {
+		t.Errorf("unexpected module build actions in the top-level file:\n%s", top)
+	}
+
+	if len(files) != 2 {
+		t.Fatalf("expected 2 per-directory files, got %q", files)
+	}
+	if g := files["out/subninja/modules.ninja"]; !strings.Contains(g, "build foo.stamp: g.blueprint.touch dep\n") {
+		t.Errorf("missing foo in out/subninja/modules.ninja:\n%s", g)
+	}
+	if g := files["out/subninja/dir/modules.ninja"]; !strings.Contains(g, "build bar.stamp: g.blueprint.touch dep\n") ||
+		strings.Contains(g, "foo.stamp") {
+		t.Errorf("expected only bar in out/subninja/dir/modules.ninja:\n%s", g)
 	}
 }
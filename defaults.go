@@ -0,0 +1,81 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueprint
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// A DefaultsMergeFunc merges the property structs of a defaults module, src, into the property
+// structs of a module that depends on it, dst.  Both are the property structs returned by the
+// factories of the modules.
+type DefaultsMergeFunc func(dst, src []interface{})
+
+type defaultsMerge struct {
+	tag   DependencyTag
+	merge DefaultsMergeFunc
+}
+
+// RegisterDefaultsMerge registers a function that merges the properties of a defaults module into
+// each module that depends on it with the given dependency tag, so that module types don't each
+// need to implement defaults.  The merge happens at the end of the mutator pass that adds the
+// dependency, so mutators that run later see the merged properties.  A module that depends on
+// several defaults modules has them merged in the order the dependencies were added, and a
+// defaults module that itself depends on defaults modules has them merged before it is merged
+// into the modules that depend on it.  The tag must be comparable, and is matched with ==.
+func (c *Context) RegisterDefaultsMerge(tag DependencyTag, merge func(dst, src []interface{})) {
+	if tag == nil || !reflect.TypeOf(tag).Comparable() {
+		panic(fmt.Errorf("defaults dependency tag %#v is not comparable", tag))
+	}
+	for _, m := range c.defaultsMerges {
+		if m.tag == tag {
+			panic(fmt.Errorf("defaults merge for dependency tag %#v is already registered", tag))
+		}
+	}
+	c.defaultsMerges = append(c.defaultsMerges, defaultsMerge{tag, merge})
+}
+
+// pendingDefaults holds the dependencies on defaults modules that were added by the current
+// mutator pass, keyed by the depending module.
+type pendingDefaults map[*moduleInfo][]pendingDefaultsDep
+
+type pendingDefaultsDep struct {
+	defaults *moduleInfo
+	merge    DefaultsMergeFunc
+}
+
+// addDefaultsDeps records the dependencies in deps that were added to module by the current
+// mutator pass with a tag registered with RegisterDefaultsMerge.
+func (c *Context) addDefaultsDeps(pending pendingDefaults, module *moduleInfo, deps []depInfo) {
+	for _, dep := range deps {
+		for _, m := range c.defaultsMerges {
+			if dep.tag == m.tag {
+				pending[module] = append(pending[module], pendingDefaultsDep{dep.module, m.merge})
+			}
+		}
+	}
+}
+
+// mergeDefaults merges the properties of the defaults modules in pending into the modules that
+// depend on them.  It must be called after updateDependencies, as it merges them in dependency
+// order so that defaults modules have their own defaults merged first.
+func (c *Context) mergeDefaults(pending pendingDefaults) {
+	for _, module := range c.modulesSorted {
+		for _, dep := range pending[module] {
+			dep.merge(module.properties, dep.defaults.properties)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueprint
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/blueprint/proptools"
+)
+
+type defaultsTestTag struct {
+	BaseDependencyTag
+}
+
+var defaultsTag = defaultsTestTag{}
+
+// defaultsTestMutator adds a dependency with defaultsTag on the module named by the foo property.
+func defaultsTestMutator(ctx BottomUpMutatorContext) {
+	if m, ok := ctx.Module().(*fooModule); ok && m.properties.Foo != "" {
+		ctx.AddDependency(ctx.Module(), defaultsTag, m.properties.Foo)
+	}
+}
+
+// mergeDeps prepends the deps property of the defaults module.
+func mergeDeps(dst, src []interface{}) {
+	err := proptools.PrependMatchingProperties(dst, src[0], func(dstField, srcField reflect.StructField) (bool, error) {
+		return srcField.Name == "Deps", nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestDefaultsMerge(t *testing.T) {
+	ctx := NewContext()
+	ctx.RegisterModuleType("foo_module", newFooModule)
+	ctx.RegisterBottomUpMutator("defaults", defaultsTestMutator)
+	ctx.RegisterBottomUpMutator("deps", depsMutator)
+	ctx.RegisterDefaultsMerge(defaultsTag, mergeDeps)
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			foo_module {
+			    name: "A",
+			    foo: "defaults",
+			    deps: ["C"],
+			}
+
+			foo_module {
+			    name: "defaults",
+			    foo: "other_defaults",
+			    deps: ["B"],
+			}
+
+			foo_module {
+			    name: "other_defaults",
+			    deps: ["D"],
+			}
+
+			foo_module {
+			    name: "B",
+			}
+
+			foo_module {
+			    name: "C",
+			}
+
+			foo_module {
+			    name: "D",
+			}
+		`),
+	})
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected dep errors: %v", errs)
+	}
+
+	for _, tc := range []struct {
+		module string
+		foo    string
+		deps   []string
+	}{
+		{"A", "defaults", []string{"D", "B", "C"}},
+		{"defaults", "other_defaults", []string{"D", "B"}},
+		{"other_defaults", "", []string{"D"}},
+		{"B", "", nil},
+	} {
+		module := ctx.moduleGroupFromName(tc.module, nil).modules.firstModule()
+		m := module.logicModule.(*fooModule)
+		if !reflect.DeepEqual(m.properties.Deps, tc.deps) {
+			t.Errorf("expected deps of %s to be %q, got %q", tc.module, tc.deps, m.properties.Deps)
+		}
+		if m.properties.Foo != tc.foo {
+			t.Errorf("expected foo of %s to be %q, got %q", tc.module, tc.foo, m.properties.Foo)
+		}
+
+		// The deps mutator runs after the defaults are merged, so it sees the merged deps.
+		var deps []string
+		for _, dep := range module.directDeps {
+			if dep.tag != defaultsTag {
+				deps = append(deps, dep.module.Name())
+			}
+		}
+		if !reflect.DeepEqual(deps, tc.deps) {
+			t.Errorf("expected dependencies of %s to be %q, got %q", tc.module, tc.deps, deps)
+		}
+	}
+}
+
+func TestRegisterDefaultsMergeTwice(t *testing.T) {
+	ctx := NewContext()
+	ctx.RegisterDefaultsMerge(defaultsTag, mergeDeps)
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("expected registering a second merge for the same tag to panic")
+		}
+	}()
+	ctx.RegisterDefaultsMerge(defaultsTestTag{}, mergeDeps)
+}
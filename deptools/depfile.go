@@ -20,32 +20,34 @@ import (
 	"strings"
 )
 
-var (
-	pathEscaper = strings.NewReplacer(
-		`\`, `\\`,
-		` `, `\ `,
-		`#`, `\#`,
-		`*`, `\*`,
-		`[`, `\[`,
-		`|`, `\|`)
-)
-
 // WriteDepFile creates a new gcc-style depfile and populates it with content
-// indicating that target depends on deps.
+// indicating that target depends on deps.  Spaces, '#' and '$' in the paths are
+// escaped the way Ninja's depfile parser expects.  It is an error for a path to
+// contain a newline or to end with a backslash, as neither can be represented in
+// a depfile.
 func WriteDepFile(filename, target string, deps []string) error {
-	f, err := os.Create(filename)
+	escapedTarget, err := escapePath(target)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
 	var escapedDeps []string
 
 	for _, dep := range deps {
-		escapedDeps = append(escapedDeps, pathEscaper.Replace(dep))
+		escapedDep, err := escapePath(dep)
+		if err != nil {
+			return err
+		}
+		escapedDeps = append(escapedDeps, escapedDep)
 	}
 
-	_, err = fmt.Fprintf(f, "%s: \\\n %s\n", target,
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "%s: \\\n %s\n", escapedTarget,
 		strings.Join(escapedDeps, " \\\n "))
 	if err != nil {
 		return err
@@ -53,3 +55,41 @@ func WriteDepFile(filename, target string, deps []string) error {
 
 	return nil
 }
+
+// escapePath escapes a path for use in a depfile read by Ninja.  Ninja unescapes
+// 2N+1 backslashes followed by a space to N backslashes and a space, a backslash
+// followed by '#' to '#' and "$$" to "$", and leaves any other backslashes alone.
+func escapePath(path string) (string, error) {
+	if strings.ContainsAny(path, "\r\n") {
+		return "", fmt.Errorf("path %q in depfile contains a newline", path)
+	}
+	if strings.HasSuffix(path, `\`) {
+		return "", fmt.Errorf("path %q in depfile ends with a backslash", path)
+	}
+
+	buf := &strings.Builder{}
+	backslashes := 0
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch c {
+		case '\\':
+			backslashes++
+			continue
+		case ' ':
+			buf.WriteString(strings.Repeat(`\`, 2*backslashes+1))
+			buf.WriteByte(' ')
+		case '#':
+			buf.WriteString(strings.Repeat(`\`, backslashes))
+			buf.WriteString(`\#`)
+		case '$':
+			buf.WriteString(strings.Repeat(`\`, backslashes))
+			buf.WriteString("$$")
+		default:
+			buf.WriteString(strings.Repeat(`\`, backslashes))
+			buf.WriteByte(c)
+		}
+		backslashes = 0
+	}
+
+	return buf.String(), nil
+}
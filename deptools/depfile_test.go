@@ -0,0 +1,71 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deptools
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEscapePath(t *testing.T) {
+	testCases := []struct {
+		in, out string
+	}{
+		{in: "a/b.c", out: "a/b.c"},
+		{in: "a b", out: `a\ b`},
+		{in: `a\ b`, out: `a\\\ b`},
+		{in: `a\\ b`, out: `a\\\\\ b`},
+		{in: "a#b", out: `a\#b`},
+		{in: "a$b", out: "a$$b"},
+		{in: `a\b`, out: `a\b`},
+		{in: "a*[b]|c", out: "a*[b]|c"},
+	}
+	for _, tc := range testCases {
+		got, err := escapePath(tc.in)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", tc.in, err)
+		} else if got != tc.out {
+			t.Errorf("incorrect escaping of %q: expected %q, got %q", tc.in, tc.out, got)
+		}
+	}
+
+	for _, in := range []string{"a\nb", "a\rb", `a\`} {
+		if _, err := escapePath(in); err == nil {
+			t.Errorf("expected error for %q", in)
+		}
+	}
+}
+
+func TestWriteDepFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.d")
+	err := WriteDepFile(path, "out dir/out", []string{"a b", "c$d", "e#f"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "out\\ dir/out: \\\n a\\ b \\\n c$$d \\\n e\\#f\n"
+	if string(got) != expected {
+		t.Errorf("incorrect depfile:\n  expected: %q\n       got: %q", expected, string(got))
+	}
+
+	if err := WriteDepFile(path, "out", []string{"bad\n"}); err == nil {
+		t.Errorf("expected error for dep containing a newline")
+	}
+}
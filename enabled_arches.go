@@ -0,0 +1,228 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueprint
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/google/blueprint/proptools"
+)
+
+// EnabledArchesProperties can be added to the properties of a module type to support the
+// enabled_arches property used by ArchMutator, for example:
+//
+//	my_module {
+//	    name: "only_64",
+//	    enabled_arches: ["arm64", "x86_64"],
+//	}
+type EnabledArchesProperties struct {
+	// Enabled_arches lists the architectures that the module is built for.  If it is empty the
+	// module is built for all architectures.
+	Enabled_arches []string
+}
+
+func (p *EnabledArchesProperties) EnabledArches() []string {
+	return p.Enabled_arches
+}
+
+// EnabledArchesModule is implemented by modules that are only built for some architectures,
+// usually by embedding EnabledArchesProperties.
+type EnabledArchesModule interface {
+	Module
+
+	// EnabledArches returns the architectures that the module is built for, or an empty list if
+	// it is built for all architectures.
+	EnabledArches() []string
+}
+
+// ArchMutator returns a BottomUpMutator that splits each module into one variant for each of
+// arches, in order, leaving out the architectures that are not listed in the module's
+// EnabledArches.  Dependencies of a module on a variant of another module that is disabled
+// for the architecture of the depending variant are reported as errors.
+//
+// Properties of type map[string][]string are arch-specific lists keyed by arch, with the key
+// "common" for the entries that are used for every arch, for example:
+//
+//	my_module {
+//	    name: "foo",
+//	    arch_srcs: {
+//	        common: ["foo.c"],
+//	        arm64: ["foo_arm64.c"],
+//	    },
+//	}
+//
+// After the module is split the property of each variant only contains the key for the arch of
+// the variant, whose list is the common entries followed by the entries for the arch.  Modules
+// with the common property are not split, their property only contains the "common" key.
+func ArchMutator(arches []string) BottomUpMutator {
+	return func(ctx BottomUpMutatorContext) {
+		mctx := ctx.(*mutatorContext)
+
+		if !checkArchLists(ctx, mctx.module.properties, arches) {
+			return
+		}
+
+		variations := enabledArches(mctx.module.logicModule, arches)
+		if len(variations) == 0 {
+			ctx.PropertyErrorf("enabled_arches", "none of the enabled arches are in %q", arches)
+			return
+		}
+
+		// Dependencies are visited before the modules that depend on them, so they have already
+		// been split into their enabled arches.
+		failed := false
+		for _, dep := range mctx.module.directDeps {
+			depArches := make(map[string]bool)
+			for _, variant := range dep.module.splitModules {
+				if arch, ok := variant.moduleOrAliasVariant().variations[mctx.name]; ok {
+					depArches[arch] = true
+				}
+			}
+			if len(depArches) == 0 {
+				continue
+			}
+			for _, arch := range variations {
+				if !depArches[arch] {
+					ctx.ModuleErrorf("depends on disabled module %q: it is not enabled for arch %q",
+						dep.module.Name(), arch)
+					failed = true
+				}
+			}
+		}
+		if failed {
+			return
+		}
+
+		ctx.CreateVariations(variations...)
+
+		for i, variant := range mctx.newVariations {
+			arch := variations[i]
+			if variant.module().common {
+				// Common modules are not split, they only use the entries for every arch.
+				arch = archListCommon
+			}
+			resolveArchLists(variant.module().properties, arch)
+		}
+	}
+}
+
+// archListCommon is the key of an arch-specific list property for the entries used by all arches.
+const archListCommon = "common"
+
+// visitArchLists calls visit for each map[string][]string property in a list of property
+// structs, with its dotted property name.
+func visitArchLists(propertyStructs []interface{}, visit func(name string, v reflect.Value)) {
+	var walk func(prefix string, v reflect.Value)
+	walk = func(prefix string, v reflect.Value) {
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name := prefix + proptools.PropertyNameForField(field.Name)
+			fieldValue := v.Field(i)
+
+			if fieldValue.Kind() == reflect.Interface || fieldValue.Kind() == reflect.Ptr {
+				if fieldValue.IsNil() {
+					continue
+				}
+				fieldValue = fieldValue.Elem()
+				if fieldValue.Kind() == reflect.Ptr {
+					fieldValue = fieldValue.Elem()
+				}
+			}
+
+			switch fieldValue.Kind() {
+			case reflect.Struct:
+				if field.Anonymous {
+					walk(prefix, fieldValue)
+				} else {
+					walk(name+".", fieldValue)
+				}
+			case reflect.Map:
+				visit(name, fieldValue)
+			}
+		}
+	}
+
+	for _, props := range propertyStructs {
+		walk("", reflect.ValueOf(props).Elem())
+	}
+}
+
+// checkArchLists reports an error for each key of an arch-specific list property that is not
+// one of arches or "common", and returns false if there were any.
+func checkArchLists(ctx BottomUpMutatorContext, propertyStructs []interface{}, arches []string) bool {
+	valid := map[string]bool{archListCommon: true}
+	for _, arch := range arches {
+		valid[arch] = true
+	}
+
+	ok := true
+	visitArchLists(propertyStructs, func(name string, v reflect.Value) {
+		var keys []string
+		for key := range v.Interface().(map[string][]string) {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if !valid[key] {
+				ctx.PropertyErrorf(name+"."+key, "unknown arch %q, expected one of %q", key, arches)
+				ok = false
+			}
+		}
+	})
+	return ok
+}
+
+// resolveArchLists replaces each arch-specific list property with a map containing only arch,
+// whose list is the common entries followed by the entries for arch, or only the common entries
+// if arch is archListCommon.
+func resolveArchLists(propertyStructs []interface{}, arch string) {
+	visitArchLists(propertyStructs, func(name string, v reflect.Value) {
+		m := v.Interface().(map[string][]string)
+		if m == nil {
+			return
+		}
+		var list []string
+		list = append(list, m[archListCommon]...)
+		if arch != archListCommon {
+			list = append(list, m[arch]...)
+		}
+		v.Set(reflect.ValueOf(map[string][]string{arch: list}))
+	})
+}
+
+// enabledArches returns the elements of arches that are enabled for the module.
+func enabledArches(module Module, arches []string) []string {
+	m, ok := module.(EnabledArchesModule)
+	if !ok || len(m.EnabledArches()) == 0 {
+		return arches
+	}
+
+	enabled := make(map[string]bool)
+	for _, arch := range m.EnabledArches() {
+		enabled[arch] = true
+	}
+
+	var ret []string
+	for _, arch := range arches {
+		if enabled[arch] {
+			ret = append(ret, arch)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,189 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueprint
+
+import (
+	"reflect"
+	"testing"
+)
+
+type enabledArchesTestModule struct {
+	SimpleName
+	EnabledArchesProperties
+	properties struct {
+		Deps      []string
+		Arch_srcs map[string][]string
+	}
+}
+
+func newEnabledArchesTestModule() (Module, []interface{}) {
+	m := &enabledArchesTestModule{}
+	return m, []interface{}{&m.SimpleName.Properties, &m.EnabledArchesProperties, &m.properties}
+}
+
+func (m *enabledArchesTestModule) GenerateBuildActions(ModuleContext) {}
+
+func enabledArchesDepsMutator(ctx BottomUpMutatorContext) {
+	m := ctx.Module().(*enabledArchesTestModule)
+	ctx.AddDependency(m, nil, m.properties.Deps...)
+}
+
+func runEnabledArchesTest(t *testing.T, bp string) (*Context, []error) {
+	t.Helper()
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(bp),
+	})
+	ctx.RegisterModuleType("test", newEnabledArchesTestModule)
+	ctx.RegisterBottomUpMutator("deps", enabledArchesDepsMutator)
+	ctx.RegisterBottomUpMutator("arch", ArchMutator([]string{"arm", "arm64"}))
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+	_, errs = ctx.ResolveDependencies(nil)
+	return ctx, errs
+}
+
+func TestArchMutator(t *testing.T) {
+	t.Run("enabled arches", func(t *testing.T) {
+		ctx, errs := runEnabledArchesTest(t, `
+			test {
+			    name: "all",
+			    deps: ["all_dep"],
+			}
+			test {
+			    name: "all_dep",
+			}
+			test {
+			    name: "only64",
+			    enabled_arches: ["arm64"],
+			    deps: ["all_dep"],
+			}
+		`)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+
+		variants := func(name string) []string {
+			var ret []string
+			for _, m := range ctx.moduleGroupFromName(name, nil).modules {
+				ret = append(ret, m.moduleOrAliasVariant().name)
+			}
+			return ret
+		}
+		if g, w := variants("all"), []string{"arm", "arm64"}; !reflect.DeepEqual(g, w) {
+			t.Errorf("expected variants %q, got %q", w, g)
+		}
+		if g, w := variants("only64"), []string{"arm64"}; !reflect.DeepEqual(g, w) {
+			t.Errorf("expected variants %q, got %q", w, g)
+		}
+	})
+
+	t.Run("arch lists", func(t *testing.T) {
+		ctx, errs := runEnabledArchesTest(t, `
+			test {
+			    name: "foo",
+			    arch_srcs: {
+			        common: ["foo.c"],
+			        arm64: ["foo_arm64.c"],
+			    },
+			}
+		`)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+
+		want := []map[string][]string{
+			{"arm": {"foo.c"}},
+			{"arm64": {"foo.c", "foo_arm64.c"}},
+		}
+		var got []map[string][]string
+		for _, m := range ctx.moduleGroupFromName("foo", nil).modules {
+			got = append(got, m.module().logicModule.(*enabledArchesTestModule).properties.Arch_srcs)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected arch_srcs %q, got %q", want, got)
+		}
+	})
+
+	t.Run("common module arch lists", func(t *testing.T) {
+		ctx, errs := runEnabledArchesTest(t, `
+			test {
+			    name: "foo",
+			    common: true,
+			    arch_srcs: {
+			        common: ["foo.c"],
+			        arm64: ["foo_arm64.c"],
+			    },
+			}
+		`)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+
+		foo := ctx.moduleGroupFromName("foo", nil).modules.firstModule()
+		want := map[string][]string{"common": {"foo.c"}}
+		if got := foo.logicModule.(*enabledArchesTestModule).properties.Arch_srcs; !reflect.DeepEqual(got, want) {
+			t.Errorf("expected arch_srcs %q, got %q", want, got)
+		}
+	})
+
+	t.Run("unknown arch in arch list", func(t *testing.T) {
+		_, errs := runEnabledArchesTest(t, `
+			test {
+			    name: "foo",
+			    arch_srcs: {
+			        x86: ["foo_x86.c"],
+			    },
+			}
+		`)
+		expected := `Android.bp:5:15: module "foo": arch_srcs.x86: unknown arch "x86", expected one of ["arm" "arm64"]`
+		if len(errs) != 1 || errs[0].Error() != expected {
+			t.Errorf("expected error %q, got %q", expected, errs)
+		}
+	})
+
+	t.Run("depends on disabled module", func(t *testing.T) {
+		_, errs := runEnabledArchesTest(t, `
+			test {
+			    name: "all",
+			    deps: ["only64"],
+			}
+			test {
+			    name: "only64",
+			    enabled_arches: ["arm64"],
+			}
+		`)
+		expected := `Android.bp:2:4: module "all": depends on disabled module "only64": it is not enabled for arch "arm"`
+		if len(errs) != 1 || errs[0].Error() != expected {
+			t.Errorf("expected error %q, got %q", expected, errs)
+		}
+	})
+
+	t.Run("no enabled arches", func(t *testing.T) {
+		_, errs := runEnabledArchesTest(t, `
+			test {
+			    name: "none",
+			    enabled_arches: ["x86"],
+			}
+		`)
+		expected := `Android.bp:4:22: module "none": enabled_arches: none of the enabled arches are in ["arm" "arm64"]`
+		if len(errs) != 1 || errs[0].Error() != expected {
+			t.Errorf("expected error %q, got %q", expected, errs)
+		}
+	})
+}
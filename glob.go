@@ -16,10 +16,14 @@ package blueprint
 
 import (
 	"fmt"
+	"path/filepath"
+	"reflect"
+	"slices"
 	"sort"
 	"strings"
 
 	"github.com/google/blueprint/pathtools"
+	"github.com/google/blueprint/proptools"
 )
 
 func verifyGlob(key globKey, pattern string, excludes []string, g pathtools.GlobResult) {
@@ -38,13 +42,35 @@ func verifyGlob(key globKey, pattern string, excludes []string, g pathtools.Glob
 }
 
 func (c *Context) glob(pattern string, excludes []string) ([]string, error) {
-	// Sort excludes so that two globs with the same excludes in a different order reuse the same
-	// key.  Make a copy first to avoid modifying the caller's version.
-	excludes = append([]string(nil), excludes...)
+	return c.moduleGlob(nil, pattern, excludes)
+}
+
+// moduleGlob is like glob, but also records module, if it is not nil, as one of the modules that
+// requested the glob for RegisteredGlobs.
+func (c *Context) moduleGlob(module *moduleInfo, pattern string, excludes []string) ([]string, error) {
+	// Add the defaults set by SetGlobExcludeDefaults, then sort and deduplicate the excludes so
+	// that two globs with the same excludes in a different order reuse the same key.  Make a copy
+	// first to avoid modifying the caller's version.
+	excludes = append(append([]string(nil), excludes...), c.globExcludeDefaults...)
+	if c.caseInsensitiveFS {
+		pattern = pathtools.CanonicalCase(c.fs, pattern)
+		for i, exclude := range excludes {
+			excludes[i] = pathtools.CanonicalCase(c.fs, exclude)
+		}
+	}
 	sort.Strings(excludes)
+	excludes = slices.Compact(excludes)
 
 	key := globToKey(pattern, excludes)
 
+	if module != nil {
+		c.globLock.Lock()
+		if !slices.Contains(c.globRequesters[key], module) {
+			c.globRequesters[key] = append(c.globRequesters[key], module)
+		}
+		c.globLock.Unlock()
+	}
+
 	// Try to get existing glob from the stored results
 	c.globLock.Lock()
 	g, exists := c.globs[key]
@@ -62,6 +88,9 @@ func (c *Context) glob(pattern string, excludes []string) ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
+	if c.caseInsensitiveFS {
+		result = result.WithCanonicalCase(c.fs)
+	}
 
 	// Store the results
 	c.globLock.Lock()
@@ -102,6 +131,56 @@ func (c *Context) Globs() pathtools.MultipleGlobResults {
 	return globs
 }
 
+// GlobSpec describes a glob made during the build, see Context.RegisteredGlobs.
+type GlobSpec struct {
+	// Pattern and Excludes are the pattern and the excludes of the glob, including the defaults
+	// set by SetGlobExcludeDefaults.
+	Pattern  string
+	Excludes []string
+
+	// Modules is the list of modules that requested the glob, for example with
+	// ModuleContext.GlobWithDeps, ModuleContext.AddGlobDependency or a property tagged
+	// `blueprint:"glob"`.  It is empty for globs that were only requested by singletons or used to
+	// find Blueprints files.
+	Modules []Module
+}
+
+// RegisteredGlobs returns the distinct globs, by pattern and excludes, that were made during the
+// build, along with the modules that requested each of them.  It can be used to audit the globs
+// for performance, for example to find overly broad recursive patterns.
+func (c *Context) RegisteredGlobs() []GlobSpec {
+	c.globLock.Lock()
+	defer c.globLock.Unlock()
+
+	keys := make([]globKey, 0, len(c.globs))
+	for k := range c.globs {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].pattern != keys[j].pattern {
+			return keys[i].pattern < keys[j].pattern
+		}
+		return keys[i].excludes < keys[j].excludes
+	})
+
+	specs := make([]GlobSpec, len(keys))
+	for i, key := range keys {
+		g := c.globs[key]
+		requesters := append([]*moduleInfo(nil), c.globRequesters[key]...)
+		sort.Slice(requesters, func(i, j int) bool {
+			return visitOrderLess(requesters[i], requesters[j])
+		})
+		specs[i] = GlobSpec{
+			Pattern:  g.Pattern,
+			Excludes: append([]string(nil), g.Excludes...),
+		}
+		for _, module := range requesters {
+			specs[i].Modules = append(specs[i].Modules, module.logicModule)
+		}
+	}
+	return specs
+}
+
 // globKey combines a pattern and a list of excludes into a hashable struct to be used as a key in
 // a map.
 type globKey struct {
@@ -114,3 +193,110 @@ type globKey struct {
 func globToKey(pattern string, excludes []string) globKey {
 	return globKey{pattern, strings.Join(excludes, "|")}
 }
+
+// expandGlobProperties expands the elements containing glob characters in the []string properties
+// of a module that are tagged `blueprint:"glob"`.  The patterns are relative to the directory of
+// the Blueprints file that defines the module, and so are the matching files that replace them.
+// Elements prefixed with "!" are excluded from every glob in the property, and elements without
+// glob characters are left as they are.  The globs are recorded like those made through
+// GlobWithDeps, so the build is regenerated when the list of matching files changes.
+func (c *Context) expandGlobProperties(module *moduleInfo) []error {
+	var errs []error
+
+	expand := func(name string, v reflect.Value) {
+		list := v.Interface().([]string)
+		if !pathtools.HasGlob(list) {
+			return
+		}
+		expanded, expandErrs := c.expandGlobList(module, name, list)
+		errs = append(errs, expandErrs...)
+		v.Set(reflect.ValueOf(expanded))
+	}
+
+	var walk func(prefix string, v reflect.Value)
+	walk = func(prefix string, v reflect.Value) {
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if !field.IsExported() && !field.Anonymous {
+				continue
+			}
+			name := prefix + proptools.PropertyNameForField(field.Name)
+			fieldValue := v.Field(i)
+			if fieldValue.Kind() == reflect.Ptr {
+				if fieldValue.IsNil() || fieldValue.Elem().Kind() != reflect.Struct {
+					continue
+				}
+				fieldValue = fieldValue.Elem()
+			}
+			switch {
+			case fieldValue.Kind() == reflect.Struct:
+				if field.Anonymous {
+					walk(prefix, fieldValue)
+				} else {
+					walk(name+".", fieldValue)
+				}
+			case proptools.HasTag(field, "blueprint", "glob"):
+				if fieldValue.Type() != reflect.TypeOf([]string(nil)) {
+					panic(fmt.Errorf(`field %s tagged blueprint:"glob" must be a []string`, name))
+				}
+				expand(name, fieldValue)
+			}
+		}
+	}
+
+	for _, props := range module.properties {
+		walk("", reflect.ValueOf(props).Elem())
+	}
+
+	return errs
+}
+
+// expandGlobList expands the elements containing glob characters in the list of paths in the
+// property name of a module, as described in expandGlobProperties.
+func (c *Context) expandGlobList(module *moduleInfo, name string, list []string) ([]string, []error) {
+	var errs []error
+	dir := filepath.Dir(module.relBlueprintsFile)
+
+	var patterns, excludes []string
+	for _, s := range list {
+		if strings.HasPrefix(s, "!") {
+			excludes = append(excludes, filepath.Join(dir, s[1:]))
+		} else {
+			patterns = append(patterns, s)
+		}
+	}
+
+	var expanded []string
+	for _, s := range patterns {
+		if !pathtools.IsGlob(s) {
+			expanded = append(expanded, s)
+			continue
+		}
+		matches, err := c.moduleGlob(module, filepath.Join(dir, s), excludes)
+		if err != nil {
+			errs = append(errs, &PropertyError{
+				ModuleError: ModuleError{
+					BlueprintError: BlueprintError{
+						Err: fmt.Errorf("glob %q: %s", s, err),
+						Pos: module.propertyPos[name],
+					},
+					module: module,
+				},
+				property: name,
+			})
+			continue
+		}
+		for _, match := range matches {
+			if strings.HasSuffix(match, "/") {
+				// Skip directories.
+				continue
+			}
+			rel, err := filepath.Rel(dir, match)
+			if err != nil {
+				panic(err)
+			}
+			expanded = append(expanded, rel)
+		}
+	}
+	return expanded, errs
+}
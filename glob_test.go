@@ -14,7 +14,10 @@
 
 package blueprint
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 func TestGlobCache(t *testing.T) {
 	ctx := NewContext()
@@ -53,3 +56,172 @@ func TestGlobCache(t *testing.T) {
 		t.Error(`expected ["a/a"], got`, matches)
 	}
 }
+
+func TestGlobExcludeDefaults(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": nil,
+		"a/a":        nil,
+		"a/a~":       nil,
+		"a/b":        nil,
+		"a/OWNERS":   nil,
+	})
+	ctx.SetGlobExcludeDefaults([]string{"**/*~", "**/OWNERS"})
+
+	matches, err := ctx.glob("a/*", nil)
+	if err != nil {
+		t.Error("unexpected error", err)
+	}
+	if len(matches) != 2 || matches[0] != "a/a" || matches[1] != "a/b" {
+		t.Error(`expected ["a/a", "a/b"], got`, matches)
+	}
+
+	// Excludes passed to the glob are combined with the defaults, and repeating a default
+	// reuses the same glob.
+	matches, err = ctx.glob("a/*", []string{"a/b", "**/OWNERS"})
+	if err != nil {
+		t.Error("unexpected error", err)
+	}
+	if len(matches) != 1 || matches[0] != "a/a" {
+		t.Error(`expected ["a/a"], got`, matches)
+	}
+
+	globs := ctx.Globs()
+	if len(globs) != 2 {
+		t.Fatalf("expected 2 globs, got %d", len(globs))
+	}
+	for _, g := range globs {
+		if len(g.Excludes) < 2 || g.Excludes[0] != "**/*~" || g.Excludes[1] != "**/OWNERS" {
+			t.Errorf("expected the default excludes to be recorded in the glob result, got %q", g.Excludes)
+		}
+	}
+}
+
+type globPropertiesTestModule struct {
+	SimpleName
+	properties struct {
+		Srcs   []string `blueprint:"glob"`
+		Other  []string
+		Nested struct {
+			Srcs []string `blueprint:"glob"`
+		}
+	}
+}
+
+func globPropertiesTestModuleFactory() (Module, []interface{}) {
+	module := &globPropertiesTestModule{}
+	return module, []interface{}{&module.SimpleName.Properties, &module.properties}
+}
+
+func (m *globPropertiesTestModule) GenerateBuildActions(ModuleContext) {}
+
+func TestGlobProperties(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"dir/Android.bp": []byte(`
+			test {
+			    name: "foo",
+			    srcs: ["*.c", "!b.c", "gen.c"],
+			    other: ["*.c"],
+			    nested: {
+			        srcs: ["sub/*.c"],
+			    },
+			}
+		`),
+		"dir/a.c":     nil,
+		"dir/b.c":     nil,
+		"dir/c.h":     nil,
+		"dir/sub/d.c": nil,
+	})
+	ctx.RegisterModuleType("test", globPropertiesTestModuleFactory)
+
+	_, errs := ctx.ParseFileList(".", []string{"dir/Android.bp"}, nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+
+	foo := ctx.moduleGroupFromName("foo", nil).moduleByVariantName("").logicModule.(*globPropertiesTestModule)
+	if g, w := foo.properties.Srcs, []string{"a.c", "gen.c"}; !reflect.DeepEqual(g, w) {
+		t.Errorf("expected srcs %q, got %q", w, g)
+	}
+	if g, w := foo.properties.Other, []string{"*.c"}; !reflect.DeepEqual(g, w) {
+		t.Errorf("expected other %q, got %q", w, g)
+	}
+	if g, w := foo.properties.Nested.Srcs, []string{"sub/d.c"}; !reflect.DeepEqual(g, w) {
+		t.Errorf("expected nested.srcs %q, got %q", w, g)
+	}
+
+	globs := ctx.Globs()
+	if len(globs) != 2 || globs[0].Pattern != "dir/*.c" || !reflect.DeepEqual(globs[0].Excludes, []string{"dir/b.c"}) {
+		t.Errorf("expected the globs to be recorded, got %+v", globs)
+	}
+}
+
+func TestGlobCaseInsensitiveFS(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": nil,
+		"Dir/A.c":    nil,
+		"Dir/b.c":    nil,
+	})
+	ctx.SetCaseInsensitiveFS(true)
+
+	for _, pattern := range []string{"dir/*.c", "DIR/*.c", "Dir/*.c"} {
+		matches, err := ctx.glob(pattern, []string{"dir/B.C"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w := []string{"Dir/A.c"}; !reflect.DeepEqual(matches, w) {
+			t.Errorf("glob %q: expected %q, got %q", pattern, w, matches)
+		}
+	}
+
+	globs := ctx.Globs()
+	if len(globs) != 1 || globs[0].Pattern != "Dir/*.c" || !reflect.DeepEqual(globs[0].Excludes, []string{"Dir/b.c"}) {
+		t.Errorf("expected a single glob in the stored case, got %+v", globs)
+	}
+}
+
+func TestRegisteredGlobs(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"dir/Android.bp": []byte(`
+			test {
+			    name: "foo",
+			    srcs: ["*.c"],
+			}
+			test {
+			    name: "bar",
+			    srcs: ["*.c"],
+			    nested: {
+			        srcs: ["*.c", "!a.c"],
+			    },
+			}
+		`),
+		"dir/a.c": nil,
+		"dir/b.c": nil,
+	})
+	ctx.RegisterModuleType("test", globPropertiesTestModuleFactory)
+
+	_, errs := ctx.ParseFileList(".", []string{"dir/Android.bp"}, nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+
+	if _, err := ctx.glob("dir/*.h", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	module := func(name string) Module {
+		return ctx.moduleGroupFromName(name, nil).moduleByVariantName("").logicModule
+	}
+
+	want := []GlobSpec{
+		{Pattern: "dir/*.c", Modules: []Module{module("bar"), module("foo")}},
+		{Pattern: "dir/*.c", Excludes: []string{"dir/a.c"}, Modules: []Module{module("bar")}},
+		{Pattern: "dir/*.h"},
+	}
+	if g := ctx.RegisteredGlobs(); !reflect.DeepEqual(g, want) {
+		t.Errorf("expected globs %+v, got %+v", want, g)
+	}
+}
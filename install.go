@@ -0,0 +1,173 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueprint
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/blueprint/proptools"
+)
+
+// InstallPhonyTarget is the name of the phony Ninja target that depends on every output that is
+// installed by a module with an install_to property.
+const InstallPhonyTarget = "install"
+
+// InstallProperties can be added to the properties of a module type to support the install_to
+// property used by Context.InstallMap, for example:
+//
+//	my_binary {
+//	    name: "foo",
+//	    install_to: "bin",
+//	}
+type InstallProperties struct {
+	// Install_to is the directory, relative to the install root, that the outputs of the module
+	// are installed to.  The module is not installed if it is not set.
+	Install_to *string
+}
+
+func (p *InstallProperties) InstallTo() string {
+	return proptools.String(p.Install_to)
+}
+
+// InstallableModule is implemented by modules that can be installed, usually by embedding
+// InstallProperties.
+type InstallableModule interface {
+	Module
+
+	// InstallTo returns the directory, relative to the install root, that the outputs of the
+	// module are installed to, or an empty string if the module is not installed.
+	InstallTo() string
+}
+
+// InstallMap returns a map from each installed output to its destination relative to the install
+// root.  The installed outputs of a module with an install_to property are the explicit outputs
+// of its build statements, except those with BuildParams.NoCache set, and each is installed to
+// the install_to directory under its own base name.  Outputs are written as they appear in the
+// Ninja manifest, with the values of variables expanded.  The map is computed by
+// PrepareBuildActions, which also adds a phony InstallPhonyTarget target that depends on all of
+// the installed outputs.
+func (c *Context) InstallMap() map[string]string {
+	ret := make(map[string]string, len(c.installMap))
+	for src, dest := range c.installMap {
+		ret[src] = dest
+	}
+	return ret
+}
+
+// generateInstallMap computes the map returned by InstallMap.  It returns an error for each
+// install_to property that is not a relative path inside the install root, and for each
+// destination that is installed by more than one output.
+func (c *Context) generateInstallMap() (map[string]string, []error) {
+	var errs []error
+
+	propertyError := func(module *moduleInfo, format string, args ...interface{}) {
+		pos := module.propertyPos["install_to"]
+		if !pos.IsValid() {
+			pos = module.pos
+		}
+		errs = append(errs, &PropertyError{
+			ModuleError: ModuleError{
+				BlueprintError: BlueprintError{
+					Err: fmt.Errorf(format, args...),
+					Pos: pos,
+				},
+				module: module,
+			},
+			property: "install_to",
+		})
+	}
+
+	globalLookup := func(v Variable) *ninjaString {
+		return c.liveGlobals.variables[v]
+	}
+
+	installMap := make(map[string]string)
+	installedBy := make(map[string]*moduleInfo)
+	for _, module := range c.sortedModules() {
+		installable, ok := module.logicModule.(InstallableModule)
+		if !ok || module.disabled || installable.InstallTo() == "" {
+			continue
+		}
+
+		installTo := filepath.Clean(installable.InstallTo())
+		if filepath.IsAbs(installTo) || installTo == ".." || strings.HasPrefix(installTo, "../") {
+			propertyError(module, "%q is not a relative path inside the install root", installable.InstallTo())
+			continue
+		}
+
+		locals := make(map[Variable]*ninjaString, len(module.actionDefs.variables))
+		for _, v := range module.actionDefs.variables {
+			locals[v] = v.value_
+		}
+		lookup := func(v Variable) *ninjaString {
+			if value, ok := locals[v]; ok {
+				return value
+			}
+			return globalLookup(v)
+		}
+
+		var outputs []string
+		for _, def := range module.actionDefs.buildDefs {
+			if def.NoCache {
+				continue
+			}
+			outputs = append(outputs, def.OutputStrings...)
+			for _, output := range def.Outputs {
+				outputs = append(outputs, output.expand(lookup, c.nameTracker))
+			}
+		}
+
+		for _, output := range outputs {
+			dest := filepath.Join(installTo, filepath.Base(output))
+			if other, exists := installedBy[dest]; exists {
+				propertyError(module, "%q is also installed by %s", dest, other)
+				continue
+			}
+			installedBy[dest] = module
+			installMap[output] = dest
+		}
+	}
+
+	return installMap, errs
+}
+
+// writeInstallPhony writes the phony InstallPhonyTarget target that depends on every installed
+// output in installMap.
+func writeInstallPhony(nw *ninjaWriter, installMap map[string]string, nameTracker *nameTracker) error {
+	if len(installMap) == 0 {
+		return nil
+	}
+
+	sources := make([]string, 0, len(installMap))
+	for src := range installMap {
+		sources = append(sources, src)
+	}
+	sort.Strings(sources)
+
+	def := &buildDef{
+		Comment:       "Installed outputs",
+		Rule:          Phony,
+		OutputStrings: []string{InstallPhonyTarget},
+		InputStrings:  sources,
+		Optional:      true,
+	}
+	if err := def.WriteTo(nw, nameTracker); err != nil {
+		return err
+	}
+	return nw.BlankLine()
+}
@@ -0,0 +1,172 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueprint
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var (
+	installTestPctx = NewPackageContext("github.com/google/blueprint/install_test")
+
+	installTestCopyRule = installTestPctx.StaticRule("copy",
+		RuleParams{
+			Command: "cp $in $out",
+		})
+)
+
+type installTestModule struct {
+	SimpleName
+	InstallProperties
+	properties struct {
+		Outs []string
+	}
+}
+
+func newInstallTestModule() (Module, []interface{}) {
+	m := &installTestModule{}
+	return m, []interface{}{&m.SimpleName.Properties, &m.InstallProperties, &m.properties}
+}
+
+func (m *installTestModule) GenerateBuildActions(ctx ModuleContext) {
+	ctx.Variable(installTestPctx, "outDir", "out/"+ctx.ModuleName())
+	for _, out := range m.properties.Outs {
+		ctx.Build(installTestPctx, BuildParams{
+			Rule:    installTestCopyRule,
+			Outputs: []string{"${outDir}/" + out},
+			Inputs:  []string{out + ".in"},
+		})
+	}
+	ctx.Build(installTestPctx, BuildParams{
+		Rule:    installTestCopyRule,
+		Outputs: []string{ctx.ModuleName() + ".tmp"},
+		Inputs:  []string{"tmp.in"},
+		NoCache: true,
+	})
+}
+
+func runInstallTest(t *testing.T, bp string) (*Context, []error) {
+	t.Helper()
+	ctx := NewContext()
+	ctx.RegisterModuleType("test", newInstallTestModule)
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(bp),
+	})
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected dep errors: %v", errs)
+	}
+	_, errs = ctx.PrepareBuildActions(nil)
+	return ctx, errs
+}
+
+func TestInstallMap(t *testing.T) {
+	t.Run("installed", func(t *testing.T) {
+		ctx, errs := runInstallTest(t, `
+			test {
+			    name: "foo",
+			    outs: ["foo", "foo.conf"],
+			    install_to: "bin",
+			}
+			test {
+			    name: "bar",
+			    outs: ["libbar.so"],
+			    install_to: "./lib/",
+			}
+			test {
+			    name: "baz",
+			    outs: ["baz"],
+			}
+		`)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+
+		want := map[string]string{
+			"out/foo/foo":       "bin/foo",
+			"out/foo/foo.conf":  "bin/foo.conf",
+			"out/bar/libbar.so": "lib/libbar.so",
+		}
+		if g := ctx.InstallMap(); !reflect.DeepEqual(g, want) {
+			t.Errorf("expected install map %q, got %q", want, g)
+		}
+
+		buf := &strings.Builder{}
+		if err := ctx.WriteBuildFile(buf); err != nil {
+			t.Fatal(err)
+		}
+		phony := "build install: phony out/bar/libbar.so out/foo/foo out/foo/foo.conf\n"
+		if !strings.Contains(buf.String(), phony) {
+			t.Errorf("expected install phony %q in:\n%s", phony, buf.String())
+		}
+		if strings.Contains(buf.String(), "default install") {
+			t.Errorf("expected install phony not to be built by default")
+		}
+	})
+
+	t.Run("absolute", func(t *testing.T) {
+		_, errs := runInstallTest(t, `
+			test {
+			    name: "foo",
+			    outs: ["foo"],
+			    install_to: "/bin",
+			}
+		`)
+		expected := `Android.bp:5:18: module "foo": install_to: "/bin" is not a relative path inside the install root`
+		if len(errs) != 1 || errs[0].Error() != expected {
+			t.Errorf("expected error %q, got %q", expected, errs)
+		}
+	})
+
+	t.Run("outside install root", func(t *testing.T) {
+		_, errs := runInstallTest(t, `
+			test {
+			    name: "foo",
+			    outs: ["foo"],
+			    install_to: "bin/../..",
+			}
+		`)
+		expected := `Android.bp:5:18: module "foo": install_to: "bin/../.." is not a relative path inside the install root`
+		if len(errs) != 1 || errs[0].Error() != expected {
+			t.Errorf("expected error %q, got %q", expected, errs)
+		}
+	})
+
+	t.Run("collision", func(t *testing.T) {
+		_, errs := runInstallTest(t, `
+			test {
+			    name: "foo",
+			    outs: ["tool"],
+			    install_to: "bin",
+			}
+			test {
+			    name: "bar",
+			    outs: ["tool"],
+			    install_to: "bin",
+			}
+		`)
+		expected := `Android.bp:5:18: module "foo": install_to: "bin/tool" is also installed by module "bar"`
+		if len(errs) != 1 || errs[0].Error() != expected {
+			t.Errorf("expected error %q, got %q", expected, errs)
+		}
+	})
+}
@@ -0,0 +1,298 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueprint
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"text/scanner"
+
+	"github.com/google/blueprint/parser"
+)
+
+// ParseJSONModules adds the modules described by a JSON document to the Context, as an
+// alternative to Blueprints syntax for tools that generate modules.  The document is a list of
+// objects, one per module, with the module type in the "type" key and the properties in the
+// other keys, for example:
+//
+//	[{"type": "foo_module", "name": "A", "deps": ["B"]}]
+//
+// JSON strings, booleans, integers, lists and objects become the equivalent Blueprints values.
+// The modules are unpacked and added the same way as modules parsed by ParseFileList, including
+// running their load hooks and init hooks, loading the sidecar dependencies of path and skipping
+// path if it is excluded by AddSourceRootDirs, and path is used as their Blueprints file.  Errors
+// are reported in the same format as errors in Blueprints files, with the line and column in the
+// JSON document.
+// The returned deps are the Ninja file dependencies added by load hooks and sidecar loaders.
+func (c *Context) ParseJSONModules(path string, contents []byte,
+	config interface{}) (deps []string, errs []error) {
+
+	defer func() {
+		errs = c.failFastErrors(errs)
+		c.reportErrors(errs)
+	}()
+
+	defs, errs := parseJSONModules(path, contents)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	file := &parser.File{Name: path}
+	for _, def := range defs {
+		file.Defs = append(file.Defs, def)
+	}
+
+	return c.addFileModules(context.Background(), 1, config, func(handleOneFile FileHandler) ([]string, []error) {
+		handleOneFile(file)
+		return nil, nil
+	})
+}
+
+// jsonParser converts a JSON document into Blueprints module definitions, keeping track of the
+// positions of the JSON tokens for error messages.
+type jsonParser struct {
+	filename   string
+	contents   []byte
+	lineStarts []int
+	decoder    *json.Decoder
+}
+
+// parseJSONModules converts the JSON document described in ParseJSONModules into module
+// definitions.
+func parseJSONModules(filename string, contents []byte) ([]*parser.Module, []error) {
+	p := &jsonParser{
+		filename:   filename,
+		contents:   contents,
+		lineStarts: []int{0},
+		decoder:    json.NewDecoder(bytes.NewReader(contents)),
+	}
+	p.decoder.UseNumber()
+	for i, b := range contents {
+		if b == '\n' {
+			p.lineStarts = append(p.lineStarts, i+1)
+		}
+	}
+
+	pos, token, err := p.next()
+	if err != nil {
+		return nil, []error{err}
+	}
+	if token != json.Delim('[') {
+		return nil, []error{p.errorf(pos, "expected a list of modules")}
+	}
+
+	var modules []*parser.Module
+	var errs []error
+	for p.decoder.More() {
+		pos, token, err := p.next()
+		if err != nil {
+			return nil, append(errs, err)
+		}
+		if token != json.Delim('{') {
+			return nil, append(errs, p.errorf(pos, "expected a module object"))
+		}
+		moduleMap, err := p.parseMap(pos)
+		if err != nil {
+			return nil, append(errs, err)
+		}
+
+		module := &parser.Module{
+			TypePos: pos,
+			Map: parser.Map{
+				LBracePos: moduleMap.LBracePos,
+				RBracePos: moduleMap.RBracePos,
+			},
+		}
+		for _, property := range moduleMap.Properties {
+			if property.Name != "type" {
+				module.Properties = append(module.Properties, property)
+				continue
+			}
+			typeName, ok := property.Value.(*parser.String)
+			if !ok {
+				errs = append(errs, p.errorf(property.Value.Pos(), "module type must be a string"))
+				continue
+			}
+			module.Type = typeName.Value
+			module.TypePos = typeName.LiteralPos
+		}
+		if module.Type == "" {
+			errs = append(errs, p.errorf(pos, "module is missing a type"))
+			continue
+		}
+		modules = append(modules, module)
+	}
+
+	if _, _, err := p.next(); err != nil {
+		return nil, append(errs, err)
+	}
+	if pos, _, err := p.next(); err != io.EOF {
+		if err != nil {
+			return nil, append(errs, err)
+		}
+		return nil, append(errs, p.errorf(pos, "unexpected data after the list of modules"))
+	}
+
+	return modules, errs
+}
+
+// position returns the position of the byte at offset in the document.
+func (p *jsonParser) position(offset int) scanner.Position {
+	line := sort.Search(len(p.lineStarts), func(i int) bool { return p.lineStarts[i] > offset })
+	return scanner.Position{
+		Filename: p.filename,
+		Offset:   offset,
+		Line:     line,
+		Column:   offset - p.lineStarts[line-1] + 1,
+	}
+}
+
+// skipSpace returns the offset of the first byte at or after offset that is not whitespace.
+func (p *jsonParser) skipSpace(offset int) int {
+	for offset < len(p.contents) {
+		switch p.contents[offset] {
+		case ' ', '\t', '\r', '\n':
+			offset++
+		default:
+			return offset
+		}
+	}
+	return offset
+}
+
+func (p *jsonParser) errorf(pos scanner.Position, format string, args ...interface{}) error {
+	return &BlueprintError{
+		Err: fmt.Errorf(format, args...),
+		Pos: pos,
+	}
+}
+
+// next returns the next token in the document and its position.
+func (p *jsonParser) next() (scanner.Position, json.Token, error) {
+	// The decoder reports the offset after the previous token, skip any whitespace and
+	// separators to find the start of the next one.
+	offset := int(p.decoder.InputOffset())
+	for offset < len(p.contents) {
+		offset = p.skipSpace(offset)
+		if offset < len(p.contents) && (p.contents[offset] == ',' || p.contents[offset] == ':') {
+			offset++
+			continue
+		}
+		break
+	}
+	pos := p.position(offset)
+
+	token, err := p.decoder.Token()
+	if err == io.EOF {
+		return pos, nil, err
+	} else if err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			pos = p.position(int(syntaxErr.Offset))
+		}
+		return pos, nil, p.errorf(pos, "%s", err)
+	}
+	return pos, token, nil
+}
+
+// parseValue converts the JSON value starting with token at pos into a Blueprints expression.
+func (p *jsonParser) parseValue(pos scanner.Position, token json.Token) (parser.Expression, error) {
+	switch token := token.(type) {
+	case string:
+		return &parser.String{LiteralPos: pos, Value: token}, nil
+	case bool:
+		return &parser.Bool{LiteralPos: pos, Value: token, Token: fmt.Sprint(token)}, nil
+	case json.Number:
+		i, err := token.Int64()
+		if err != nil {
+			return nil, p.errorf(pos, "%s is not an integer", token)
+		}
+		return &parser.Int64{LiteralPos: pos, Value: i, Token: token.String()}, nil
+	case json.Delim:
+		if token == '{' {
+			return p.parseMap(pos)
+		}
+		return p.parseList(pos)
+	default:
+		return nil, p.errorf(pos, "null values are not supported")
+	}
+}
+
+// parseList converts the rest of the JSON list that starts at pos.
+func (p *jsonParser) parseList(pos scanner.Position) (*parser.List, error) {
+	list := &parser.List{LBracePos: pos}
+	for p.decoder.More() {
+		valuePos, token, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		value, err := p.parseValue(valuePos, token)
+		if err != nil {
+			return nil, err
+		}
+		if len(list.Values) > 0 && value.Type() != list.Values[0].Type() {
+			return nil, p.errorf(valuePos, "mixed types in list, %s and %s",
+				list.Values[0].Type(), value.Type())
+		}
+		list.Values = append(list.Values, value)
+	}
+
+	endPos, _, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	list.RBracePos = endPos
+	return list, nil
+}
+
+// parseMap converts the rest of the JSON object that starts at pos.
+func (p *jsonParser) parseMap(pos scanner.Position) (*parser.Map, error) {
+	m := &parser.Map{LBracePos: pos}
+	for p.decoder.More() {
+		namePos, token, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		name := token.(string)
+		colonPos := p.position(p.skipSpace(int(p.decoder.InputOffset())))
+
+		valuePos, token, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		value, err := p.parseValue(valuePos, token)
+		if err != nil {
+			return nil, err
+		}
+		m.Properties = append(m.Properties, &parser.Property{
+			Name:     name,
+			NamePos:  namePos,
+			ColonPos: colonPos,
+			Value:    value,
+		})
+	}
+
+	endPos, _, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	m.RBracePos = endPos
+	return m, nil
+}
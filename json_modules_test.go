@@ -0,0 +1,172 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueprint
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseJSONModules(t *testing.T) {
+	newJSONContext := func() *Context {
+		ctx := NewContext()
+		ctx.RegisterModuleType("foo_module", newFooModule)
+		ctx.RegisterModuleType("bar_module", newBarModule)
+		ctx.RegisterBottomUpMutator("deps", depsMutator)
+		return ctx
+	}
+
+	t.Run("modules", func(t *testing.T) {
+		ctx := newJSONContext()
+		_, errs := ctx.ParseJSONModules("dir/modules.json", []byte(`[
+			{"type": "foo_module", "name": "A", "deps": ["B"], "foo": "x"},
+			{"type": "bar_module", "name": "B"}
+		]`), nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected parse errors: %v", errs)
+		}
+		_, errs = ctx.ResolveDependencies(nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected dep errors: %v", errs)
+		}
+
+		a := ctx.moduleGroupFromName("A", nil).modules.firstModule()
+		if g, w := a.logicModule.(*fooModule).properties.Foo, "x"; g != w {
+			t.Errorf("expected foo %q, got %q", w, g)
+		}
+		if g, w := ctx.BlueprintFile(a.logicModule), "dir/modules.json"; g != w {
+			t.Errorf("expected Blueprints file %q, got %q", w, g)
+		}
+		var deps []string
+		ctx.VisitDirectDeps(a.logicModule, func(dep Module) {
+			deps = append(deps, ctx.ModuleName(dep))
+		})
+		if w := []string{"B"}; !reflect.DeepEqual(deps, w) {
+			t.Errorf("expected deps %q, got %q", w, deps)
+		}
+	})
+
+	t.Run("hooks", func(t *testing.T) {
+		ctx := newJSONContext()
+		var initialized []string
+		ctx.RegisterModuleInitHook(func(ctx ModuleInitContext) {
+			initialized = append(initialized, ctx.ModuleName())
+		})
+		ctx.RegisterSidecarDepsLoader(func(bpPath string) (map[string][]string, []string, error) {
+			return map[string][]string{"A": {"B"}}, []string{bpPath + ".deps"}, nil
+		})
+		deps, errs := ctx.ParseJSONModules("dir/modules.json", []byte(`[
+			{"type": "foo_module", "name": "A"},
+			{"type": "bar_module", "name": "B"}
+		]`), nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected parse errors: %v", errs)
+		}
+		if w := []string{"A", "B"}; !reflect.DeepEqual(initialized, w) {
+			t.Errorf("expected init hooks to run for %q, got %q", w, initialized)
+		}
+		if w := []string{"dir/modules.json.deps"}; !reflect.DeepEqual(deps, w) {
+			t.Errorf("expected deps %q, got %q", w, deps)
+		}
+
+		_, errs = ctx.ResolveDependencies(nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected dep errors: %v", errs)
+		}
+		a := ctx.moduleGroupFromName("A", nil).modules.firstModule()
+		var moduleDeps []string
+		ctx.VisitDirectDeps(a.logicModule, func(dep Module) {
+			moduleDeps = append(moduleDeps, ctx.ModuleName(dep))
+		})
+		if w := []string{"B"}; !reflect.DeepEqual(moduleDeps, w) {
+			t.Errorf("expected sidecar deps %q, got %q", w, moduleDeps)
+		}
+	})
+
+	t.Run("source root dirs", func(t *testing.T) {
+		ctx := newJSONContext()
+		ctx.AddSourceRootDirs("-dir")
+		_, errs := ctx.ParseJSONModules("dir/modules.json", []byte(`[
+			{"type": "foo_module", "name": "A"}
+		]`), nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected parse errors: %v", errs)
+		}
+		if ctx.moduleGroupFromName("A", nil) != nil {
+			t.Errorf("expected module A to be skipped")
+		}
+	})
+
+	testCases := []struct {
+		name string
+		json string
+		errs []string
+	}{
+		{
+			name: "missing name",
+			json: `[
+				{"type": "foo_module", "deps": ["B"]}
+			]`,
+			errs: []string{`modules.json:2:14: property 'name' is missing from a module`},
+		},
+		{
+			name: "unknown type",
+			json: `[
+				{"type": "baz_module", "name": "A"}
+			]`,
+			errs: []string{`modules.json:2:14: unrecognized module type "baz_module"`},
+		},
+		{
+			name: "unknown property",
+			json: `[
+				{"type": "foo_module", "name": "A", "bar": true}
+			]`,
+			errs: []string{`modules.json:2:46: unrecognized property "bar"`},
+		},
+		{
+			name: "wrong property type",
+			json: `[
+				{"type": "foo_module", "name": "A", "deps": "B"}
+			]`,
+			errs: []string{`modules.json:2:49: can't assign string value to list property "deps"`},
+		},
+		{
+			name: "not a list",
+			json: `{"type": "foo_module", "name": "A"}`,
+			errs: []string{`modules.json:1:1: expected a list of modules`},
+		},
+		{
+			name: "syntax error",
+			json: `[
+				{"type": "foo_module", "name": "A",}
+			]`,
+			errs: []string{`modules.json:2:40: invalid character ',' looking for beginning of value`},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := newJSONContext()
+			_, errs := ctx.ParseJSONModules("modules.json", []byte(tc.json), nil)
+			var got []string
+			for _, err := range errs {
+				got = append(got, err.Error())
+			}
+			if !reflect.DeepEqual(got, tc.errs) {
+				t.Errorf("expected errors %q, got %q", tc.errs, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,456 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueprint
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// MergeBuildFiles writes a single Ninja manifest containing the build actions of all of the
+// given Contexts, each of which must have completed PrepareBuildActions.  Global variables, pools
+// and rules that are defined by more than one Context are written once, and it is an error for
+// two Contexts to define a global with the same name but a different definition.  The builddir
+// of all the Contexts that set one must match, and the highest ninja_required_version is used.
+// The module and singleton build actions of each Context follow in the order the Contexts were
+// passed.  It is an error for two Contexts to build the same output, to define module or
+// singleton local rules or variables with the same name, to install the same output to different
+// destinations or to create order-only deduplication phonys with the same name but different
+// dependencies.  All of these are checked before anything is written to w.
+//
+// The rewriting set by SetReproducibleCommandPaths and the NinjaPostProcessors of each Context
+// are applied to the parts of the manifest that come from that Context, its global definitions
+// and its build actions, so they are written as they would be by WriteBuildFile.  Global
+// definitions are compared after they have been post-processed.
+func MergeBuildFiles(w io.Writer, contexts ...*Context) error {
+	for _, c := range contexts {
+		if !c.buildActionsReady {
+			return ErrBuildActionsNotReady
+		}
+	}
+
+	if err := checkMergedLocals(contexts); err != nil {
+		return err
+	}
+
+	if err := checkMergedOutputs(contexts); err != nil {
+		return err
+	}
+
+	installMap, err := mergedInstallMap(contexts)
+	if err != nil {
+		return err
+	}
+
+	phonys, err := mergedDedupPhonys(contexts)
+	if err != nil {
+		return err
+	}
+
+	buf := bufio.NewWriter(w)
+	nw := newNinjaWriter(buf)
+
+	if err := writeBuildFileHeader(nw, mergedPkgAssociations(contexts)); err != nil {
+		return err
+	}
+
+	if err := writeMergedNinjaRequiredVersion(nw, contexts); err != nil {
+		return err
+	}
+
+	if err := writeMergedSubninjas(nw, contexts); err != nil {
+		return err
+	}
+
+	variables := newMergedDefinitions("variable")
+	pools := newMergedDefinitions("pool")
+	rules := newMergedDefinitions("rule")
+	for i, c := range contexts {
+		for _, v := range c.globalVariablesInWriteOrder() {
+			name := c.nameTracker.Variable(v)
+			err := variables.add(c, i, name, func(nw *ninjaWriter) error {
+				return nw.Assign(name, c.globalVariables[v].Value(c.nameTracker))
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, pool := range c.sortedGlobalPools() {
+			name := c.nameTracker.Pool(pool)
+			err := pools.add(c, i, name, func(nw *ninjaWriter) error {
+				return c.globalPools[pool].WriteTo(nw, name)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, rule := range c.sortedGlobalRules() {
+			name := c.nameTracker.Rule(rule)
+			err := rules.add(c, i, name, func(nw *ninjaWriter) error {
+				return c.ruleDefForWrite(c.globalRules[rule]).WriteTo(nw, name, c.nameTracker)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Variables are written in the order they were added so that each variable follows the
+	// variables it refers to, pools and rules are sorted by name.
+	if err := variables.writeTo(buf); err != nil {
+		return err
+	}
+
+	pools.sort()
+	if err := pools.writeTo(buf); err != nil {
+		return err
+	}
+
+	if err := writeMergedBuildDir(nw, contexts); err != nil {
+		return err
+	}
+
+	rules.sort()
+	if err := rules.writeTo(buf); err != nil {
+		return err
+	}
+
+	for i, c := range contexts {
+		if err := writePostProcessed(buf, c, func(nw *ninjaWriter) error {
+			return c.writeLocalBuildActions(nw, phonys[i])
+		}); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range contexts {
+		if err := writePostProcessed(buf, c, func(nw *ninjaWriter) error {
+			if err := c.writeModuleActions(nw, c.sortedModules(), nil); err != nil {
+				return err
+			}
+			return c.writeAllSingletonActions(nw)
+		}); err != nil {
+			return err
+		}
+	}
+
+	// The install map only contains paths that were already resolved with the names of the
+	// Context that installs them, and the phony rule is a builtin, so no Context's names are
+	// needed to write it.
+	if err := writeInstallPhony(nw, installMap, nil); err != nil {
+		return err
+	}
+
+	return buf.Flush()
+}
+
+// checkMergedOutputs returns an error if the module or singleton build actions of more than one
+// Context build the same output.
+func checkMergedOutputs(contexts []*Context) error {
+	builtBy := make(map[string]int)
+	for i, c := range contexts {
+		var defs []*buildDef
+		for _, module := range c.sortedModules() {
+			defs = append(defs, module.actionDefs.buildDefs...)
+		}
+		for _, info := range c.singletonInfo {
+			defs = append(defs, info.actionDefs.buildDefs...)
+		}
+
+		for _, def := range defs {
+			for _, output := range buildDefOutputs(def, c.nameTracker) {
+				if other, ok := builtBy[output]; ok && other != i {
+					return fmt.Errorf("output %q is built in contexts %d and %d", output, other, i)
+				}
+				builtBy[output] = i
+			}
+		}
+	}
+	return nil
+}
+
+// buildDefOutputs returns the outputs of def as they are written to the Ninja file.
+func buildDefOutputs(def *buildDef, nameTracker *nameTracker) []string {
+	var outputs []string
+	for _, list := range [][]*ninjaString{def.Outputs, def.ImplicitOutputs, def.DirectoryOutputs} {
+		for _, output := range list {
+			outputs = append(outputs, output.Value(nameTracker))
+		}
+	}
+	for _, list := range [][]string{def.OutputStrings, def.ImplicitOutputStrings, def.DirectoryOutputStrings} {
+		for _, output := range list {
+			outputs = append(outputs, defaultEscaper.Replace(output))
+		}
+	}
+	return outputs
+}
+
+// checkMergedLocals returns an error if more than one Context defines a module or singleton local
+// rule or variable with the same name.  Local names are derived from the module or singleton name,
+// so they clash whenever two Contexts contain a module with the same name and variant.
+func checkMergedLocals(contexts []*Context) error {
+	rules := make(map[string]int)
+	variables := make(map[string]int)
+	for i, c := range contexts {
+		var defs []*localBuildActions
+		for _, module := range c.sortedModules() {
+			defs = append(defs, &module.actionDefs)
+		}
+		for _, info := range c.singletonInfo {
+			defs = append(defs, &info.actionDefs)
+		}
+
+		for _, def := range defs {
+			for _, r := range def.rules {
+				name := r.fullName(nil)
+				if other, ok := rules[name]; ok && other != i {
+					return fmt.Errorf("local rule %q is defined in contexts %d and %d", name, other, i)
+				}
+				rules[name] = i
+			}
+			for _, v := range def.variables {
+				name := v.fullName(nil)
+				if other, ok := variables[name]; ok && other != i {
+					return fmt.Errorf("local variable %q is defined in contexts %d and %d", name, other, i)
+				}
+				variables[name] = i
+			}
+		}
+	}
+	return nil
+}
+
+// mergedInstallMap combines the install maps of all the Contexts into a single one, returning an
+// error if two Contexts install the same output to different destinations or different outputs to
+// the same destination.
+func mergedInstallMap(contexts []*Context) (map[string]string, error) {
+	installMap := make(map[string]string)
+	srcDefiner := make(map[string]int)
+	installedBy := make(map[string]string)
+	destDefiner := make(map[string]int)
+	for i, c := range contexts {
+		sources := make([]string, 0, len(c.installMap))
+		for src := range c.installMap {
+			sources = append(sources, src)
+		}
+		sort.Strings(sources)
+
+		for _, src := range sources {
+			dest := c.installMap[src]
+			if other, ok := installMap[src]; ok && other != dest {
+				return nil, fmt.Errorf("%q is installed to %q in context %d and to %q in context %d",
+					src, other, srcDefiner[src], dest, i)
+			}
+			if other, ok := installedBy[dest]; ok && other != src {
+				return nil, fmt.Errorf("%q is installed from %q in context %d and from %q in context %d",
+					dest, other, destDefiner[dest], src, i)
+			}
+			installMap[src], srcDefiner[src] = dest, i
+			installedBy[dest], destDefiner[dest] = src, i
+		}
+	}
+	return installMap, nil
+}
+
+// mergedDedupPhonys returns the phony build statements used to deduplicate order-only dependencies
+// that need to be written for each Context.  Phonys with the same name and dependencies in more
+// than one Context are only written for the first one, it is an error for them to have the same
+// name but different dependencies, which can happen when the phonys have indexed names.
+func mergedDedupPhonys(contexts []*Context) ([]*localBuildActions, error) {
+	phonys := make([]*localBuildActions, len(contexts))
+	defs := make(map[string]string)
+	definer := make(map[string]int)
+	for i, c := range contexts {
+		phonys[i] = &localBuildActions{}
+		for _, phony := range c.orderOnlyDedupPhonys().buildDefs {
+			def := &strings.Builder{}
+			if err := phony.WriteTo(newNinjaWriter(def), c.nameTracker); err != nil {
+				return nil, err
+			}
+
+			name := phony.OutputStrings[0]
+			if existing, ok := defs[name]; ok {
+				if existing != def.String() {
+					return nil, fmt.Errorf("conflicting definitions of phony %q in contexts %d and %d:\n%s\n%s",
+						name, definer[name], i, existing, def.String())
+				}
+				continue
+			}
+
+			defs[name], definer[name] = def.String(), i
+			phonys[i].buildDefs = append(phonys[i].buildDefs, phony)
+		}
+	}
+	return phonys, nil
+}
+
+// mergedDefinitions collects the definitions of one kind of global from multiple Contexts, keeping
+// a single copy of definitions that are identical and reporting ones that conflict.
+type mergedDefinitions struct {
+	kind    string
+	names   []string
+	defs    map[string]string
+	definer map[string]int
+}
+
+func newMergedDefinitions(kind string) *mergedDefinitions {
+	return &mergedDefinitions{
+		kind:    kind,
+		defs:    make(map[string]string),
+		definer: make(map[string]int),
+	}
+}
+
+// add records the definition of name written by write for c, the Context at index contextIndex,
+// after applying the post-processing of c to it.
+func (m *mergedDefinitions) add(c *Context, contextIndex int, name string, write func(nw *ninjaWriter) error) error {
+	buf := &bytes.Buffer{}
+	nw := newNinjaWriter(buf)
+	if err := write(nw); err != nil {
+		return err
+	}
+	if err := nw.BlankLine(); err != nil {
+		return err
+	}
+	processed, err := c.postProcessBuildFile(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	def := string(processed)
+
+	if existing, ok := m.defs[name]; ok {
+		if existing != def {
+			return fmt.Errorf("conflicting definitions of %s %q in contexts %d and %d:\n%s\n%s",
+				m.kind, name, m.definer[name], contextIndex, existing, def)
+		}
+		return nil
+	}
+
+	m.names = append(m.names, name)
+	m.defs[name] = def
+	m.definer[name] = contextIndex
+	return nil
+}
+
+func (m *mergedDefinitions) sort() {
+	sort.Strings(m.names)
+}
+
+func (m *mergedDefinitions) writeTo(w io.StringWriter) error {
+	for _, name := range m.names {
+		if _, err := w.WriteString(m.defs[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePostProcessed writes the part of a merged manifest written by write for c to w, after
+// applying the post-processing of c to it.
+func writePostProcessed(w StringWriterWriter, c *Context, write func(nw *ninjaWriter) error) error {
+	if !c.hasPostProcessing() {
+		return write(newNinjaWriter(w))
+	}
+
+	buf := &bytes.Buffer{}
+	if err := write(newNinjaWriter(buf)); err != nil {
+		return err
+	}
+	processed, err := c.postProcessBuildFile(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(processed)
+	return err
+}
+
+func mergedPkgAssociations(contexts []*Context) []pkgAssociation {
+	seen := make(map[pkgAssociation]bool)
+	var pkgs []pkgAssociation
+	for _, c := range contexts {
+		for _, pkg := range c.pkgAssociations() {
+			if !seen[pkg] {
+				seen[pkg] = true
+				pkgs = append(pkgs, pkg)
+			}
+		}
+	}
+	return pkgs
+}
+
+func writeMergedNinjaRequiredVersion(nw *ninjaWriter, contexts []*Context) error {
+	var major, minor, micro int
+	for _, c := range contexts {
+		if c.requiredNinjaMajor > major ||
+			(c.requiredNinjaMajor == major && c.requiredNinjaMinor > minor) ||
+			(c.requiredNinjaMajor == major && c.requiredNinjaMinor == minor && c.requiredNinjaMicro > micro) {
+			major, minor, micro = c.requiredNinjaMajor, c.requiredNinjaMinor, c.requiredNinjaMicro
+		}
+	}
+
+	err := nw.Assign("ninja_required_version", fmt.Sprintf("%d.%d.%d", major, minor, micro))
+	if err != nil {
+		return err
+	}
+
+	return nw.BlankLine()
+}
+
+func writeMergedSubninjas(nw *ninjaWriter, contexts []*Context) error {
+	seen := make(map[string]bool)
+	for _, c := range contexts {
+		for _, subninja := range c.subninjas {
+			if seen[subninja] {
+				continue
+			}
+			seen[subninja] = true
+			if err := nw.Subninja(subninja); err != nil {
+				return err
+			}
+		}
+	}
+	return nw.BlankLine()
+}
+
+func writeMergedBuildDir(nw *ninjaWriter, contexts []*Context) error {
+	var buildDir string
+	definer := -1
+	for i, c := range contexts {
+		if c.outDir == nil {
+			continue
+		}
+		dir := c.outDir.Value(c.nameTracker)
+		if definer >= 0 && dir != buildDir {
+			return fmt.Errorf("conflicting builddir in contexts %d and %d: %q and %q",
+				definer, i, buildDir, dir)
+		}
+		buildDir, definer = dir, i
+	}
+
+	if definer < 0 {
+		return nil
+	}
+
+	if err := nw.Assign("builddir", buildDir); err != nil {
+		return err
+	}
+	return nw.BlankLine()
+}
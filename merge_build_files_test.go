@@ -0,0 +1,224 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueprint
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMergeBuildFiles(t *testing.T) {
+	newMergeContext := func(t *testing.T, factory ModuleFactory, bp string, setup func(ctx *Context)) *Context {
+		t.Helper()
+		ctx := NewContext()
+		ctx.MockFileSystem(map[string][]byte{
+			"Android.bp": []byte(bp),
+		})
+		ctx.RegisterModuleType("test", factory)
+		if setup != nil {
+			setup(ctx)
+		}
+
+		_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected parse errors: %v", errs)
+		}
+		_, errs = ctx.ResolveDependencies(nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected dep errors: %v", errs)
+		}
+		_, errs = ctx.PrepareBuildActions(nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected build action errors: %v", errs)
+		}
+		return ctx
+	}
+
+	newStampContext := func(t *testing.T, name string, workingDir string) *Context {
+		t.Helper()
+		return newMergeContext(t, stampTestModuleFactory, `
+			test {
+			    name: "`+name+`",
+			    stamp: true,
+			}
+		`, func(ctx *Context) {
+			ctx.SetWorkingDirForCommands(workingDir)
+		})
+	}
+
+	t.Run("shared rules", func(t *testing.T) {
+		merge := func() string {
+			buf := &strings.Builder{}
+			err := MergeBuildFiles(buf, newStampContext(t, "foo", ""), newStampContext(t, "bar", ""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return buf.String()
+		}
+
+		out := merge()
+		if g := strings.Count(out, "\nrule g.blueprint.touch\n"); g != 1 {
+			t.Errorf("expected touch rule to be declared once, got %d:\n%s", g, out)
+		}
+		if g := strings.Count(out, "ninja_required_version"); g != 1 {
+			t.Errorf("expected ninja_required_version to be set once, got %d:\n%s", g, out)
+		}
+		foo := strings.Index(out, "build foo.stamp: g.blueprint.touch dep\n")
+		bar := strings.Index(out, "build bar.stamp: g.blueprint.touch dep\n")
+		if foo < 0 || bar < 0 || bar < foo {
+			t.Errorf("expected build statements for foo and then bar in:\n%s", out)
+		}
+
+		if again := merge(); again != out {
+			t.Errorf("expected merged output to be deterministic")
+		}
+	})
+
+	t.Run("conflicting rules", func(t *testing.T) {
+		err := MergeBuildFiles(&strings.Builder{}, newStampContext(t, "foo", ""),
+			newStampContext(t, "bar", "sub"))
+		if err == nil || !strings.HasPrefix(err.Error(), `conflicting definitions of rule "g.blueprint.touch" in contexts 0 and 1`) {
+			t.Errorf("expected conflicting rule error, got %v", err)
+		}
+	})
+
+	t.Run("duplicate outputs", func(t *testing.T) {
+		err := MergeBuildFiles(&strings.Builder{}, newStampContext(t, "foo", ""), newStampContext(t, "foo", ""))
+		expected := `output "foo.stamp" is built in contexts 0 and 1`
+		if err == nil || err.Error() != expected {
+			t.Errorf("expected error %q, got %v", expected, err)
+		}
+	})
+
+	t.Run("duplicate locals", func(t *testing.T) {
+		bp := `
+			test {
+			    name: "foo",
+			    outs: ["foo"],
+			}
+		`
+		err := MergeBuildFiles(&strings.Builder{}, newMergeContext(t, newInstallTestModule, bp, nil),
+			newMergeContext(t, newInstallTestModule, bp, nil))
+		expected := `local variable "m.foo_.outDir" is defined in contexts 0 and 1`
+		if err == nil || err.Error() != expected {
+			t.Errorf("expected error %q, got %v", expected, err)
+		}
+	})
+
+	t.Run("conflicting installs", func(t *testing.T) {
+		newInstallContext := func(name string) *Context {
+			return newMergeContext(t, newInstallTestModule, `
+				test {
+				    name: "`+name+`",
+				    outs: ["out"],
+				    install_to: "bin",
+				}
+			`, nil)
+		}
+		err := MergeBuildFiles(&strings.Builder{}, newInstallContext("foo"), newInstallContext("bar"))
+		expected := `"bin/out" is installed from "out/foo/out" in context 0 and from "out/bar/out" in context 1`
+		if err == nil || err.Error() != expected {
+			t.Errorf("expected error %q, got %v", expected, err)
+		}
+	})
+
+	t.Run("conflicting dedup phonys", func(t *testing.T) {
+		newDedupContext := func(dep string) *Context {
+			return newMergeContext(t, newDirectoryOutputTestModule, `
+				test {
+				    name: "`+dep+`1",
+				    outputs: ["`+dep+`1.out"],
+				    order_only: ["`+dep+`"],
+				}
+				test {
+				    name: "`+dep+`2",
+				    outputs: ["`+dep+`2.out"],
+				    order_only: ["`+dep+`"],
+				}
+			`, func(ctx *Context) {
+				ctx.SetIndexedDedupPhonyNames(true)
+			})
+		}
+
+		buf := &strings.Builder{}
+		if err := MergeBuildFiles(buf, newDedupContext("a"), newDedupContext("a")); err == nil {
+			t.Errorf("expected duplicate output error")
+		}
+
+		err := MergeBuildFiles(buf, newDedupContext("a"), newDedupContext("b"))
+		expected := `conflicting definitions of phony "dedup-0" in contexts 0 and 1`
+		if err == nil || !strings.HasPrefix(err.Error(), expected) {
+			t.Errorf("expected error %q, got %v", expected, err)
+		}
+	})
+
+	t.Run("post processing", func(t *testing.T) {
+		newPostProcessedContext := func(name string) *Context {
+			return newMergeContext(t, stampTestModuleFactory, `
+				test {
+				    name: "`+name+`",
+				    stamp: true,
+				}
+			`, func(ctx *Context) {
+				ctx.RegisterNinjaPostProcessor(func(manifest []byte) ([]byte, error) {
+					return bytes.ReplaceAll(manifest, []byte(".stamp"), []byte(".stamp.x")), nil
+				})
+			})
+		}
+
+		buf := &strings.Builder{}
+		err := MergeBuildFiles(buf, newPostProcessedContext("foo"), newPostProcessedContext("bar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Each Context's post-processor is applied once to its own build actions.
+		out := buf.String()
+		for _, name := range []string{"foo", "bar"} {
+			if !strings.Contains(out, "build "+name+".stamp.x: g.blueprint.touch dep\n") {
+				t.Errorf("expected post-processed build statement for %s in:\n%s", name, out)
+			}
+		}
+		if strings.Contains(out, ".stamp.x.x") {
+			t.Errorf("expected post-processors to be applied once in:\n%s", out)
+		}
+	})
+
+	t.Run("installs from later contexts", func(t *testing.T) {
+		installContext := newMergeContext(t, newInstallTestModule, `
+			test {
+			    name: "bar",
+			    outs: ["out"],
+			    install_to: "bin",
+			}
+		`, nil)
+
+		buf := &strings.Builder{}
+		if err := MergeBuildFiles(buf, newStampContext(t, "foo", ""), installContext); err != nil {
+			t.Fatal(err)
+		}
+		if out := buf.String(); !strings.Contains(out, "build "+InstallPhonyTarget+": phony out/bar/out\n") {
+			t.Errorf("expected install phony for the outputs of context 1 in:\n%s", out)
+		}
+	})
+
+	t.Run("not ready", func(t *testing.T) {
+		err := MergeBuildFiles(&strings.Builder{}, newStampContext(t, "foo", ""), NewContext())
+		if err != ErrBuildActionsNotReady {
+			t.Errorf("expected %v, got %v", ErrBuildActionsNotReady, err)
+		}
+	})
+}
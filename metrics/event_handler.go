@@ -29,6 +29,9 @@ type EventHandler struct {
 	// is pushed onto these fields. When ending an event, these fields are popped.
 	scopeIds        []string
 	scopeStartTimes []time.Time
+
+	// set by SetEndHandler
+	endHandler func(Event)
 }
 
 // _now simply delegates to time.Now() function. _now is declared for unit testing purpose.
@@ -52,6 +55,18 @@ func (e Event) RuntimeNanoseconds() uint64 {
 	return uint64(e.end.Sub(e.Start).Nanoseconds())
 }
 
+// End returns the time the event ended.
+func (e Event) End() time.Time {
+	return e.end
+}
+
+// SetEndHandler sets a function that is called with each event as it ends, including events
+// nested within other events, for example to report the time taken by each phase of a build
+// while it is still running.
+func (h *EventHandler) SetEndHandler(handler func(Event)) {
+	h.endHandler = handler
+}
+
 // Begin logs the start of an event. This must be followed by a corresponding
 // call to End (though other events may begin and end before this event ends).
 // Events within the same scope must have unique names.
@@ -88,6 +103,9 @@ func (h *EventHandler) End(name string) {
 	h.completedEvents = append(h.completedEvents, event)
 	h.scopeIds = h.scopeIds[:len(h.scopeIds)-1]
 	h.scopeStartTimes = h.scopeStartTimes[:len(h.scopeStartTimes)-1]
+	if h.endHandler != nil {
+		h.endHandler(event)
+	}
 }
 
 // CompletedEvents returns all events which have been completed, after
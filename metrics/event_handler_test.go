@@ -98,3 +98,24 @@ func TestIncompleteEvent(t *testing.T) {
 	}()
 	eh.CompletedEvents()
 }
+
+func TestEndHandler(t *testing.T) {
+	eh := EventHandler{}
+	var ended []string
+	eh.SetEndHandler(func(e Event) {
+		if e.End().Before(e.Start) {
+			t.Errorf("event %s ended at %s before it started at %s", e.Id, e.End(), e.Start)
+		}
+		ended = append(ended, e.Id)
+	})
+	eh.Begin("a")
+	eh.Begin("b")
+	eh.End("b")
+	if expected := []string{"a.b"}; !reflect.DeepEqual(expected, ended) {
+		t.Errorf("expected: %s actual %s", expected, ended)
+	}
+	eh.End("a")
+	if expected := []string{"a.b", "a"}; !reflect.DeepEqual(expected, ended) {
+		t.Errorf("expected: %s actual %s", expected, ended)
+	}
+}
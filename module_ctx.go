@@ -16,7 +16,10 @@ package blueprint
 
 import (
 	"fmt"
+	"hash/fnv"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
 	"text/scanner"
@@ -289,6 +292,11 @@ type BaseModuleContext interface {
 	// It is intended for use inside the visit functions of Visit* and WalkDeps.
 	OtherModuleType(m Module) string
 
+	// OtherModuleEnabled returns false if another Module was disabled with "enabled: false".  A module can only
+	// depend on a disabled module through a dependency tag that implements OptionalDependencyTag.
+	// It is intended for use inside the visit functions of Visit* and WalkDeps.
+	OtherModuleEnabled(m Module) bool
+
 	// OtherModuleErrorf reports an error on another Module.  See BaseModuleContext.ModuleErrorf for more information.
 	// It is intended for use inside the visit functions of Visit* and WalkDeps.
 	OtherModuleErrorf(m Module, fmt string, args ...interface{})
@@ -299,7 +307,9 @@ type BaseModuleContext interface {
 	OtherModuleDependencyTag(m Module) DependencyTag
 
 	// OtherModuleExists returns true if a module with the specified name exists, as determined by the NameInterface
-	// passed to Context.SetNameInterface, or SimpleNameInterface if it was not called.
+	// passed to Context.SetNameInterface, or SimpleNameInterface if it was not called.  It returns false for modules
+	// that were skipped because their Blueprints file is outside of the directories passed to
+	// Context.AddSourceRootDirs, so it can be used to add a dependency only if the module exists.
 	OtherModuleExists(name string) bool
 
 	// ModuleFromName returns (module, true) if a module exists by the given name and same context namespace,
@@ -368,6 +378,10 @@ type ModuleContext interface {
 	// to ensure that each variant of a module gets its own intermediates directory to write to.
 	ModuleSubDir() string
 
+	// ModuleOutputDir returns a relative path made up of ModuleDir, ModuleName and ModuleSubDir that is
+	// unique to the current variant of the module, for use as a prefix for its intermediates.
+	ModuleOutputDir() string
+
 	// Variable creates a new ninja variable scoped to the module.  It can be referenced by calls to Rule and Build
 	// in the same module.
 	Variable(pctx PackageContext, name, value string)
@@ -378,6 +392,23 @@ type ModuleContext interface {
 	// Build creates a new ninja build statement.
 	Build(pctx PackageContext, params BuildParams)
 
+	// Stamp creates a ninja build statement that touches output after all of deps are up to date,
+	// using the shared Touch rule.
+	Stamp(output string, deps ...string)
+
+	// Phony creates a ninja build statement that makes name a phony target depending on all of
+	// deps, using the builtin phony rule.  PrepareBuildActions reports an error if name is also an
+	// output of another build statement.
+	Phony(name string, deps []string)
+
+	// AddGlobDependency globs for the files that match pattern but do not match any of excludes,
+	// and adds a file containing the list of matching files as an implicit input to every build
+	// statement created by the module, so that they rerun whenever a matching file is added,
+	// removed or changed.  The file list is written by a build statement created with the function
+	// set by Context.SetGlobFileFunc.  It returns the path of the file list file, which is inside
+	// the directory set by Context.SetGlobListDir.
+	AddGlobDependency(pattern string, excludes ...string) string
+
 	// GetMissingDependencies returns the list of dependencies that were passed to AddDependencies or related methods,
 	// but do not exist.  It can be used with Context.SetAllowMissingDependencies to allow the primary builder to
 	// handle missing dependencies on its own instead of having Blueprint treat them as an error.
@@ -490,7 +521,7 @@ func (d *baseModuleContext) Failed() bool {
 
 func (d *baseModuleContext) GlobWithDeps(pattern string,
 	excludes []string) ([]string, error) {
-	return d.context.glob(pattern, excludes)
+	return d.context.moduleGlob(d.module, pattern, excludes)
 }
 
 func (d *baseModuleContext) Fs() pathtools.FileSystem {
@@ -508,6 +539,14 @@ type moduleContext struct {
 	scope              *localScope
 	actionDefs         localBuildActions
 	handledMissingDeps bool
+	globDeps           []globDependency
+}
+
+// globDependency is a glob added by AddGlobDependency.
+type globDependency struct {
+	pattern      string
+	excludes     []string
+	fileListFile string
 }
 
 func (m *baseModuleContext) OtherModuleName(logicModule Module) string {
@@ -530,6 +569,11 @@ func (m *baseModuleContext) OtherModuleType(logicModule Module) string {
 	return module.typeName
 }
 
+func (m *baseModuleContext) OtherModuleEnabled(logicModule Module) bool {
+	module := m.context.moduleInfo[logicModule]
+	return !module.disabled
+}
+
 func (m *baseModuleContext) OtherModuleErrorf(logicModule Module, format string,
 	args ...interface{}) {
 
@@ -559,7 +603,8 @@ func (m *baseModuleContext) OtherModuleDependencyTag(logicModule Module) Depende
 }
 
 func (m *baseModuleContext) ModuleFromName(name string) (Module, bool) {
-	moduleGroup, exists := m.context.nameInterface.ModuleFromName(name, m.module.namespace())
+	moduleGroup := m.context.moduleGroupFromName(name, m.module.namespace())
+	exists := moduleGroup != nil
 	if exists {
 		if len(moduleGroup.modules) != 1 {
 			panic(fmt.Errorf("Expected exactly one module named %q, but got %d", name, len(moduleGroup.modules)))
@@ -576,8 +621,7 @@ func (m *baseModuleContext) ModuleFromName(name string) (Module, bool) {
 }
 
 func (m *baseModuleContext) OtherModuleExists(name string) bool {
-	_, exists := m.context.nameInterface.ModuleFromName(name, m.module.namespace())
-	return exists
+	return m.context.moduleGroupFromName(name, m.module.namespace()) != nil
 }
 
 func (m *baseModuleContext) OtherModuleDependencyVariantExists(variations []Variation, name string) bool {
@@ -767,6 +811,10 @@ func (m *moduleContext) ModuleSubDir() string {
 	return m.module.variant.name
 }
 
+func (m *moduleContext) ModuleOutputDir() string {
+	return m.module.outputDir()
+}
+
 func (m *moduleContext) Variable(pctx PackageContext, name, value string) {
 	m.scope.ReparentTo(pctx)
 
@@ -804,6 +852,84 @@ func (m *moduleContext) Build(pctx PackageContext, params BuildParams) {
 	m.actionDefs.buildDefs = append(m.actionDefs.buildDefs, def)
 }
 
+func (m *moduleContext) Stamp(output string, deps ...string) {
+	m.Build(blueprintPctx, BuildParams{
+		Rule:    Touch,
+		Outputs: []string{output},
+		Inputs:  deps,
+	})
+}
+
+func (m *moduleContext) Phony(name string, deps []string) {
+	m.Build(blueprintPctx, BuildParams{
+		Rule:    Phony,
+		Outputs: []string{name},
+		Inputs:  deps,
+	})
+}
+
+func (m *moduleContext) AddGlobDependency(pattern string, excludes ...string) string {
+	if m.context.globFileFunc == nil {
+		panic(fmt.Errorf("AddGlobDependency requires Context.SetGlobFileFunc to be called"))
+	}
+	if m.context.globListDir == "" {
+		panic(fmt.Errorf("AddGlobDependency requires Context.SetGlobListDir to be called"))
+	}
+
+	// Use the same excludes for the file list file as for the glob result so that the two agree.
+	excludes = append(append([]string(nil), excludes...), m.context.globExcludeDefaults...)
+	sort.Strings(excludes)
+	excludes = slices.Compact(excludes)
+
+	if _, err := m.context.moduleGlob(m.module, pattern, excludes); err != nil {
+		m.ModuleErrorf("glob %q: %s", pattern, err)
+		return ""
+	}
+
+	key := globToKey(pattern, excludes)
+	hash := fnv.New32a()
+	hash.Write([]byte(key.pattern + "\x00" + key.excludes))
+	fileListFile := filepath.Join(m.context.globListDir, "modules", m.ModuleOutputDir(),
+		fmt.Sprintf("%08x", hash.Sum32()))
+
+	for _, g := range m.globDeps {
+		if g.fileListFile == fileListFile {
+			return fileListFile
+		}
+	}
+	m.globDeps = append(m.globDeps, globDependency{pattern, excludes, fileListFile})
+	return fileListFile
+}
+
+// buildGlobDependencies adds the file list files of the globs added by AddGlobDependency as
+// implicit inputs to the module's build statements, and then creates the build statements that
+// write them.
+func (m *moduleContext) buildGlobDependencies() {
+	if len(m.globDeps) == 0 {
+		return
+	}
+
+	fileListFiles := make([]string, len(m.globDeps))
+	for i, g := range m.globDeps {
+		fileListFiles[i] = g.fileListFile
+	}
+	ninjaStrs, simpleStrs, err := parseNinjaOrSimpleStrings(m.scope, fileListFiles)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, def := range m.actionDefs.buildDefs {
+		// The slices may be shared with the BuildParams passed to Build, copy them before appending.
+		def.Implicits = append(def.Implicits[:len(def.Implicits):len(def.Implicits)], ninjaStrs...)
+		def.ImplicitStrings = append(def.ImplicitStrings[:len(def.ImplicitStrings):len(def.ImplicitStrings)],
+			simpleStrs...)
+	}
+
+	for _, g := range m.globDeps {
+		m.context.globFileFunc(m, g.pattern, g.excludes, g.fileListFile)
+	}
+}
+
 func (m *moduleContext) GetMissingDependencies() []string {
 	m.handledMissingDeps = true
 	return m.module.missingDeps
@@ -846,6 +972,12 @@ type TopDownMutatorContext interface {
 	// CreateModule creates a new module by calling the factory method for the specified moduleType, and applies
 	// the specified property structs to it as if the properties were set in a blueprint file.
 	CreateModule(ModuleFactory, string, ...interface{}) Module
+
+	// CreateModuleInDirectory is like CreateModule, but the new module is attributed to a
+	// Blueprints file in the given directory, relative to the root directory, instead of to the
+	// Blueprints file of the current module.  The module is skipped if the directory was excluded
+	// with AddSourceRootDirs, as if it had been defined in a Blueprints file there.
+	CreateModuleInDirectory(ModuleFactory, string, string, ...interface{}) Module
 }
 
 type BottomUpMutatorContext interface {
@@ -924,6 +1056,11 @@ type BottomUpMutatorContext interface {
 	// be ordered correctly for all future mutator passes.
 	AddFarVariationDependencies([]Variation, DependencyTag, ...string) []Module
 
+	// AddClosestFarVariationDependencies is like AddFarVariationDependencies, but if several
+	// variants of a dependency match the variations argument it uses the one with the fewest other
+	// variations instead of the first one.
+	AddClosestFarVariationDependencies([]Variation, DependencyTag, ...string) []Module
+
 	// AddInterVariantDependency adds a dependency between two variants of the same module.  Variants are always
 	// ordered in the same order as they were listed in CreateVariations, and AddInterVariantDependency does not change
 	// that ordering, but it associates a DependencyTag with the dependency and makes it visible to VisitDirectDeps,
@@ -937,7 +1074,9 @@ type BottomUpMutatorContext interface {
 
 	// ReplaceDependenciesIf replaces all dependencies on the identical variant of the module with the
 	// specified name with the current variant of this module as long as the supplied predicate returns
-	// true.
+	// true.  The predicate is called once for each incoming dependency with the depending module and
+	// the tag of that dependency, so a module that depends on the replaced module with multiple tags
+	// can have some of its dependencies replaced and others left pointing at the original module.
 	//
 	// Replacements don't take effect until after the mutator pass is finished.
 	ReplaceDependenciesIf(string, ReplaceDependencyPredicate)
@@ -965,6 +1104,19 @@ type BottomUpMutatorContext interface {
 	// variant of the current module.  The value should not be modified after being passed to
 	// SetVariationProvider.
 	SetVariationProvider(module Module, provider AnyProviderKey, value interface{})
+
+	// Variation returns the variation of the current module for the mutator or transition with
+	// the given name, and true if the current module has been split along that axis.  It returns
+	// false if the module has no variation for the axis.
+	Variation(axis string) (string, bool)
+
+	// PruneVariant deletes the current variant from its module group at the end of the mutator
+	// pass.  It can be used to remove invalid combinations of variations that were created by
+	// independent mutators.  Aliases to the pruned variant are removed, dependencies on it are
+	// dropped, and it will not be found by later dependency lookups.  If every variant of a module
+	// is pruned the module is removed, and later dependencies on its name are missing dependencies.
+	// It panics if the current module was split by this mutator.
+	PruneVariant()
 }
 
 // A Mutator function is called for each Module, and can use
@@ -995,6 +1147,27 @@ func (BaseDependencyTag) dependencyTag(DependencyTag) {
 
 var _ DependencyTag = BaseDependencyTag{}
 
+// TestDependencyTag is a DependencyTag for dependencies that are only needed to build or run
+// tests, for example a test module's dependencies on the module it tests and on test helper
+// libraries.  It can be used directly or embedded in another tag to add fields.  The dependency
+// walks on Context used to analyze the module graph, such as Context.VisitDepsDepthFirst and
+// Context.TransitiveLicenses, skip dependencies with a TestDependencyTag so that they don't
+// count towards what a module ships with; use Context.WalkDepsIncludingTests to follow them.
+// The walks on ModuleContext and the other mutator contexts are not affected.
+type TestDependencyTag struct {
+	BaseDependencyTag
+}
+
+func (TestDependencyTag) testDependencyTag() {}
+
+var _ DependencyTag = TestDependencyTag{}
+
+// IsTestDependencyTag returns true if the tag is or embeds a TestDependencyTag.
+func IsTestDependencyTag(tag DependencyTag) bool {
+	_, ok := tag.(interface{ testDependencyTag() })
+	return ok
+}
+
 func (mctx *mutatorContext) MutatorName() string {
 	return mctx.name
 }
@@ -1023,7 +1196,34 @@ func (mctx *mutatorContext) SetVariationProvider(module Module, provider AnyProv
 	panic(fmt.Errorf("module %q is not a newly created variant of %q", module, mctx.module))
 }
 
+func (mctx *mutatorContext) Variation(axis string) (string, bool) {
+	variation, ok := mctx.module.variant.variations[axis]
+	return variation, ok
+}
+
 func (mctx *mutatorContext) createVariations(variationNames []string, depChooser depChooser, local bool) []Module {
+	if mctx.module.common {
+		// Modules with the common property are not split, every variation is the module itself.
+		if len(variationNames) == 0 {
+			panic(fmt.Errorf("mutator %q passed zero-length variation list for module %q",
+				mctx.name, mctx.module.Name()))
+		}
+		if errs := mctx.context.convertDepsToVariation(mctx.module, depChooser); len(errs) > 0 {
+			mctx.errs = append(mctx.errs, errs...)
+		}
+		if mctx.newVariations != nil {
+			panic("module already has variations from this mutator")
+		}
+		// The module is recorded as its own single new variant, so that SetVariationProvider and
+		// mutators that look at the new variants, like ArchMutator, still apply to it.
+		mctx.newVariations = modulesOrAliases{mctx.module}
+		ret := make([]Module, len(variationNames))
+		for i := range ret {
+			ret[i] = mctx.module.logicModule
+		}
+		return ret
+	}
+
 	var ret []Module
 	modules, errs := mctx.context.createVariations(mctx.module, mctx.name, depChooser, variationNames, local)
 	if len(errs) > 0 {
@@ -1119,6 +1319,13 @@ func (mctx *mutatorContext) SetDefaultDependencyVariation(variationName *string)
 	mctx.defaultVariation = variationName
 }
 
+func (mctx *mutatorContext) PruneVariant() {
+	if mctx.newVariations != nil {
+		panic(fmt.Errorf("can't prune module %s after it has been split by mutator %q", mctx.module, mctx.name))
+	}
+	mctx.module.pruned = true
+}
+
 func (mctx *mutatorContext) Module() Module {
 	return mctx.module.logicModule
 }
@@ -1153,7 +1360,7 @@ func (mctx *mutatorContext) AddReverseDependency(module Module, tag DependencyTa
 
 	mctx.reverseDeps = append(mctx.reverseDeps, reverseDep{
 		destModule,
-		depInfo{mctx.context.moduleInfo[module], tag},
+		depInfo{mctx.context.moduleInfo[module], mctx.context.InternTag(tag)},
 	})
 }
 
@@ -1162,7 +1369,7 @@ func (mctx *mutatorContext) AddVariationDependencies(variations []Variation, tag
 
 	depInfos := make([]Module, 0, len(deps))
 	for _, dep := range deps {
-		depInfo, errs := mctx.context.addVariationDependency(mctx.module, variations, tag, dep, false)
+		depInfo, errs := mctx.context.addVariationDependency(mctx.module, variations, tag, dep, matchVariant)
 		if len(errs) > 0 {
 			mctx.errs = append(mctx.errs, errs...)
 		}
@@ -1178,9 +1385,21 @@ func (mctx *mutatorContext) AddVariationDependencies(variations []Variation, tag
 func (mctx *mutatorContext) AddFarVariationDependencies(variations []Variation, tag DependencyTag,
 	deps ...string) []Module {
 
+	return mctx.addFarVariationDependencies(variations, tag, matchFarVariant, deps)
+}
+
+func (mctx *mutatorContext) AddClosestFarVariationDependencies(variations []Variation, tag DependencyTag,
+	deps ...string) []Module {
+
+	return mctx.addFarVariationDependencies(variations, tag, matchClosestFarVariant, deps)
+}
+
+func (mctx *mutatorContext) addFarVariationDependencies(variations []Variation, tag DependencyTag,
+	match variantMatch, deps []string) []Module {
+
 	depInfos := make([]Module, 0, len(deps))
 	for _, dep := range deps {
-		depInfo, errs := mctx.context.addVariationDependency(mctx.module, variations, tag, dep, true)
+		depInfo, errs := mctx.context.addVariationDependency(mctx.module, variations, tag, dep, match)
 		if len(errs) > 0 {
 			mctx.errs = append(mctx.errs, errs...)
 		}
@@ -1201,6 +1420,9 @@ func (mctx *mutatorContext) ReplaceDependencies(name string) {
 	mctx.ReplaceDependenciesIf(name, nil)
 }
 
+// ReplaceDependencyPredicate is called by ReplaceDependenciesIf for each dependency of from on the
+// replaced module to, and returns true if the dependency should be replaced.  To replace only
+// the dependencies with a specific tag, ignore from and to and compare tag.
 type ReplaceDependencyPredicate func(from Module, tag DependencyTag, to Module) bool
 
 func (mctx *mutatorContext) ReplaceDependenciesIf(name string, predicate ReplaceDependencyPredicate) {
@@ -1222,12 +1444,26 @@ func (mctx *mutatorContext) Rename(name string) {
 }
 
 func (mctx *mutatorContext) CreateModule(factory ModuleFactory, typeName string, props ...interface{}) Module {
+	return mctx.createModule(factory, typeName, mctx.module.relBlueprintsFile, props)
+}
+
+func (mctx *mutatorContext) CreateModuleInDirectory(factory ModuleFactory, typeName string, dir string,
+	props ...interface{}) Module {
+
+	relBlueprintsFile := filepath.Join(dir, filepath.Base(mctx.module.relBlueprintsFile))
+	return mctx.createModule(factory, typeName, relBlueprintsFile, props)
+}
+
+func (mctx *mutatorContext) createModule(factory ModuleFactory, typeName string, relBlueprintsFile string,
+	props []interface{}) Module {
+
 	module := newModule(factory)
 
-	module.relBlueprintsFile = mctx.module.relBlueprintsFile
+	module.relBlueprintsFile = relBlueprintsFile
 	module.pos = mctx.module.pos
 	module.propertyPos = mctx.module.propertyPos
 	module.createdBy = mctx.module
+	module.createdByMutator = mctx.name
 	module.typeName = typeName
 
 	for _, p := range props {
@@ -1399,8 +1635,17 @@ func runAndRemoveLoadHooks(ctx *Context, config interface{}, module *moduleInfo,
 // * Unpacks the properties into the Module.
 // * Does not invoke load hooks or any mutators.
 //
-// The filename is only used for reporting errors.
+// The filename is only used for reporting errors.  Properties of value types, see
+// Context.RegisterValueType, are reported as errors when they are set, use
+// CheckBlueprintSyntaxWithValueTypes to check them.
 func CheckBlueprintSyntax(moduleFactories map[string]ModuleFactory, filename string, contents string) []error {
+	return CheckBlueprintSyntaxWithValueTypes(moduleFactories, nil, filename, contents)
+}
+
+// CheckBlueprintSyntaxWithValueTypes is like CheckBlueprintSyntax, but also checks the properties
+// of the value types registered in valueTypes, see Context.RegisterValueType.
+func CheckBlueprintSyntaxWithValueTypes(moduleFactories map[string]ModuleFactory,
+	valueTypes map[string]proptools.ValueTypeParser, filename string, contents string) []error {
 	scope := parser.NewScope(nil)
 	file, errs := parser.Parse(filename, strings.NewReader(contents), scope)
 	if len(errs) != 0 {
@@ -1410,7 +1655,7 @@ func CheckBlueprintSyntax(moduleFactories map[string]ModuleFactory, filename str
 	for _, def := range file.Defs {
 		switch def := def.(type) {
 		case *parser.Module:
-			_, moduleErrs := processModuleDef(def, filename, moduleFactories, nil, false)
+			_, moduleErrs := processModuleDef(def, filename, moduleFactories, nil, valueTypes, false, false)
 			errs = append(errs, moduleErrs...)
 
 		default:
@@ -15,9 +15,13 @@
 package blueprint
 
 import (
+	"fmt"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/google/blueprint/proptools"
 )
 
 type moduleCtxTestModule struct {
@@ -325,6 +329,167 @@ func expectedErrors(t *testing.T, errs []error, expectedMessages ...string) {
 	}
 }
 
+func pruneVariantMutator(name, axis, variation string) func(ctx BottomUpMutatorContext) {
+	return func(ctx BottomUpMutatorContext) {
+		if v, _ := ctx.Variation(axis); ctx.ModuleName() == name && v == variation {
+			ctx.PruneVariant()
+		}
+	}
+}
+
+func TestPruneVariant(t *testing.T) {
+	runWithFailures := func(ctx *Context, expectedErr string) {
+		t.Helper()
+		bp := `
+			test {
+				name: "foo",
+			}
+
+			test {
+				name: "bar",
+			}
+		`
+
+		mockFS := map[string][]byte{
+			"Android.bp": []byte(bp),
+		}
+
+		ctx.MockFileSystem(mockFS)
+
+		_, errs := ctx.ParseFileList(".", []string{"Android.bp"}, nil)
+		if len(errs) > 0 {
+			t.Errorf("unexpected parse errors:")
+			for _, err := range errs {
+				t.Errorf("  %s", err)
+			}
+		}
+
+		_, errs = ctx.ResolveDependencies(nil)
+		if len(errs) > 0 {
+			if expectedErr == "" {
+				t.Errorf("unexpected dep errors:")
+				for _, err := range errs {
+					t.Errorf("  %s", err)
+				}
+			} else {
+				for _, err := range errs {
+					if !strings.Contains(err.Error(), expectedErr) {
+						t.Errorf("unexpected dep error: %s", err)
+					}
+				}
+			}
+		} else if expectedErr != "" {
+			t.Errorf("missing dep error: %s", expectedErr)
+		}
+	}
+
+	run := func(ctx *Context) {
+		t.Helper()
+		runWithFailures(ctx, "")
+	}
+
+	t.Run("pruned", func(t *testing.T) {
+		// Creates a module "bar" with variants "a_a", "a_b", "b_a" and "b_b", then prunes "a_b".
+		ctx := NewContext()
+		ctx.RegisterModuleType("test", newModuleCtxTestModule)
+		ctx.RegisterBottomUpMutator("1", noAliasMutator("bar"))
+		ctx.RegisterBottomUpMutator("2", noAliasMutator("bar"))
+		ctx.RegisterBottomUpMutator("3", func(ctx BottomUpMutatorContext) {
+			v1, _ := ctx.Variation("1")
+			v2, _ := ctx.Variation("2")
+			if ctx.ModuleName() == "bar" && v1 == "a" && v2 == "b" {
+				ctx.PruneVariant()
+			}
+		})
+
+		run(ctx)
+
+		bar := ctx.moduleGroupFromName("bar", nil)
+		var variants []string
+		for _, m := range bar.modules {
+			variants = append(variants, m.moduleOrAliasVariant().name)
+		}
+		if g, w := variants, []string{"a_a", "b_a", "b_b"}; !reflect.DeepEqual(g, w) {
+			t.Errorf("expected bar variants %q, got %q", w, g)
+		}
+		for _, m := range ctx.modulesSorted {
+			if m.variant.name == "a_b" {
+				t.Errorf("expected pruned variant to be removed from the sorted modules")
+			}
+		}
+	})
+
+	t.Run("lookup", func(t *testing.T) {
+		// Creates a module "bar" with variants "a" and "b", prunes "a", then tests that a dependency
+		// from "foo" to "bar" variant "a" fails.
+		ctx := NewContext()
+		ctx.RegisterModuleType("test", newModuleCtxTestModule)
+		ctx.RegisterBottomUpMutator("1", noAliasMutator("bar"))
+		ctx.RegisterBottomUpMutator("2", pruneVariantMutator("bar", "1", "a"))
+		ctx.RegisterBottomUpMutator("3", addVariantDepsMutator([]Variation{{"1", "a"}}, nil, "foo", "bar"))
+
+		runWithFailures(ctx, `dependency "bar" of "foo" missing variant:`+"\n  1:a\n"+
+			"available variants:"+
+			"\n  1:b")
+	})
+
+	t.Run("alias", func(t *testing.T) {
+		// Creates a module "bar" with variants "a" and "b" and alias "" -> "b", prunes "b", then
+		// tests that a dependency from "foo" to "bar" through the removed alias "" fails.
+		ctx := NewContext()
+		ctx.RegisterModuleType("test", newModuleCtxTestModule)
+		ctx.RegisterBottomUpMutator("1", aliasMutator("bar"))
+		ctx.RegisterBottomUpMutator("2", pruneVariantMutator("bar", "1", "b"))
+		ctx.RegisterBottomUpMutator("3", addVariantDepsMutator(nil, nil, "foo", "bar"))
+
+		runWithFailures(ctx, `dependency "bar" of "foo" missing variant:`+"\n  \n"+
+			"available variants:"+
+			"\n  1:a")
+	})
+
+	t.Run("all variants", func(t *testing.T) {
+		// Creates a module "bar" with variants "a" and "b", prunes both, then tests that "bar" is
+		// removed and that a dependency from "foo" to "bar" is a missing dependency.
+		ctx := NewContext()
+		ctx.RegisterModuleType("test", newModuleCtxTestModule)
+		ctx.RegisterBottomUpMutator("1", noAliasMutator("bar"))
+		ctx.RegisterBottomUpMutator("2", pruneVariantMutator("bar", "1", "a"))
+		ctx.RegisterBottomUpMutator("3", pruneVariantMutator("bar", "1", "b"))
+		ctx.RegisterBottomUpMutator("4", addVariantDepsMutator(nil, nil, "foo", "bar"))
+
+		runWithFailures(ctx, `"foo" depends on undefined module "bar"`)
+
+		if ctx.moduleGroupFromName("bar", nil) != nil {
+			t.Errorf("expected bar to be removed")
+		}
+		for _, group := range ctx.moduleGroups {
+			if group.name == "bar" {
+				t.Errorf("expected bar to be removed from the module groups")
+			}
+		}
+	})
+
+	t.Run("edges", func(t *testing.T) {
+		// Creates a module "bar" with variants "a" and "b", adds dependencies from "foo" to both
+		// variants, then prunes "a" and tests that only the dependency on "b" remains.
+		ctx := NewContext()
+		ctx.RegisterModuleType("test", newModuleCtxTestModule)
+		ctx.RegisterBottomUpMutator("1", noAliasMutator("bar"))
+		ctx.RegisterBottomUpMutator("2", addVariantDepsMutator([]Variation{{"1", "a"}}, nil, "foo", "bar"))
+		ctx.RegisterBottomUpMutator("3", addVariantDepsMutator([]Variation{{"1", "b"}}, nil, "foo", "bar"))
+		ctx.RegisterBottomUpMutator("4", pruneVariantMutator("bar", "1", "a"))
+
+		run(ctx)
+
+		foo := ctx.moduleGroupFromName("foo", nil).moduleByVariantName("")
+		barB := ctx.moduleGroupFromName("bar", nil).moduleByVariantName("b")
+
+		if g, w := foo.forwardDeps, []*moduleInfo{barB}; !reflect.DeepEqual(g, w) {
+			t.Errorf("expected foo deps to be %q, got %q", w, g)
+		}
+	})
+}
+
 func TestAddVariationDependencies(t *testing.T) {
 	runWithFailures := func(ctx *Context, expectedErr string) {
 		t.Helper()
@@ -514,6 +679,47 @@ test {
 		expectedErrors(t, errs, `path/Blueprint:3:8: can't assign bool value to string property "name"`)
 	})
 
+	t.Run("value types", func(t *testing.T) {
+		factories := map[string]ModuleFactory{
+			"test": newValueTypeTestModule,
+		}
+		valueTypes := map[string]proptools.ValueTypeParser{
+			"duration": func(s string) (interface{}, error) {
+				return time.ParseDuration(s)
+			},
+		}
+
+		errs := CheckBlueprintSyntax(factories, "path/Blueprint", `
+test {
+	name: "unset",
+}
+`)
+		expectedErrors(t, errs)
+
+		errs = CheckBlueprintSyntax(factories, "path/Blueprint", `
+test {
+	name: "set",
+	timeout: "10s",
+}
+`)
+		expectedErrors(t, errs,
+			`path/Blueprint:4:11: property "timeout" has unregistered value type "duration"`)
+
+		errs = CheckBlueprintSyntaxWithValueTypes(factories, valueTypes, "path/Blueprint", `
+test {
+	name: "good",
+	timeout: "10s",
+}
+
+test {
+	name: "bad",
+	timeout: "soon",
+}
+`)
+		expectedErrors(t, errs,
+			`path/Blueprint:9:11: module "bad": timeout: invalid duration value "soon" for property "timeout": time: invalid duration "soon"`)
+	})
+
 	t.Run("multiple failures", func(t *testing.T) {
 		errs := CheckBlueprintSyntax(factories, "path/Blueprint", `
 test {
@@ -620,3 +826,522 @@ func TestAddNinjaFileDeps(t *testing.T) {
 	}
 
 }
+
+func TestModuleOutputDir(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			test {
+			    name: "foo",
+			}
+		`),
+		"dir/Android.bp": []byte(`
+			test {
+			    name: "bar",
+			}
+		`),
+	})
+	ctx.RegisterModuleType("test", newModuleCtxTestModule)
+	ctx.RegisterBottomUpMutator("1", noAliasMutator("bar"))
+	ctx.RegisterBottomUpMutator("2", noAliasMutator("bar"))
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected dep errors: %v", errs)
+	}
+
+	foo := ctx.moduleGroupFromName("foo", nil).moduleByVariantName("")
+	barAB := ctx.moduleGroupFromName("bar", nil).moduleByVariantName("a_b")
+
+	if g, w := ctx.ModuleOutputDir(foo.logicModule), "foo"; g != w {
+		t.Errorf("wanted output dir %q, got %q", w, g)
+	}
+	if g, w := ctx.ModuleOutputDir(barAB.logicModule), "dir/bar/a_b"; g != w {
+		t.Errorf("wanted output dir %q, got %q", w, g)
+	}
+
+	unknown := &fooModule{}
+	if g := ctx.ModuleOutputDir(unknown); g != "" {
+		t.Errorf("wanted empty output dir for a module not in the context, got %q", g)
+	}
+	if g := ctx.ModuleSubDir(unknown); g != "" {
+		t.Errorf("wanted empty subdir for a module not in the context, got %q", g)
+	}
+	if g := ctx.ModuleVariantName(unknown); g != "" {
+		t.Errorf("wanted empty variant name for a module not in the context, got %q", g)
+	}
+}
+
+type stampTestModule struct {
+	SimpleName
+	properties struct {
+		Stamp bool
+	}
+}
+
+func stampTestModuleFactory() (Module, []interface{}) {
+	module := &stampTestModule{}
+	return module, []interface{}{&module.SimpleName.Properties, &module.properties}
+}
+
+func (m *stampTestModule) GenerateBuildActions(ctx ModuleContext) {
+	if m.properties.Stamp {
+		ctx.Stamp(ctx.ModuleName()+".stamp", "dep")
+	}
+}
+
+func TestStamp(t *testing.T) {
+	run := func(t *testing.T, bp string) string {
+		ctx := NewContext()
+		ctx.MockFileSystem(map[string][]byte{
+			"Android.bp": []byte(bp),
+		})
+		ctx.RegisterModuleType("test", stampTestModuleFactory)
+
+		_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected parse errors: %v", errs)
+		}
+		_, errs = ctx.ResolveDependencies(nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected dep errors: %v", errs)
+		}
+		_, errs = ctx.PrepareBuildActions(nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected build action errors: %v", errs)
+		}
+
+		buf := &strings.Builder{}
+		if err := ctx.WriteBuildFile(buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	t.Run("used", func(t *testing.T) {
+		out := run(t, `
+			test {
+			    name: "foo",
+			    stamp: true,
+			}
+			test {
+			    name: "bar",
+			    stamp: true,
+			}
+		`)
+		if g := strings.Count(out, "\nrule g.blueprint.touch\n"); g != 1 {
+			t.Errorf("expected touch rule to be declared once, got %d:\n%s", g, out)
+		}
+		for _, s := range []string{
+			"build foo.stamp: g.blueprint.touch dep\n",
+			"build bar.stamp: g.blueprint.touch dep\n",
+		} {
+			if !strings.Contains(out, s) {
+				t.Errorf("missing %q in:\n%s", s, out)
+			}
+		}
+	})
+
+	t.Run("unused", func(t *testing.T) {
+		out := run(t, `
+			test {
+			    name: "foo",
+			}
+		`)
+		if strings.Contains(out, "g.blueprint.touch") {
+			t.Errorf("unexpected touch rule in:\n%s", out)
+		}
+	})
+}
+
+type phonyTestModule struct {
+	SimpleName
+	properties struct {
+		Phony  string
+		Output string
+	}
+}
+
+func phonyTestModuleFactory() (Module, []interface{}) {
+	module := &phonyTestModule{}
+	return module, []interface{}{&module.SimpleName.Properties, &module.properties}
+}
+
+func (m *phonyTestModule) GenerateBuildActions(ctx ModuleContext) {
+	if m.properties.Phony != "" {
+		ctx.Phony(m.properties.Phony, []string{ctx.ModuleName() + ".a", ctx.ModuleName() + ".b"})
+	}
+	if m.properties.Output != "" {
+		ctx.Stamp(m.properties.Output)
+	}
+}
+
+func TestPhony(t *testing.T) {
+	run := func(t *testing.T, bp string) (string, []error) {
+		ctx := NewContext()
+		ctx.MockFileSystem(map[string][]byte{
+			"Android.bp": []byte(bp),
+		})
+		ctx.RegisterModuleType("test", phonyTestModuleFactory)
+
+		_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected parse errors: %v", errs)
+		}
+		_, errs = ctx.ResolveDependencies(nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected dep errors: %v", errs)
+		}
+		_, errs = ctx.PrepareBuildActions(nil)
+		if len(errs) > 0 {
+			return "", errs
+		}
+
+		buf := &strings.Builder{}
+		if err := ctx.WriteBuildFile(buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String(), nil
+	}
+
+	t.Run("phony", func(t *testing.T) {
+		out, errs := run(t, `
+			test {
+			    name: "foo",
+			    phony: "all_foo",
+			}
+		`)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+		if s := "build all_foo: phony foo.a foo.b\n"; !strings.Contains(out, s) {
+			t.Errorf("missing %q in:\n%s", s, out)
+		}
+	})
+
+	t.Run("collides with output", func(t *testing.T) {
+		_, errs := run(t, `
+			test {
+			    name: "foo",
+			    phony: "out",
+			}
+			test {
+			    name: "bar",
+			    output: "out",
+			}
+		`)
+		if len(errs) != 1 {
+			t.Fatalf("expected 1 error, got %q", errs)
+		}
+		if g, w := errs[0].Error(), `Android.bp:2:4: module "foo": phony target "out" is also an output of module "bar"`; g != w {
+			t.Errorf("expected error %q, got %q", w, g)
+		}
+	})
+
+	t.Run("collides with phony", func(t *testing.T) {
+		_, errs := run(t, `
+			test {
+			    name: "foo",
+			    phony: "all",
+			}
+			test {
+			    name: "bar",
+			    phony: "all",
+			}
+		`)
+		if len(errs) != 1 {
+			t.Fatalf("expected 1 error, got %q", errs)
+		}
+		if g, w := errs[0].Error(), `Android.bp:2:4: module "foo": phony target "all" is also created by module "bar"`; g != w {
+			t.Errorf("expected error %q, got %q", w, g)
+		}
+	})
+}
+
+type globDependencyTestModule struct {
+	SimpleName
+}
+
+func globDependencyTestModuleFactory() (Module, []interface{}) {
+	module := &globDependencyTestModule{}
+	return module, []interface{}{&module.SimpleName.Properties}
+}
+
+func (m *globDependencyTestModule) GenerateBuildActions(ctx ModuleContext) {
+	ctx.Stamp("foo.stamp", "dep")
+	fileListFile := ctx.AddGlobDependency("dir/*", "dir/b")
+	if again := ctx.AddGlobDependency("dir/*", "dir/b"); again != fileListFile {
+		ctx.ModuleErrorf("expected the same file list file %q, got %q", fileListFile, again)
+	}
+}
+
+func TestAddGlobDependency(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			test {
+			    name: "foo",
+			}
+		`),
+		"dir/a": nil,
+		"dir/b": nil,
+	})
+	ctx.RegisterModuleType("test", globDependencyTestModuleFactory)
+
+	ctx.SetGlobListDir("out/globs")
+	var fileListFiles []string
+	ctx.SetGlobFileFunc(func(ctx ModuleContext, pattern string, excludes []string, fileListFile string) {
+		if pattern != "dir/*" || !reflect.DeepEqual(excludes, []string{"dir/b"}) {
+			t.Errorf("unexpected glob %q excluding %q", pattern, excludes)
+		}
+		fileListFiles = append(fileListFiles, fileListFile)
+		ctx.Stamp(fileListFile)
+	})
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected dep errors: %v", errs)
+	}
+	_, errs = ctx.PrepareBuildActions(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected build action errors: %v", errs)
+	}
+
+	if len(fileListFiles) != 1 {
+		t.Fatalf("expected 1 file list file, got %q", fileListFiles)
+	}
+	fileListFile := fileListFiles[0]
+	if !strings.HasPrefix(fileListFile, "out/globs/modules/foo/") {
+		t.Errorf("expected file list file in the glob list directory, got %q", fileListFile)
+	}
+
+	globs := ctx.Globs()
+	if len(globs) != 1 || !reflect.DeepEqual(globs[0].Matches, []string{"dir/a"}) {
+		t.Errorf("expected glob matching dir/a, got %+v", globs)
+	}
+
+	buf := &strings.Builder{}
+	if err := ctx.WriteBuildFile(buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, s := range []string{
+		"build foo.stamp: g.blueprint.touch dep | " + fileListFile + "\n",
+		"build " + fileListFile + ": g.blueprint.touch\n",
+	} {
+		if !strings.Contains(out, s) {
+			t.Errorf("missing %q in:\n%s", s, out)
+		}
+	}
+}
+
+type noBuildActionsTestModule struct {
+	stampTestModule
+}
+
+func noBuildActionsTestModuleFactory() (Module, []interface{}) {
+	module := &noBuildActionsTestModule{}
+	return module, []interface{}{&module.SimpleName.Properties, &module.properties}
+}
+
+func (m *noBuildActionsTestModule) NoBuildActions() {}
+
+func TestWarnOnEmptyModules(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			test {
+			    name: "foo",
+			    stamp: true,
+			}
+			test {
+			    name: "bar",
+			}
+			no_build_actions {
+			    name: "baz",
+			}
+		`),
+	})
+	ctx.RegisterModuleType("test", stampTestModuleFactory)
+	ctx.RegisterModuleType("no_build_actions", noBuildActionsTestModuleFactory)
+	ctx.SetWarnOnEmptyModules(true)
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected dep errors: %v", errs)
+	}
+	_, errs = ctx.PrepareBuildActions(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected build action errors: %v", errs)
+	}
+
+	warnings := ctx.Warnings()
+	if len(warnings) != 1 {
+		t.Fatalf("expected 1 warning, got %q", warnings)
+	}
+	expected := `Android.bp:6:4: module "bar": produced no build actions and no providers`
+	if g := warnings[0].Error(); g != expected {
+		t.Errorf("expected warning %q, got %q", expected, g)
+	}
+}
+
+type replaceDepsTestTag struct {
+	BaseDependencyTag
+	name string
+}
+
+var (
+	replaceDepsLinkTag = replaceDepsTestTag{name: "link"}
+	replaceDepsDataTag = replaceDepsTestTag{name: "data"}
+)
+
+func TestReplaceDependenciesIf(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			test {
+			    name: "user",
+			}
+			test {
+			    name: "src",
+			}
+			test {
+			    name: "prebuilt",
+			}
+		`),
+	})
+	ctx.RegisterModuleType("test", newModuleCtxTestModule)
+	ctx.RegisterBottomUpMutator("deps", func(ctx BottomUpMutatorContext) {
+		if ctx.ModuleName() == "user" {
+			ctx.AddDependency(ctx.Module(), replaceDepsLinkTag, "src")
+			ctx.AddDependency(ctx.Module(), replaceDepsDataTag, "src")
+		}
+	})
+	ctx.RegisterBottomUpMutator("replace", func(ctx BottomUpMutatorContext) {
+		if ctx.ModuleName() == "prebuilt" {
+			ctx.ReplaceDependenciesIf("src", func(from Module, tag DependencyTag, to Module) bool {
+				return tag == replaceDepsLinkTag
+			})
+		}
+	})
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected dep errors: %v", errs)
+	}
+
+	user := ctx.moduleGroupFromName("user", nil).moduleByVariantName("")
+	src := ctx.moduleGroupFromName("src", nil).moduleByVariantName("")
+	prebuilt := ctx.moduleGroupFromName("prebuilt", nil).moduleByVariantName("")
+
+	var got []string
+	for _, dep := range user.directDeps {
+		got = append(got, dep.tag.(replaceDepsTestTag).name+":"+dep.module.Name())
+	}
+	if w := []string{"link:prebuilt", "data:src"}; !reflect.DeepEqual(got, w) {
+		t.Errorf("wanted deps %q, got %q", w, got)
+	}
+
+	for _, m := range []*moduleInfo{src, prebuilt} {
+		if len(m.reverseDeps) != 1 || m.reverseDeps[0] != user {
+			t.Errorf("wanted reverse deps of %s to be [%s], got %s", m, user, m.reverseDeps)
+		}
+	}
+}
+
+func TestMutatorContextVariation(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			test {
+			    name: "foo",
+			}
+		`),
+	})
+	ctx.RegisterModuleType("test", newModuleCtxTestModule)
+	ctx.RegisterBottomUpMutator("arch", noAliasMutator("foo"))
+
+	var got []string
+	ctx.RegisterBottomUpMutator("check", func(ctx BottomUpMutatorContext) {
+		arch, ok := ctx.Variation("arch")
+		_, missing := ctx.Variation("missing")
+		got = append(got, fmt.Sprintf("%s:%v:%v", arch, ok, missing))
+	})
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected dep errors: %v", errs)
+	}
+
+	if w := []string{"a:true:false", "b:true:false"}; !reflect.DeepEqual(got, w) {
+		t.Errorf("wanted %q, got %q", w, got)
+	}
+}
+
+func TestOtherModuleExists(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			test {
+			    name: "foo",
+			}
+		`),
+		"dir1/Android.bp": []byte(`
+			test {
+			    name: "bar",
+			}
+		`),
+		"dir2/Android.bp": []byte(`
+			test {
+			    name: "skipped",
+			}
+		`),
+	})
+	ctx.RegisterModuleType("test", newModuleCtxTestModule)
+	ctx.AddSourceRootDirs("-dir2")
+
+	got := map[string]bool{}
+	ctx.RegisterBottomUpMutator("check", func(ctx BottomUpMutatorContext) {
+		if ctx.ModuleName() == "foo" {
+			for _, name := range []string{"bar", "skipped", "missing"} {
+				got[name] = ctx.OtherModuleExists(name)
+				if got[name] {
+					ctx.AddDependency(ctx.Module(), nil, name)
+				}
+			}
+		}
+	})
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected dep errors: %v", errs)
+	}
+
+	if w := map[string]bool{"bar": true, "skipped": false, "missing": false}; !reflect.DeepEqual(got, w) {
+		t.Errorf("wanted %v, got %v", w, got)
+	}
+}
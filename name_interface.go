@@ -16,6 +16,7 @@ package blueprint
 
 import (
 	"fmt"
+	"path/filepath"
 	"sort"
 	"strings"
 )
@@ -108,22 +109,38 @@ type SkippedModuleInfo struct {
 	reason   string
 }
 
-// a SimpleNameInterface just stores all modules in a map based on name
+// a SimpleNameInterface just stores all modules in a map based on name, with a separate map for
+// each BlueprintNamespace declared by a blueprint_namespace module
 type SimpleNameInterface struct {
 	modules        map[string]ModuleGroup
 	skippedModules map[string][]SkippedModuleInfo
+
+	namespaces      map[string]*BlueprintNamespace
+	namespacesByDir map[string]*BlueprintNamespace
+	dirsWithModules map[string]bool
 }
 
 func NewSimpleNameInterface() *SimpleNameInterface {
 	return &SimpleNameInterface{
-		modules:        make(map[string]ModuleGroup),
-		skippedModules: make(map[string][]SkippedModuleInfo),
+		modules:         make(map[string]ModuleGroup),
+		skippedModules:  make(map[string][]SkippedModuleInfo),
+		namespaces:      make(map[string]*BlueprintNamespace),
+		namespacesByDir: make(map[string]*BlueprintNamespace),
+		dirsWithModules: make(map[string]bool),
 	}
 }
 
 func (s *SimpleNameInterface) NewModule(ctx NamespaceContext, group ModuleGroup, module Module) (namespace Namespace, err []error) {
+	if namespaceModule, ok := module.(*NamespaceModule); ok {
+		if err := s.newNamespace(ctx, namespaceModule); err != nil {
+			return nil, []error{err}
+		}
+	}
+
 	name := group.name
-	if group, present := s.modules[name]; present {
+	namespace = s.GetNamespace(ctx)
+	modules := s.modulesInNamespace(namespace)
+	if group, present := modules[name]; present {
 		return nil, []error{
 			// seven characters at the start of the second line to align with the string "error: "
 			fmt.Errorf("module %q already defined\n"+
@@ -131,9 +148,10 @@ func (s *SimpleNameInterface) NewModule(ctx NamespaceContext, group ModuleGroup,
 		}
 	}
 
-	s.modules[name] = group
+	modules[name] = group
+	s.dirsWithModules[filepath.Dir(ctx.ModulePath())] = true
 
-	return nil, []error{}
+	return namespace, []error{}
 }
 
 func (s *SimpleNameInterface) NewSkippedModule(ctx NamespaceContext, name string, info SkippedModuleInfo) {
@@ -144,7 +162,7 @@ func (s *SimpleNameInterface) NewSkippedModule(ctx NamespaceContext, name string
 }
 
 func (s *SimpleNameInterface) ModuleFromName(moduleName string, namespace Namespace) (group ModuleGroup, found bool) {
-	group, found = s.modules[moduleName]
+	group, found = s.modulesInNamespace(namespace)[moduleName]
 	return group, found
 }
 
@@ -154,7 +172,8 @@ func (s *SimpleNameInterface) SkippedModuleFromName(moduleName string, namespace
 }
 
 func (s *SimpleNameInterface) Rename(oldName string, newName string, namespace Namespace) (errs []error) {
-	existingGroup, exists := s.modules[newName]
+	modules := s.modulesInNamespace(namespace)
+	existingGroup, exists := modules[newName]
 	if exists {
 		return []error{
 			// seven characters at the start of the second line to align with the string "error: "
@@ -164,26 +183,50 @@ func (s *SimpleNameInterface) Rename(oldName string, newName string, namespace N
 		}
 	}
 
-	group, exists := s.modules[oldName]
+	group, exists := modules[oldName]
 	if !exists {
 		return []error{fmt.Errorf("module %q to renamed to %q doesn't exist", oldName, newName)}
 	}
-	s.modules[newName] = group
-	delete(s.modules, group.name)
+	modules[newName] = group
+	delete(modules, group.name)
 	group.name = newName
 	return nil
 }
 
+// removeModule removes a module group that was added by NewModule, for Context.ReparseFile.
+func (s *SimpleNameInterface) removeModule(group ModuleGroup) {
+	modules := s.modulesInNamespace(group.namespace)
+	if existing, exists := modules[group.name]; exists && existing.moduleGroup == group.moduleGroup {
+		delete(modules, group.name)
+	}
+}
+
 func (s *SimpleNameInterface) AllModules() []ModuleGroup {
 	groups := make([]ModuleGroup, 0, len(s.modules))
 	for _, group := range s.modules {
 		groups = append(groups, group)
 	}
+	for _, namespace := range s.namespaces {
+		for _, group := range namespace.modules {
+			groups = append(groups, group)
+		}
+	}
+
+	namespaceName := func(group ModuleGroup) string {
+		if ns, ok := group.namespace.(*BlueprintNamespace); ok && ns != nil {
+			return ns.name
+		}
+		return ""
+	}
 
 	duplicateName := ""
 	less := func(i, j int) bool {
 		if groups[i].name == groups[j].name {
-			duplicateName = groups[i].name
+			iNamespace, jNamespace := namespaceName(groups[i]), namespaceName(groups[j])
+			if iNamespace == jNamespace {
+				duplicateName = groups[i].name
+			}
+			return iNamespace < jNamespace
 		}
 		return groups[i].name < groups[j].name
 	}
@@ -224,9 +267,15 @@ func (s *SimpleNameInterface) MissingDependencyError(depender string, dependerNa
 }
 
 func (s *SimpleNameInterface) GetNamespace(ctx NamespaceContext) Namespace {
+	if namespace := s.findNamespace(ctx); namespace != nil {
+		return namespace
+	}
 	return nil
 }
 
 func (s *SimpleNameInterface) UniqueName(ctx NamespaceContext, name string) (unique string) {
+	if namespace := s.findNamespace(ctx); namespace != nil {
+		return "//" + namespace.name + ":" + name
+	}
 	return name
 }
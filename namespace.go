@@ -0,0 +1,213 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueprint
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/google/blueprint/proptools"
+)
+
+// A BlueprintNamespace is the Namespace used by SimpleNameInterface for the modules in a directory
+// that contains a blueprint_namespace module, and in all of its subdirectories that don't contain
+// their own blueprint_namespace module.  Module names only have to be unique within a namespace.
+//
+// A dependency is resolved by first looking for the name in the namespace of the depending module,
+// then in each of the namespaces imported by that namespace, and finally in the default namespace
+// that contains the modules that are not in any blueprint_namespace.  Imports are not transitive.
+type BlueprintNamespace struct {
+	NamespaceMarker
+
+	name    string
+	dir     string
+	module  *NamespaceModule
+	modules map[string]ModuleGroup
+
+	// set by resolveNamespaceImports
+	importedNamespaces []*BlueprintNamespace
+}
+
+// Name returns the name of the namespace given by the name property of its blueprint_namespace
+// module.
+func (ns *BlueprintNamespace) Name() string {
+	return ns.name
+}
+
+// Dir returns the directory containing the blueprint_namespace module that declared the namespace.
+func (ns *BlueprintNamespace) Dir() string {
+	return ns.dir
+}
+
+func (ns *BlueprintNamespace) String() string {
+	return ns.name
+}
+
+// NamespaceModule is the blueprint_namespace module type, which declares the namespace of the
+// modules in the directory that contains it and its subdirectories.  It must be the first module in
+// its directory.
+//
+//	blueprint_namespace {
+//	    name: "vendor",
+//	    imports: ["common"],
+//	}
+type NamespaceModule struct {
+	properties struct {
+		// Name is the name of the namespace, which must be unique.
+		Name *string
+
+		// Imports is the list of namespaces that are searched for dependencies that are not found
+		// in this namespace, before the default namespace.
+		Imports []string
+	}
+
+	imports []string
+}
+
+func newNamespaceModuleFactory() (Module, []interface{}) {
+	module := &NamespaceModule{}
+	return module, []interface{}{&module.properties}
+}
+
+// RegisterNamespaceModuleType registers the blueprint_namespace module type.
+func RegisterNamespaceModuleType(ctx *Context) {
+	ctx.RegisterModuleType("blueprint_namespace", newNamespaceModuleFactory)
+}
+
+func (m *NamespaceModule) Name() string {
+	return proptools.String(m.properties.Name)
+}
+
+// This module type does not have any build actions
+func (m *NamespaceModule) GenerateBuildActions(ctx ModuleContext) {
+}
+
+// AddImportedNamespaces adds to the namespaces that are searched for dependencies that are not
+// found in this namespace.  It must be called before ResolveDependencies, usually from a load hook.
+func (m *NamespaceModule) AddImportedNamespaces(names ...string) {
+	m.imports = append(m.imports, names...)
+}
+
+// ImportedNamespaces returns the names of the namespaces imported by the namespace, from the
+// imports property followed by any added by AddImportedNamespaces.
+func (m *NamespaceModule) ImportedNamespaces() []string {
+	return append(append([]string(nil), m.properties.Imports...), m.imports...)
+}
+
+// newNamespace creates the namespace declared by a blueprint_namespace module.
+func (s *SimpleNameInterface) newNamespace(ctx NamespaceContext, module *NamespaceModule) error {
+	dir := filepath.Dir(ctx.ModulePath())
+	if module.Name() == "" {
+		return fmt.Errorf("blueprint_namespace must have a name")
+	}
+	if existing, exists := s.namespaces[module.Name()]; exists {
+		return fmt.Errorf("namespace %q already defined in %q", module.Name(), existing.dir)
+	}
+	if existing, exists := s.namespacesByDir[dir]; exists {
+		return fmt.Errorf("directory %q already contains namespace %q", dir, existing.name)
+	}
+	if s.dirsWithModules[dir] {
+		return fmt.Errorf("blueprint_namespace must be the first module in directory %q", dir)
+	}
+
+	namespace := &BlueprintNamespace{
+		name:    module.Name(),
+		dir:     dir,
+		module:  module,
+		modules: make(map[string]ModuleGroup),
+	}
+	s.namespaces[namespace.name] = namespace
+	s.namespacesByDir[dir] = namespace
+	return nil
+}
+
+// findNamespace returns the namespace declared in the closest directory containing the module,
+// or nil if the module is in the default namespace.
+func (s *SimpleNameInterface) findNamespace(ctx NamespaceContext) *BlueprintNamespace {
+	if len(s.namespacesByDir) == 0 {
+		return nil
+	}
+	for dir := filepath.Dir(ctx.ModulePath()); ; dir = filepath.Dir(dir) {
+		if namespace, exists := s.namespacesByDir[dir]; exists {
+			return namespace
+		}
+		if dir == "." || dir == string(filepath.Separator) {
+			return nil
+		}
+	}
+}
+
+// modulesInNamespace returns the map of module names to module groups for a namespace, which may
+// be nil for the default namespace.
+func (s *SimpleNameInterface) modulesInNamespace(namespace Namespace) map[string]ModuleGroup {
+	if ns, ok := namespace.(*BlueprintNamespace); ok && ns != nil {
+		return ns.modules
+	}
+	return s.modules
+}
+
+// sortedNamespaces returns the namespaces sorted by name.
+func (s *SimpleNameInterface) sortedNamespaces() []*BlueprintNamespace {
+	namespaces := make([]*BlueprintNamespace, 0, len(s.namespaces))
+	for _, namespace := range s.namespaces {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Slice(namespaces, func(i, j int) bool {
+		return namespaces[i].name < namespaces[j].name
+	})
+	return namespaces
+}
+
+// resolveNamespaceImports resolves the names of the namespaces imported by each blueprint_namespace
+// module.  It is called by ResolveDependencies once all of the namespaces have been parsed.
+func (c *Context) resolveNamespaceImports() (errs []error) {
+	s, ok := c.nameInterface.(*SimpleNameInterface)
+	if !ok {
+		return nil
+	}
+
+	for _, namespace := range s.sortedNamespaces() {
+		namespace.importedNamespaces = nil
+		for _, name := range namespace.module.ImportedNamespaces() {
+			imported, exists := s.namespaces[name]
+			if !exists {
+				errs = append(errs, c.ModuleErrorf(namespace.module,
+					"blueprint_namespace %q imports undefined namespace %q", namespace.name, name))
+				continue
+			}
+			if imported != namespace {
+				namespace.importedNamespaces = append(namespace.importedNamespaces, imported)
+			}
+		}
+	}
+
+	return errs
+}
+
+// namespaceSearchOrder returns the namespaces that are searched for a dependency of a module in
+// the given namespace, in order.  The last entry is always nil for the default namespace.
+func namespaceSearchOrder(namespace Namespace) []Namespace {
+	ns, ok := namespace.(*BlueprintNamespace)
+	if !ok || ns == nil {
+		return []Namespace{namespace}
+	}
+	order := make([]Namespace, 0, len(ns.importedNamespaces)+2)
+	order = append(order, ns)
+	for _, imported := range ns.importedNamespaces {
+		order = append(order, imported)
+	}
+	return append(order, nil)
+}
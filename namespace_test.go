@@ -0,0 +1,253 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueprint
+
+import (
+	"strings"
+	"testing"
+)
+
+func newNamespaceTestContext(files map[string]string) *Context {
+	ctx := NewContext()
+	ctx.RegisterModuleType("foo_module", newFooModule)
+	RegisterNamespaceModuleType(ctx)
+	ctx.RegisterModuleType("imports_a_namespace", func() (Module, []interface{}) {
+		module, properties := newNamespaceModuleFactory()
+		AddLoadHook(module, func(LoadHookContext) {
+			module.(*NamespaceModule).AddImportedNamespaces("a")
+		})
+		return module, properties
+	})
+	ctx.RegisterBottomUpMutator("deps", depsMutator)
+
+	mockFS := make(map[string][]byte)
+	for name, contents := range files {
+		mockFS[name] = []byte(contents)
+	}
+	ctx.MockFileSystem(mockFS)
+	return ctx
+}
+
+func parseNamespaceTestFiles(ctx *Context, files map[string]string) []error {
+	var paths []string
+	for name := range files {
+		paths = append(paths, name)
+	}
+	_, errs := ctx.ParseFileList(".", paths, nil)
+	if len(errs) > 0 {
+		return errs
+	}
+	_, errs = ctx.ResolveDependencies(nil)
+	return errs
+}
+
+func TestNamespaces(t *testing.T) {
+	files := map[string]string{
+		"Android.bp": `
+			foo_module {
+				name: "foo",
+			}
+			foo_module {
+				name: "bar",
+			}
+			foo_module {
+				name: "top_user",
+				deps: ["foo"],
+			}
+		`,
+		"a/Android.bp": `
+			blueprint_namespace {
+				name: "a",
+			}
+			foo_module {
+				name: "foo",
+			}
+			foo_module {
+				name: "a_user",
+				deps: ["foo", "bar"],
+			}
+		`,
+		"b/Android.bp": `
+			blueprint_namespace {
+				name: "b",
+				imports: ["a"],
+			}
+			foo_module {
+				name: "b_user",
+				deps: ["foo", "bar"],
+			}
+		`,
+		"b/sub/Android.bp": `
+			foo_module {
+				name: "sub_user",
+				deps: ["foo"],
+			}
+		`,
+		"c/Android.bp": `
+			imports_a_namespace {
+				name: "c",
+			}
+			foo_module {
+				name: "foo",
+			}
+			foo_module {
+				name: "c_user",
+				deps: ["foo", "a_user"],
+			}
+		`,
+	}
+
+	ctx := newNamespaceTestContext(files)
+	if errs := parseNamespaceTestFiles(ctx, files); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	depFiles := func(name string) []string {
+		t.Helper()
+		var ret []string
+		found := false
+		for _, group := range ctx.moduleGroups {
+			if group.name != name {
+				continue
+			}
+			if found {
+				t.Fatalf("found multiple modules named %q", name)
+			}
+			found = true
+			for _, dep := range group.modules.firstModule().directDeps {
+				ret = append(ret, dep.module.Name()+" in "+dep.module.relBlueprintsFile)
+			}
+		}
+		return ret
+	}
+
+	testCases := []struct {
+		module string
+		want   string
+	}{
+		{"top_user", "foo in Android.bp"},
+		{"a_user", "foo in a/Android.bp, bar in Android.bp"},
+		{"b_user", "foo in a/Android.bp, bar in Android.bp"},
+		{"sub_user", "foo in a/Android.bp"},
+		{"c_user", "foo in c/Android.bp, a_user in a/Android.bp"},
+	}
+	for _, tc := range testCases {
+		if g := strings.Join(depFiles(tc.module), ", "); g != tc.want {
+			t.Errorf("expected deps of %q to be %q, got %q", tc.module, tc.want, g)
+		}
+	}
+
+	if _, errs := ctx.PrepareBuildActions(nil); len(errs) > 0 {
+		t.Errorf("unexpected errors from PrepareBuildActions: %v", errs)
+	}
+}
+
+func TestNamespaceErrors(t *testing.T) {
+	testCases := []struct {
+		name  string
+		files map[string]string
+		err   string
+	}{
+		{
+			name: "duplicate in namespace",
+			files: map[string]string{
+				"a/Android.bp": `
+					blueprint_namespace {
+						name: "a",
+					}
+					foo_module {
+						name: "foo",
+					}
+					foo_module {
+						name: "foo",
+					}
+				`,
+			},
+			err: `a/Android.bp:8:6: module "foo" already defined`,
+		},
+		{
+			name: "not first",
+			files: map[string]string{
+				"a/Android.bp": `
+					foo_module {
+						name: "foo",
+					}
+					blueprint_namespace {
+						name: "a",
+					}
+				`,
+			},
+			err: `a/Android.bp:5:6: blueprint_namespace must be the first module in directory "a"`,
+		},
+		{
+			name: "duplicate namespace",
+			files: map[string]string{
+				"a/Android.bp": `
+					blueprint_namespace {
+						name: "a",
+					}
+				`,
+				"a/b/Android.bp": `
+					blueprint_namespace {
+						name: "a",
+					}
+				`,
+			},
+			err: `a/b/Android.bp:2:6: namespace "a" already defined in "a"`,
+		},
+		{
+			name: "undefined import",
+			files: map[string]string{
+				"a/Android.bp": `
+					blueprint_namespace {
+						name: "a",
+						imports: ["b"],
+					}
+				`,
+			},
+			err: `a/Android.bp:2:6: blueprint_namespace "a" imports undefined namespace "b"`,
+		},
+		{
+			name: "not visible",
+			files: map[string]string{
+				"a/Android.bp": `
+					blueprint_namespace {
+						name: "a",
+					}
+					foo_module {
+						name: "foo",
+					}
+				`,
+				"b/Android.bp": `
+					foo_module {
+						name: "b_user",
+						deps: ["foo"],
+					}
+				`,
+			},
+			err: `b/Android.bp:2:6: "b_user" depends on undefined module "foo".`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := newNamespaceTestContext(tc.files)
+			errs := parseNamespaceTestFiles(ctx, tc.files)
+			if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), tc.err) {
+				t.Errorf("expected error %q, got %q", tc.err, errs)
+			}
+		})
+	}
+}
@@ -90,6 +90,18 @@ type BuildParams struct {
 	Validations     []string          // The list of validations to run when this rule runs.
 	Args            map[string]string // The variable/value pairs to set.
 	Optional        bool              // Skip outputting a default statement
+	NoCache         bool              // The outputs are scratch files that must not be cached
+
+	// DirectoryOutputs lists output directories whose contents are not known ahead of time.  They
+	// are written as implicit outputs, so Outputs must still list at least one file, for example
+	// a stamp file.  Other build statements may only depend on a directory output, or on a path
+	// inside it, with OrderOnly or Validations, unless they set Dyndep.
+	DirectoryOutputs []string
+
+	// Dyndep is the dyndep file that lists the files this build statement reads from or writes
+	// to directory outputs.  It is added to OrderOnly if it is not already an input, and the
+	// order-only dependencies of the build statement are never deduplicated into a phony.
+	Dyndep string
 }
 
 // A poolDef describes a pool definition.  It does not include the name of the
@@ -247,6 +259,55 @@ func (r *ruleDef) WriteTo(nw *ninjaWriter, name string, nameTracker *nameTracker
 	return nil
 }
 
+// Names of the build statement variables that hold the paths of $in and $out for commands that
+// run in the directory set by Context.SetWorkingDirForCommands.
+const (
+	workingDirInVariable  = "in_wd"
+	workingDirOutVariable = "out_wd"
+)
+
+// withWorkingDir returns a copy of the ruleDef whose command is preceded by prefix, which must
+// already be ninja escaped, and whose command and rspfile_content refer to the workingDirInVariable
+// and workingDirOutVariable variables of the build statement instead of $in and $out.  The
+// receiver is not modified so that the same ruleDef can be written out with or without the prefix.
+func (r *ruleDef) withWorkingDir(prefix string) *ruleDef {
+	command, ok := r.Variables["command"]
+	if !ok {
+		return r
+	}
+
+	replacements := map[string]Variable{
+		"in":  &argVariable{workingDirInVariable},
+		"out": &argVariable{workingDirOutVariable},
+	}
+
+	newDef := *r
+	newDef.Variables = make(map[string]*ninjaString, len(r.Variables))
+	for name, value := range r.Variables {
+		newDef.Variables[name] = value
+	}
+	newDef.Variables["command"] = command.replaceArgs(replacements).prepend(prefix)
+	if content, ok := r.Variables["rspfile_content"]; ok {
+		newDef.Variables["rspfile_content"] = content.replaceArgs(replacements)
+	}
+
+	return &newDef
+}
+
+// withVariables returns a copy of the buildDef with the given variables added.  The receiver is
+// not modified.
+func (b *buildDef) withVariables(variables map[string]*ninjaString) *buildDef {
+	newDef := *b
+	newDef.Variables = make(map[string]*ninjaString, len(b.Variables)+len(variables))
+	for name, value := range b.Variables {
+		newDef.Variables[name] = value
+	}
+	for name, value := range variables {
+		newDef.Variables[name] = value
+	}
+	return &newDef
+}
+
 // A buildDef describes a build target definition.
 type buildDef struct {
 	Comment               string
@@ -267,6 +328,11 @@ type buildDef struct {
 	Args                  map[Variable]*ninjaString
 	Variables             map[string]*ninjaString
 	Optional              bool
+	NoCache               bool
+
+	DirectoryOutputs       []*ninjaString
+	DirectoryOutputStrings []string
+	HasDyndep              bool
 }
 
 func formatTags(tags map[string]string, rule Rule) string {
@@ -333,7 +399,12 @@ func parseBuildParams(scope scope, params *BuildParams,
 		return nil, fmt.Errorf("error parsing Implicits param: %s", err)
 	}
 
-	b.OrderOnly, b.OrderOnlyStrings, err = parseNinjaOrSimpleStrings(scope, params.OrderOnly)
+	orderOnly := params.OrderOnly
+	if params.Dyndep != "" && !dyndepIsInput(params) {
+		// Ninja requires the dyndep file to be an input of the build statement.
+		orderOnly = append(append([]string(nil), orderOnly...), params.Dyndep)
+	}
+	b.OrderOnly, b.OrderOnlyStrings, err = parseNinjaOrSimpleStrings(scope, orderOnly)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing OrderOnly param: %s", err)
 	}
@@ -343,7 +414,13 @@ func parseBuildParams(scope scope, params *BuildParams,
 		return nil, fmt.Errorf("error parsing Validations param: %s", err)
 	}
 
+	b.DirectoryOutputs, b.DirectoryOutputStrings, err = parseNinjaOrSimpleStrings(scope, params.DirectoryOutputs)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing DirectoryOutputs param: %s", err)
+	}
+
 	b.Optional = params.Optional
+	b.NoCache = params.NoCache
 
 	if params.Depfile != "" {
 		value, err := parseNinjaString(scope, params.Depfile)
@@ -353,6 +430,15 @@ func parseBuildParams(scope scope, params *BuildParams,
 		setVariable("depfile", value)
 	}
 
+	if params.Dyndep != "" {
+		value, err := parseNinjaString(scope, params.Dyndep)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing Dyndep param: %s", err)
+		}
+		setVariable("dyndep", value)
+		b.HasDyndep = true
+	}
+
 	if params.Deps != DepsNone {
 		setVariable("deps", simpleNinjaString(params.Deps.String()))
 	}
@@ -397,6 +483,18 @@ func parseBuildParams(scope scope, params *BuildParams,
 	return b, nil
 }
 
+// dyndepIsInput returns true if the Dyndep file of params is one of its inputs.
+func dyndepIsInput(params *BuildParams) bool {
+	for _, inputs := range [][]string{params.Inputs, params.Implicits, params.OrderOnly} {
+		for _, input := range inputs {
+			if input == params.Dyndep {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (b *buildDef) WriteTo(nw *ninjaWriter, nameTracker *nameTracker) error {
 	var (
 		comment             = b.Comment
@@ -415,6 +513,12 @@ func (b *buildDef) WriteTo(nw *ninjaWriter, nameTracker *nameTracker) error {
 		validationStrings   = b.ValidationStrings
 	)
 
+	if len(b.DirectoryOutputs) > 0 || len(b.DirectoryOutputStrings) > 0 {
+		// Directory outputs are written as implicit outputs so that they don't change $out.
+		implicitOuts = append(append([]*ninjaString(nil), implicitOuts...), b.DirectoryOutputs...)
+		implicitOutStrings = append(append([]string(nil), implicitOutStrings...), b.DirectoryOutputStrings...)
+	}
+
 	if b.RuleDef != nil {
 		implicitDeps = append(b.RuleDef.CommandDeps, implicitDeps...)
 		orderOnlyDeps = append(b.RuleDef.CommandOrderOnly, orderOnlyDeps...)
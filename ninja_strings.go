@@ -384,6 +384,33 @@ func (n *ninjaString) Eval(variables map[Variable]*ninjaString) (string, error)
 	return w.String(), nil
 }
 
+// expand returns the value of n with every variable reference that lookup returns a value for
+// replaced by that value, recursively expanded.  References to any other variables, for example
+// rule arguments like $out, are left as ${name}.
+func (n *ninjaString) expand(lookup func(Variable) *ninjaString, nameTracker *nameTracker) string {
+	if n.variables == nil || len(*n.variables) == 0 {
+		return n.str
+	}
+
+	w := &strings.Builder{}
+	i := 0
+	for _, v := range *n.variables {
+		w.WriteString(n.str[i:v.start])
+		if v.variable == nil {
+			w.WriteString(" ")
+		} else if value := lookup(v.variable); value != nil {
+			w.WriteString(value.expand(lookup, nameTracker))
+		} else {
+			w.WriteString("${")
+			w.WriteString(nameTracker.Variable(v.variable))
+			w.WriteString("}")
+		}
+		i = int(v.end)
+	}
+	w.WriteString(n.str[i:len(n.str)])
+	return w.String()
+}
+
 func (n *ninjaString) Variables() []Variable {
 	if n.variables == nil || len(*n.variables) == 0 {
 		return nil
@@ -398,6 +425,43 @@ func (n *ninjaString) Variables() []Variable {
 	return variables
 }
 
+// prepend returns a new ninjaString containing the literal string s, which must already be
+// ninja escaped, followed by the contents of n.  The offsets of any variable references are
+// shifted so that they still point at the same variables.
+func (n *ninjaString) prepend(s string) *ninjaString {
+	result := &ninjaString{str: s + n.str}
+	if n.variables != nil {
+		variables := make([]variableReference, len(*n.variables))
+		for i, v := range *n.variables {
+			v.start += int32(len(s))
+			v.end += int32(len(s))
+			variables[i] = v
+		}
+		result.variables = &variables
+	}
+	return result
+}
+
+// replaceArgs returns a copy of n in which references to the rule arguments named in replacements,
+// like $in, refer to the replacement variables instead.
+func (n *ninjaString) replaceArgs(replacements map[string]Variable) *ninjaString {
+	if n.variables == nil {
+		return n
+	}
+	result := &ninjaString{str: n.str}
+	variables := make([]variableReference, len(*n.variables))
+	for i, v := range *n.variables {
+		if arg, ok := v.variable.(*argVariable); ok {
+			if replacement, ok := replacements[arg.name_]; ok {
+				v.variable = replacement
+			}
+		}
+		variables[i] = v
+	}
+	result.variables = &variables
+	return result
+}
+
 func validateNinjaName(name string) error {
 	for i, r := range name {
 		valid := (r >= 'a' && r <= 'z') ||
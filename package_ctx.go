@@ -123,6 +123,20 @@ func NewPackageContext(pkgPath string) PackageContext {
 
 var Phony Rule = NewBuiltinRule("phony")
 
+// blueprintPctx is the PackageContext for rules that Blueprint provides to all primary builders.
+var blueprintPctx = NewPackageContext("github.com/google/blueprint")
+
+// Touch is a rule that creates or updates the timestamp of its outputs.  It is useful for stamp
+// files that mark the completion of other build actions.  Like any other package-scoped rule it
+// is only written to the ninja file if a build statement uses it.  It is most easily used through
+// ModuleContext.Stamp; build statements that use it directly must be created with a PackageContext
+// that imports "github.com/google/blueprint".
+var Touch Rule = blueprintPctx.StaticRule("touch",
+	RuleParams{
+		Command:     "touch $out",
+		Description: "touch $out",
+	})
+
 var Console Pool = NewBuiltinPool("console")
 
 var errRuleIsBuiltin = errors.New("the rule is a built-in")
@@ -21,6 +21,8 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 )
 
@@ -47,6 +49,28 @@ func (result GlobResult) FileList() []byte {
 	return []byte(strings.Join(result.Matches, "\n") + "\n")
 }
 
+// WithCanonicalCase returns a copy of the result with the Matches and Deps spelled with the case
+// stored on fs, see CanonicalCase, and sorted with duplicates removed.  It is used on
+// case-insensitive filesystems, where a path can be returned with the case of the pattern instead
+// of the stored case.
+func (result GlobResult) WithCanonicalCase(fs FileSystem) GlobResult {
+	canonical := func(paths []string) []string {
+		if paths == nil {
+			return nil
+		}
+		ret := make([]string, len(paths))
+		for i, path := range paths {
+			ret[i] = CanonicalCase(fs, path)
+		}
+		sort.Strings(ret)
+		return slices.Compact(ret)
+	}
+
+	result.Matches = canonical(result.Matches)
+	result.Deps = canonical(result.Deps)
+	return result
+}
+
 // MultipleGlobResults is a list of GlobResult structs.
 type MultipleGlobResults []GlobResult
 
@@ -251,12 +275,19 @@ func isWild(pattern string) bool {
 }
 
 // Filters the strings in matches based on the glob patterns in excludes.  Hierarchical (a/*) and
-// recursive (**) glob patterns are supported.
+// recursive (**) glob patterns are supported.  The excludes are validated even if there are no
+// matches, so that a malformed exclude is reported consistently.
 func filterExcludes(matches []string, excludes []string) ([]string, error) {
 	if len(excludes) == 0 {
 		return matches, nil
 	}
 
+	for _, e := range excludes {
+		if err := ValidatePattern(e); err != nil {
+			return nil, err
+		}
+	}
+
 	var ret []string
 matchLoop:
 	for _, m := range matches {
@@ -350,6 +381,30 @@ func Match(pattern, name string) (bool, error) {
 	}
 }
 
+// ValidatePattern returns an error if pattern is not a valid pattern for Glob or Match, without
+// matching it against any files.  A recursive glob (**) must be a whole path element, may only
+// appear once, and may not be the last path element.
+func ValidatePattern(pattern string) error {
+	if filepath.Base(pattern) == "**" {
+		return GlobLastRecursiveErr
+	}
+
+	hasRecursive := false
+	for _, elem := range strings.Split(pattern, "/") {
+		if elem == "**" {
+			if hasRecursive {
+				return GlobMultipleRecursiveErr
+			}
+			hasRecursive = true
+		} else if strings.Contains(elem, "**") {
+			return GlobInvalidRecursiveErr
+		} else if _, err := filepath.Match(elem, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // IsGlob returns true if the pattern contains any glob characters (*, ?, or [).
 func IsGlob(pattern string) bool {
 	return strings.IndexAny(pattern, "*?[") >= 0
@@ -430,3 +485,60 @@ var matchEscaper = strings.NewReplacer(
 func MatchEscape(s string) string {
 	return matchEscaper.Replace(s)
 }
+
+// CanonicalCase returns path with each element replaced by the name of the entry in its parent
+// directory on fs that matches it when case is ignored, for case-insensitive filesystems where a
+// path can be spelled with a different case than the one stored.  An element that matches an
+// entry exactly is kept, and the elements after the first one that doesn't match any entry, for
+// example a glob wildcard, are left unchanged.  A trailing '/' is preserved.
+func CanonicalCase(fs FileSystem, path string) string {
+	if path == "" {
+		return path
+	}
+
+	elems := strings.Split(filepath.Clean(path), "/")
+	for i, elem := range elems {
+		if elem == "" || elem == "." || elem == ".." {
+			continue
+		}
+
+		parent := strings.Join(elems[:i], "/")
+		if parent == "" {
+			if i > 0 {
+				parent = "/"
+			} else {
+				parent = "."
+			}
+		}
+		names, err := fs.ReadDirNames(parent)
+		if err != nil {
+			break
+		}
+
+		found := false
+		for _, name := range names {
+			if name == elem {
+				found = true
+				break
+			}
+		}
+		if !found {
+			for _, name := range names {
+				if strings.EqualFold(name, elem) {
+					elems[i] = name
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			break
+		}
+	}
+
+	ret := strings.Join(elems, "/")
+	if strings.HasSuffix(path, "/") && !strings.HasSuffix(ret, "/") {
+		ret += "/"
+	}
+	return ret
+}
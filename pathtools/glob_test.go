@@ -447,6 +447,16 @@ var globTestCases = []globTestCase{
 		excludes: []string{"**/**"},
 		err:      GlobLastRecursiveErr,
 	},
+	{
+		pattern:  "missing/*",
+		excludes: []string{"**/a**"},
+		err:      GlobInvalidRecursiveErr,
+	},
+	{
+		pattern:  "missing/*",
+		excludes: []string{"a/[b"},
+		err:      filepath.ErrBadPattern,
+	},
 
 	// If names are excluded by default, but referenced explicitly, they should return results
 	{
@@ -974,3 +984,45 @@ func TestMatch(t *testing.T) {
 		})
 	}
 }
+
+func TestCanonicalCase(t *testing.T) {
+	mock := MockFs(map[string][]byte{
+		"Dir/Sub/File.c": nil,
+		"Dir/other.c":    nil,
+		"dir2/a.c":       nil,
+		"dir2/A.c":       nil,
+	})
+
+	testCases := []struct {
+		path, want string
+	}{
+		{"dir/sub/file.c", "Dir/Sub/File.c"},
+		{"DIR/SUB/", "Dir/Sub/"},
+		{"Dir/OTHER.C", "Dir/other.c"},
+		// An exact match is preferred over a case-insensitive one.
+		{"DIR2/A.c", "dir2/A.c"},
+		{"dir2/a.c", "dir2/a.c"},
+		// Elements after one that doesn't match an entry are left unchanged.
+		{"dir/*/File.C", "Dir/*/File.C"},
+		{"missing/File.c", "missing/File.c"},
+	}
+
+	for _, testCase := range testCases {
+		if g := CanonicalCase(mock, testCase.path); g != testCase.want {
+			t.Errorf("CanonicalCase(%q): expected %q, got %q", testCase.path, testCase.want, g)
+		}
+	}
+
+	// Simulate a case-insensitive filesystem returning matches with the case of the pattern.
+	result := GlobResult{
+		Pattern: "Dir/*/file.c",
+		Matches: []string{"Dir/Sub/file.c", "Dir/sub/File.c"},
+		Deps:    []string{"Dir", "Dir/sub"},
+	}.WithCanonicalCase(mock)
+	if g, w := result.Matches, []string{"Dir/Sub/File.c"}; !reflect.DeepEqual(g, w) {
+		t.Errorf("expected matches %q, got %q", w, g)
+	}
+	if g, w := result.Deps, []string{"Dir", "Dir/Sub"}; !reflect.DeepEqual(g, w) {
+		t.Errorf("expected deps %q, got %q", w, g)
+	}
+}
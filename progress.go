@@ -0,0 +1,139 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueprint
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// ProgressCallback is called with the progress of a phase of the build, see SetProgressCallback.
+type ProgressCallback func(phase string, done, total int)
+
+// The phases reported to a ProgressCallback.
+const (
+	// ProgressParse counts the Blueprints files parsed by ParseFileList.
+	ProgressParse = "parse"
+	// ProgressResolve counts the modules visited by the mutators in ResolveDependencies, once for
+	// each mutator.
+	ProgressResolve = "resolve"
+	// ProgressPrepare counts the modules whose build actions were generated by
+	// PrepareBuildActions.
+	ProgressPrepare = "prepare"
+	// ProgressWrite counts the modules whose build actions were written by WriteBuildFile.
+	ProgressWrite = "write"
+)
+
+// progressSteps is the number of times a phase is reported, so that the callback is not called
+// for every file or module.
+const progressSteps = 100
+
+// progressReporter counts the progress of a phase and calls the ProgressCallback when it has
+// moved by at least 1/progressSteps of the total.  All methods may be called concurrently, and
+// on a nil progressReporter when there is no callback.
+type progressReporter struct {
+	callback ProgressCallback
+	phase    string
+
+	done  int64
+	total int64
+
+	// reportLock serializes the calls to the callback so that done never goes backwards.
+	// reported and reportedTotal are the last counts passed to the callback, they are only
+	// written with reportLock held.
+	reportLock    sync.Mutex
+	reported      int64
+	reportedTotal int64
+}
+
+// startProgress returns a progressReporter for a phase, or nil if SetProgressCallback was not
+// called.
+func (c *Context) startProgress(phase string, total int) *progressReporter {
+	return startProgressWithCallback(c.progressCallback, phase, total)
+}
+
+// startProgressWithCallback returns a progressReporter for a phase that reports to callback, or
+// nil if callback is nil.
+func startProgressWithCallback(callback ProgressCallback, phase string, total int) *progressReporter {
+	if callback == nil {
+		return nil
+	}
+	p := &progressReporter{
+		callback: callback,
+		phase:    phase,
+		total:    int64(total),
+		reported: -1,
+	}
+	p.report(false)
+	return p
+}
+
+// setTotal updates the estimated total of the phase.
+func (p *progressReporter) setTotal(total int) {
+	if p == nil {
+		return
+	}
+	atomic.StoreInt64(&p.total, int64(total))
+}
+
+// increment counts one more file or module as done.
+func (p *progressReporter) increment() {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.done, 1)
+	p.report(false)
+}
+
+// finish reports the phase as complete.
+func (p *progressReporter) finish() {
+	if p == nil {
+		return
+	}
+	done := atomic.LoadInt64(&p.done)
+	atomic.StoreInt64(&p.total, done)
+	p.report(true)
+}
+
+func (p *progressReporter) report(force bool) {
+	done := atomic.LoadInt64(&p.done)
+	total := atomic.LoadInt64(&p.total)
+
+	step := total / progressSteps
+	if step < 1 {
+		step = 1
+	}
+	if reported := atomic.LoadInt64(&p.reported); !force && reported >= 0 && done-reported < step {
+		return
+	}
+
+	p.reportLock.Lock()
+	defer p.reportLock.Unlock()
+	// Read done again under the lock, another caller may have reported a later count.
+	done = atomic.LoadInt64(&p.done)
+	total = atomic.LoadInt64(&p.total)
+	if !force && p.reported >= 0 && done-p.reported < step {
+		return
+	}
+	if total < done {
+		total = done
+	}
+	if done == p.reported && total == p.reportedTotal {
+		return
+	}
+	atomic.StoreInt64(&p.reported, done)
+	p.reportedTotal = total
+	p.callback(p.phase, int(done), int(total))
+}
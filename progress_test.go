@@ -0,0 +1,200 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueprint
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type progressCall struct {
+	phase       string
+	done, total int
+}
+
+func TestProgressCallback(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			foo_module {
+			    name: "A",
+			    deps: ["B"],
+			}
+			bar_module {
+			    name: "B",
+			}
+		`),
+	})
+	ctx.RegisterModuleType("foo_module", newFooModule)
+	ctx.RegisterModuleType("bar_module", newBarModule)
+	ctx.RegisterBottomUpMutator("deps", depsMutator)
+
+	var calls []progressCall
+	ctx.SetProgressCallback(func(phase string, done, total int) {
+		calls = append(calls, progressCall{phase, done, total})
+	})
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected dep errors: %v", errs)
+	}
+	_, errs = ctx.PrepareBuildActions(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors calling PrepareBuildActions: %v", errs)
+	}
+
+	// The deps mutator and the builtin blueprint_deps mutator each visit both modules.
+	want := []progressCall{
+		{ProgressParse, 0, 1},
+		{ProgressParse, 1, 1},
+		{ProgressResolve, 0, 4},
+		{ProgressResolve, 1, 4},
+		{ProgressResolve, 2, 4},
+		{ProgressResolve, 3, 4},
+		{ProgressResolve, 4, 4},
+		{ProgressPrepare, 0, 2},
+		{ProgressPrepare, 1, 2},
+		{ProgressPrepare, 2, 2},
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("expected calls %v, got %v", want, calls)
+	}
+}
+
+func TestProgressReporterThrottling(t *testing.T) {
+	ctx := NewContext()
+	var lock sync.Mutex
+	var calls []progressCall
+	ctx.SetProgressCallback(func(phase string, done, total int) {
+		lock.Lock()
+		defer lock.Unlock()
+		calls = append(calls, progressCall{phase, done, total})
+	})
+
+	const total = 10000
+	p := ctx.startProgress(ProgressPrepare, total)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < total/10; j++ {
+				p.increment()
+			}
+		}()
+	}
+	wg.Wait()
+	p.finish()
+
+	if len(calls) > progressSteps+2 {
+		t.Errorf("expected at most %d calls, got %d", progressSteps+2, len(calls))
+	}
+	for i, call := range calls {
+		if i > 0 && call.done < calls[i-1].done {
+			t.Errorf("done went backwards from %d to %d", calls[i-1].done, call.done)
+		}
+		if call.done > call.total {
+			t.Errorf("done %d is more than total %d", call.done, call.total)
+		}
+	}
+	if last := calls[len(calls)-1]; last.done != total || last.total != total {
+		t.Errorf("expected last call to be %d/%d, got %d/%d", total, total, last.done, last.total)
+	}
+}
+
+func TestWriteBuildFileWithProgress(t *testing.T) {
+	bp := &strings.Builder{}
+	const withActions = 1000
+	for i := 0; i < withActions; i++ {
+		fmt.Fprintf(bp, "test { name: \"m%d\", stamps: 1 }\n", i)
+	}
+	bp.WriteString(`test { name: "no_actions", stamps: 0 }`)
+
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(bp.String()),
+	})
+	ctx.RegisterModuleType("test", newShardTestModule)
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected dep errors: %v", errs)
+	}
+	_, errs = ctx.PrepareBuildActions(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors calling PrepareBuildActions: %v", errs)
+	}
+
+	var contextCalls []progressCall
+	ctx.SetProgressCallback(func(phase string, done, total int) {
+		contextCalls = append(contextCalls, progressCall{phase, done, total})
+	})
+
+	var calls []progressCall
+	withProgress := &bytes.Buffer{}
+	err := ctx.WriteBuildFileWithProgress(withProgress, func(written, total int) {
+		calls = append(calls, progressCall{ProgressWrite, written, total})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(contextCalls) > 0 {
+		t.Errorf("expected the context's callback not to be called, got %v", contextCalls)
+	}
+	if len(calls) < 2 || len(calls) > progressSteps+2 {
+		t.Errorf("expected between 2 and %d calls, got %d", progressSteps+2, len(calls))
+	}
+	for i, call := range calls {
+		if call.total != withActions {
+			t.Errorf("expected total to be %d, got %d", withActions, call.total)
+		}
+		if i > 0 && call.done <= calls[i-1].done {
+			t.Errorf("written went from %d to %d", calls[i-1].done, call.done)
+		}
+	}
+	if first := calls[0]; first.done != 0 {
+		t.Errorf("expected first call to have written 0, got %d", first.done)
+	}
+	if last := calls[len(calls)-1]; last.done != withActions {
+		t.Errorf("expected last call to have written %d, got %d", withActions, last.done)
+	}
+
+	// The manifest is the same as the one from WriteBuildFile, which reports to the context's
+	// callback.
+	plain := &bytes.Buffer{}
+	if err := ctx.WriteBuildFile(plain); err != nil {
+		t.Fatal(err)
+	}
+	if withProgress.String() != plain.String() {
+		t.Errorf("expected WriteBuildFileWithProgress to write the same manifest as WriteBuildFile")
+	}
+	if last := contextCalls[len(contextCalls)-1]; last != (progressCall{ProgressWrite, withActions, withActions}) {
+		t.Errorf("expected the context's callback to end with %d/%d modules written, got %v",
+			withActions, withActions, last)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueprint
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/google/blueprint/proptools"
+)
+
+// PropertyDiffKind describes how a property differs between two modules.
+type PropertyDiffKind int
+
+const (
+	// PropertyAdded is a property that is only set on the second module.
+	PropertyAdded PropertyDiffKind = iota
+	// PropertyRemoved is a property that is only set on the first module.
+	PropertyRemoved
+	// PropertyChanged is a property that is set on both modules to different values.
+	PropertyChanged
+)
+
+func (k PropertyDiffKind) String() string {
+	switch k {
+	case PropertyAdded:
+		return "added"
+	case PropertyRemoved:
+		return "removed"
+	case PropertyChanged:
+		return "changed"
+	default:
+		panic(fmt.Errorf("unknown PropertyDiffKind %d", int(k)))
+	}
+}
+
+// ListComparison selects how DiffModuleProperties compares list properties.
+type ListComparison int
+
+const (
+	// ListsOrdered compares lists element by element, so lists with the same elements in a
+	// different order are different.
+	ListsOrdered ListComparison = iota
+	// ListsAsSets compares lists ignoring the order of their elements, so lists are only different
+	// if an element appears a different number of times in each.
+	ListsAsSets
+)
+
+// PropertyDiff is a difference between a property of two modules found by DiffModuleProperties.
+type PropertyDiff struct {
+	// Property is the name of the property as it is written in a Blueprints file, with the names
+	// of nested properties separated by '.', for example "target.host.srcs".
+	Property string
+
+	Kind PropertyDiffKind
+
+	// A and B are the values of the property on the first and second module, or nil if the
+	// property is not set on that module.  Pointers are dereferenced.
+	A, B interface{}
+}
+
+func (d PropertyDiff) String() string {
+	switch d.Kind {
+	case PropertyAdded:
+		return fmt.Sprintf("%s: added %v", d.Property, d.B)
+	case PropertyRemoved:
+		return fmt.Sprintf("%s: removed %v", d.Property, d.A)
+	default:
+		return fmt.Sprintf("%s: changed from %v to %v", d.Property, d.A, d.B)
+	}
+}
+
+// DiffModuleProperties compares the property structs of two modules, which may be of different
+// module types, for example a module and the module generated to replace it, and returns the
+// differences sorted by property name.  Nested property structs are compared property by
+// property.  A property is considered unset if it is a nil pointer or an empty list, so a
+// property that is only set on one of the modules, or only exists on one of the module types,
+// is reported as added or removed.
+func (c *Context) DiffModuleProperties(a, b Module, lists ListComparison) []PropertyDiff {
+	aProps := flattenProperties(c.moduleInfo[a].properties)
+	bProps := flattenProperties(c.moduleInfo[b].properties)
+
+	var diffs []PropertyDiff
+	for name, aValue := range aProps {
+		bValue, ok := bProps[name]
+		if !ok {
+			diffs = append(diffs, PropertyDiff{Property: name, Kind: PropertyRemoved, A: aValue.Interface()})
+		} else if !propertyValuesEqual(aValue, bValue, lists) {
+			diffs = append(diffs, PropertyDiff{Property: name, Kind: PropertyChanged,
+				A: aValue.Interface(), B: bValue.Interface()})
+		}
+	}
+	for name, bValue := range bProps {
+		if _, ok := aProps[name]; !ok {
+			diffs = append(diffs, PropertyDiff{Property: name, Kind: PropertyAdded, B: bValue.Interface()})
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Property < diffs[j].Property
+	})
+	return diffs
+}
+
+// flattenProperties returns the values of the set properties in a list of property structs,
+// keyed by their dotted property names.  If more than one property struct contains a property
+// with the same name the first one is used.
+func flattenProperties(propertyStructs []interface{}) map[string]reflect.Value {
+	ret := make(map[string]reflect.Value)
+
+	var walk func(prefix string, v reflect.Value)
+	walk = func(prefix string, v reflect.Value) {
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if !field.IsExported() && !field.Anonymous {
+				continue
+			}
+			name := prefix + proptools.PropertyNameForField(field.Name)
+			fieldValue := v.Field(i)
+
+			if fieldValue.Kind() == reflect.Ptr {
+				if fieldValue.IsNil() {
+					continue
+				}
+				fieldValue = fieldValue.Elem()
+			}
+
+			switch fieldValue.Kind() {
+			case reflect.Struct:
+				if field.Anonymous {
+					walk(prefix, fieldValue)
+				} else {
+					walk(name+".", fieldValue)
+				}
+				continue
+			case reflect.Slice, reflect.Map:
+				if fieldValue.Len() == 0 {
+					continue
+				}
+			case reflect.Interface:
+				if fieldValue.IsNil() {
+					continue
+				}
+			}
+
+			if !field.IsExported() {
+				continue
+			}
+			if _, exists := ret[name]; !exists {
+				ret[name] = fieldValue
+			}
+		}
+	}
+
+	for _, props := range propertyStructs {
+		walk("", reflect.ValueOf(props).Elem())
+	}
+
+	return ret
+}
+
+// propertyValuesEqual returns true if a and b are equal, ignoring the order of list elements if
+// lists is ListsAsSets.
+func propertyValuesEqual(a, b reflect.Value, lists ListComparison) bool {
+	if lists != ListsAsSets || a.Kind() != reflect.Slice || b.Kind() != reflect.Slice {
+		return reflect.DeepEqual(a.Interface(), b.Interface())
+	}
+
+	if a.Len() != b.Len() {
+		return false
+	}
+
+	// Match each element of a with an unmatched equal element of b.
+	matched := make([]bool, b.Len())
+outer:
+	for i := 0; i < a.Len(); i++ {
+		for j := 0; j < b.Len(); j++ {
+			if !matched[j] && reflect.DeepEqual(a.Index(i).Interface(), b.Index(j).Interface()) {
+				matched[j] = true
+				continue outer
+			}
+		}
+		return false
+	}
+	return true
+}
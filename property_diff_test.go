@@ -0,0 +1,117 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueprint
+
+import (
+	"reflect"
+	"testing"
+)
+
+type propertyDiffTestModule struct {
+	SimpleName
+	properties struct {
+		Srcs   []string
+		Flag   *bool
+		Nested struct {
+			Value *string
+		}
+	}
+}
+
+func propertyDiffTestModuleFactory() (Module, []interface{}) {
+	module := &propertyDiffTestModule{}
+	return module, []interface{}{&module.SimpleName.Properties, &module.properties}
+}
+
+func (m *propertyDiffTestModule) GenerateBuildActions(ModuleContext) {}
+
+func TestDiffModuleProperties(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			test {
+			    name: "a",
+			    srcs: ["x.c", "y.c"],
+			    flag: true,
+			    nested: {
+			        value: "old",
+			    },
+			}
+			test {
+			    name: "b",
+			    srcs: ["y.c", "x.c"],
+			    nested: {
+			        value: "new",
+			    },
+			}
+			foo_module {
+			    name: "c",
+			    foo: "bar",
+			}
+		`),
+	})
+	ctx.RegisterModuleType("test", propertyDiffTestModuleFactory)
+	ctx.RegisterModuleType("foo_module", newFooModule)
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+
+	module := func(name string) Module {
+		return ctx.moduleGroupFromName(name, nil).modules.firstModule().logicModule
+	}
+
+	t.Run("ordered", func(t *testing.T) {
+		want := []PropertyDiff{
+			{Property: "flag", Kind: PropertyRemoved, A: true},
+			{Property: "name", Kind: PropertyChanged, A: "a", B: "b"},
+			{Property: "nested.value", Kind: PropertyChanged, A: "old", B: "new"},
+			{Property: "srcs", Kind: PropertyChanged, A: []string{"x.c", "y.c"}, B: []string{"y.c", "x.c"}},
+		}
+		if g := ctx.DiffModuleProperties(module("a"), module("b"), ListsOrdered); !reflect.DeepEqual(g, want) {
+			t.Errorf("expected diffs %q, got %q", want, g)
+		}
+	})
+
+	t.Run("sets", func(t *testing.T) {
+		want := []PropertyDiff{
+			{Property: "flag", Kind: PropertyRemoved, A: true},
+			{Property: "name", Kind: PropertyChanged, A: "a", B: "b"},
+			{Property: "nested.value", Kind: PropertyChanged, A: "old", B: "new"},
+		}
+		if g := ctx.DiffModuleProperties(module("a"), module("b"), ListsAsSets); !reflect.DeepEqual(g, want) {
+			t.Errorf("expected diffs %q, got %q", want, g)
+		}
+	})
+
+	t.Run("different module types", func(t *testing.T) {
+		want := []PropertyDiff{
+			{Property: "foo", Kind: PropertyAdded, B: "bar"},
+			{Property: "name", Kind: PropertyChanged, A: "b", B: "c"},
+			{Property: "nested.value", Kind: PropertyRemoved, A: "new"},
+			{Property: "srcs", Kind: PropertyRemoved, A: []string{"y.c", "x.c"}},
+		}
+		if g := ctx.DiffModuleProperties(module("b"), module("c"), ListsOrdered); !reflect.DeepEqual(g, want) {
+			t.Errorf("expected diffs %q, got %q", want, g)
+		}
+	})
+
+	t.Run("identical", func(t *testing.T) {
+		if g := ctx.DiffModuleProperties(module("a"), module("a"), ListsOrdered); len(g) != 0 {
+			t.Errorf("expected no diffs, got %q", g)
+		}
+	})
+}
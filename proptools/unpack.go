@@ -36,6 +36,32 @@ func (e *UnpackError) Error() string {
 	return fmt.Sprintf("%s: %s", e.Pos, e.Err)
 }
 
+// An UnrecognizedPropertyError is the Err of an UnpackError for a property that doesn't match a
+// field in any of the property structs.
+type UnrecognizedPropertyError struct {
+	Property string
+}
+
+func (e *UnrecognizedPropertyError) Error() string {
+	return fmt.Sprintf("unrecognized property %q", e.Property)
+}
+
+// A ValueTypeError describes a property whose value was rejected by the parse function of the
+// value type that the receiving field is tagged with.
+type ValueTypeError struct {
+	Err      error
+	Pos      scanner.Position
+	Property string
+}
+
+func (e *ValueTypeError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Err)
+}
+
+// A ValueTypeParser converts the string value of a property into the value to store in a field
+// tagged with the name of a value type.  See UnpackPropertiesWithValueTypes.
+type ValueTypeParser func(string) (interface{}, error)
+
 // packedProperty helps to track properties usage (`used` will be true)
 type packedProperty struct {
 	property *parser.Property
@@ -46,6 +72,7 @@ type packedProperty struct {
 // parsed properties.
 type unpackContext struct {
 	propertyMap map[string]*packedProperty
+	valueTypes  map[string]ValueTypeParser
 	errs        []error
 }
 
@@ -71,8 +98,23 @@ type unpackContext struct {
 // The same property can initialize fields in multiple runtime values. It is an error if any property
 // value was not used to initialize at least one field.
 func UnpackProperties(properties []*parser.Property, objects ...interface{}) (map[string]*parser.Property, []error) {
+	return UnpackPropertiesWithValueTypes(properties, nil, objects...)
+}
+
+// UnpackPropertiesWithValueTypes is like UnpackProperties, but also supports fields tagged with
+// blueprint_value_type:"<name>".  The value of the property for such a field must be a string,
+// which is converted by the ValueTypeParser registered for <name> in valueTypes.  The value
+// returned by the parser must be assignable to the field, or to the type it points to if the
+// field is a pointer, or be of a named type with the same underlying type.  The field itself
+// must still be of a type that is supported in property structs, for example a *int64 for a
+// time.Duration.  An error returned by the parser is reported as a *ValueTypeError, and a
+// property whose value type is not in valueTypes is reported as an *UnpackError.
+func UnpackPropertiesWithValueTypes(properties []*parser.Property, valueTypes map[string]ValueTypeParser,
+	objects ...interface{}) (map[string]*parser.Property, []error) {
+
 	var unpackContext unpackContext
 	unpackContext.propertyMap = make(map[string]*packedProperty)
+	unpackContext.valueTypes = valueTypes
 	if !unpackContext.buildPropertyMap("", properties) {
 		return nil, unpackContext.errs
 	}
@@ -119,7 +161,7 @@ func (ctx *unpackContext) reportUnusedNames(unusedNames []string) []error {
 			}
 		}
 		ctx.errs = append(ctx.errs, &UnpackError{
-			fmt.Errorf("unrecognized property %q", name),
+			&UnrecognizedPropertyError{Property: name},
 			ctx.propertyMap[name].property.ColonPos})
 		lastReported = name
 	}
@@ -234,6 +276,13 @@ func (ctx *unpackContext) unpackToStruct(namePrefix string, structValue reflect.
 
 		origFieldValue := fieldValue
 
+		if valueTypeName, ok := field.Tag.Lookup("blueprint_value_type"); ok {
+			if !ctx.unpackValueType(valueTypeName, propertyName, packedProperty, fieldValue) {
+				return
+			}
+			continue
+		}
+
 		// To make testing easier we validate the struct field's type regardless
 		// of whether or not the property was specified in the parsed string.
 		// TODO(ccross): we don't validate types inside nil struct pointers
@@ -268,6 +317,12 @@ func (ctx *unpackContext) unpackToStruct(namePrefix string, structValue reflect.
 				panic(fmt.Errorf("field %s contains a pointer to %s", propertyName, ptrKind))
 			}
 
+		case reflect.Map:
+			if fieldValue.Type() != stringListMapType {
+				panic(fmt.Errorf("field %s is a %s, only map[string][]string is supported",
+					propertyName, fieldValue.Type()))
+			}
+
 		case reflect.Int, reflect.Uint:
 			if !HasTag(field, "blueprint", "mutated") {
 				panic(fmt.Errorf(`int field %s must be tagged blueprint:"mutated"`, propertyName))
@@ -301,7 +356,12 @@ func (ctx *unpackContext) unpackToStruct(namePrefix string, structValue reflect.
 			continue
 		}
 
-		if isStruct(fieldValue.Type()) {
+		if fieldValue.Kind() == reflect.Map {
+			ctx.unpackToStringListMap(propertyName, property, fieldValue)
+			if len(ctx.errs) >= maxUnpackErrors {
+				return
+			}
+		} else if isStruct(fieldValue.Type()) {
 			if property.Value.Eval().Type() != parser.MapType {
 				ctx.addError(&UnpackError{
 					fmt.Errorf("can't assign %s value to map property %q",
@@ -332,6 +392,71 @@ func (ctx *unpackContext) unpackToStruct(namePrefix string, structValue reflect.
 	}
 }
 
+// unpackValueType sets a field tagged with blueprint_value_type from the string value of its
+// property using the ValueTypeParser registered for the tag.  It returns false if unpacking
+// should stop because too many errors have been reported.
+func (ctx *unpackContext) unpackValueType(valueTypeName, propertyName string,
+	packedProperty *packedProperty, fieldValue reflect.Value) bool {
+
+	if packedProperty == nil {
+		// This property wasn't specified.
+		return true
+	}
+	packedProperty.used = true
+	property := packedProperty.property
+
+	parse, ok := ctx.valueTypes[valueTypeName]
+	if !ok {
+		return ctx.addError(&UnpackError{
+			fmt.Errorf("property %q has unregistered value type %q", property.Name, valueTypeName),
+			property.Value.Pos(),
+		})
+	}
+
+	s, ok := property.Value.Eval().(*parser.String)
+	if !ok {
+		return ctx.addError(&UnpackError{
+			fmt.Errorf("can't assign %s value to %s property %q",
+				property.Value.Type(), valueTypeName, property.Name),
+			property.Value.Pos(),
+		})
+	}
+
+	parsed, err := parse(s.Value)
+	if err != nil {
+		return ctx.addError(&ValueTypeError{
+			Err:      fmt.Errorf("invalid %s value %q for property %q: %s", valueTypeName, s.Value, property.Name, err),
+			Pos:      property.Value.Pos(),
+			Property: property.Name,
+		})
+	}
+
+	targetType := fieldValue.Type()
+	isPtr := targetType.Kind() == reflect.Ptr
+	if isPtr {
+		targetType = targetType.Elem()
+	}
+
+	value := reflect.ValueOf(parsed)
+	if value.IsValid() && !value.Type().AssignableTo(targetType) &&
+		value.Kind() == targetType.Kind() && value.Type().ConvertibleTo(targetType) {
+		// Allow named types such as time.Duration to be stored in a field of their underlying type.
+		value = value.Convert(targetType)
+	}
+	if !value.IsValid() || !value.Type().AssignableTo(targetType) {
+		panic(fmt.Errorf("value type %q returned %T, which can't be assigned to field %s of type %s",
+			valueTypeName, parsed, propertyName, fieldValue.Type()))
+	}
+
+	if isPtr {
+		ptrValue := reflect.New(targetType)
+		ptrValue.Elem().Set(value)
+		value = ptrValue
+	}
+	fieldValue.Set(value)
+	return true
+}
+
 // unpackSlice creates a value of a given slice type from the property which should be a list
 func (ctx *unpackContext) unpackToSlice(
 	sliceName string, property *parser.Property, sliceType reflect.Type) (reflect.Value, bool) {
@@ -405,6 +530,54 @@ func (ctx *unpackContext) unpackToSlice(
 	return value, true
 }
 
+var stringListMapType = reflect.TypeOf(map[string][]string(nil))
+
+// unpackToStringListMap sets a map[string][]string field from a map property whose values are
+// lists of strings, appending to the lists of any keys that are already in the field.
+func (ctx *unpackContext) unpackToStringListMap(mapName string, property *parser.Property,
+	fieldValue reflect.Value) {
+
+	propValueAsMap, ok := property.Value.Eval().(*parser.Map)
+	if !ok {
+		ctx.addError(&UnpackError{
+			fmt.Errorf("can't assign %s value to map property %q",
+				property.Value.Type(), property.Name),
+			property.Value.Pos(),
+		})
+		return
+	}
+
+	m := fieldValue.Interface().(map[string][]string)
+	if m == nil {
+		m = make(map[string][]string, len(propValueAsMap.Properties))
+	}
+	for _, itemProperty := range propValueAsMap.Properties {
+		if packedProperty, ok := ctx.propertyMap[fieldPath(mapName, itemProperty.Name)]; ok {
+			packedProperty.used = true
+		}
+		if list, ok := itemProperty.Value.Eval().(*parser.List); ok && len(list.Values) > 0 &&
+			list.Values[0].Type() != parser.StringType {
+			ctx.addError(&UnpackError{
+				fmt.Errorf("can't assign list of %s to list of string property %q",
+					list.Values[0].Type(), itemProperty.Name),
+				list.Values[0].Pos(),
+			})
+			continue
+		}
+		if value, ok := ctx.unpackToSlice(itemProperty.Name, itemProperty, reflect.TypeOf([]string(nil))); ok {
+			if existing, exists := m[itemProperty.Name]; exists {
+				m[itemProperty.Name] = append(existing, value.Interface().([]string)...)
+			} else {
+				m[itemProperty.Name] = value.Interface().([]string)
+			}
+		}
+		if len(ctx.errs) >= maxUnpackErrors {
+			return
+		}
+	}
+	fieldValue.Set(reflect.ValueOf(m))
+}
+
 // propertyToValue creates a value of a given value type from the property.
 func propertyToValue(typ reflect.Type, property *parser.Property) (reflect.Value, error) {
 	var value reflect.Value
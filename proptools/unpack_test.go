@@ -16,7 +16,9 @@ package proptools
 
 import (
 	"bytes"
+	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/google/blueprint/parser"
@@ -706,6 +708,27 @@ var validUnpackTestCases = []struct {
 			},
 		},
 	},
+	{
+		name: "string list map",
+		input: `
+			m {
+				arch_srcs: {
+					arm64: ["a.c", "b.c"],
+					x86: [],
+				},
+			}
+		`,
+		output: []interface{}{
+			&struct {
+				Arch_srcs map[string][]string
+			}{
+				Arch_srcs: map[string][]string{
+					"arm64": {"a.c", "b.c"},
+					"x86":   {},
+				},
+			},
+		},
+	},
 	// Captitalized property
 	{
 		input: `
@@ -821,6 +844,22 @@ func TestUnpackErrors(t *testing.T) {
 			},
 			errors: []string{`<input>:4:14: unrecognized property "nested.missing"`},
 		},
+		{
+			name: "string list map with non-string list",
+			input: `
+				m {
+					arch_srcs: {
+						arm64: [true],
+					},
+				}
+			`,
+			output: []interface{}{
+				&struct {
+					Arch_srcs map[string][]string
+				}{},
+			},
+			errors: []string{`<input>:4:15: can't assign list of bool to list of string property "arm64"`},
+		},
 		{
 			name: "mutated",
 			input: `
@@ -1227,6 +1266,110 @@ func BenchmarkUnpackProperties(b *testing.B) {
 	})
 }
 
+func TestUnpackValueTypes(t *testing.T) {
+	type version struct {
+		Major, Minor string
+	}
+	type namedInt64 int64
+
+	valueTypes := map[string]ValueTypeParser{
+		"version": func(s string) (interface{}, error) {
+			parts := strings.Split(s, ".")
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("expected <major>.<minor>")
+			}
+			return version{parts[0], parts[1]}, nil
+		},
+		"length": func(s string) (interface{}, error) {
+			return namedInt64(len(s)), nil
+		},
+	}
+
+	parse := func(t *testing.T, input string) []*parser.Property {
+		t.Helper()
+		file, errs := parser.ParseAndEval("<input>", bytes.NewBufferString(input), parser.NewScope(nil))
+		if len(errs) != 0 {
+			t.Fatalf("unexpected parse errors: %v", errs)
+		}
+		return file.Defs[0].(*parser.Module).Properties
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		var props struct {
+			Version version `blueprint_value_type:"version"`
+			Length  *int64  `blueprint_value_type:"length"`
+			Unset   *int64  `blueprint_value_type:"length"`
+		}
+		_, errs := UnpackPropertiesWithValueTypes(parse(t, `
+			m {
+				version: "1.2",
+				length: "abc",
+			}
+		`), valueTypes, &props)
+		if len(errs) != 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+		if w := (version{"1", "2"}); props.Version != w {
+			t.Errorf("expected version %v, got %v", w, props.Version)
+		}
+		if props.Length == nil || *props.Length != 3 {
+			t.Errorf("expected length 3, got %v", props.Length)
+		}
+		if props.Unset != nil {
+			t.Errorf("expected unset property to be nil, got %v", *props.Unset)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		var props struct {
+			Version version `blueprint_value_type:"version"`
+			Length  *int64  `blueprint_value_type:"length"`
+		}
+		_, errs := UnpackPropertiesWithValueTypes(parse(t, `
+			m {
+				version: "1.2.3",
+				length: true,
+			}
+		`), valueTypes, &props)
+		expected := []string{
+			`<input>:3:14: invalid version value "1.2.3" for property "version": expected <major>.<minor>`,
+			`<input>:4:13: can't assign bool value to length property "length"`,
+		}
+		var got []string
+		for _, err := range errs {
+			got = append(got, err.Error())
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected errors %q, got %q", expected, got)
+		}
+		if valueTypeErr, ok := errs[0].(*ValueTypeError); !ok || valueTypeErr.Property != "version" {
+			t.Errorf("expected a *ValueTypeError for property version, got %#v", errs[0])
+		}
+	})
+
+	t.Run("unregistered", func(t *testing.T) {
+		var props struct {
+			Version version `blueprint_value_type:"version"`
+			Unset   *int64  `blueprint_value_type:"length"`
+		}
+		_, errs := UnpackPropertiesWithValueTypes(parse(t, `
+			m {
+				version: "1.2",
+			}
+		`), nil, &props)
+		expected := []string{
+			`<input>:3:14: property "version" has unregistered value type "version"`,
+		}
+		var got []string
+		for _, err := range errs {
+			got = append(got, err.Error())
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected errors %q, got %q", expected, got)
+		}
+	})
+}
+
 func TestRemoveUnnecessaryUnusedNames(t *testing.T) {
 	testCases := []struct {
 		name   string
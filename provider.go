@@ -16,6 +16,8 @@ package blueprint
 
 import (
 	"fmt"
+	"reflect"
+	"sort"
 
 	"github.com/google/blueprint/proptools"
 )
@@ -154,6 +156,12 @@ func (c *Context) setProvider(m *moduleInfo, provider *providerKey, value any) {
 
 	m.providers[provider.id] = value
 
+	c.recordProviderInitialValueHash(m, provider, value)
+}
+
+// recordProviderInitialValueHash stores the hash of a newly set provider value so that it can be
+// verified later if SetVerifyProvidersAreUnchanged was set.
+func (c *Context) recordProviderInitialValueHash(m *moduleInfo, provider *providerKey, value any) {
 	if c.verifyProvidersAreUnchanged {
 		if m.providerInitialValueHashes == nil {
 			m.providerInitialValueHashes = make([]uint64, len(providerRegistry))
@@ -195,6 +203,132 @@ func (c *Context) provider(m *moduleInfo, provider *providerKey) (any, bool) {
 	return nil, false
 }
 
+// ImportProviders copies the values of a provider from the modules in another Context to the
+// matching modules in this Context, so that a value computed in one Context, for example a
+// bp2build Context, doesn't need to be recomputed in another.  Modules are matched by their unique
+// name and variant name.  The values are deep copied, so that neither Context can observe
+// modifications made through the other.
+//
+// ImportProviders must be called after the provider has been set in from and after the modules
+// have been created in this Context, and the modules in this Context must not set the provider
+// themselves.  It returns the sorted names of the modules that have a value for the provider in
+// from but no matching module in this Context, and of the modules in this Context with no
+// matching module in from, which callers may report or ignore.
+func (c *Context) ImportProviders(from *Context, key AnyProviderKey) (skipped []string) {
+	provider := key.provider()
+
+	modules := make(map[string]*moduleInfo, len(c.modulesSorted))
+	for _, m := range c.modulesSorted {
+		modules[c.moduleID(m)] = m
+	}
+
+	for _, fromModule := range from.modulesSorted {
+		id := from.moduleID(fromModule)
+		m, ok := modules[id]
+		if !ok {
+			if _, ok := from.provider(fromModule, provider); ok {
+				skipped = append(skipped, id)
+			}
+			continue
+		}
+		delete(modules, id)
+
+		value, ok := from.provider(fromModule, provider)
+		if !ok {
+			continue
+		}
+
+		if m.providers == nil {
+			m.providers = make([]any, len(providerRegistry))
+		}
+		if m.providers[provider.id] != nil {
+			panic(fmt.Sprintf("Value of provider %s is already set on %s", provider.typ, id))
+		}
+		value = cloneProviderValue(reflect.ValueOf(value), make(map[uintptr]reflect.Value)).Interface()
+		m.providers[provider.id] = value
+		c.recordProviderInitialValueHash(m, provider, value)
+	}
+
+	for id := range modules {
+		skipped = append(skipped, id)
+	}
+	sort.Strings(skipped)
+
+	return skipped
+}
+
+// moduleID returns a name for a module that is unique within the Context and is the same for the
+// equivalent module in another Context.
+func (c *Context) moduleID(m *moduleInfo) string {
+	name := c.nameInterface.UniqueName(newNamespaceContext(m), m.group.name)
+	if m.variant.name != "" {
+		name += "{" + m.variant.name + "}"
+	}
+	return name
+}
+
+// cloneProviderValue returns a deep copy of a provider value.  Pointers that are reachable more
+// than once are copied once, so that the copy has the same shape as the original.  Unexported
+// struct fields can't be set through reflection and are copied shallowly.
+func cloneProviderValue(v reflect.Value, ptrs map[uintptr]reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return v
+		}
+		if ptr, ok := ptrs[v.Pointer()]; ok {
+			return ptr
+		}
+		ptr := reflect.New(v.Type().Elem())
+		ptrs[v.Pointer()] = ptr
+		ptr.Elem().Set(cloneProviderValue(v.Elem(), ptrs))
+		return ptr
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		ret := reflect.New(v.Type()).Elem()
+		ret.Set(cloneProviderValue(v.Elem(), ptrs))
+		return ret
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		ret := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			ret.Index(i).Set(cloneProviderValue(v.Index(i), ptrs))
+		}
+		return ret
+	case reflect.Array:
+		ret := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			ret.Index(i).Set(cloneProviderValue(v.Index(i), ptrs))
+		}
+		return ret
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		ret := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			ret.SetMapIndex(iter.Key(), cloneProviderValue(iter.Value(), ptrs))
+		}
+		return ret
+	case reflect.Struct:
+		ret := reflect.New(v.Type()).Elem()
+		ret.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if ret.Field(i).CanSet() {
+				ret.Field(i).Set(cloneProviderValue(v.Field(i), ptrs))
+			}
+		}
+		return ret
+	default:
+		return v
+	}
+}
+
 func (c *Context) mutatorFinishedForModule(mutator *mutatorInfo, m *moduleInfo) bool {
 	if c.finishedMutators[mutator] {
 		// mutator pass finished for all modules
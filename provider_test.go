@@ -169,6 +169,84 @@ func TestProviders(t *testing.T) {
 	}
 }
 
+func TestImportProviders(t *testing.T) {
+	from := NewContext()
+	from.RegisterModuleType("provider_module", newProviderTestModule)
+	from.RegisterBottomUpMutator("provider_deps_mutator", providerTestDepsMutator)
+	from.RegisterBottomUpMutator("provider_mutator", providerTestMutator)
+	from.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			provider_module {
+				name: "A",
+				deps: ["B"],
+			}
+
+			provider_module {
+				name: "B",
+			}
+
+			provider_module {
+				name: "C",
+			}
+		`),
+	})
+
+	to := NewContext()
+	to.RegisterModuleType("provider_module", newProviderTestModule)
+	to.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			provider_module {
+				name: "A",
+			}
+
+			provider_module {
+				name: "C",
+			}
+
+			provider_module {
+				name: "D",
+			}
+		`),
+	})
+
+	for _, ctx := range []*Context{from, to} {
+		_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+		if len(errs) == 0 {
+			_, errs = ctx.ResolveDependencies(nil)
+		}
+		if len(errs) > 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+	}
+
+	skipped := to.ImportProviders(from, providerTestMutatorInfoProvider)
+	if w := []string{"B", "D"}; !reflect.DeepEqual(skipped, w) {
+		t.Errorf("expected skipped modules %q, got %q", w, skipped)
+	}
+
+	for _, name := range []string{"A", "C"} {
+		fromModule := from.moduleGroupFromName(name, nil).moduleByVariantName("")
+		toModule := to.moduleGroupFromName(name, nil).moduleByVariantName("")
+		fromValue, _ := from.provider(fromModule, providerTestMutatorInfoProvider.provider())
+		toValue, ok := to.provider(toModule, providerTestMutatorInfoProvider.provider())
+		if !ok {
+			t.Errorf("expected %s to have an imported value", name)
+			continue
+		}
+		if !reflect.DeepEqual(toValue, fromValue) {
+			t.Errorf("expected %s to have value %v, got %v", name, fromValue, toValue)
+		}
+		if toValue == fromValue {
+			t.Errorf("expected the value of %s to be copied", name)
+		}
+	}
+
+	d := to.moduleGroupFromName("D", nil).moduleByVariantName("")
+	if _, ok := to.provider(d, providerTestMutatorInfoProvider.provider()); ok {
+		t.Errorf("expected D to have no value")
+	}
+}
+
 type invalidProviderUsageMutatorInfo string
 type invalidProviderUsageGenerateBuildActionsInfo string
 
@@ -0,0 +1,257 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueprint
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"text/scanner"
+
+	"github.com/google/blueprint/parser"
+)
+
+// SetKeepParsedModules makes ResolveDependencies keep a copy of every module as it was parsed, so
+// that ReparseFile can be called after ResolveDependencies.  The copies are made by calling the
+// module factories and copying the properties, so they double the memory used by the properties
+// of the modules.
+func (c *Context) SetKeepParsedModules(keep bool) {
+	c.keepParsedModules = keep
+}
+
+// parsedModule is a copy of a module made before ResolveDependencies, see SetKeepParsedModules.
+type parsedModule struct {
+	original *moduleInfo
+	copy     *moduleInfo
+}
+
+// ReparseFile replaces the modules defined in the Blueprints file name with the modules defined by
+// content, without parsing the rest of the tree again, for example to give fast feedback on a file
+// that is being edited.  name is the path of the file relative to the root directory passed to
+// ParseFileList, as returned by BlueprintFile for its modules.  The modules defined in other files
+// are untouched; dependencies are resolved by name when ResolveDependencies is called, so a module
+// that depends on a module that was renamed or removed gets the usual missing dependency error then.
+//
+// ReparseFile can be called after ResolveDependencies if SetKeepParsedModules was set.  The
+// mutators change every module in ways that can't be undone one file at a time, so all of the
+// modules of the other files are restored to the state they were parsed in, and
+// ResolveDependencies and PrepareBuildActions must be called again.  It requires the default
+// SimpleNameInterface, and can't reparse a file that defines a blueprint_namespace module or that
+// lists other files in a build variable, as those files would be parsed again.  The modules of the
+// file are removed even if the new contents have errors, so ReparseFile can be called again once
+// the errors are fixed.
+func (c *Context) ReparseFile(name string, content io.Reader, config interface{}) []error {
+	s, ok := c.nameInterface.(*SimpleNameInterface)
+	if !ok {
+		return []error{fmt.Errorf("ReparseFile(%q) requires the SimpleNameInterface", name)}
+	}
+
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return []error{err}
+	}
+	if err := checkNoBuildVariable(name, data); err != nil {
+		return []error{err}
+	}
+
+	// liveGlobals is set when ResolveDependencies starts running the mutators.
+	if c.liveGlobals != nil {
+		if !c.keepParsedModules || c.parsedModules == nil {
+			return []error{fmt.Errorf("ReparseFile(%q) called after ResolveDependencies without SetKeepParsedModules", name)}
+		}
+		if errs := c.restoreParsedModules(s); len(errs) > 0 {
+			return errs
+		}
+	}
+
+	name = filepath.Clean(name)
+	insertAt := -1
+	var removed []*moduleGroup
+	for i, group := range c.moduleGroups {
+		module := group.modules.firstModule()
+		if module.relBlueprintsFile != name {
+			continue
+		}
+		if _, ok := module.logicModule.(*NamespaceModule); ok {
+			return []error{&BlueprintError{
+				Err: fmt.Errorf("can't reparse a file that defines a blueprint_namespace"),
+				Pos: module.pos,
+			}}
+		}
+		if insertAt < 0 {
+			insertAt = i
+		}
+		removed = append(removed, group)
+	}
+
+	for _, group := range removed {
+		module := group.modules.firstModule()
+		s.removeModule(ModuleGroup{moduleGroup: group})
+		delete(c.moduleInfo, module.logicModule)
+		for key, requesters := range c.globRequesters {
+			c.globRequesters[key] = slices.DeleteFunc(requesters, func(m *moduleInfo) bool {
+				return m == module
+			})
+		}
+	}
+	c.moduleGroups = slices.DeleteFunc(c.moduleGroups, func(group *moduleGroup) bool {
+		return slices.Contains(removed, group)
+	})
+	c.removeParseWarnings(name)
+
+	// The sidecar dependencies of the file are loaded again while parsing it.
+	c.sidecarDepsLock.Lock()
+	delete(c.sidecarDeps, name)
+	c.sidecarDepsLock.Unlock()
+
+	rootDir := c.parseRootDir
+	if rootDir == "" {
+		rootDir = "."
+	}
+	filename := filepath.Join(rootDir, name)
+
+	firstNewGroup := len(c.moduleGroups)
+	_, errs := c.parseFileList(context.Background(), rootDir, []string{filename},
+		map[string]io.Reader{filename: bytes.NewReader(data)}, config)
+
+	// Move the new modules to where the old ones were, so that they are visited in the same order
+	// as if the whole tree had been parsed again.
+	if insertAt >= 0 && insertAt < firstNewGroup {
+		newGroups := slices.Clone(c.moduleGroups[firstNewGroup:])
+		c.moduleGroups = slices.Insert(c.moduleGroups[:firstNewGroup], insertAt, newGroups...)
+	}
+
+	return errs
+}
+
+// checkNoBuildVariable returns an error if the Blueprints file name with the given contents lists
+// other Blueprints files in the build variable.  Syntax errors are ignored, they are reported when
+// the file is parsed.
+func checkNoBuildVariable(name string, data []byte) error {
+	scope := parser.NewScope(nil)
+	if _, errs := parser.ParseAndEval(name, bytes.NewReader(data), scope); len(errs) > 0 {
+		return nil
+	}
+	build, buildPos, err := getLocalStringListFromScope(scope, "build")
+	if err != nil {
+		return err
+	}
+	if len(build) > 0 {
+		return &BlueprintError{
+			Err: fmt.Errorf("can't reparse a file that lists other Blueprints files in the build variable"),
+			Pos: buildPos,
+		}
+	}
+	return nil
+}
+
+// copyParsedModules copies the modules before the mutators run if SetKeepParsedModules was set.
+func (c *Context) copyParsedModules() {
+	if !c.keepParsedModules {
+		return
+	}
+	c.parsedModules = make([]parsedModule, 0, len(c.moduleGroups))
+	for _, group := range c.moduleGroups {
+		for _, module := range group.modules {
+			original := module.module()
+			if original == nil {
+				continue
+			}
+			logicModule, properties := c.cloneLogicModule(original)
+			c.parsedModules = append(c.parsedModules, parsedModule{
+				original: original,
+				copy: &moduleInfo{
+					typeName:          original.typeName,
+					factory:           original.factory,
+					relBlueprintsFile: original.relBlueprintsFile,
+					pos:               original.pos,
+					propertyPos:       original.propertyPos,
+					disabled:          original.disabled,
+					common:            original.common,
+					testData:          original.testData,
+					logicModule:       logicModule,
+					properties:        properties,
+				},
+			})
+		}
+	}
+}
+
+// restoreParsedModules replaces all of the modules with the copies made by copyParsedModules and
+// resets the state set by ResolveDependencies and PrepareBuildActions, so that they can be called
+// again.  It returns the errors from adding the copies, which leave the modules that failed out.
+func (c *Context) restoreParsedModules(s *SimpleNameInterface) []error {
+	restored := make(map[*moduleInfo]*moduleInfo, len(c.parsedModules))
+	for _, parsed := range c.parsedModules {
+		restored[parsed.original] = parsed.copy
+	}
+
+	for _, group := range c.moduleGroups {
+		s.removeModule(ModuleGroup{moduleGroup: group})
+	}
+	c.moduleGroups = nil
+	c.moduleInfo = make(map[Module]*moduleInfo)
+	var errs []error
+	for _, parsed := range c.parsedModules {
+		errs = append(errs, c.addModule(parsed.copy)...)
+	}
+
+	// Modules created by the mutators no longer exist, the glob requests of parsed modules are
+	// moved to their copies.
+	for key, requesters := range c.globRequesters {
+		var newRequesters []*moduleInfo
+		for _, module := range requesters {
+			if copy, ok := restored[module]; ok {
+				newRequesters = append(newRequesters, copy)
+			}
+		}
+		c.globRequesters[key] = newRequesters
+	}
+
+	c.parsedModules = nil
+	c.liveGlobals = nil
+	c.dependenciesReady = false
+	c.buildActionsReady = false
+	c.modulesSorted = nil
+	c.cachedSortedModuleGroups = nil
+	c.finishedMutators = make(map[*mutatorInfo]bool)
+	c.startedMutator = nil
+	c.moduleBlobs = nil
+	c.installMap = nil
+	c.dedupPhonys = nil
+
+	return errs
+}
+
+// removeParseWarnings removes the warnings found while parsing the Blueprints file name.
+func (c *Context) removeParseWarnings(name string) {
+	c.parseWarningsLock.Lock()
+	defer c.parseWarningsLock.Unlock()
+	c.parseWarnings = slices.DeleteFunc(c.parseWarnings, func(warning error) bool {
+		var pos scanner.Position
+		switch warning := warning.(type) {
+		case *BlueprintError:
+			pos = warning.Pos
+		case *ModuleError:
+			pos = warning.Pos
+		case *PropertyError:
+			pos = warning.Pos
+		}
+		return pos.Filename == name
+	})
+}
@@ -0,0 +1,238 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueprint
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReparseFile(t *testing.T) {
+	newReparseContext := func(t *testing.T) *Context {
+		t.Helper()
+		ctx := NewContext()
+		// Register the modules in the order of their Blueprints files so the order can be checked.
+		ctx.SetConcurrentParse(1)
+		ctx.RegisterModuleType("foo_module", newFooModule)
+		ctx.RegisterBottomUpMutator("deps", depsMutator)
+		ctx.MockFileSystem(map[string][]byte{
+			"a/Android.bp": []byte(`foo_module { name: "A", deps: ["B"] }`),
+			"b/Android.bp": []byte(`
+				foo_module { name: "B" }
+				foo_module { name: "C" }
+			`),
+			"d/Android.bp": []byte(`foo_module { name: "D" }`),
+		})
+		if _, errs := ctx.ParseBlueprintsFiles("Android.bp", nil); len(errs) > 0 {
+			t.Fatalf("unexpected parse errors: %v", errs)
+		}
+		return ctx
+	}
+
+	groupNames := func(ctx *Context) []string {
+		var names []string
+		for _, group := range ctx.moduleGroups {
+			names = append(names, group.name)
+		}
+		return names
+	}
+
+	t.Run("replace", func(t *testing.T) {
+		ctx := newReparseContext(t)
+		oldA := ctx.moduleGroupFromName("A", nil).modules.firstModule().logicModule
+		oldB := ctx.moduleGroupFromName("B", nil).modules.firstModule().logicModule
+
+		errs := ctx.ReparseFile("b/Android.bp", strings.NewReader(`
+			foo_module { name: "E" }
+			foo_module { name: "B", foo: "new" }
+		`), nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected reparse errors: %v", errs)
+		}
+
+		if g, w := groupNames(ctx), []string{"A", "E", "B", "D"}; !reflect.DeepEqual(g, w) {
+			t.Errorf("expected modules %q, got %q", w, g)
+		}
+		if ctx.moduleGroupFromName("C", nil) != nil {
+			t.Errorf("expected module C to be removed")
+		}
+		newB := ctx.moduleGroupFromName("B", nil).modules.firstModule().logicModule
+		if newB == oldB || newB.(*fooModule).properties.Foo != "new" {
+			t.Errorf("expected module B to be replaced")
+		}
+		if ctx.moduleGroupFromName("A", nil).modules.firstModule().logicModule != oldA {
+			t.Errorf("expected module A to be untouched")
+		}
+
+		if _, errs := ctx.ResolveDependencies(nil); len(errs) > 0 {
+			t.Fatalf("unexpected errors calling ResolveDependencies: %v", errs)
+		}
+		a := ctx.moduleGroupFromName("A", nil).modules.firstModule()
+		var deps []string
+		ctx.VisitDirectDeps(a.logicModule, func(dep Module) {
+			deps = append(deps, dep.Name()+":"+dep.(*fooModule).properties.Foo)
+		})
+		if g, w := deps, []string{"B:new"}; !reflect.DeepEqual(g, w) {
+			t.Errorf("expected A to depend on %q, got %q", w, g)
+		}
+
+		errs = ctx.ReparseFile("b/Android.bp", strings.NewReader(`foo_module { name: "B" }`), nil)
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), "called after ResolveDependencies") {
+			t.Errorf("expected an error reparsing after ResolveDependencies, got %v", errs)
+		}
+	})
+
+	t.Run("after ResolveDependencies", func(t *testing.T) {
+		ctx := newReparseContext(t)
+		ctx.SetKeepParsedModules(true)
+		ctx.RegisterBottomUpMutator("variants", func(mctx BottomUpMutatorContext) {
+			mctx.CreateVariations("v")
+		})
+
+		resolve := func(t *testing.T) []string {
+			t.Helper()
+			if _, errs := ctx.ResolveDependencies(nil); len(errs) > 0 {
+				t.Fatalf("unexpected errors calling ResolveDependencies: %v", errs)
+			}
+			group := ctx.moduleGroupFromName("A", nil)
+			if len(group.modules) != 1 || group.modules.firstModule().variant.name != "v" {
+				t.Errorf("expected a single variant of A, got %s", group.modules)
+			}
+			var deps []string
+			ctx.VisitDirectDeps(group.modules.firstModule().logicModule, func(dep Module) {
+				deps = append(deps, dep.Name()+":"+dep.(*fooModule).properties.Foo)
+			})
+			return deps
+		}
+
+		if g, w := resolve(t), []string{"B:"}; !reflect.DeepEqual(g, w) {
+			t.Errorf("expected A to depend on %q, got %q", w, g)
+		}
+
+		errs := ctx.ReparseFile("b/Android.bp", strings.NewReader(`foo_module { name: "B", foo: "new" }`), nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected reparse errors: %v", errs)
+		}
+		if g, w := groupNames(ctx), []string{"A", "B", "D"}; !reflect.DeepEqual(g, w) {
+			t.Errorf("expected modules %q, got %q", w, g)
+		}
+
+		if g, w := resolve(t), []string{"B:new"}; !reflect.DeepEqual(g, w) {
+			t.Errorf("expected A to depend on %q, got %q", w, g)
+		}
+		if _, errs := ctx.PrepareBuildActions(nil); len(errs) > 0 {
+			t.Fatalf("unexpected errors calling PrepareBuildActions: %v", errs)
+		}
+	})
+
+	t.Run("restore errors", func(t *testing.T) {
+		ctx := newReparseContext(t)
+		ctx.SetKeepParsedModules(true)
+		if _, errs := ctx.ResolveDependencies(nil); len(errs) > 0 {
+			t.Fatalf("unexpected errors calling ResolveDependencies: %v", errs)
+		}
+
+		// Add second copies of A and D so that restoring the parsed modules fails twice.
+		for _, parsed := range []parsedModule{ctx.parsedModules[0], ctx.parsedModules[len(ctx.parsedModules)-1]} {
+			logicModule, properties := ctx.cloneLogicModule(parsed.copy)
+			dup := *parsed.copy
+			dup.logicModule, dup.properties = logicModule, properties
+			ctx.parsedModules = append(ctx.parsedModules, parsedModule{original: parsed.original, copy: &dup})
+		}
+
+		errs := ctx.ReparseFile("b/Android.bp", strings.NewReader(`foo_module { name: "B" }`), nil)
+		if len(errs) != 2 || !strings.Contains(errs[0].Error(), `module "A" already defined`) ||
+			!strings.Contains(errs[1].Error(), `module "D" already defined`) {
+			t.Errorf("expected duplicate module errors for A and D, got %q", errs)
+		}
+	})
+
+	t.Run("build variable", func(t *testing.T) {
+		ctx := newReparseContext(t)
+		errs := ctx.ReparseFile("b/Android.bp", strings.NewReader(`build = ["other.bp"]`), nil)
+		expected := `b/Android.bp:1:7: can't reparse a file that lists other Blueprints files in the build variable`
+		if len(errs) != 1 || errs[0].Error() != expected {
+			t.Errorf("expected error %q, got %q", expected, errs)
+		}
+		if g, w := groupNames(ctx), []string{"A", "B", "C", "D"}; !reflect.DeepEqual(g, w) {
+			t.Errorf("expected modules %q, got %q", w, g)
+		}
+	})
+
+	t.Run("root dir and sidecar deps", func(t *testing.T) {
+		ctx := NewContext()
+		ctx.RegisterModuleType("foo_module", newFooModule)
+		ctx.RegisterBottomUpMutator("deps", depsMutator)
+		ctx.RegisterSidecarDepsLoader(func(bpPath string) (map[string][]string, []string, error) {
+			if bpPath == "a/Android.bp" {
+				return map[string][]string{"A": {"B"}}, nil, nil
+			}
+			return nil, nil, nil
+		})
+		ctx.MockFileSystem(map[string][]byte{
+			"src/a/Android.bp": []byte(`foo_module { name: "A" }`),
+			"src/b/Android.bp": []byte(`foo_module { name: "B" }`),
+		})
+		_, errs := ctx.ParseFileList("src", []string{"src/a/Android.bp", "src/b/Android.bp"}, nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected parse errors: %v", errs)
+		}
+
+		for i := 0; i < 2; i++ {
+			errs := ctx.ReparseFile("a/Android.bp", strings.NewReader(`foo_module { name: "A" }`), nil)
+			if len(errs) > 0 {
+				t.Fatalf("unexpected reparse errors: %v", errs)
+			}
+		}
+		if g := ctx.moduleGroupFromName("A", nil).modules.firstModule().relBlueprintsFile; g != "a/Android.bp" {
+			t.Errorf("expected A to be defined in %q, got %q", "a/Android.bp", g)
+		}
+		if g, w := ctx.sidecarDeps["a/Android.bp"]["A"], []string{"B"}; !reflect.DeepEqual(g, w) {
+			t.Errorf("expected sidecar deps %q, got %q", w, g)
+		}
+	})
+
+	t.Run("renamed dependency", func(t *testing.T) {
+		ctx := newReparseContext(t)
+		errs := ctx.ReparseFile("b/Android.bp", strings.NewReader(`foo_module { name: "B2" }`), nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected reparse errors: %v", errs)
+		}
+		_, errs = ctx.ResolveDependencies(nil)
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), `"A" depends on undefined module "B"`) {
+			t.Errorf("expected a missing dependency error, got %v", errs)
+		}
+	})
+
+	t.Run("syntax error", func(t *testing.T) {
+		ctx := newReparseContext(t)
+		errs := ctx.ReparseFile("b/Android.bp", strings.NewReader(`foo_module { name: "B"`), nil)
+		if len(errs) == 0 {
+			t.Fatalf("expected a parse error")
+		}
+		if g, w := groupNames(ctx), []string{"A", "D"}; !reflect.DeepEqual(g, w) {
+			t.Errorf("expected modules %q, got %q", w, g)
+		}
+
+		errs = ctx.ReparseFile("b/Android.bp", strings.NewReader(`foo_module { name: "B" }`), nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected reparse errors: %v", errs)
+		}
+		if g, w := groupNames(ctx), []string{"A", "D", "B"}; !reflect.DeepEqual(g, w) {
+			t.Errorf("expected modules %q, got %q", w, g)
+		}
+	})
+}
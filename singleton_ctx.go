@@ -100,6 +100,10 @@ type SingletonContext interface {
 	// true calls visit.
 	VisitAllModulesIf(pred func(Module) bool, visit func(Module))
 
+	// VisitAllModuleGroups calls visit once for each module with the name of the module and its
+	// variants, see Context.VisitAllModuleGroups.
+	VisitAllModuleGroups(visit func(name string, variants []Module))
+
 	// VisitDirectDeps calls visit for each direct dependency of the Module.  If there are
 	// multiple direct dependencies on the same module visit will be called multiple times on
 	// that module and OtherModuleDependencyTag will return a different tag for each.
@@ -324,6 +328,10 @@ func (s *singletonContext) VisitAllModulesIf(pred func(Module) bool,
 	s.context.VisitAllModulesIf(pred, visit)
 }
 
+func (s *singletonContext) VisitAllModuleGroups(visit func(name string, variants []Module)) {
+	s.context.VisitAllModuleGroups(visit)
+}
+
 func (s *singletonContext) VisitDirectDeps(module Module, visit func(Module)) {
 	s.context.VisitDirectDeps(module, visit)
 }
@@ -378,8 +386,8 @@ func (s *singletonContext) ModuleVariantsFromName(referer Module, name string) [
 		return nil
 	}
 
-	moduleGroup, exists := c.nameInterface.ModuleFromName(name, refererInfo.namespace())
-	if !exists {
+	moduleGroup := c.moduleGroupFromName(name, refererInfo.namespace())
+	if moduleGroup == nil {
 		return nil
 	}
 	result := make([]Module, 0, len(moduleGroup.modules))
@@ -0,0 +1,82 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueprint
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// testDataProperty is the name of the property that sets moduleInfo.testData.
+const testDataProperty = "test_data"
+
+// resolveTestData expands the globs in the test_data property of each module and checks that the
+// listed files exist.  The globs are recorded like those made through GlobWithDeps, so the build
+// is regenerated when the list of matching files changes.  It is called by ResolveDependencies
+// before the mutators run, so variants created by the mutators share the resolved files.
+func (c *Context) resolveTestData() []error {
+	var errs []error
+	for _, module := range c.sortedModules() {
+		if len(module.testData) == 0 {
+			continue
+		}
+
+		dir := filepath.Dir(module.relBlueprintsFile)
+		expanded, expandErrs := c.expandGlobList(module, testDataProperty, module.testData)
+		if len(expandErrs) > 0 {
+			errs = append(errs, expandErrs...)
+			continue
+		}
+
+		files := make([]string, 0, len(expanded))
+		for _, file := range expanded {
+			path := filepath.Join(dir, file)
+			exists, _, err := c.fs.Exists(path)
+			if err == nil && !exists {
+				err = fmt.Errorf("data file %q does not exist", path)
+			}
+			if err != nil {
+				errs = append(errs, &PropertyError{
+					ModuleError: ModuleError{
+						BlueprintError: BlueprintError{
+							Err: err,
+							Pos: module.propertyPos[testDataProperty],
+						},
+						module: module,
+					},
+					property: testDataProperty,
+				})
+				continue
+			}
+			files = append(files, path)
+		}
+		module.testDataFiles = files
+	}
+	return errs
+}
+
+// TestDataManifest returns the files listed in the test_data property of each module that has
+// one, for test runners to find the files the tests need when they run.  The paths are relative
+// to the source root, and globs have been expanded.  It must be called after
+// ResolveDependencies.
+func (c *Context) TestDataManifest() map[Module][]string {
+	manifest := make(map[Module][]string)
+	for logicModule, module := range c.moduleInfo {
+		if len(module.testDataFiles) > 0 {
+			manifest[logicModule] = append([]string(nil), module.testDataFiles...)
+		}
+	}
+	return manifest
+}
@@ -0,0 +1,91 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueprint
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTestDataManifest(t *testing.T) {
+	newTestDataContext := func(bp string) *Context {
+		ctx := NewContext()
+		ctx.MockFileSystem(map[string][]byte{
+			"dir/Android.bp":     []byte(bp),
+			"dir/data/a.txt":     nil,
+			"dir/data/b.txt":     nil,
+			"dir/data/c.bin":     nil,
+			"dir/golden/out.txt": nil,
+		})
+		ctx.RegisterModuleType("foo_module", newFooModule)
+		ctx.RegisterModuleType("bar_module", newBarModule)
+		return ctx
+	}
+
+	t.Run("manifest", func(t *testing.T) {
+		ctx := newTestDataContext(`
+			foo_module {
+			    name: "foo",
+			    test_data: ["data/*.txt", "!data/b.txt", "golden/out.txt"],
+			}
+			bar_module {
+			    name: "bar",
+			}
+		`)
+		_, errs := ctx.ParseFileList(".", []string{"dir/Android.bp"}, nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected parse errors: %v", errs)
+		}
+		_, errs = ctx.ResolveDependencies(nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected dep errors: %v", errs)
+		}
+
+		foo := ctx.moduleGroupFromName("foo", nil).modules.firstModule().logicModule
+		want := map[Module][]string{
+			foo: {"dir/data/a.txt", "dir/golden/out.txt"},
+		}
+		if g := ctx.TestDataManifest(); !reflect.DeepEqual(g, want) {
+			t.Errorf("expected manifest %q, got %q", want, g)
+		}
+
+		globs := ctx.Globs()
+		if len(globs) != 1 || globs[0].Pattern != "dir/data/*.txt" {
+			t.Errorf("expected the glob to be recorded, got %+v", globs)
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		ctx := newTestDataContext(`
+			foo_module {
+			    name: "foo",
+			    test_data: ["data/a.txt", "data/missing.txt"],
+			}
+		`)
+		_, errs := ctx.ParseFileList(".", []string{"dir/Android.bp"}, nil)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected parse errors: %v", errs)
+		}
+		_, errs = ctx.ResolveDependencies(nil)
+		var got []string
+		for _, err := range errs {
+			got = append(got, err.Error())
+		}
+		want := []string{`dir/Android.bp:4:17: module "foo": test_data: data file "dir/data/missing.txt" does not exist`}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected errors %q, got %q", want, got)
+		}
+	})
+}
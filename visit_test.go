@@ -162,8 +162,418 @@ func TestVisit(t *testing.T) {
 	assertString(t, eModule.properties.VisitDirectDepsIf, "FF")
 }
 
+func TestVisitDirectReverseDeps(t *testing.T) {
+	ctx := setupVisitTest(t)
+
+	visitReverse := func(name string) string {
+		visited := ""
+		module := ctx.moduleGroupFromName(name, nil).modules.firstModule().logicModule
+		ctx.VisitDirectReverseDeps(module, func(dep Module) {
+			visited += ctx.ModuleName(dep)
+		})
+		return visited
+	}
+
+	assertString(t, visitReverse("A"), "")
+	assertString(t, visitReverse("D"), "BC")
+	assertString(t, visitReverse("F"), "E")
+
+	withTestDeps := setupVisitWithTagsTest(t)
+	e := withTestDeps.moduleGroupFromName("E", nil).modules.firstModule().logicModule
+	withTestDeps.VisitDirectReverseDeps(e, func(dep Module) {
+		t.Errorf("unexpected reverse dependency %s through a test dependency", withTestDeps.ModuleName(dep))
+	})
+
+	unresolved := NewContext()
+	unresolved.RegisterModuleType("visit_module", newVisitModule)
+	unresolved.RegisterBottomUpMutator("visit_deps", visitDepsMutator)
+	unresolved.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			visit_module {
+				name: "A",
+				visit: ["B"],
+			}
+
+			visit_module {
+				name: "B",
+			}
+		`),
+	})
+	if _, errs := unresolved.ParseBlueprintsFiles("Android.bp", nil); len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+	b := unresolved.moduleGroupFromName("B", nil).modules.firstModule().logicModule
+	unresolved.VisitDirectReverseDeps(b, func(dep Module) {
+		t.Errorf("unexpected reverse dependency %s before ResolveDependencies", unresolved.ModuleName(dep))
+	})
+}
+
 func assertString(t *testing.T, got, expected string) {
 	if got != expected {
 		t.Errorf("expected %q got %q", expected, got)
 	}
 }
+
+type licenseModule struct {
+	SimpleName
+	properties struct {
+		Licenses  []string
+		Deps      []string
+		Data      []string
+		Test_deps []string
+	}
+}
+
+func newLicenseModule() (Module, []interface{}) {
+	m := &licenseModule{}
+	return m, []interface{}{&m.properties, &m.SimpleName.Properties}
+}
+
+func (m *licenseModule) GenerateBuildActions(ModuleContext) {}
+
+func (m *licenseModule) Licenses() []string {
+	return m.properties.Licenses
+}
+
+type licenseTestTag struct {
+	BaseDependencyTag
+	propagates bool
+}
+
+func (t licenseTestTag) PropagatesLicenses() bool {
+	return t.propagates
+}
+
+func licenseDepsMutator(ctx BottomUpMutatorContext) {
+	m := ctx.Module().(*licenseModule)
+	ctx.AddDependency(m, visitTagDep, m.properties.Deps...)
+	ctx.AddDependency(m, licenseTestTag{propagates: false}, m.properties.Data...)
+	ctx.AddDependency(m, TestDependencyTag{}, m.properties.Test_deps...)
+}
+
+func TestTransitiveLicenses(t *testing.T) {
+	ctx := NewContext()
+	ctx.RegisterModuleType("license_module", newLicenseModule)
+	ctx.RegisterBottomUpMutator("deps", licenseDepsMutator)
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			license_module {
+				name: "A",
+				licenses: ["MIT"],
+				deps: ["B", "C"],
+				data: ["D"],
+			}
+
+			license_module {
+				name: "B",
+				licenses: ["BSD", "MIT"],
+				deps: ["E"],
+			}
+
+			license_module {
+				name: "C",
+				data: ["E"],
+			}
+
+			license_module {
+				name: "D",
+				licenses: ["GPL"],
+			}
+
+			license_module {
+				name: "E",
+				licenses: ["Apache-2.0"],
+			}
+		`),
+	})
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected dep errors: %v", errs)
+	}
+
+	testCases := map[string][]string{
+		"A": {"Apache-2.0", "BSD", "MIT"},
+		"B": {"Apache-2.0", "BSD", "MIT"},
+		"C": {},
+		"D": {"GPL"},
+	}
+	for name, want := range testCases {
+		module := ctx.moduleGroupFromName(name, nil).modules.firstModule().logicModule
+		got := ctx.TransitiveLicenses(module)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: expected licenses %q, got %q", name, want, got)
+		}
+	}
+}
+
+// setupVisitWithTagsTest returns a Context where module A depends on B and C with visitTagDep, on
+// D with a licenseTestTag and on E with a TestDependencyTag.
+func setupVisitWithTagsTest(t *testing.T) *Context {
+	ctx := NewContext()
+	ctx.RegisterModuleType("license_module", newLicenseModule)
+	ctx.RegisterBottomUpMutator("deps", licenseDepsMutator)
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			license_module {
+				name: "A",
+				deps: ["B", "C"],
+				data: ["D"],
+				test_deps: ["E"],
+			}
+
+			license_module {
+				name: "B",
+			}
+
+			license_module {
+				name: "C",
+			}
+
+			license_module {
+				name: "D",
+			}
+
+			license_module {
+				name: "E",
+			}
+		`),
+	})
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected dep errors: %v", errs)
+	}
+
+	return ctx
+}
+
+func TestVisitDirectDepsWithTags(t *testing.T) {
+	ctx := setupVisitWithTagsTest(t)
+	module := ctx.moduleGroupFromName("A", nil).modules.firstModule().logicModule
+
+	visited := ""
+	ctx.VisitDirectDepsWithTags(module, func(tag DependencyTag, dep Module) {
+		visited += fmt.Sprintf("%s:%T ", ctx.ModuleName(dep), tag)
+	})
+	assertString(t, visited, "B:blueprint.visitTag C:blueprint.visitTag D:blueprint.licenseTestTag ")
+}
+
+func TestVisitDirectDepsWithTagIf(t *testing.T) {
+	ctx := setupVisitWithTagsTest(t)
+	module := ctx.moduleGroupFromName("A", nil).modules.firstModule().logicModule
+
+	visitWithTag := func(pred func(DependencyTag) bool) string {
+		visited := ""
+		ctx.VisitDirectDepsWithTagIf(module, pred, func(dep Module) {
+			visited += ctx.ModuleName(dep) + " "
+		})
+		return visited
+	}
+
+	assertString(t, visitWithTag(func(tag DependencyTag) bool {
+		return tag == visitTagDep
+	}), "B C ")
+	assertString(t, visitWithTag(func(tag DependencyTag) bool {
+		_, ok := tag.(licenseTestTag)
+		return ok
+	}), "D ")
+	assertString(t, visitWithTag(func(tag DependencyTag) bool {
+		return true
+	}), "B C D ")
+}
+
+func TestTestDependencyTag(t *testing.T) {
+	ctx := NewContext()
+	ctx.RegisterModuleType("license_module", newLicenseModule)
+	ctx.RegisterBottomUpMutator("deps", licenseDepsMutator)
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			license_module {
+				name: "A_test",
+				licenses: ["MIT"],
+				deps: ["B"],
+				test_deps: ["A", "helper"],
+			}
+
+			license_module {
+				name: "A",
+				deps: ["B"],
+			}
+
+			license_module {
+				name: "B",
+				licenses: ["BSD"],
+			}
+
+			license_module {
+				name: "helper",
+				licenses: ["GPL"],
+				deps: ["C"],
+			}
+
+			license_module {
+				name: "C",
+				licenses: ["Apache-2.0"],
+			}
+		`),
+	})
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected dep errors: %v", errs)
+	}
+
+	module := ctx.moduleGroupFromName("A_test", nil).modules.firstModule().logicModule
+
+	if !IsTestDependencyTag(TestDependencyTag{}) {
+		t.Errorf("expected TestDependencyTag to be a test dependency tag")
+	}
+	if IsTestDependencyTag(visitTagDep) {
+		t.Errorf("expected visitTag not to be a test dependency tag")
+	}
+
+	visited := ""
+	ctx.VisitDirectDeps(module, func(dep Module) {
+		visited += ctx.ModuleName(dep) + " "
+	})
+	assertString(t, visited, "B ")
+
+	visited = ""
+	ctx.VisitDepsDepthFirst(module, func(dep Module) {
+		visited += ctx.ModuleName(dep) + " "
+	})
+	assertString(t, visited, "B ")
+
+	visited = ""
+	ctx.WalkDeps(module, func(child, parent Module, tag DependencyTag) bool {
+		visited += ctx.ModuleName(child) + " "
+		return true
+	})
+	assertString(t, visited, "B ")
+
+	visited = ""
+	ctx.WalkDepsIncludingTests(module, func(child, parent Module, tag DependencyTag) bool {
+		visited += ctx.ModuleName(child)
+		if IsTestDependencyTag(tag) {
+			visited += "(test)"
+		}
+		visited += " "
+		return true
+	})
+	assertString(t, visited, "B A(test) B helper(test) C ")
+
+	if got, want := ctx.TransitiveLicenses(module), []string{"BSD", "MIT"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected licenses %q, got %q", want, got)
+	}
+}
+
+func TestLongestDependencyChain(t *testing.T) {
+	ctx := NewContext()
+	ctx.RegisterModuleType("license_module", newLicenseModule)
+	ctx.RegisterBottomUpMutator("deps", licenseDepsMutator)
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			license_module {
+				name: "X",
+				deps: ["Y"],
+			}
+
+			license_module {
+				name: "Y",
+				deps: ["Z"],
+			}
+
+			license_module {
+				name: "Z",
+			}
+
+			license_module {
+				name: "A",
+				deps: ["C", "B"],
+			}
+
+			license_module {
+				name: "C",
+				deps: ["D"],
+			}
+
+			license_module {
+				name: "B",
+				deps: ["D"],
+			}
+
+			license_module {
+				name: "D",
+			}
+
+			license_module {
+				name: "A_test",
+				test_deps: ["X"],
+			}
+		`),
+	})
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+
+	if _, err := ctx.LongestDependencyChain(); err == nil {
+		t.Errorf("expected an error before ResolveDependencies")
+	}
+
+	_, errs = ctx.ResolveDependencies(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected dep errors: %v", errs)
+	}
+
+	chain, err := ctx.LongestDependencyChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, module := range chain {
+		names = append(names, ctx.ModuleName(module))
+	}
+	if g, w := fmt.Sprint(names), "[A B D]"; g != w {
+		t.Errorf("expected chain %s, got %s", w, g)
+	}
+}
+
+func TestDependencyDistances(t *testing.T) {
+	ctx := setupVisitTest(t)
+
+	module := func(name string) Module {
+		return ctx.moduleGroupFromName(name, nil).modules.firstModule().logicModule
+	}
+	a, d, f := module("A"), module("D"), module("F")
+
+	distances := ctx.DependencyDistances([]Module{a, d, f, a})
+	want := map[[2]Module]int{
+		{a, a}: 0, {a, d}: 2, {a, f}: 4,
+		{d, a}: -1, {d, d}: 0, {d, f}: 2,
+		{f, a}: -1, {f, d}: -1, {f, f}: 0,
+	}
+	if len(distances) != len(want) {
+		t.Errorf("expected %d distances, got %d", len(want), len(distances))
+	}
+	for pair, w := range want {
+		if g, ok := distances[pair]; !ok || g != w {
+			t.Errorf("expected distance from %s to %s to be %d, got %d",
+				ctx.ModuleName(pair[0]), ctx.ModuleName(pair[1]), w, g)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueprint
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"text/scanner"
+
+	"github.com/google/blueprint/proptools"
+)
+
+// AddWarning records a non-fatal problem at the given line of a Blueprints file, which is
+// returned by Warnings in the same format as the errors, for example from a mutator that finds a
+// module using a discouraged pattern.  It may be called concurrently.
+func (c *Context) AddWarning(file string, line int, msg string) {
+	c.addParseWarning(&BlueprintError{
+		Err: errors.New(msg),
+		Pos: scanner.Position{Filename: file, Line: line},
+	})
+}
+
+func (c *Context) addParseWarning(warning error) {
+	c.parseWarningsLock.Lock()
+	defer c.parseWarningsLock.Unlock()
+	c.parseWarnings = append(c.parseWarnings, warning)
+}
+
+// warnDeprecatedProperties adds a warning for each property of module that is set in its
+// Blueprints file and whose field is tagged with `blueprint:"deprecated"`.
+func (c *Context) warnDeprecatedProperties(module *moduleInfo) {
+	var walk func(prefix string, t reflect.Type)
+	walk = func(prefix string, t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() && !field.Anonymous {
+				continue
+			}
+			name := prefix + proptools.PropertyNameForField(field.Name)
+			fieldType := field.Type
+			if fieldType.Kind() == reflect.Ptr && fieldType.Elem().Kind() == reflect.Struct {
+				fieldType = fieldType.Elem()
+			}
+
+			if proptools.HasTag(field, "blueprint", "deprecated") {
+				if pos, ok := module.propertyPos[name]; ok {
+					c.addParseWarning(&PropertyError{
+						ModuleError: ModuleError{
+							BlueprintError: BlueprintError{
+								Err: fmt.Errorf("property is deprecated"),
+								Pos: pos,
+							},
+							module: module,
+						},
+						property: name,
+					})
+				}
+			} else if fieldType.Kind() == reflect.Struct {
+				if field.Anonymous {
+					walk(prefix, fieldType)
+				} else {
+					walk(name+".", fieldType)
+				}
+			}
+		}
+	}
+
+	for _, props := range module.properties {
+		walk("", reflect.TypeOf(props).Elem())
+	}
+}
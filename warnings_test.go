@@ -0,0 +1,86 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueprint
+
+import (
+	"reflect"
+	"testing"
+)
+
+type deprecatedTestModule struct {
+	SimpleName
+	properties struct {
+		Srcs   []string
+		Old    *string `blueprint:"deprecated"`
+		Nested struct {
+			Flags []string `blueprint:"deprecated"`
+		}
+	}
+}
+
+func newDeprecatedTestModule() (Module, []interface{}) {
+	m := &deprecatedTestModule{}
+	return m, []interface{}{&m.properties, &m.SimpleName.Properties}
+}
+
+func (m *deprecatedTestModule) GenerateBuildActions(ModuleContext) {}
+
+func TestWarnings(t *testing.T) {
+	ctx := NewContext()
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(`
+			test {
+			    name: "A",
+			    srcs: ["a.c"],
+			    old: "x",
+			    nested: {
+			        flags: ["-x"],
+			    },
+			}
+			test {
+			    name: "B",
+			    srcs: ["b.c"],
+			}
+		`),
+	})
+	ctx.RegisterModuleType("test", newDeprecatedTestModule)
+	ctx.RegisterBottomUpMutator("warn", func(mctx BottomUpMutatorContext) {
+		if mctx.ModuleName() == "B" {
+			ctx.AddWarning("Android.bp", 12, "module B is discouraged")
+		}
+	}).Parallel()
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp", nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+	_, errs = ctx.PrepareBuildActions(nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors calling PrepareBuildActions: %v", errs)
+	}
+
+	var got []string
+	for _, warning := range ctx.Warnings() {
+		got = append(got, warning.Error())
+	}
+	want := []string{
+		`Android.bp:12:0: module B is discouraged`,
+		`Android.bp:5:11: module "A": old: property is deprecated`,
+		`Android.bp:7:17: module "A": nested.flags: property is deprecated`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected warnings %q, got %q", want, got)
+	}
+}